@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/spf13/cobra"
+)
+
+func NewBalloonCommand() *cobra.Command {
+	const (
+		long = `Shows the memory balloon of a running microVM. With --target the balloon is
+inflated or deflated so the guest hands that much memory back to the host,
+0 deflates it completely.`
+		short = "shows or sets the memory balloon of a microVM"
+	)
+
+	cmd := command.New("balloon <id|name>", short, long, runBalloon)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd,
+		socketFlag(),
+		flag.Int{
+			Name:        "target",
+			Description: "MiB of guest memory the balloon should reclaim",
+		},
+	)
+
+	return cmd
+}
+
+func runBalloon(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+	)
+
+	target, err := resolveVM(ctx, c, flag.FirstArg(ctx))
+	if err != nil {
+		return err
+	}
+
+	var balloon *kiln.BalloonStatus
+	if flag.FromContext(ctx).Changed("target") {
+		var updated *api.VM
+		if updated, err = c.UpdateBalloon(ctx, target.ID, flag.GetInt(ctx, "target")); err == nil {
+			balloon = updated.Balloon
+		}
+	} else {
+		var status *kiln.Status
+		if status, err = c.Status(ctx, target.ID); err == nil {
+			balloon = status.Balloon
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reach the balloon of vm %s: %w", target.ID, err)
+	}
+
+	if balloon == nil {
+		return fmt.Errorf("vm %s has no balloon device", target.ID)
+	}
+
+	fmt.Fprintf(io.Out, "target:    %d MiB\n", balloon.TargetMiB)
+	if stats := balloon.Stats; stats != nil {
+		fmt.Fprintf(io.Out, "actual:    %d MiB\n", stats.ActualMib)
+		if stats.TotalMemory != nil && stats.AvailableMemory != nil {
+			fmt.Fprintf(io.Out, "available: %d of %d MiB\n", *stats.AvailableMemory>>20, *stats.TotalMemory>>20)
+		}
+	}
+	return nil
+}
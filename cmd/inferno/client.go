@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/client"
+	"github.com/rugwirobaker/inferno/internal/flag"
+)
+
+// socketFlag returns the flag selecting the server socket to talk to
+func socketFlag() flag.String {
+	return flag.String{
+		Name:        "socket",
+		Description: "Path to the inferno server socket",
+		Default:     client.DefaultSocketPath,
+	}
+}
+
+func newClient(ctx context.Context) *client.Client {
+	return client.New(flag.GetString(ctx, "socket"), client.WithUserAgent("inferno-cli"))
+}
+
+// resolveVM looks a VM up by ID, falling back to its name
+func resolveVM(ctx context.Context, c *client.Client, ref string) (*api.VM, error) {
+	vm, err := c.Inspect(ctx, ref)
+	if err == nil || !client.IsNotFound(err) {
+		return vm, err
+	}
+
+	vms, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if vm.Name == ref {
+			return vm, nil
+		}
+	}
+	return nil, fmt.Errorf("no vm with id or name %q", ref)
+}
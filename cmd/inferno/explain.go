@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/spf13/cobra"
+)
+
+func NewExplainCommand() *cobra.Command {
+	const (
+		long = `Explains why a microVM stopped from the exit status kiln recorded: what
+stopped it, how its main process ended and how long it ran.`
+		short = "explains why a microVM stopped"
+	)
+
+	cmd := command.New("explain <id|name>", short, long, runExplain)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd, socketFlag())
+
+	return cmd
+}
+
+func runExplain(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+	)
+
+	target, err := resolveVM(ctx, c, flag.FirstArg(ctx))
+	if err != nil {
+		return err
+	}
+	if target.ExitReason == "" {
+		fmt.Fprintf(io.Out, "VM %s is %s and hasn't exited yet\n", target.ID, target.State)
+		return nil
+	}
+	fmt.Fprintf(io.Out, "VM %s is %s. %s\n", target.ID, target.State, target.ExitReason)
+	return nil
+}
@@ -22,11 +22,13 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), signals...)
 	defer cancel()
 
-	// handle the case where the user interrupts the command with ctrl+c
+	// handle the case where the user interrupts the command with ctrl+c, the
+	// command winds down with its context and a second interrupt exits
+	// straight away
 	go func() {
 		<-ctx.Done()
 		fmt.Fprintln(os.Stderr, "Received interrupt signal, exiting...")
-		os.Exit(1)
+		cancel()
 	}()
 
 	exit := Run(ctx, iostreams.System(), os.Args[1:]...)
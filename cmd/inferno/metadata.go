@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/spf13/cobra"
+)
+
+func NewMetadataCommand() *cobra.Command {
+	const (
+		long = `Changes the labels and user data served by a microVM's metadata service. A
+running microVM sees the change right away. Labels are merged into the
+current ones, KEY= removes a label.`
+		short = "changes the metadata of a microVM"
+	)
+
+	cmd := command.New("metadata <id|name>", short, long, runMetadata)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd,
+		socketFlag(),
+		metadataFlags(),
+	)
+
+	return cmd
+}
+
+func runMetadata(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+	)
+
+	labels, err := parseLabels(flag.GetStringArray(ctx, "label"))
+	if err != nil {
+		return err
+	}
+	userData, err := parseUserData(flag.GetString(ctx, "user-data"))
+	if err != nil {
+		return err
+	}
+	if labels == nil && userData == nil {
+		return errors.New("nothing to change, set --label or --user-data")
+	}
+
+	target, err := resolveVM(ctx, c, flag.FirstArg(ctx))
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.UpdateMetadata(ctx, target.ID, &api.MetadataUpdate{Labels: labels, UserData: userData}); err != nil {
+		return fmt.Errorf("failed to update metadata of vm %s: %w", target.ID, err)
+	}
+
+	fmt.Fprintf(io.ErrOut, "Updated metadata of VM %s\n", target.ID)
+	return nil
+}
+
+func metadataFlags() flag.Set {
+	return flag.Set{
+		flag.StringArray{
+			Name:        "label",
+			Shorthand:   "l",
+			Description: "Set a label served by the metadata service, as KEY=VALUE",
+		},
+		flag.String{
+			Name:        "user-data",
+			Description: "JSON document served by the metadata service as user_data",
+		},
+	}
+}
+
+func parseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, expected KEY=VALUE", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+func parseUserData(s string) (json.RawMessage, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(s)) {
+		return nil, errors.New("user data must be valid JSON")
+	}
+	return json.RawMessage(s), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/spf13/cobra"
+)
+
+func NewRateLimitCommand() *cobra.Command {
+	const (
+		long = `Changes the disk and network limits of a running microVM without restarting
+it. Limits that aren't given are left as they are, a limit of 0 removes it.`
+		short = "changes the disk and network limits of a microVM"
+	)
+
+	cmd := command.New("ratelimit <id|name>", short, long, runRateLimit)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd,
+		socketFlag(),
+		rateLimitFlags(),
+	)
+
+	return cmd
+}
+
+func runRateLimit(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+	)
+
+	limits := rateLimitsFromFlags(ctx)
+	if limits == nil {
+		return errors.New("no limits given, set them with --disk-mbps, --disk-iops or --net-mbps")
+	}
+
+	target, err := resolveVM(ctx, c, flag.FirstArg(ctx))
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.UpdateRateLimits(ctx, target.ID, limits); err != nil {
+		return fmt.Errorf("failed to update rate limits of vm %s: %w", target.ID, err)
+	}
+
+	fmt.Fprintf(io.ErrOut, "Updated rate limits of VM %s\n", target.ID)
+	return nil
+}
+
+func rateLimitFlags() flag.Set {
+	return flag.Set{
+		flag.Int{
+			Name:        "disk-mbps",
+			Description: "Limit the root disk to this many MiB per second",
+		},
+		flag.Int{
+			Name:        "disk-iops",
+			Description: "Limit the root disk to this many operations per second",
+		},
+		flag.Int{
+			Name:        "net-mbps",
+			Description: "Limit network traffic to this many MiB per second in each direction",
+		},
+	}
+}
+
+// rateLimitsFromFlags builds limiters for the devices whose flags were set,
+// it returns nil when none were
+func rateLimitsFromFlags(ctx context.Context) *kiln.RateLimits {
+	var (
+		flags  = flag.FromContext(ctx)
+		limits kiln.RateLimits
+	)
+
+	if flags.Changed("disk-mbps") || flags.Changed("disk-iops") {
+		limits.Drive = firecracker.NewRateLimiter(
+			int64(flag.GetInt(ctx, "disk-mbps"))<<20,
+			int64(flag.GetInt(ctx, "disk-iops")),
+		)
+	}
+	if flags.Changed("net-mbps") {
+		nic := firecracker.NewRateLimiter(int64(flag.GetInt(ctx, "net-mbps"))<<20, 0)
+		limits.NetworkRx = nic
+		limits.NetworkTx = nic
+	}
+
+	if limits == (kiln.RateLimits{}) {
+		return nil
+	}
+	return &limits
+}
@@ -21,6 +21,12 @@ func NewRootCmd() *cobra.Command {
 	cmd.AddCommand(
 		NewRunCommand(),
 		NewStopCommand(),
+		NewExplainCommand(),
+		NewSnapshotCommand(),
+		NewRestoreCommand(),
+		NewRateLimitCommand(),
+		NewBalloonCommand(),
+		NewMetadataCommand(),
 		NewServerCommand(),
 		NewInitCommand(),
 	)
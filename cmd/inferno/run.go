@@ -1,38 +1,312 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/client"
 	"github.com/rugwirobaker/inferno/internal/command"
 	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/rugwirobaker/inferno/internal/vm"
 	"github.com/spf13/cobra"
 )
 
+const (
+	// operationPollInterval is how often boot progress is polled
+	operationPollInterval = 250 * time.Millisecond
+	// interruptStopTimeout bounds the stop request sent when a foreground run is interrupted
+	interruptStopTimeout = 10 * time.Second
+)
+
 func NewRunCommand() *cobra.Command {
 	const (
 		long  = "Launches a microVM using the specified Docker image with optional CPU and memory configurations."
 		short = "Launches a microVM"
 	)
 
-	cmd := command.New("run", short, long, nil)
+	cmd := command.New("run", short, long, runRun)
 
 	flag.Add(cmd,
+		socketFlag(),
 		flag.String{
 			Name:        "image",
 			Shorthand:   "i",
 			Description: "The Docker image to run",
 		},
+		flag.String{
+			Name:        "name",
+			Shorthand:   "n",
+			Description: "A unique name for the microVM",
+		},
+		flag.String{
+			Name:        "cpu-kind",
+			Description: "The CPU kind of the microVM, defaults to the server's default kind",
+		},
 		flag.Int{
 			Name:        "cpu",
 			Shorthand:   "c",
-			Description: "Number of CPUs to allocate to the microVM",
-			Default:     1,
+			Description: "Number of CPUs to allocate to the microVM, defaults to the CPU kind's",
 		},
 		flag.Int{
 			Name:        "mem",
 			Shorthand:   "m",
-			Description: "Memory (in MB) to allocate to the microVM",
-			Default:     512,
+			Description: "Memory (in MB) to allocate to the microVM, defaults to the CPU kind's minimum",
+		},
+		flag.String{
+			Name:        "restart",
+			Description: "Restart policy: no, always, unless-stopped or on-failure[:max-retries]",
+			Default:     string(api.RestartNo),
+		},
+		flag.StringArray{
+			Name:        "env",
+			Shorthand:   "e",
+			Description: "Set an environment variable in the microVM, as KEY=VALUE",
+		},
+		flag.StringArray{
+			Name:        "publish",
+			Shorthand:   "p",
+			Description: "Publish a port of the microVM on the host, as [HOST_IP:]HOST_PORT:GUEST_PORT",
+		},
+		flag.Duration{
+			Name:        "idle-timeout",
+			Description: "Scale the microVM to zero after its published ports had no traffic for this long, the next connection wakes it",
+		},
+		flag.String{
+			Name:        "idle-action",
+			Description: "What scaling to zero does: stop, or snapshot to resume where it left off when woken",
+			Default:     string(api.IdleStop),
+		},
+		rateLimitFlags(),
+		metadataFlags(),
+		flag.Bool{
+			Name:        "track-dirty-pages",
+			Description: "Track dirtied memory so the microVM can take diff snapshots",
+		},
+		flag.Bool{
+			Name:        "detach",
+			Shorthand:   "d",
+			Description: "Return once the microVM has booted instead of following its logs",
 		},
 	)
 
 	return cmd
 }
+
+func runRun(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+	)
+
+	image := flag.GetString(ctx, "image")
+	if image == "" {
+		return errors.New("an image is required, set it with --image")
+	}
+
+	policy, err := parseRestartPolicy(flag.GetString(ctx, "restart"))
+	if err != nil {
+		return err
+	}
+
+	env, err := parseEnv(flag.GetStringArray(ctx, "env"))
+	if err != nil {
+		return err
+	}
+
+	ports, err := parsePorts(flag.GetStringArray(ctx, "publish"))
+	if err != nil {
+		return err
+	}
+
+	labels, err := parseLabels(flag.GetStringArray(ctx, "label"))
+	if err != nil {
+		return err
+	}
+	userData, err := parseUserData(flag.GetString(ctx, "user-data"))
+	if err != nil {
+		return err
+	}
+
+	var idle *api.IdlePolicy
+	if timeout := flag.GetDuration(ctx, "idle-timeout"); timeout > 0 {
+		idle = &api.IdlePolicy{
+			TimeoutS: int(timeout.Seconds()),
+			Action:   api.IdleAction(flag.GetString(ctx, "idle-action")),
+		}
+	}
+
+	run, err := c.Run(ctx, &api.RunRequest{
+		Name:          flag.GetString(ctx, "name"),
+		Image:         image,
+		CPUKind:       flag.GetString(ctx, "cpu-kind"),
+		CPUCount:      flag.GetInt(ctx, "cpu"),
+		MemoryMB:      flag.GetInt(ctx, "mem"),
+		RestartPolicy: policy,
+		Env:           env,
+		Ports:         ports,
+		Idle:          idle,
+
+		TrackDirtyPages: flag.GetBool(ctx, "track-dirty-pages"),
+		RateLimits:      rateLimitsFromFlags(ctx),
+		Labels:          labels,
+		UserData:        userData,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create vm: %w", err)
+	}
+	fmt.Fprintf(io.ErrOut, "Creating VM %s\n", run.ID)
+
+	var reported int
+	op, err := c.WaitOperation(ctx, run.OperationID, operationPollInterval, func(op *api.Operation) {
+		reported = reportPhases(io.ErrOut, op, reported)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to wait for vm %s to boot: %w", run.ID, err)
+	}
+	if op.Status == api.OperationFailed {
+		return fmt.Errorf("vm %s failed to boot: %s", run.ID, op.Error)
+	}
+
+	if flag.GetBool(ctx, "detach") {
+		fmt.Fprintln(io.Out, run.ID)
+		return nil
+	}
+	return followVM(ctx, c, io, run.ID)
+}
+
+// parseEnv turns KEY=VALUE pairs into a map
+func parseEnv(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	env := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", pair)
+		}
+		env[k] = v
+	}
+	return env, nil
+}
+
+// parsePorts parses [HOST_IP:]HOST_PORT:GUEST_PORT mappings, an IPv6 host
+// address is bracketed
+func parsePorts(specs []string) ([]api.PortMapping, error) {
+	ports := make([]api.PortMapping, 0, len(specs))
+	for _, spec := range specs {
+		rest, guest, ok := cutLast(spec)
+		if !ok {
+			return nil, fmt.Errorf("invalid port %q, expected [HOST_IP:]HOST_PORT:GUEST_PORT", spec)
+		}
+		hostIP, host, ok := cutLast(rest)
+		if !ok {
+			hostIP, host = "", rest
+		}
+
+		hostPort, err := strconv.Atoi(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host port in %q", spec)
+		}
+		guestPort, err := strconv.Atoi(guest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid guest port in %q", spec)
+		}
+		ports = append(ports, api.PortMapping{HostIP: strings.Trim(hostIP, "[]"), HostPort: hostPort, GuestPort: guestPort})
+	}
+	return ports, nil
+}
+
+// cutLast splits s around its last colon
+func cutLast(s string) (before, after string, ok bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// reportPhases prints the phases that completed since the last poll and
+// returns how many have been reported so far
+func reportPhases(w io.Writer, op *api.Operation, reported int) int {
+	for ; reported < len(op.Phases); reported++ {
+		phase := op.Phases[reported]
+		if phase.CompletedAt == nil {
+			break
+		}
+		if phase.Status == api.OperationFailed {
+			fmt.Fprintf(w, "  %s failed: %s\n", phaseLabel(phase.Name), phase.Error)
+			continue
+		}
+		fmt.Fprintf(w, "  %s (%s)\n", phaseLabel(phase.Name), time.Duration(phase.DurationMS)*time.Millisecond)
+	}
+	return reported
+}
+
+func phaseLabel(name string) string {
+	return strings.ReplaceAll(name, "_", " ")
+}
+
+// followVM streams the VM's logs until it stops. Interrupting the command
+// stops the VM, like a container running in the foreground.
+func followVM(ctx context.Context, c *client.Client, streams *iostreams.IOStreams, id string) error {
+	logs, err := c.Logs(ctx, id, true)
+	if err != nil {
+		return fmt.Errorf("failed to follow logs of vm %s: %w", id, err)
+	}
+	defer logs.Close()
+
+	_, err = io.Copy(streams.Out, logs)
+
+	if ctx.Err() != nil {
+		stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), interruptStopTimeout)
+		defer cancel()
+
+		fmt.Fprintf(streams.ErrOut, "Stopping VM %s\n", id)
+		if _, err := c.Stop(stopCtx, id, 0); err != nil && !client.IsConflict(err) {
+			return fmt.Errorf("failed to stop vm %s: %w", id, err)
+		}
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to follow logs of vm %s: %w", id, err)
+	}
+
+	final, err := c.Inspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	if final.ExitReason != "" {
+		fmt.Fprintf(streams.ErrOut, "VM %s %s: %s\n", id, final.State, final.ExitReason)
+	}
+	if final.State == vm.StateFailed {
+		return fmt.Errorf("vm %s failed", id)
+	}
+	return nil
+}
+
+// parseRestartPolicy parses docker style restart policies such as on-failure:3
+func parseRestartPolicy(s string) (api.RestartPolicy, error) {
+	name, retries, hasRetries := strings.Cut(s, ":")
+
+	policy := api.RestartPolicy{Name: api.RestartPolicyName(name)}
+	if hasRetries {
+		n, err := strconv.Atoi(retries)
+		if err != nil {
+			return api.RestartPolicy{}, fmt.Errorf("invalid restart policy %q: max retries must be a number", s)
+		}
+		policy.MaxRetries = n
+	}
+
+	if err := policy.Validate(); err != nil {
+		return api.RestartPolicy{}, fmt.Errorf("invalid restart policy %q: %w", s, err)
+	}
+	return policy, nil
+}
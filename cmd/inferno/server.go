@@ -47,6 +47,10 @@ func NewServerCommand() *cobra.Command {
 			Name:        "log-base-dir",
 			Description: "Base directory for logs",
 		},
+		flag.Bool{
+			Name:        "keep-on-failure",
+			Description: "Keep the artifacts of failed VM creations for inspection",
+		},
 	)
 
 	return cmd
@@ -64,6 +68,10 @@ func runDaemon(ctx context.Context) error {
 	// Override configuration with command-line flags
 	cfg.OverrideWithFlags(ctx)
 
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	if err := configureLogger(cfg); err != nil {
 		slog.Error("Failed to configure logger", "error", err)
 		return err
@@ -101,9 +109,12 @@ func runDaemon(ctx context.Context) error {
 	}
 
 	// Pass the configuration to the server
-	srv := server.New(listener, cfg, images)
+	srv, err := server.New(listener, cfg, images)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %w", err)
+	}
 
-	return srv.Run()
+	return srv.Run(ctx)
 }
 
 func ensureDirectories(cfg *config.Config) error {
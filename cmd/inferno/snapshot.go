@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/spf13/cobra"
+)
+
+func NewSnapshotCommand() *cobra.Command {
+	const (
+		long = `Snapshots a running microVM's memory, device state and disk. The microVM
+is paused while the snapshot is written and resumed afterwards. With --diff
+only the memory dirtied since the previous snapshot is written, the microVM
+must have been started with --track-dirty-pages.`
+		short = "snapshots a running microVM"
+	)
+
+	cmd := command.New("snapshot <id|name>", short, long, runSnapshot)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd,
+		socketFlag(),
+		flag.Bool{
+			Name:        "diff",
+			Description: "Take a diff snapshot on top of the previous one",
+		},
+	)
+
+	return cmd
+}
+
+func runSnapshot(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+	)
+
+	target, err := resolveVM(ctx, c, flag.FirstArg(ctx))
+	if err != nil {
+		return err
+	}
+
+	typ := api.SnapshotFull
+	if flag.GetBool(ctx, "diff") {
+		typ = api.SnapshotDiff
+	}
+
+	snap, err := c.Snapshot(ctx, target.ID, typ)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot vm %s: %w", target.ID, err)
+	}
+
+	fmt.Fprintf(io.ErrOut, "Snapshotted VM %s (%s, %d MB, paused %dms)\n", target.ID, snap.Type, snap.SizeBytes>>20, snap.PausedMS)
+	fmt.Fprintln(io.Out, snap.ID)
+	return nil
+}
+
+func NewRestoreCommand() *cobra.Command {
+	const (
+		long = `Creates and starts a new microVM from a snapshot. The snapshot must have been
+taken with the same Firecracker version on the same kind of CPU.`
+		short = "restores a microVM from a snapshot"
+	)
+
+	cmd := command.New("restore <snapshot>", short, long, runRestore)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd,
+		socketFlag(),
+		flag.String{
+			Name:        "name",
+			Shorthand:   "n",
+			Description: "Name of the new microVM",
+		},
+	)
+
+	return cmd
+}
+
+func runRestore(ctx context.Context) error {
+	var (
+		io = iostreams.FromContext(ctx)
+		c  = newClient(ctx)
+		id = flag.FirstArg(ctx)
+	)
+
+	restored, err := c.Restore(ctx, id, &api.RestoreRequest{Name: flag.GetString(ctx, "name")})
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", id, err)
+	}
+
+	fmt.Fprintf(io.ErrOut, "Restored VM %s from snapshot %s\n", restored.ID, id)
+	fmt.Fprintln(io.Out, restored.ID)
+	return nil
+}
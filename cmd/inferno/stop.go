@@ -1,17 +1,169 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/client"
 	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/iostreams"
+	"github.com/rugwirobaker/inferno/internal/vm"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// stopPollInterval is how often the VM state is checked while waiting for it to stop
+	stopPollInterval = 250 * time.Millisecond
+	// killTimeout is how long a VM gets to go away after SIGKILL
+	killTimeout = 2 * time.Second
 )
 
 func NewStopCommand() *cobra.Command {
 	const (
-		long  = "stops a microVM"
+		long = `Stops a microVM by signalling its main process, waiting up to the timeout
+for it to exit. With --kill the VM is sent SIGKILL if it's still running
+once the timeout expires.`
 		short = "stops a microVM"
 	)
 
-	cmd := command.New("stop", short, long, nil)
+	cmd := command.New("stop <id|name>", short, long, runStop)
+	cmd.Args = cobra.ExactArgs(1)
+
+	flag.Add(cmd,
+		socketFlag(),
+		flag.String{
+			Name:        "signal",
+			Shorthand:   "s",
+			Description: "Signal sent to the main process, by name or number",
+			Default:     "SIGTERM",
+		},
+		flag.Duration{
+			Name:        "timeout",
+			Shorthand:   "t",
+			Description: "How long to wait for the microVM to stop",
+			Default:     10 * time.Second,
+		},
+		flag.Bool{
+			Name:        "kill",
+			Description: "Send SIGKILL if the microVM hasn't stopped once the timeout expires",
+		},
+	)
 
 	return cmd
 }
+
+func runStop(ctx context.Context) error {
+	var (
+		io      = iostreams.FromContext(ctx)
+		c       = newClient(ctx)
+		timeout = flag.GetDuration(ctx, "timeout")
+	)
+
+	sig, err := parseSignal(flag.GetString(ctx, "signal"))
+	if err != nil {
+		return err
+	}
+
+	target, err := resolveVM(ctx, c, flag.FirstArg(ctx))
+	if err != nil {
+		return err
+	}
+	if target.State != vm.StateRunning {
+		fmt.Fprintf(io.ErrOut, "VM %s is already %s\n", target.ID, target.State)
+		return nil
+	}
+
+	fmt.Fprintf(io.ErrOut, "Stopping VM %s (signal=%s, timeout=%s)\n", target.ID, unix.SignalName(sig), timeout)
+
+	if _, err := c.Stop(ctx, target.ID, int32(sig)); err != nil {
+		return fmt.Errorf("failed to stop vm %s: %w", target.ID, err)
+	}
+
+	stopped, err := waitStopped(ctx, c, target.ID, timeout)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		fmt.Fprintln(io.Out, target.ID)
+		return nil
+	}
+	if !flag.GetBool(ctx, "kill") {
+		return fmt.Errorf("vm %s did not stop within %s, retry with --kill to force it", target.ID, timeout)
+	}
+
+	fmt.Fprintf(io.ErrOut, "Escalating: sending SIGKILL to VM %s\n", target.ID)
+
+	// the VM may have stopped between the last check and now
+	if _, err := c.Stop(ctx, target.ID, int32(syscall.SIGKILL)); err != nil && !client.IsConflict(err) {
+		return fmt.Errorf("failed to kill vm %s: %w", target.ID, err)
+	}
+
+	stopped, err = waitStopped(ctx, c, target.ID, killTimeout)
+	if err != nil {
+		return err
+	}
+	if !stopped {
+		return fmt.Errorf("vm %s is still running after SIGKILL", target.ID)
+	}
+	fmt.Fprintln(io.Out, target.ID)
+	return nil
+}
+
+// waitStopped polls the VM until it's no longer running or the timeout expires
+func waitStopped(ctx context.Context, c *client.Client, id string, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(stopPollInterval)
+	defer ticker.Stop()
+
+	for {
+		rec, err := c.Inspect(ctx, id)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return false, nil
+		case err != nil:
+			return false, err
+		case rec.State != vm.StateRunning && rec.State != vm.StateInitializing:
+			return true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			// only the caller's context being cancelled is an error
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return false, nil
+			}
+			return false, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseSignal accepts signals by number or by name, with or without the SIG prefix
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		// init only relays signals the guest kernel knows
+		if n <= 0 || unix.SignalName(syscall.Signal(n)) == "" {
+			return 0, fmt.Errorf("invalid signal %q", s)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("unknown signal %q", s)
+	}
+	return sig, nil
+}
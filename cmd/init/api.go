@@ -7,17 +7,24 @@ import (
 	"syscall"
 
 	"github.com/rugwirobaker/inferno/internal/vsock"
+	"golang.org/x/sys/unix"
 )
 
 type API struct {
 	vsockPort  uint32
 	signalChan chan syscall.Signal
+	env        map[string]string
+	// identity hands identities to waitForIdentity, it's unbuffered so a
+	// send only succeeds while init is waiting for one
+	identity chan identityRequest
 }
 
-func NewAPI(vsockPort uint32, signalChan chan syscall.Signal) *API {
+func NewAPI(vsockPort uint32, signalChan chan syscall.Signal, env map[string]string) *API {
 	return &API{
 		vsockPort:  vsockPort,
 		signalChan: signalChan,
+		env:        env,
+		identity:   make(chan identityRequest),
 	}
 }
 
@@ -26,6 +33,8 @@ func (a *API) Handler() http.Handler {
 	v1.HandleFunc("/status", statusHandler)
 	v1.Handle("/signal", signalHandler(a.signalChan))
 	v1.Handle("/ping", pingVsockHandler(a.vsockPort))
+	v1.Handle("/exec", execHandler(a.env))
+	v1.Handle("/identity", identityHandler(a.identity))
 	v1.Handle("/v1/", http.StripPrefix("/v1", v1))
 	return v1
 }
@@ -58,12 +67,9 @@ func signalHandler(killChan chan syscall.Signal) http.Handler {
 		}
 		slog.Info("Received kill signal", "signal", ks.Signal)
 
-		// validate the signal via syscall.Signal
+		// any signal the kernel knows is relayed to the main process
 		sig := syscall.Signal(ks.Signal)
-		switch sig {
-		case syscall.SIGTERM, syscall.SIGINT:
-			break
-		default:
+		if unix.SignalName(sig) == "" {
 			slog.Error("Invalid signal", "signal", ks.Signal)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/vsock"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// kmsgTailLines is how many of the last kernel messages go in a report
+	kmsgTailLines = 50
+	// bootReportTimeout bounds how long a dying init waits on kiln
+	bootReportTimeout = 2 * time.Second
+)
+
+// bootReporter tells kiln which stage of the boot failed before init exits,
+// otherwise the host only sees the VM die
+type bootReporter struct {
+	started    time.Time
+	port       uint32
+	configHash string
+}
+
+func newBootReporter(started time.Time, configPath string, port uint32) *bootReporter {
+	hash, err := configHash(configPath)
+	if err != nil {
+		slog.Warn("Failed to hash config", "error", err)
+	}
+	return &bootReporter{started: started, port: port, configHash: hash}
+}
+
+// fail logs msg, reports the failed stage to kiln and powers off
+func (b *bootReporter) fail(stage, msg string, err error, args ...any) {
+	slog.Error(msg, append([]any{"stage", stage, "error", err}, args...)...)
+
+	report := image.BootFailure{
+		Stage:      stage,
+		Error:      err.Error(),
+		ElapsedMS:  time.Since(b.started).Milliseconds(),
+		Kmsg:       kmsgTail(kmsgTailLines),
+		ConfigHash: b.configHash,
+	}
+	if err := b.send(report); err != nil {
+		slog.Error("Failed to report boot failure", "error", err)
+	}
+	powerOff()
+}
+
+func (b *bootReporter) send(report image.BootFailure) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bootReportTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode boot failure report: %w", err)
+	}
+
+	client, err := vsock.NewHostClient(ctx, b.port)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://host/boot-failure", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send boot failure report: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kiln rejected boot failure report: %s", resp.Status)
+	}
+	return nil
+}
+
+// configHash is the sha256 of the config init booted with, so a report can
+// be matched to the run.json that caused it
+func configHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// kmsgTail returns the last n lines of the kernel ring buffer. It's read
+// with syslog(2) rather than /dev/kmsg, which may not be mounted yet.
+func kmsgTail(n int) []string {
+	size, err := unix.Klogctl(unix.SYSLOG_ACTION_SIZE_BUFFER, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	read, err := unix.Klogctl(unix.SYSLOG_ACTION_READ_ALL, buf)
+	if err != nil {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buf[:read]), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
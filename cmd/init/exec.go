@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	// maxExecOutput caps how much of each output stream is sent back to the host
+	maxExecOutput = 1 << 20
+)
+
+type ExecRequest struct {
+	Cmd     []string `json:"cmd"`
+	Env     []string `json:"env,omitempty"`
+	Timeout int      `json:"timeout,omitempty"` // seconds
+}
+
+type ExecResponse struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+func execHandler(env map[string]string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var req ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Cmd) == 0 {
+			slog.Error("Failed to decode exec request", "error", err)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid exec request"})
+			return
+		}
+
+		timeout := defaultExecTimeout
+		if req.Timeout > 0 {
+			timeout = time.Duration(req.Timeout) * time.Second
+		}
+
+		// the API server's write timeout is shorter than what commands may take
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 5*time.Second))
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		var stdout, stderr = &cappedBuffer{max: maxExecOutput}, &cappedBuffer{max: maxExecOutput}
+
+		cmd := exec.CommandContext(ctx, req.Cmd[0], req.Cmd[1:]...)
+		cmd.Env = append(envList(env), req.Env...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		slog.Info("Executing command", "cmd", req.Cmd)
+
+		var resp ExecResponse
+
+		err := cmd.Run()
+
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			// same convention as timeout(1)
+			resp.ExitCode = 124
+		case errors.As(err, &exitErr):
+			resp.ExitCode = exitErr.ExitCode()
+		default:
+			slog.Error("Failed to execute command", "cmd", req.Cmd, "error", err)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+		resp.Stdout = stdout.String()
+		resp.Stderr = stderr.String()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for k, v := range env {
+		list = append(list, k+"="+v)
+	}
+	return list
+}
+
+// cappedBuffer keeps the first max bytes written to it and silently drops the
+// rest so the command doesn't fail on a closed pipe
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/vsock"
+)
+
+// sendHeartbeats tells kiln the guest is alive every interval until ctx is
+// done. A failed write is retried on the next beat, the connection redials.
+func sendHeartbeats(ctx context.Context, port uint32, interval time.Duration) error {
+	conn, err := vsock.NewRedialConn(port)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer conn.Close()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for seq := 1; ; seq++ {
+			if _, err := fmt.Fprintf(conn, "%d\n", seq); err != nil {
+				slog.Debug("Failed to send heartbeat", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
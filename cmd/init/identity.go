@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+)
+
+type identityRequest struct {
+	identity image.Identity
+	done     chan error
+}
+
+// identityHandler passes an identity on to waitForIdentity and reports whether it was applied
+func identityHandler(requests chan identityRequest) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var id image.Identity
+		if err := json.NewDecoder(r.Body).Decode(&id); err != nil {
+			slog.Error("Failed to decode identity", "error", err)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid identity"})
+			return
+		}
+
+		req := identityRequest{identity: id, done: make(chan error, 1)}
+		select {
+		case requests <- req:
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: "Not waiting for an identity"})
+			return
+		}
+
+		if err := <-req.done; err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "ok"}`))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// waitForIdentity blocks until the host delivers an identity that applies cleanly
+func (a *API) waitForIdentity(ctx context.Context, config *image.Config) error {
+	slog.Info("Waiting for identity")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case req := <-a.identity:
+			err := applyIdentity(config, req.identity)
+			req.done <- err
+			if err != nil {
+				slog.Error("Failed to apply identity", "error", err)
+				continue
+			}
+			slog.Info("Identity applied", "id", config.ID)
+			return nil
+		}
+	}
+}
+
+// applyIdentity sets the hostname, environment, addresses and files of the VM.
+// config.Env is updated in place, it's shared with the exec handler.
+func applyIdentity(config *image.Config, id image.Identity) error {
+	if id.ID != "" {
+		if err := setHostname(id.ID); err != nil {
+			return err
+		}
+		if err := os.WriteFile("/etc/hostname", []byte(id.ID), 0644); err != nil {
+			return fmt.Errorf("failed to write /etc/hostname: %w", err)
+		}
+		config.ID = id.ID
+	}
+
+	for k, v := range id.Env {
+		config.Env[k] = v
+	}
+
+	if len(id.IPs) > 0 {
+		if err := setupNetworking(image.Config{IPs: id.IPs}); err != nil {
+			return err
+		}
+	}
+
+	if err := CreateUserFiles(id.Files); err != nil {
+		return fmt.Errorf("failed to create files: %w", err)
+	}
+	return nil
+}
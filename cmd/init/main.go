@@ -24,6 +24,9 @@ import (
 
 const Path = "PATH=/usr/local/bin:/usr/local/sbin:/usr/bin:/usr/sbin:/bin:/sbin"
 
+// configPath is the run config the manager writes into the initramfs
+const configPath = "/inferno/run.json"
+
 var LogLevel struct {
 	sync.Mutex
 	slog.LevelVar
@@ -33,9 +36,10 @@ var LogLevel struct {
 // after the Kernel has started.
 func main() {
 	ctx := context.Background()
+	started := time.Now()
 
 	// Load and validate configuration
-	config, err := image.FromFile("/inferno/run.json")
+	config, err := image.FromFile(configPath)
 	if err != nil {
 		panic(fmt.Sprintf("could not read run.json, error: %s", err))
 	}
@@ -45,68 +49,60 @@ func main() {
 	}
 
 	slog.Info("inferno init started")
+
+	boot := newBootReporter(started, configPath, uint32(config.VsockExitPort))
 	slog.With("config", config).Debug("loaded config")
 
 	// Initial system setup
 	if err := MountInitialDevFS(); err != nil {
-		slog.Error("Failed to mount initial devfs", "error", err)
-		os.Exit(1)
+		boot.fail("devfs", "Failed to mount initial devfs", err)
 	}
 
 	// Mount root filesystem
 	if err := MountRootFS(config.Mounts.Root.Device, config.Mounts.Root.FSType, config.Mounts.Root.Options); err != nil {
-		slog.Error("Failed to mount root filesystem", "error", err)
-		os.Exit(1)
+		boot.fail("rootfs", "Failed to mount root filesystem", err)
 	}
 
 	// Mount /proc and /sys early - required for device-mapper initialization
 	// This must happen BEFORE unlockEncryptedVolumes so cryptsetup can initialize device-mapper
 	if err := MountEarlyPseudoFS(); err != nil {
-		slog.Error("Failed to mount early pseudo filesystems", "error", err)
-		os.Exit(1)
+		boot.fail("pseudofs", "Failed to mount early pseudo filesystems", err)
 	}
 
 	// Mount /run as tmpfs for runtime data (needed by cryptsetup for lock files)
 	// This must happen early, before volume unlock
 	if err := os.MkdirAll("/run", 0755); err != nil {
-		slog.Error("Failed to create /run", "error", err)
-		os.Exit(1)
+		boot.fail("run", "Failed to create /run", err)
 	}
 	if err := syscall.Mount("tmpfs", "/run", "tmpfs", 0, "mode=0755"); err != nil {
-		slog.Error("Failed to mount /run", "error", err)
-		os.Exit(1)
+		boot.fail("run", "Failed to mount /run", err)
 	}
 	if err := os.MkdirAll("/run/cryptsetup", 0755); err != nil {
-		slog.Error("Failed to create /run/cryptsetup", "error", err)
-		os.Exit(1)
+		boot.fail("run", "Failed to create /run/cryptsetup", err)
 	}
 
 	// Unlock encrypted volumes BEFORE moving /dev
 	// This must happen while /dev is still in initramfs where devices are accessible
 	if err := unlockEncryptedVolumes(ctx, config); err != nil {
-		slog.Error("FATAL: encrypted volume unlock failed", "error", err)
 		// Fail fast - exit init with non-zero status
 		// VM will terminate, operator must fix key/volume issues
-		os.Exit(1)
+		boot.fail("unlock_volumes", "FATAL: encrypted volume unlock failed", err)
 	}
 
 	// Move /dev to new root AFTER volume unlock
 	// This preserves both /dev/vdb and /dev/mapper/*_crypt devices
 	if err := MoveDevToNewRoot(); err != nil {
-		slog.Error("Failed to move /dev to new root", "error", err)
-		os.Exit(1)
+		boot.fail("move_dev", "Failed to move /dev to new root", err)
 	}
 
 	// Switch to new root
 	if err := switchRoot(); err != nil {
-		slog.Error("Failed to switch root", "error", err)
-		os.Exit(1)
+		boot.fail("switch_root", "Failed to switch root", err)
 	}
 
 	// Mount essential filesystems
 	if err := MountFS(); err != nil {
-		slog.Error("Failed to mount filesystems", "error", err)
-		os.Exit(1)
+		boot.fail("mount_fs", "Failed to mount filesystems", err)
 	}
 
 	// Mount additional volumes
@@ -140,24 +136,20 @@ func main() {
 		}
 
 		if err := Mount(device, vol.MountPoint, vol.FSType, flags, ""); err != nil {
-			slog.Error("Failed to mount volume",
+			boot.fail("mount_volumes", "Failed to mount volume", err,
 				"device", device,
 				"mountPoint", vol.MountPoint,
-				"error", err,
 			)
-			os.Exit(1)
 		}
 	}
 
 	// Create necessary directories
 	if err := os.MkdirAll("/run/lock", 0755); err != nil {
-		slog.Error("Failed to create /run/lock", "error", err)
-		os.Exit(1)
+		boot.fail("run", "Failed to create /run/lock", err)
 	}
 
 	if err := unix.Setrlimit(0, &unix.Rlimit{Cur: 10240, Max: 10240}); err != nil {
-		slog.Error("Failed to set rlimit", "error", err)
-		os.Exit(1)
+		boot.fail("rlimit", "Failed to set rlimit", err)
 	}
 
 	if err := os.Setenv("PATH", Path); err != nil {
@@ -170,58 +162,55 @@ func main() {
 
 	// mkdir /etc with 0755
 	if err := os.MkdirAll("/etc", 0755); err != nil {
-		slog.Error("Failed to create /etc", "error", err)
-		os.Exit(1)
+		boot.fail("etc", "Failed to create /etc", err)
 	}
 
 	// write hostname to /etc/hostname
 	if err := os.WriteFile("/etc/hostname", []byte(config.ID), 0644); err != nil {
-		slog.Error("Failed to write hostname to /etc/hostname", "error", err)
-		os.Exit(1)
+		boot.fail("etc", "Failed to write hostname to /etc/hostname", err)
 	}
 
 	// write resolv.conf
 	if err := writeResolvConf(config.EtcResolv); err != nil {
-		slog.Error("Failed to write resolv.conf", "error", err)
-		os.Exit(1)
+		boot.fail("etc", "Failed to write resolv.conf", err)
 	}
 
 	// populate /etc/hosts
 	if err := writeEtcHost(config.EtcHost); err != nil {
-		slog.Error("Failed to write /etc/hosts", "error", err)
-		os.Exit(1)
+		boot.fail("etc", "Failed to write /etc/hosts", err)
 	}
 
 	slog.Debug("Mounting user defined files")
 	if err := CreateUserFiles(config.Files); err != nil {
-		slog.Error("Failed to create user files", "error", err)
-		os.Exit(1)
+		boot.fail("files", "Failed to create user files", err)
 	}
 
 	if err := setupNetworking(*config); err != nil {
-		slog.Error("Failed to setup networking", "error", err)
-		os.Exit(1)
+		boot.fail("networking", "Failed to setup networking", err)
+	}
+
+	if config.MMDS {
+		if err := routeMetadata(); err != nil {
+			boot.fail("metadata", "Failed to route the metadata service", err)
+		}
 	}
 
 	// Setup the user environment
 	users := NewUserManager(config.User)
 	if err := users.Initialize(); err != nil {
-		slog.Error("Failed to setup user", "error", err)
-		os.Exit(1)
+		boot.fail("user", "Failed to setup user", err)
 	}
 
 	// Create VSOCK client to send exit status
 	exitClient, err := vsock.NewHostClient(ctx, uint32(config.VsockExitPort))
 	if err != nil {
-		slog.Error("Failed to create exit code vsock client", "error", err)
-		os.Exit(1)
+		boot.fail("vsock", "Failed to create exit code vsock client", err)
 	}
 
 	// Open VSOCK connection for logging
-	stdoutConn, err := vsock.NewVsockConn(uint32(config.VsockStdoutPort))
+	stdoutConn, err := vsock.NewRedialConn(uint32(config.VsockStdoutPort))
 	if err != nil {
-		slog.Error("Failed to create vsock log connection", "error", err)
-		os.Exit(1)
+		boot.fail("vsock", "Failed to create vsock log connection", err)
 	}
 	defer stdoutConn.Close()
 
@@ -231,10 +220,16 @@ func main() {
 		panic(fmt.Sprintf("could not reconfigure logger to vsock: %s", err))
 	}
 
+	if config.HeartbeatIntervalS > 0 {
+		interval := time.Duration(config.HeartbeatIntervalS) * time.Second
+		if err := sendHeartbeats(ctx, uint32(config.VsockHeartbeatPort), interval); err != nil {
+			boot.fail("heartbeat", "Failed to start heartbeats", err)
+		}
+	}
+
 	apiListener, err := vsock.NewVsockListener(uint32(config.VsockAPIPort))
 	if err != nil {
-		slog.Error("Failed to create vsock listener", "error", err)
-		os.Exit(1)
+		boot.fail("api", "Failed to create vsock listener", err)
 	}
 
 	// / Create the kill signal channel and pass it to the HTTP handler
@@ -242,7 +237,12 @@ func main() {
 
 	handleSystemSignals(killChan)
 
-	api := NewAPI(uint32(config.VsockStdoutPort), killChan)
+	// the identity's environment is merged into the map the API shares
+	if config.Env == nil {
+		config.Env = make(map[string]string)
+	}
+
+	api := NewAPI(uint32(config.VsockStdoutPort), killChan, config.Env)
 	server := &http.Server{
 		Handler:      api.Handler(),
 		ReadTimeout:  5 * time.Second,
@@ -260,6 +260,20 @@ func main() {
 		}
 
 	}()
+	// a pooled VM is paused here until it's handed out
+	if config.WaitForIdentity {
+		if err := api.waitForIdentity(ctx, config); err != nil {
+			boot.fail("identity", "Failed to receive identity", err)
+		}
+	}
+
+	// read after the identity, a pooled VM's metadata changes when it's handed out
+	if config.MMDS {
+		if err := writeMetadata(ctx); err != nil {
+			slog.Warn("Failed to read metadata", "error", err)
+		}
+	}
+
 	// Create and set up supervisor
 	supervisor := process.NewSupervisor(exitClient)
 
@@ -271,8 +285,7 @@ func main() {
 	// Create and add SSH server
 	sshServer, err := ssh.NewServer(config)
 	if err != nil {
-		slog.Error("Failed to create SSH server", "error", err)
-		os.Exit(1)
+		boot.fail("ssh", "Failed to create SSH server", err)
 	}
 	supervisor.Add(sshServer, stdoutConn)
 
@@ -280,7 +293,7 @@ func main() {
 	slog.Debug("Starting supervisor.Run()")
 	if err := supervisor.Run(ctx, killChan); err != nil {
 		slog.Error("Supervisor error", "error", err)
-		os.Exit(1)
+		powerOff()
 	}
 	slog.Info("Supervisor.Run() completed successfully")
 
@@ -295,6 +308,17 @@ func main() {
 	slog.Info("API server shutdown complete")
 
 	slog.Info("init exiting")
+	powerOff()
+}
+
+// powerOff stops the VM. Init returning as PID 1 would panic the kernel, with
+// reboot=k a reboot makes firecracker exit instead.
+func powerOff() {
+	unix.Sync()
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+		slog.Error("Failed to power off", "error", err)
+	}
+	os.Exit(1)
 }
 
 func setHostname(hostname string) error {
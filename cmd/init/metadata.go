@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// metadataPath is where workloads find the metadata document read at boot,
+	// the service at mmds.Address always has the current one
+	metadataPath = "/run/inferno/metadata.json"
+
+	// metadataTimeout bounds waiting for the host to publish the document
+	metadataTimeout = 5 * time.Second
+)
+
+// routeMetadata makes the metadata service reachable through eth0
+func routeMetadata() error {
+	eth0, err := netlink.LinkByName("eth0")
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(eth0); err != nil {
+		return fmt.Errorf("failed to bring up interface eth0: %w", err)
+	}
+
+	route := &netlink.Route{
+		LinkIndex: eth0.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.ParseIP(mmds.Address), Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err := netlink.RouteAdd(route); err != nil && err != unix.EEXIST {
+		return fmt.Errorf("failed to add route to the metadata service: %w", err)
+	}
+	return nil
+}
+
+// writeMetadata fetches the metadata document and writes it to metadataPath.
+// The host publishes it once firecracker is up, so early reads are retried.
+func writeMetadata(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: time.Second}
+
+	var (
+		md  *mmds.Metadata
+		err error
+	)
+	for {
+		md, err = mmds.Fetch(ctx, client, mmds.Address)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(metadataPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(metadataPath), err)
+	}
+	if err := os.WriteFile(metadataPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	slog.Info("Metadata written", "path", metadataPath)
+	return nil
+}
@@ -0,0 +1,64 @@
+// Package api holds the types exchanged between the inferno server and its clients.
+package api
+
+import (
+	"encoding/json"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+// ErrorResponse is the body returned by the API when a request fails
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// RunRequest asks the server to create and boot a VM
+type RunRequest struct {
+	Name     string `json:"name,omitempty"`
+	Image    string `json:"image"`
+	CPUKind  string `json:"cpu_kind"`
+	CPUCount int    `json:"cpu_count"`
+	MemoryMB int    `json:"memory_mb"`
+
+	Env map[string]string `json:"env,omitempty"` // added to the image's environment
+
+	// IPs replace the image's network config, Files are written to the guest
+	// before the main process starts
+	IPs   []image.IPConfig `json:"ips,omitempty"`
+	Files []image.File     `json:"files,omitempty"`
+
+	RestartPolicy RestartPolicy `json:"restart_policy"`
+	// Ports are published on the host, the daemon proxies them to the guest
+	Ports []PortMapping `json:"ports,omitempty"`
+	// Idle scales the VM to zero when its ports have no traffic
+	Idle *IdlePolicy `json:"idle,omitempty"`
+	// TrackDirtyPages lets the VM take diff snapshots, at some memory cost
+	TrackDirtyPages bool `json:"track_dirty_pages,omitempty"`
+	// RateLimits throttles the VM's disk and network, unset devices are unthrottled
+	RateLimits *kiln.RateLimits `json:"rate_limits,omitempty"`
+
+	// Labels and UserData are served to the guest by the metadata service
+	Labels   map[string]string `json:"labels,omitempty"`
+	UserData json.RawMessage   `json:"user_data,omitempty"`
+}
+
+// MetadataUpdate changes what the metadata service serves a VM. Labels are
+// merged, an empty value removes a label. UserData is replaced when set.
+type MetadataUpdate struct {
+	Labels   map[string]string `json:"labels,omitempty"`
+	UserData json.RawMessage   `json:"user_data,omitempty"`
+}
+
+// RunResponse is returned as soon as a VM has been registered, the rest of
+// the work is tracked by the operation
+type RunResponse struct {
+	ID          string `json:"id"`
+	OperationID string `json:"operation_id"`
+}
+
+// StopRequest asks the server to stop a VM, the signal defaults to SIGTERM
+type StopRequest struct {
+	ID     string `json:"id"`
+	Signal int32  `json:"signal"`
+}
@@ -0,0 +1,23 @@
+package api
+
+import "time"
+
+type EventType string
+
+const (
+	EventCreated   EventType = "created"
+	EventStarted   EventType = "started"
+	EventExited    EventType = "exited"
+	EventRestarted EventType = "restarted"
+	EventStopping  EventType = "stopping"
+	EventDeleted   EventType = "deleted"
+	EventFailed    EventType = "failed"
+)
+
+// Event is a VM lifecycle event, the events endpoint streams them as JSON lines
+type Event struct {
+	Time    time.Time `json:"time"`
+	VMID    string    `json:"vm_id"`
+	Type    EventType `json:"type"`
+	Message string    `json:"message,omitempty"`
+}
@@ -0,0 +1,15 @@
+package api
+
+// ExecRequest runs a command inside the guest next to its main process
+type ExecRequest struct {
+	Cmd     []string `json:"cmd"`
+	Env     []string `json:"env,omitempty"`     // KEY=VALUE pairs added to the guest environment
+	Timeout int      `json:"timeout,omitempty"` // seconds, the guest applies a default when zero
+}
+
+// ExecResponse carries the outcome of an exec, output is capped by the guest
+type ExecResponse struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
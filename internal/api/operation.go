@@ -0,0 +1,50 @@
+package api
+
+import "time"
+
+// phases reported while creating a VM
+const (
+	PhasePrepareChroot = "preparing_chroot"
+	PhaseFetchImage    = "fetching_image"
+	PhaseBuildInitrd   = "building_initrd"
+	PhaseCreateRootFS  = "creating_rootfs"
+	PhaseWriteConfigs  = "writing_configs"
+	PhaseBoot          = "booting"
+	// PhaseClaimPooled replaces all of the above when a pre-booted VM is handed out
+	PhaseClaimPooled = "claiming_pooled_vm"
+)
+
+type OperationStatus string
+
+const (
+	OperationPending   OperationStatus = "pending"
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+)
+
+// Phase is a single step of an operation
+type Phase struct {
+	Name        string          `json:"name"`
+	Status      OperationStatus `json:"status"`
+	StartedAt   time.Time       `json:"started_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	DurationMS  int64           `json:"duration_ms"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// Operation tracks a long running request such as creating a VM
+type Operation struct {
+	ID          string          `json:"id"`
+	VMID        string          `json:"vm_id"`
+	Status      OperationStatus `json:"status"`
+	Phases      []Phase         `json:"phases"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// Done reports whether the operation has completed, successfully or not
+func (o *Operation) Done() bool {
+	return o.Status == OperationSucceeded || o.Status == OperationFailed
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+type SnapshotType string
+
+const (
+	// SnapshotFull holds all of the guest's memory
+	SnapshotFull SnapshotType = "full"
+	// SnapshotDiff only captures the pages dirtied since the previous snapshot,
+	// the daemon merges them onto that snapshot so every snapshot restores on its own
+	SnapshotDiff SnapshotType = "diff"
+)
+
+// Snapshot is a VM's memory, device state and disk captured at a point in time
+type Snapshot struct {
+	ID        string       `json:"id"`
+	VMID      string       `json:"vm_id"`
+	Type      SnapshotType `json:"type"`
+	Parent    string       `json:"parent,omitempty"` // snapshot a diff was taken on top of
+	CreatedAt time.Time    `json:"created_at"`
+
+	Image         string                    `json:"image"`
+	Resources     kiln.Resources            `json:"resources"`
+	MachineConfig firecracker.MachineConfig `json:"machine_config"`
+	Host          SnapshotHost              `json:"host"`
+
+	SizeBytes int64 `json:"size_bytes"`
+	// PausedMS is how long the VM was paused while the snapshot was written
+	PausedMS int64 `json:"paused_ms"`
+}
+
+// SnapshotHost is the environment a snapshot was taken in, a snapshot only
+// restores on a host that matches it
+type SnapshotHost struct {
+	FirecrackerVersion string `json:"firecracker_version"`
+	KernelSHA256       string `json:"kernel_sha256"`
+	Arch               string `json:"arch"`
+	CPUModel           string `json:"cpu_model,omitempty"`
+}
+
+// SnapshotRequest asks for a snapshot of a running VM, full by default
+type SnapshotRequest struct {
+	Type SnapshotType `json:"type,omitempty"`
+}
+
+// RestoreRequest creates a new VM from a snapshot
+type RestoreRequest struct {
+	Name string `json:"name,omitempty"`
+}
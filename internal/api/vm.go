@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+// VM is the daemon's view of a VM.
+type VM struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name,omitempty"`
+	Image     string         `json:"image"`
+	State     vm.State       `json:"state"`
+	PID       int            `json:"pid,omitempty"`
+	Resources kiln.Resources `json:"resources"`
+	CreatedAt time.Time      `json:"created_at"`
+	StartedAt *time.Time     `json:"started_at,omitempty"`
+	StoppedAt *time.Time     `json:"stopped_at,omitempty"`
+
+	RestartPolicy RestartPolicy `json:"restart_policy"`
+	// RestartCount counts consecutive restarts, it's reset once the VM stays up for a while
+	RestartCount int            `json:"restart_count"`
+	Restarts     []RestartEvent `json:"restarts,omitempty"`
+	// UserStopped is set when the VM was stopped through the API, restart policies leave it alone
+	UserStopped bool `json:"user_stopped,omitempty"`
+	// RestoredFrom is the snapshot the VM was created from
+	RestoredFrom string `json:"restored_from,omitempty"`
+	// Pool is the template a pre-booted VM is kept ready for, it's cleared
+	// once the VM is handed out
+	Pool string `json:"pool,omitempty"`
+
+	Labels   map[string]string `json:"labels,omitempty"`
+	UserData json.RawMessage   `json:"user_data,omitempty"`
+
+	Ports      []PortMapping    `json:"ports,omitempty"`
+	Idle       *IdlePolicy      `json:"idle,omitempty"`
+	RateLimits *kiln.RateLimits `json:"rate_limits,omitempty"`
+	// IdledAt is when the idle policy scaled the VM to zero, it's cleared
+	// once the VM starts again
+	IdledAt *time.Time `json:"idled_at,omitempty"`
+
+	// Balloon is the balloon as kiln last reported it, it's only set in
+	// answers to balloon updates and is not persisted in the record
+	Balloon *kiln.BalloonStatus `json:"balloon,omitempty"`
+
+	// ExitStatus is read from the chroot, it is not persisted in the record
+	ExitStatus *kiln.KilnExitStatus `json:"exit_status,omitempty"`
+	// ExitReason explains ExitStatus for people
+	ExitReason string `json:"exit_reason,omitempty"`
+}
+
+type RestartPolicyName string
+
+const (
+	// RestartNo never restarts the VM
+	RestartNo RestartPolicyName = "no"
+	// RestartAlways restarts the VM whenever it exits, including after a daemon restart
+	RestartAlways RestartPolicyName = "always"
+	// RestartOnFailure restarts the VM when it fails, up to MaxRetries times in a row
+	RestartOnFailure RestartPolicyName = "on-failure"
+	// RestartUnlessStopped behaves like always unless the VM was stopped through the API
+	RestartUnlessStopped RestartPolicyName = "unless-stopped"
+)
+
+// RestartPolicy decides what happens when a VM exits
+type RestartPolicy struct {
+	Name       RestartPolicyName `json:"name"`
+	MaxRetries int               `json:"max_retries,omitempty"`
+}
+
+func (p RestartPolicy) Validate() error {
+	switch p.Name {
+	case "", RestartNo, RestartAlways, RestartUnlessStopped:
+		if p.MaxRetries != 0 {
+			return fmt.Errorf("max_retries is only supported by the %s restart policy", RestartOnFailure)
+		}
+		return nil
+	case RestartOnFailure:
+		if p.MaxRetries < 0 {
+			return fmt.Errorf("max_retries must not be negative")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown restart policy %q", p.Name)
+	}
+}
+
+// RestartEvent records a restart performed on behalf of the restart policy
+type RestartEvent struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+type IdleAction string
+
+const (
+	// IdleStop stops the VM, it cold boots on the next start
+	IdleStop IdleAction = "stop"
+	// IdleSnapshot snapshots the VM before stopping it, the next start
+	// resumes it where it left off
+	IdleSnapshot IdleAction = "snapshot"
+)
+
+// IdlePolicy scales a VM to zero once its published ports had no traffic for Timeout
+type IdlePolicy struct {
+	TimeoutS int        `json:"timeout_s"`
+	Action   IdleAction `json:"action"`
+}
+
+func (p IdlePolicy) Timeout() time.Duration {
+	return time.Duration(p.TimeoutS) * time.Second
+}
+
+func (p IdlePolicy) Validate() error {
+	if p.TimeoutS <= 0 {
+		return fmt.Errorf("idle timeout must be positive")
+	}
+	switch p.Action {
+	case IdleStop, IdleSnapshot:
+		return nil
+	default:
+		return fmt.Errorf("unknown idle action %q", p.Action)
+	}
+}
+
+// PortMapping publishes a guest port on the host, the daemon listens on the
+// host port and proxies connections to the guest
+type PortMapping struct {
+	// HostIP is the address listened on, all of the host's when empty
+	HostIP    string `json:"host_ip,omitempty"`
+	HostPort  int    `json:"host_port"`
+	GuestPort int    `json:"guest_port"`
+}
+
+// HostAddr is the address the port is published on
+func (p PortMapping) HostAddr() string {
+	return net.JoinHostPort(p.HostIP, strconv.Itoa(p.HostPort))
+}
+
+func (p PortMapping) Validate() error {
+	if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+		return fmt.Errorf("invalid host ip %q", p.HostIP)
+	}
+	if p.HostPort < 1 || p.HostPort > 65535 || p.GuestPort < 1 || p.GuestPort > 65535 {
+		return fmt.Errorf("ports must be between 1 and 65535")
+	}
+	return nil
+}
+
+// ValidatePorts validates each mapping and rejects host ports published twice
+func ValidatePorts(ports []PortMapping) error {
+	seen := make(map[int]bool, len(ports))
+	for _, p := range ports {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if seen[p.HostPort] {
+			return fmt.Errorf("host port %d is published twice", p.HostPort)
+		}
+		seen[p.HostPort] = true
+	}
+	return nil
+}
@@ -1,8 +1,444 @@
+// Package client is a typed client for the inferno server API.
 package client
 
-import "net/http"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+const (
+	// DefaultSocketPath is where the server listens unless configured otherwise
+	DefaultSocketPath = "/var/run/inferno.sock"
+
+	defaultUserAgent = "inferno-client"
+
+	// baseURL is only used to build request URLs, connections always go to the socket
+	baseURL = "http://inferno"
+)
 
 type Client struct {
 	userAgent string
 	client    *http.Client
 }
+
+type Option func(*Client)
+
+// WithUserAgent sets the User-Agent sent with every request
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithHTTPClient replaces the HTTP client, it must know how to reach the server
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// New returns a client talking to the server listening on socketPath
+func New(socketPath string, opts ...Option) *Client {
+	var dialer net.Dialer
+
+	c := &Client{
+		userAgent: defaultUserAgent,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is returned when the server responds with an error status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (status %d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err is a 404 from the server
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether err is a 409 from the server, for instance when
+// a VM is in the wrong state or the host is out of capacity
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+func hasStatus(err error, status int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == status
+}
+
+// Run creates and boots a VM, boot progress is tracked by the returned operation
+func (c *Client) Run(ctx context.Context, req *api.RunRequest) (*api.RunResponse, error) {
+	var resp api.RunResponse
+	if err := c.do(ctx, http.MethodPost, "/run", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Operation returns the progress of a long running operation
+func (c *Client) Operation(ctx context.Context, id string) (*api.Operation, error) {
+	var op api.Operation
+	if err := c.do(ctx, http.MethodGet, "/operations/"+url.PathEscape(id), nil, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// WaitOperation polls an operation until it completes, progress is called on every poll
+func (c *Client) WaitOperation(ctx context.Context, id string, interval time.Duration, progress func(*api.Operation)) (*api.Operation, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		op, err := c.Operation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(op)
+		}
+		if op.Done() {
+			return op, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// List returns all VMs known to the server
+func (c *Client) List(ctx context.Context) ([]*api.VM, error) {
+	var vms []*api.VM
+	if err := c.do(ctx, http.MethodGet, "/vms", nil, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// Inspect returns a single VM
+func (c *Client) Inspect(ctx context.Context, id string) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodGet, vmPath(id), nil, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// Start boots a stopped VM
+func (c *Client) Start(ctx context.Context, id string) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/start", nil, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// Stop asks a VM to stop with the given signal, zero means SIGTERM.
+// It returns once the signal has been delivered, not when the VM has exited.
+func (c *Client) Stop(ctx context.Context, id string, signal int32) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/stop", &api.StopRequest{Signal: signal}, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// Restart stops a VM if it's running and boots it again
+func (c *Client) Restart(ctx context.Context, id string) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/restart", nil, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// Status returns the live state of a VM as reported by its supervisor
+func (c *Client) Status(ctx context.Context, id string) (*kiln.Status, error) {
+	var status kiln.Status
+	if err := c.do(ctx, http.MethodGet, vmPath(id)+"/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Pause freezes a running VM, its memory stays allocated
+func (c *Client) Pause(ctx context.Context, id string) (*kiln.Status, error) {
+	var status kiln.Status
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/pause", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Resume unfreezes a paused VM
+func (c *Client) Resume(ctx context.Context, id string) (*kiln.Status, error) {
+	var status kiln.Status
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/resume", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// UpdateRateLimits changes a running VM's disk and network limits, limiters
+// left nil keep their current value
+func (c *Client) UpdateRateLimits(ctx context.Context, id string, limits *kiln.RateLimits) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodPatch, vmPath(id)+"/rate-limits", limits, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// UpdateBalloon sets a running VM's balloon target, the memory in MiB the
+// guest gives back to the host. A target of 0 deflates the balloon.
+func (c *Client) UpdateBalloon(ctx context.Context, id string, targetMiB int) (*api.VM, error) {
+	var vm api.VM
+	req := kiln.BalloonRequest{TargetMiB: targetMiB}
+	if err := c.do(ctx, http.MethodPatch, vmPath(id)+"/balloon", &req, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// UpdateMetadata changes the labels and user data a VM's metadata service serves
+func (c *Client) UpdateMetadata(ctx context.Context, id string, update *api.MetadataUpdate) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodPatch, vmPath(id)+"/metadata", update, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// Snapshot captures a running VM's memory, device state and disk. The VM is
+// paused while the snapshot is written.
+func (c *Client) Snapshot(ctx context.Context, id string, typ api.SnapshotType) (*api.Snapshot, error) {
+	var snap api.Snapshot
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/snapshots", &api.SnapshotRequest{Type: typ}, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// Snapshots lists the snapshots of a VM, or all snapshots when id is empty
+func (c *Client) Snapshots(ctx context.Context, id string) ([]*api.Snapshot, error) {
+	path := "/snapshots"
+	if id != "" {
+		path = vmPath(id) + "/snapshots"
+	}
+
+	var snaps []*api.Snapshot
+	if err := c.do(ctx, http.MethodGet, path, nil, &snaps); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// InspectSnapshot returns a single snapshot
+func (c *Client) InspectSnapshot(ctx context.Context, id string) (*api.Snapshot, error) {
+	var snap api.Snapshot
+	if err := c.do(ctx, http.MethodGet, snapshotPath(id), nil, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// DeleteSnapshot removes a snapshot and its files
+func (c *Client) DeleteSnapshot(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, snapshotPath(id), nil, nil)
+}
+
+// Restore creates and starts a new VM from a snapshot
+func (c *Client) Restore(ctx context.Context, id string, req *api.RestoreRequest) (*api.VM, error) {
+	var vm api.VM
+	if err := c.do(ctx, http.MethodPost, snapshotPath(id)+"/restore", req, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// Delete removes a stopped VM
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, vmPath(id), nil, nil)
+}
+
+// Exec runs a command in the guest and returns its output
+func (c *Client) Exec(ctx context.Context, id string, req *api.ExecRequest) (*api.ExecResponse, error) {
+	var resp api.ExecResponse
+	if err := c.do(ctx, http.MethodPost, vmPath(id)+"/exec", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Logs streams the output of the guest, with follow set the stream stays open
+// until the VM stops or ctx is cancelled. The caller must close the reader.
+func (c *Client) Logs(ctx context.Context, id string, follow bool) (io.ReadCloser, error) {
+	path := vmPath(id) + "/logs"
+	if follow {
+		path += "?follow=true"
+	}
+
+	resp, err := c.stream(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// EventStream is a stream of lifecycle events
+type EventStream struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+// Recv blocks until the next event arrives, it returns io.EOF when the server ends the stream
+func (s *EventStream) Recv() (*api.Event, error) {
+	var event api.Event
+	if err := s.decoder.Decode(&event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+// Events subscribes to lifecycle events, of a single VM when vmID is set
+func (c *Client) Events(ctx context.Context, vmID string) (*EventStream, error) {
+	path := "/events"
+	if vmID != "" {
+		path += "?vm=" + url.QueryEscape(vmID)
+	}
+
+	resp, err := c.stream(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{
+		body:    resp.Body,
+		decoder: json.NewDecoder(bufio.NewReader(resp.Body)),
+	}, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(in); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = buf
+	}
+
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach inferno server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// stream starts a request whose body is consumed by the caller
+func (c *Client) stream(ctx context.Context, path string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach inferno server: %w", err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// decodeError turns an error response into an *Error, some endpoints reply
+// with plain text instead of an api.ErrorResponse
+func decodeError(resp *http.Response) error {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+
+	var e api.ErrorResponse
+	if err := json.Unmarshal(data, &e); err == nil && e.Error != "" {
+		return &Error{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	if msg := strings.TrimSpace(string(data)); msg != "" {
+		return &Error{StatusCode: resp.StatusCode, Message: msg}
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+}
+
+func vmPath(id string) string {
+	return "/vms/" + url.PathEscape(id)
+}
+
+func snapshotPath(id string) string {
+	return "/snapshots/" + url.PathEscape(id)
+}
@@ -0,0 +1,132 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/client"
+	"github.com/rugwirobaker/inferno/internal/client/clienttest"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientLifecycle(t *testing.T) {
+	var (
+		ctx = context.Background()
+		srv = clienttest.NewServer(t)
+		c   = srv.Client()
+	)
+
+	run, err := c.Run(ctx, &api.RunRequest{Image: "alpine:latest"})
+	require.NoError(t, err)
+	require.NotEmpty(t, run.ID)
+
+	op, err := c.WaitOperation(ctx, run.OperationID, 10*time.Millisecond, nil)
+	require.NoError(t, err)
+	assert.Equal(t, api.OperationSucceeded, op.Status)
+	assert.Equal(t, run.ID, op.VMID)
+
+	got, err := c.Inspect(ctx, run.ID)
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, got.State)
+	assert.Equal(t, "alpine:latest", got.Image)
+
+	vms, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, vms, 1)
+
+	// a running VM can't be deleted
+	err = c.Delete(ctx, run.ID)
+	assert.True(t, client.IsConflict(err), "expected conflict, got %v", err)
+
+	// the stop is accepted while the VM may still be going down
+	stopping, err := c.Stop(ctx, run.ID, 0)
+	require.NoError(t, err)
+	assert.True(t, stopping.UserStopped)
+
+	require.Eventually(t, func() bool {
+		stopped, err := c.Inspect(ctx, run.ID)
+		return err == nil && stopped.State == vm.StateStopped
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = c.Stop(ctx, run.ID, 0)
+	assert.True(t, client.IsConflict(err), "expected conflict, got %v", err)
+
+	require.NoError(t, c.Delete(ctx, run.ID))
+
+	_, err = c.Inspect(ctx, run.ID)
+	assert.True(t, client.IsNotFound(err), "expected not found, got %v", err)
+
+	var apiErr *client.Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "vm not found", apiErr.Message)
+}
+
+func TestClientExec(t *testing.T) {
+	var (
+		ctx = context.Background()
+		srv = clienttest.NewServer(t)
+		c   = srv.Client()
+	)
+
+	srv.AddVM(&api.VM{ID: "running", State: vm.StateRunning})
+	srv.AddVM(&api.VM{ID: "stopped", State: vm.StateStopped})
+
+	resp, err := c.Exec(ctx, "running", &api.ExecRequest{Cmd: []string{"echo", "hello"}})
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitCode)
+	assert.Equal(t, "echo hello\n", resp.Stdout)
+
+	_, err = c.Exec(ctx, "stopped", &api.ExecRequest{Cmd: []string{"true"}})
+	assert.True(t, client.IsConflict(err), "expected conflict, got %v", err)
+}
+
+func TestClientLogs(t *testing.T) {
+	var (
+		ctx = context.Background()
+		srv = clienttest.NewServer(t)
+		c   = srv.Client()
+	)
+
+	srv.AddVM(&api.VM{ID: "vm1", State: vm.StateRunning})
+	srv.SetLogs("vm1", "booting\nready\n")
+
+	logs, err := c.Logs(ctx, "vm1", false)
+	require.NoError(t, err)
+	defer logs.Close()
+
+	data, err := io.ReadAll(logs)
+	require.NoError(t, err)
+	assert.Equal(t, "booting\nready\n", string(data))
+
+	_, err = c.Logs(ctx, "missing", false)
+	assert.True(t, client.IsNotFound(err), "expected not found, got %v", err)
+}
+
+func TestClientEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var (
+		srv = clienttest.NewServer(t)
+		c   = srv.Client()
+	)
+
+	stream, err := c.Events(ctx, "vm1")
+	require.NoError(t, err)
+	defer stream.Close()
+
+	srv.Publish(api.Event{VMID: "vm2", Type: api.EventStarted})
+	srv.Publish(api.Event{VMID: "vm1", Type: api.EventExited, Message: "exit code 0"})
+
+	event, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "vm1", event.VMID)
+	assert.Equal(t, api.EventExited, event.Type)
+	assert.Equal(t, "exit code 0", event.Message)
+}
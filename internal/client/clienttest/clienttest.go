@@ -0,0 +1,408 @@
+// Package clienttest runs the inferno server's API for testing code that
+// uses the client package. The VMs are fake machines: kiln is a process that
+// sleeps until it's stopped and the guest answers exec requests with
+// ExecFunc. Like the server, it needs root to provision VMs.
+package clienttest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/client"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/rugwirobaker/inferno/internal/vsock"
+)
+
+// fakeKiln runs in place of kiln, the fake machine stops it
+const fakeKiln = "#!/bin/sh\nexec sleep 3600\n"
+
+// Server serves the inferno API on a unix socket
+type Server struct {
+	SocketPath string
+
+	// ExecFunc answers exec requests, by default it echoes the command
+	ExecFunc func(id string, req *api.ExecRequest) (*api.ExecResponse, error)
+
+	t       testing.TB
+	cfg     *config.Config
+	vms     *server.Registry
+	handler http.Handler
+	srv     *httptest.Server
+
+	mu       sync.Mutex
+	machines map[string]*machine
+}
+
+// NewServer starts a server that is shut down when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	var (
+		dir = t.TempDir()
+		cfg = config.Default()
+	)
+	cfg.StateBaseDir = filepath.Join(dir, "state")
+	cfg.LogDir = filepath.Join(dir, "logs")
+	cfg.KernelPath = filepath.Join(dir, "vmlinux")
+	cfg.InitPath = filepath.Join(dir, "init")
+	cfg.FirecrackerBinPath = filepath.Join(dir, "firecracker")
+	cfg.KilnBinPath = filepath.Join(dir, "kiln")
+
+	if err := os.MkdirAll(filepath.Join(cfg.LogDir, "vm"), 0o755); err != nil {
+		t.Fatalf("failed to create log dir: %v", err)
+	}
+	for path, content := range map[string]string{
+		cfg.KernelPath:         "vmlinux",
+		cfg.InitPath:           "init",
+		cfg.FirecrackerBinPath: "firecracker",
+		cfg.KilnBinPath:        fakeKiln,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	var (
+		vms   = server.NewRegistry(filepath.Join(cfg.StateBaseDir, "vms"))
+		alloc = server.NewAllocator(vms, server.Capacity{CPUs: 64, MemoryMB: 64 << 10}, cfg.Capacity)
+		snaps = server.NewSnapshots(filepath.Join(cfg.StateBaseDir, "snapshots"))
+	)
+
+	s := &Server{
+		SocketPath: filepath.Join(dir, "inferno.sock"),
+		ExecFunc:   echo,
+		t:          t,
+		cfg:        cfg,
+		vms:        vms,
+		machines:   make(map[string]*machine),
+	}
+
+	s.handler = server.NewHandler(cfg, &host{s: s}, vms, server.NewOperations(), alloc, nil, snaps)
+
+	listener, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", s.SocketPath, err)
+	}
+	s.srv = httptest.NewUnstartedServer(s.handler)
+	s.srv.Listener = listener
+	s.srv.Start()
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client returns a client connected to the server
+func (s *Server) Client(opts ...client.Option) *client.Client {
+	return client.New(s.SocketPath, opts...)
+}
+
+// Close shuts the server down and kills the VMs' kiln processes
+func (s *Server) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+
+	for _, rec := range s.vms.List() {
+		machine := s.vms.Machine(rec.ID)
+		if machine == nil {
+			continue
+		}
+		_ = machine.Kill()
+		<-machine.Done()
+
+		// the exit is recorded in the chroot, let it land before it's removed
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if got, err := s.vms.Get(rec.ID); err != nil || got.PID != machine.PID {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, m := range s.machines {
+		m.close()
+		delete(s.machines, id)
+	}
+}
+
+// AddVM registers a VM as if it had been created through the API, a running
+// VM is started through the API
+func (s *Server) AddVM(v *api.VM) {
+	s.t.Helper()
+
+	if err := s.addVM(v); err != nil {
+		s.t.Fatalf("failed to add vm %s: %v", v.ID, err)
+	}
+}
+
+func (s *Server) addVM(v *api.VM) error {
+	var (
+		rec    = *v
+		chroot = s.vms.Chroot(v.ID)
+	)
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now().UTC()
+	}
+	running := rec.State == vm.StateRunning
+	if running {
+		rec.State = vm.StateStopped
+	}
+
+	if err := os.MkdirAll(chroot, 0o755); err != nil {
+		return err
+	}
+	config := kiln.Default()
+	config.JailID = v.ID
+	if err := kiln.WriteConfig(filepath.Join(chroot, "kiln.json"), config); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(chroot, "kiln"), []byte(fakeKiln), 0o755); err != nil {
+		return err
+	}
+
+	if err := s.attach(v.ID); err != nil {
+		return err
+	}
+	if err := s.vms.Put(&rec); err != nil {
+		return err
+	}
+	if !running {
+		return nil
+	}
+
+	resp := httptest.NewRecorder()
+	s.handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/vms/"+v.ID+"/start", nil))
+	if resp.Code != http.StatusOK {
+		return fmt.Errorf("failed to start vm %s: %s", v.ID, resp.Body.String())
+	}
+	return nil
+}
+
+// SetLogs sets the output the logs endpoint returns for a VM
+func (s *Server) SetLogs(id, logs string) {
+	s.t.Helper()
+
+	if err := os.WriteFile(filepath.Join(s.cfg.LogDir, "vm", id+".log"), []byte(logs), 0o644); err != nil {
+		s.t.Fatalf("failed to set logs of vm %s: %v", id, err)
+	}
+}
+
+// Publish sends an event to all subscribers
+func (s *Server) Publish(event api.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	s.vms.Events().Publish(event)
+}
+
+func (s *Server) attach(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.machines[id]; ok {
+		return nil
+	}
+	m, err := newMachine(s, id)
+	if err != nil {
+		return err
+	}
+	s.machines[id] = m
+	return nil
+}
+
+// machine serves kiln's control API and the guest's init API for a VM
+type machine struct {
+	s    *Server
+	id   string
+	srvs []*http.Server
+
+	mu    sync.Mutex
+	state kiln.State
+}
+
+func newMachine(s *Server, id string) (*machine, error) {
+	var (
+		chroot = s.vms.Chroot(id)
+		m      = &machine{s: s, id: id, state: kiln.StateRunning}
+	)
+
+	control := http.NewServeMux()
+	control.HandleFunc("GET /status", m.status)
+	control.HandleFunc("POST /pause", m.transition(kiln.StateRunning, kiln.StatePaused))
+	control.HandleFunc("POST /resume", m.transition(kiln.StatePaused, kiln.StateRunning))
+	control.HandleFunc("POST /shutdown", m.shutdown)
+
+	guest := http.NewServeMux()
+	guest.HandleFunc("POST /exec", m.exec)
+
+	for socket, handler := range map[string]http.Handler{
+		kiln.DefaultControlSocket: control,
+		"control.sock":            guest,
+	} {
+		l, err := net.Listen("unix", filepath.Join(chroot, socket))
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		if socket == "control.sock" {
+			l = &vsockListener{Listener: l}
+		}
+		srv := &http.Server{Handler: handler}
+		go srv.Serve(l)
+		m.srvs = append(m.srvs, srv)
+	}
+	return m, nil
+}
+
+func (m *machine) close() {
+	for _, srv := range m.srvs {
+		srv.Close()
+	}
+}
+
+func (m *machine) status(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, kiln.Status{ID: m.id, State: m.state})
+}
+
+func (m *machine) transition(from, to kiln.State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.state != from {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("vm is %s", m.state)})
+			return
+		}
+		m.state = to
+		writeJSON(w, http.StatusOK, kiln.Status{ID: m.id, State: m.state})
+	}
+}
+
+// shutdown records the request in the exit status and kills kiln, the server
+// sees a VM that was stopped on request
+func (m *machine) shutdown(w http.ResponseWriter, r *http.Request) {
+	var req kiln.ShutdownRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	var (
+		exitCode = int64(0)
+		status   = kiln.KilnExitStatus{
+			Version:     kiln.ExitStatusVersion,
+			VMExitCode:  &exitCode,
+			StopRequest: &kiln.StopRequest{Source: kiln.StopSourceControl, Signal: req.Signal, Reason: req.Reason, Force: req.Force, At: time.Now().UTC()},
+		}
+	)
+	data, err := json.Marshal(status)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(m.s.vms.Chroot(m.id), kiln.Default().ExitStatusPath), data, 0o644)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeJSON(w, http.StatusAccepted, kiln.Status{ID: m.id, State: m.state})
+	if machine := m.s.vms.Machine(m.id); machine != nil {
+		_ = machine.Kill()
+	}
+}
+
+func (m *machine) exec(w http.ResponseWriter, r *http.Request) {
+	var req api.ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	resp, err := m.s.ExecFunc(m.id, &req)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// vsockListener answers the CONNECT line firecracker's vsock socket expects
+// before the connection is handed to the guest
+type vsockListener struct {
+	net.Listener
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// read byte by byte so nothing past the line is consumed
+		var line []byte
+		buf := make([]byte, 1)
+		for err == nil && (len(line) == 0 || line[len(line)-1] != '\n') {
+			if _, err = conn.Read(buf); err == nil {
+				line = append(line, buf[0])
+			}
+		}
+		if err == nil && strings.HasPrefix(string(line), "CONNECT ") {
+			_, err = fmt.Fprintf(conn, "OK %d\n", vsock.VsockAPIPort)
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// host provisions VMs without docker or network devices, every VM gets a
+// fake machine with its root filesystem
+type host struct {
+	s *Server
+}
+
+func (h *host) FetchImage(context.Context, string) error { return nil }
+
+func (h *host) CreateConfig(context.Context, string) (*image.Config, error) {
+	return &image.Config{}, nil
+}
+
+func (h *host) CreateRootFS(_ context.Context, _, path string) error {
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		return err
+	}
+	// the rootfs is created in the chroot, which is named after the VM
+	return h.s.attach(filepath.Base(filepath.Dir(path)))
+}
+
+func (h *host) CreateTap(string) error { return nil }
+
+func echo(_ string, req *api.ExecRequest) (*api.ExecResponse, error) {
+	return &api.ExecResponse{Stdout: strings.Join(req.Cmd, " ") + "\n"}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -20,9 +20,62 @@ type Config struct {
 	InitPath             string `yaml:"init_path"`            // /var/lib/inferno/initrd.img
 	LogDir               string `yaml:"log_dir"`              // /var/lib/inferno/logs
 	ServerSocketFilePath string `yaml:"server_socket_path"`   // /var/run/inferno.sock
+	KeepOnFailure        bool   `yaml:"keep_on_failure"`      // keep artifacts of failed VM creations for debugging
+	CgroupParent         string `yaml:"cgroup_parent"`        // cgroup v2 parent of the VMs' cgroups, opt-in, empty leaves cgroups alone
+	Jail                 bool   `yaml:"jail"`                 // start kiln through kiln jail: private mounts, network and PIDs, minimal /dev, unprivileged
 	Log                  Log    `yaml:"log"`
+
+	DefaultCPUKind string             `yaml:"default_cpu_kind"` // used when a run request doesn't name one
+	CPUKinds       map[string]CPUKind `yaml:"cpu_kinds"`
+
+	Capacity Capacity `yaml:"capacity"`
+
+	Heartbeat Heartbeat `yaml:"heartbeat"`
+
+	Pools []Pool `yaml:"pools,omitempty"`
+}
+
+// Pool keeps pre-booted, paused VMs ready for run requests matching its template
+type Pool struct {
+	Image    string `yaml:"image"`
+	CPUKind  string `yaml:"cpu_kind,omitempty"`  // defaults to the default cpu kind
+	MemoryMB int    `yaml:"memory_mb,omitempty"` // defaults to the cpu kind's minimum
+	Size     int    `yaml:"size"`                // VMs kept ready
+}
+
+// Capacity controls how much of the host VMs are allowed to commit
+type Capacity struct {
+	CPUOvercommit    float64 `yaml:"cpu_overcommit"`     // vCPUs per host CPU
+	MemoryOvercommit float64 `yaml:"memory_overcommit"`  // 1.0 disables memory overcommit
+	ReservedCPUs     int     `yaml:"reserved_cpus"`      // host CPUs kept for the host itself
+	ReservedMemoryMB int     `yaml:"reserved_memory_mb"` // host memory kept for the host itself
+}
+
+func DefaultCapacity() Capacity {
+	return Capacity{
+		CPUOvercommit:    4,
+		MemoryOvercommit: 1,
+		ReservedCPUs:     0,
+		ReservedMemoryMB: 1024,
+	}
+}
+
+// Heartbeat controls how kiln detects guests that stopped responding
+type Heartbeat struct {
+	IntervalS int  `yaml:"interval_s"` // how often the guest sends a heartbeat
+	MaxMisses int  `yaml:"max_misses"` // missed heartbeats before the guest is unhealthy
+	ForceStop bool `yaml:"force_stop"` // kill unhealthy VMs, restart policies take it from there
+}
+
+func DefaultHeartbeat() Heartbeat {
+	return Heartbeat{
+		IntervalS: 5,
+		MaxMisses: 3,
+	}
 }
 
+const defaultCPUKind = "shared-cpu-1x"
+
 type Log struct {
 	Format    string  `yaml:"format"`         // "text", "json"
 	Timestamp bool    `yaml:"timestamp"`      // show timestamp
@@ -45,7 +98,44 @@ func Default() *Config {
 			Timestamp: true,
 			Debug:     false,
 		},
+		DefaultCPUKind: defaultCPUKind,
+		CPUKinds:       DefaultCPUKinds(),
+		Capacity:       DefaultCapacity(),
+		Heartbeat:      DefaultHeartbeat(),
+	}
+}
+
+// Validate checks the parts of the configuration that can't be checked while decoding
+func (cfg *Config) Validate() error {
+	for name, kind := range cfg.CPUKinds {
+		if err := kind.Validate(); err != nil {
+			return fmt.Errorf("invalid cpu kind %q: %w", name, err)
+		}
+	}
+	if _, ok := cfg.CPUKinds[cfg.DefaultCPUKind]; !ok {
+		return fmt.Errorf("default cpu kind %q is not in the catalog", cfg.DefaultCPUKind)
+	}
+	if cfg.Capacity.CPUOvercommit <= 0 || cfg.Capacity.MemoryOvercommit <= 0 {
+		return fmt.Errorf("capacity overcommit ratios must be positive")
+	}
+	if cfg.Capacity.ReservedCPUs < 0 || cfg.Capacity.ReservedMemoryMB < 0 {
+		return fmt.Errorf("capacity reservations must not be negative")
+	}
+	if cfg.Heartbeat.IntervalS <= 0 || cfg.Heartbeat.MaxMisses <= 0 {
+		return fmt.Errorf("heartbeat interval and max misses must be positive")
 	}
+	for i, pool := range cfg.Pools {
+		if pool.Image == "" {
+			return fmt.Errorf("pool %d has no image", i)
+		}
+		if pool.Size <= 0 {
+			return fmt.Errorf("pool for %s must have a positive size", pool.Image)
+		}
+		if _, ok := cfg.CPUKinds[pool.CPUKind]; pool.CPUKind != "" && !ok {
+			return fmt.Errorf("pool for %s uses unknown cpu kind %q", pool.Image, pool.CPUKind)
+		}
+	}
+	return nil
 }
 
 func (cfg *Config) Write(w io.Writer) error {
@@ -72,6 +162,20 @@ func FromFile(path string) (*Config, error) {
 	if err := decoder.Decode(cfg); err != nil {
 		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
+
+	// configs written before the catalog existed get the default one
+	if len(cfg.CPUKinds) == 0 {
+		cfg.CPUKinds = DefaultCPUKinds()
+	}
+	if cfg.DefaultCPUKind == "" {
+		cfg.DefaultCPUKind = defaultCPUKind
+	}
+	if cfg.Capacity == (Capacity{}) {
+		cfg.Capacity = DefaultCapacity()
+	}
+	if cfg.Heartbeat == (Heartbeat{}) {
+		cfg.Heartbeat = DefaultHeartbeat()
+	}
 	return cfg, nil
 }
 
@@ -85,6 +189,9 @@ func (cfg *Config) OverrideWithFlags(ctx context.Context) {
 	if imageBaseDir := flag.GetString(ctx, "image-base-dir"); imageBaseDir != "" {
 		cfg.ImageBaseDir = imageBaseDir
 	}
+	if keepOnFailure := flag.GetBool(ctx, "keep-on-failure"); keepOnFailure {
+		cfg.KeepOnFailure = keepOnFailure
+	}
 	if logFormat := flag.GetString(ctx, "log-format"); logFormat != "" {
 		cfg.Log.Format = logFormat
 	}
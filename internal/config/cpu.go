@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// cpuTemplates are the static CPU templates firecracker ships with
+var cpuTemplates = []string{"C3", "T2", "T2S", "T2CL", "T2A", "V1N1", "None"}
+
+// CPUKind describes a named VM size
+type CPUKind struct {
+	VCPUs           int    `yaml:"vcpus"`
+	MinMemoryMB     int    `yaml:"min_memory_mb"`
+	MaxMemoryMB     int    `yaml:"max_memory_mb"`
+	SMT             bool   `yaml:"smt"`                    // expose hyperthreads to the guest
+	CPUTemplate     string `yaml:"cpu_template,omitempty"` // firecracker static CPU template
+	CPUQuotaPercent int    `yaml:"cpu_quota_percent"`      // share of each vCPU the VM may use, 100 is unthrottled
+}
+
+// DefaultCPUKinds is the catalog used when the configuration doesn't define one
+func DefaultCPUKinds() map[string]CPUKind {
+	return map[string]CPUKind{
+		"shared-cpu-1x": {
+			VCPUs:           1,
+			MinMemoryMB:     128,
+			MaxMemoryMB:     2048,
+			CPUQuotaPercent: 25,
+		},
+		"shared-cpu-2x": {
+			VCPUs:           2,
+			MinMemoryMB:     256,
+			MaxMemoryMB:     4096,
+			CPUQuotaPercent: 25,
+		},
+		"performance-1x": {
+			VCPUs:           1,
+			MinMemoryMB:     1024,
+			MaxMemoryMB:     8192,
+			CPUQuotaPercent: 100,
+		},
+		"performance-2x": {
+			VCPUs:           2,
+			MinMemoryMB:     2048,
+			MaxMemoryMB:     16384,
+			CPUQuotaPercent: 100,
+		},
+	}
+}
+
+func (k CPUKind) Validate() error {
+	if k.VCPUs < 1 || k.VCPUs > 32 {
+		return fmt.Errorf("vcpus must be between 1 and 32, got %d", k.VCPUs)
+	}
+	// firecracker only accepts 1 or an even number of vCPUs with SMT enabled
+	if k.SMT && k.VCPUs > 1 && k.VCPUs%2 != 0 {
+		return fmt.Errorf("vcpus must be 1 or even when smt is enabled, got %d", k.VCPUs)
+	}
+	if k.MinMemoryMB < 1 {
+		return fmt.Errorf("min_memory_mb must be positive, got %d", k.MinMemoryMB)
+	}
+	if k.MaxMemoryMB < k.MinMemoryMB {
+		return fmt.Errorf("max_memory_mb (%d) must not be lower than min_memory_mb (%d)", k.MaxMemoryMB, k.MinMemoryMB)
+	}
+	if k.CPUTemplate != "" && !slices.Contains(cpuTemplates, k.CPUTemplate) {
+		return fmt.Errorf("unknown cpu_template %q, expected one of %v", k.CPUTemplate, cpuTemplates)
+	}
+	if k.CPUQuotaPercent < 1 || k.CPUQuotaPercent > 100 {
+		return fmt.Errorf("cpu_quota_percent must be between 1 and 100, got %d", k.CPUQuotaPercent)
+	}
+	return nil
+}
+
+// ResolveCPUKind looks up a CPU kind in the catalog, an empty name selects the default kind
+func (cfg *Config) ResolveCPUKind(name string) (string, CPUKind, error) {
+	if name == "" {
+		name = cfg.DefaultCPUKind
+	}
+	kind, ok := cfg.CPUKinds[name]
+	if !ok {
+		return "", CPUKind{}, fmt.Errorf("unknown cpu kind %q, expected one of %v", name, cfg.cpuKindNames())
+	}
+	return name, kind, nil
+}
+
+func (cfg *Config) cpuKindNames() []string {
+	names := make([]string, 0, len(cfg.CPUKinds))
+	for name := range cfg.CPUKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,77 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDefaultCPUKinds tests that the built-in catalog is valid and covers the
+// defaults kiln and the server fall back to.
+func TestDefaultCPUKinds(t *testing.T) {
+	cfg := config.Default()
+	require.NoError(t, cfg.Validate())
+
+	for name, kind := range config.DefaultCPUKinds() {
+		assert.NoError(t, kind.Validate(), "cpu kind %s", name)
+	}
+	assert.Contains(t, cfg.CPUKinds, kiln.Default().Resources.CPUKind)
+}
+
+// TestCPUKindValidate tests that impossible VM sizes are rejected.
+func TestCPUKindValidate(t *testing.T) {
+	valid := config.CPUKind{VCPUs: 2, MinMemoryMB: 256, MaxMemoryMB: 4096, CPUQuotaPercent: 50}
+
+	tests := []struct {
+		name    string
+		modify  func(k *config.CPUKind)
+		wantErr string
+	}{
+		{"valid", func(k *config.CPUKind) {}, ""},
+		{"no vcpus", func(k *config.CPUKind) { k.VCPUs = 0 }, "vcpus must be between 1 and 32"},
+		{"too many vcpus", func(k *config.CPUKind) { k.VCPUs = 33 }, "vcpus must be between 1 and 32"},
+		{"odd vcpus with smt", func(k *config.CPUKind) { k.VCPUs, k.SMT = 3, true }, "must be 1 or even"},
+		{"one vcpu with smt", func(k *config.CPUKind) { k.VCPUs, k.SMT = 1, true }, ""},
+		{"no memory", func(k *config.CPUKind) { k.MinMemoryMB = 0 }, "min_memory_mb must be positive"},
+		{"inverted memory range", func(k *config.CPUKind) { k.MaxMemoryMB = 128 }, "must not be lower than min_memory_mb"},
+		{"known template", func(k *config.CPUKind) { k.CPUTemplate = "C3" }, ""},
+		{"unknown template", func(k *config.CPUKind) { k.CPUTemplate = "Z9" }, "unknown cpu_template"},
+		{"no quota", func(k *config.CPUKind) { k.CPUQuotaPercent = 0 }, "cpu_quota_percent must be between 1 and 100"},
+		{"quota above 100", func(k *config.CPUKind) { k.CPUQuotaPercent = 150 }, "cpu_quota_percent must be between 1 and 100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind := valid
+			tt.modify(&kind)
+
+			err := kind.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+// TestResolveCPUKind tests that an empty name picks the default kind.
+func TestResolveCPUKind(t *testing.T) {
+	cfg := config.Default()
+
+	name, kind, err := cfg.ResolveCPUKind("")
+	require.NoError(t, err)
+	assert.Equal(t, cfg.DefaultCPUKind, name)
+	assert.Equal(t, cfg.CPUKinds[cfg.DefaultCPUKind], kind)
+
+	name, kind, err = cfg.ResolveCPUKind("performance-2x")
+	require.NoError(t, err)
+	assert.Equal(t, "performance-2x", name)
+	assert.Equal(t, 2, kind.VCPUs)
+
+	_, _, err = cfg.ResolveCPUKind("C3")
+	assert.ErrorContains(t, err, `unknown cpu kind "C3"`)
+}
@@ -0,0 +1,214 @@
+package firecracker
+
+import "fmt"
+
+// Types exchanged with the Firecracker API, see
+// https://github.com/firecracker-microvm/firecracker/blob/main/src/firecracker/swagger/firecracker.yaml
+
+// InstanceState is the state of the microVM as reported by Firecracker
+type InstanceState string
+
+const (
+	InstanceNotStarted InstanceState = "Not started"
+	InstanceRunning    InstanceState = "Running"
+	InstancePaused     InstanceState = "Paused"
+)
+
+// InstanceInfo describes the running Firecracker instance
+type InstanceInfo struct {
+	AppName    string        `json:"app_name"`
+	ID         string        `json:"id"`
+	State      InstanceState `json:"state"`
+	VMMVersion string        `json:"vmm_version"`
+}
+
+// Version is the version of the Firecracker binary
+type Version struct {
+	FirecrackerVersion string `json:"firecracker_version"`
+}
+
+type ActionType string
+
+const (
+	ActionInstanceStart  ActionType = "InstanceStart"
+	ActionSendCtrlAltDel ActionType = "SendCtrlAltDel"
+	ActionFlushMetrics   ActionType = "FlushMetrics"
+)
+
+// InstanceActionInfo is the body of PUT /actions
+type InstanceActionInfo struct {
+	ActionType ActionType `json:"action_type"`
+}
+
+type VMState string
+
+const (
+	VMPaused  VMState = "Paused"
+	VMResumed VMState = "Resumed"
+)
+
+// VM is the body of PATCH /vm
+type VM struct {
+	State VMState `json:"state"`
+}
+
+type SnapshotType string
+
+const (
+	SnapshotFull SnapshotType = "Full"
+	// SnapshotDiff only contains the memory pages dirtied since the last
+	// snapshot, it requires dirty page tracking
+	SnapshotDiff SnapshotType = "Diff"
+)
+
+// SnapshotCreateParams is the body of PUT /snapshot/create, the VM must be paused
+type SnapshotCreateParams struct {
+	SnapshotType SnapshotType `json:"snapshot_type,omitempty"`
+	SnapshotPath string       `json:"snapshot_path"`
+	MemFilePath  string       `json:"mem_file_path"`
+}
+
+type MemoryBackendType string
+
+const (
+	MemoryBackendFile MemoryBackendType = "File"
+	MemoryBackendUffd MemoryBackendType = "Uffd"
+)
+
+// MemoryBackend is where the guest memory of a snapshot is loaded from
+type MemoryBackend struct {
+	BackendType MemoryBackendType `json:"backend_type"`
+	BackendPath string            `json:"backend_path"`
+}
+
+// NetworkOverride points a restored network interface at another host device
+type NetworkOverride struct {
+	IfaceID     string `json:"iface_id"`
+	HostDevName string `json:"host_dev_name"`
+}
+
+// SnapshotLoadParams is the body of PUT /snapshot/load, it must be sent
+// before the VM is configured
+type SnapshotLoadParams struct {
+	SnapshotPath        string            `json:"snapshot_path"`
+	MemBackend          *MemoryBackend    `json:"mem_backend,omitempty"`
+	EnableDiffSnapshots bool              `json:"enable_diff_snapshots,omitempty"`
+	ResumeVM            bool              `json:"resume_vm,omitempty"`
+	NetworkOverrides    []NetworkOverride `json:"network_overrides,omitempty"`
+}
+
+// Balloon configures the memory balloon device
+type Balloon struct {
+	AmountMib             int  `json:"amount_mib"`
+	DeflateOnOOM          bool `json:"deflate_on_oom"`
+	StatsPollingIntervalS int  `json:"stats_polling_interval_s,omitempty"`
+}
+
+// BalloonUpdate is the body of PATCH /balloon
+type BalloonUpdate struct {
+	AmountMib int `json:"amount_mib"`
+}
+
+// BalloonStatsUpdate is the body of PATCH /balloon/statistics
+type BalloonStatsUpdate struct {
+	StatsPollingIntervalS int `json:"stats_polling_interval_s"`
+}
+
+// BalloonStats are the memory statistics reported by the guest's balloon driver
+type BalloonStats struct {
+	TargetPages        int64  `json:"target_pages"`
+	ActualPages        int64  `json:"actual_pages"`
+	TargetMib          int64  `json:"target_mib"`
+	ActualMib          int64  `json:"actual_mib"`
+	SwapIn             *int64 `json:"swap_in,omitempty"`
+	SwapOut            *int64 `json:"swap_out,omitempty"`
+	MajorFaults        *int64 `json:"major_faults,omitempty"`
+	MinorFaults        *int64 `json:"minor_faults,omitempty"`
+	FreeMemory         *int64 `json:"free_memory,omitempty"`
+	TotalMemory        *int64 `json:"total_memory,omitempty"`
+	AvailableMemory    *int64 `json:"available_memory,omitempty"`
+	DiskCaches         *int64 `json:"disk_caches,omitempty"`
+	HugetlbAllocations *int64 `json:"hugetlb_allocations,omitempty"`
+	HugetlbFailures    *int64 `json:"hugetlb_failures,omitempty"`
+}
+
+type MMDSVersion string
+
+const (
+	MMDSv1 MMDSVersion = "V1"
+	MMDSv2 MMDSVersion = "V2"
+)
+
+// MMDSConfig is the body of PUT /mmds/config
+type MMDSConfig struct {
+	Version           MMDSVersion `json:"version,omitempty"`
+	NetworkInterfaces []string    `json:"network_interfaces"`
+	IPv4Address       string      `json:"ipv4_address,omitempty"`
+}
+
+// TokenBucket limits a resource to Size tokens every RefillTime milliseconds
+type TokenBucket struct {
+	Size         int64  `json:"size"`
+	OneTimeBurst *int64 `json:"one_time_burst,omitempty"`
+	RefillTime   int64  `json:"refill_time"`
+}
+
+// RateLimiter throttles a device by bytes (bandwidth) and operations
+type RateLimiter struct {
+	Bandwidth *TokenBucket `json:"bandwidth,omitempty"`
+	Ops       *TokenBucket `json:"ops,omitempty"`
+}
+
+// NewRateLimiter limits a device to bandwidth bytes and ops operations per
+// second. A zero rate turns that bucket off, which also clears it on a
+// device that is already limited.
+func NewRateLimiter(bandwidth, ops int64) *RateLimiter {
+	return &RateLimiter{
+		Bandwidth: &TokenBucket{Size: bandwidth, RefillTime: 1000},
+		Ops:       &TokenBucket{Size: ops, RefillTime: 1000},
+	}
+}
+
+// Validate rejects negative buckets. A bucket with a zero size or refill
+// time is how Firecracker is told to stop limiting.
+func (l *RateLimiter) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.Bandwidth.validate(); err != nil {
+		return fmt.Errorf("bandwidth %w", err)
+	}
+	if err := l.Ops.validate(); err != nil {
+		return fmt.Errorf("ops %w", err)
+	}
+	return nil
+}
+
+func (b *TokenBucket) validate() error {
+	if b == nil {
+		return nil
+	}
+	if b.Size < 0 || b.RefillTime < 0 || (b.OneTimeBurst != nil && *b.OneTimeBurst < 0) {
+		return fmt.Errorf("token bucket must not be negative")
+	}
+	return nil
+}
+
+// PartialDrive is the body of PATCH /drives/{drive_id}
+type PartialDrive struct {
+	DriveID     string       `json:"drive_id"`
+	PathOnHost  string       `json:"path_on_host,omitempty"`
+	RateLimiter *RateLimiter `json:"rate_limiter,omitempty"`
+}
+
+// PartialNetworkInterface is the body of PATCH /network-interfaces/{iface_id}
+type PartialNetworkInterface struct {
+	IfaceID       string       `json:"iface_id"`
+	RxRateLimiter *RateLimiter `json:"rx_rate_limiter,omitempty"`
+	TxRateLimiter *RateLimiter `json:"tx_rate_limiter,omitempty"`
+}
+
+// Fault is the body Firecracker returns when a request fails
+type Fault struct {
+	FaultMessage string `json:"fault_message"`
+}
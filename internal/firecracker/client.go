@@ -0,0 +1,228 @@
+package firecracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// apiBaseURL is only used to build request URLs, connections always go to the socket
+const apiBaseURL = "http://firecracker"
+
+// APIError is returned when Firecracker rejects a request
+type APIError struct {
+	StatusCode   int
+	FaultMessage string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("firecracker: %s (status %d)", e.FaultMessage, e.StatusCode)
+}
+
+// IsAPIError reports whether err was returned by Firecracker itself rather
+// than caused by failing to reach it
+func IsAPIError(err error) bool {
+	var e *APIError
+	return errors.As(err, &e)
+}
+
+// Client talks to a running Firecracker over its API socket
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a client for the API socket at socketPath, relative
+// paths are resolved against the working directory (the chroot for kiln)
+func NewClient(socketPath string) *Client {
+	var dialer net.Dialer
+
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// InstanceInfo returns the state of the microVM
+func (c *Client) InstanceInfo(ctx context.Context) (*InstanceInfo, error) {
+	var info InstanceInfo
+	if err := c.do(ctx, http.MethodGet, "/", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Version returns the version of the Firecracker binary
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	var version Version
+	if err := c.do(ctx, http.MethodGet, "/version", nil, &version); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// Action performs a synchronous action on the microVM
+func (c *Client) Action(ctx context.Context, action ActionType) error {
+	return c.do(ctx, http.MethodPut, "/actions", &InstanceActionInfo{ActionType: action}, nil)
+}
+
+// InstanceStart boots a configured microVM
+func (c *Client) InstanceStart(ctx context.Context) error {
+	return c.Action(ctx, ActionInstanceStart)
+}
+
+// SendCtrlAltDel asks the guest to reboot, with reboot=k on the kernel
+// command line the guest shuts down and Firecracker exits
+func (c *Client) SendCtrlAltDel(ctx context.Context) error {
+	return c.Action(ctx, ActionSendCtrlAltDel)
+}
+
+// FlushMetrics writes the pending metrics to the metrics file
+func (c *Client) FlushMetrics(ctx context.Context) error {
+	return c.Action(ctx, ActionFlushMetrics)
+}
+
+// Pause stops the vCPUs of a running microVM
+func (c *Client) Pause(ctx context.Context) error {
+	return c.do(ctx, http.MethodPatch, "/vm", &VM{State: VMPaused}, nil)
+}
+
+// Resume restarts the vCPUs of a paused microVM
+func (c *Client) Resume(ctx context.Context) error {
+	return c.do(ctx, http.MethodPatch, "/vm", &VM{State: VMResumed}, nil)
+}
+
+// CreateSnapshot writes the microVM state and memory to the paths in params,
+// the microVM must be paused
+func (c *Client) CreateSnapshot(ctx context.Context, params *SnapshotCreateParams) error {
+	return c.do(ctx, http.MethodPut, "/snapshot/create", params, nil)
+}
+
+// LoadSnapshot restores a snapshot into a Firecracker that hasn't been configured yet
+func (c *Client) LoadSnapshot(ctx context.Context, params *SnapshotLoadParams) error {
+	return c.do(ctx, http.MethodPut, "/snapshot/load", params, nil)
+}
+
+// PutBalloon installs the balloon device, it must be called before InstanceStart
+func (c *Client) PutBalloon(ctx context.Context, balloon *Balloon) error {
+	return c.do(ctx, http.MethodPut, "/balloon", balloon, nil)
+}
+
+// Balloon returns the balloon device configuration
+func (c *Client) Balloon(ctx context.Context) (*Balloon, error) {
+	var balloon Balloon
+	if err := c.do(ctx, http.MethodGet, "/balloon", nil, &balloon); err != nil {
+		return nil, err
+	}
+	return &balloon, nil
+}
+
+// UpdateBalloon sets the balloon target size, inflating it takes memory away from the guest
+func (c *Client) UpdateBalloon(ctx context.Context, amountMib int) error {
+	return c.do(ctx, http.MethodPatch, "/balloon", &BalloonUpdate{AmountMib: amountMib}, nil)
+}
+
+// BalloonStats returns the guest memory statistics, stats polling must be enabled
+func (c *Client) BalloonStats(ctx context.Context) (*BalloonStats, error) {
+	var stats BalloonStats
+	if err := c.do(ctx, http.MethodGet, "/balloon/statistics", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// UpdateBalloonStats changes how often the guest reports memory statistics
+func (c *Client) UpdateBalloonStats(ctx context.Context, intervalS int) error {
+	return c.do(ctx, http.MethodPatch, "/balloon/statistics", &BalloonStatsUpdate{StatsPollingIntervalS: intervalS}, nil)
+}
+
+// PutMMDSConfig enables the metadata service on the given network interfaces
+func (c *Client) PutMMDSConfig(ctx context.Context, cfg *MMDSConfig) error {
+	return c.do(ctx, http.MethodPut, "/mmds/config", cfg, nil)
+}
+
+// PutMMDS replaces the metadata document
+func (c *Client) PutMMDS(ctx context.Context, data any) error {
+	return c.do(ctx, http.MethodPut, "/mmds", data, nil)
+}
+
+// PatchMMDS merges data into the metadata document
+func (c *Client) PatchMMDS(ctx context.Context, data any) error {
+	return c.do(ctx, http.MethodPatch, "/mmds", data, nil)
+}
+
+// MMDS decodes the metadata document into out
+func (c *Client) MMDS(ctx context.Context, out any) error {
+	return c.do(ctx, http.MethodGet, "/mmds", nil, out)
+}
+
+// PatchDrive updates the backing file or rate limiter of a drive
+func (c *Client) PatchDrive(ctx context.Context, drive *PartialDrive) error {
+	return c.do(ctx, http.MethodPatch, "/drives/"+url.PathEscape(drive.DriveID), drive, nil)
+}
+
+// PatchNetworkInterface updates the rate limiters of a network interface
+func (c *Client) PatchNetworkInterface(ctx context.Context, iface *PartialNetworkInterface) error {
+	return c.do(ctx, http.MethodPatch, "/network-interfaces/"+url.PathEscape(iface.IfaceID), iface, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(in); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiBaseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach firecracker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return decodeFault(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func decodeFault(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var fault Fault
+	if err := json.Unmarshal(data, &fault); err == nil && fault.FaultMessage != "" {
+		return &APIError{StatusCode: resp.StatusCode, FaultMessage: fault.FaultMessage}
+	}
+	if msg := strings.TrimSpace(string(data)); msg != "" {
+		return &APIError{StatusCode: resp.StatusCode, FaultMessage: msg}
+	}
+	return &APIError{StatusCode: resp.StatusCode, FaultMessage: resp.Status}
+}
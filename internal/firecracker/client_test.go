@@ -0,0 +1,185 @@
+package firecracker_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/firecracker/firecrackertest"
+	"github.com/rugwirobaker/inferno/internal/pointer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPauseResumeSnapshot(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	info, err := c.InstanceInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, firecracker.InstanceRunning, info.State)
+
+	version, err := c.Version(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, firecrackertest.Version, version.FirecrackerVersion)
+
+	params := &firecracker.SnapshotCreateParams{
+		SnapshotType: firecracker.SnapshotFull,
+		SnapshotPath: "snapshot/vmstate",
+		MemFilePath:  "snapshot/memory",
+	}
+
+	// firecracker only snapshots paused VMs
+	err = c.CreateSnapshot(ctx, params)
+	require.Error(t, err)
+	assert.True(t, firecracker.IsAPIError(err))
+
+	require.NoError(t, c.Pause(ctx))
+	require.NoError(t, c.CreateSnapshot(ctx, params))
+	require.NoError(t, c.Resume(ctx))
+
+	assert.Equal(t, []firecracker.SnapshotCreateParams{*params}, fc.Snapshots())
+	assert.Equal(t, firecracker.InstanceRunning, fc.State())
+}
+
+func TestClientLoadSnapshot(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	fc.SetState(firecracker.InstanceNotStarted)
+
+	params := &firecracker.SnapshotLoadParams{
+		SnapshotPath: "snapshot/vmstate",
+		MemBackend: &firecracker.MemoryBackend{
+			BackendType: firecracker.MemoryBackendFile,
+			BackendPath: "snapshot/memory",
+		},
+		ResumeVM: true,
+		NetworkOverrides: []firecracker.NetworkOverride{
+			{IfaceID: "eth0", HostDevName: "vmrestored"},
+		},
+	}
+	require.NoError(t, c.LoadSnapshot(ctx, params))
+
+	assert.Equal(t, params, fc.LoadedSnapshot())
+	assert.Equal(t, firecracker.InstanceRunning, fc.State())
+}
+
+func TestClientActions(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	// the instance is already running
+	require.Error(t, c.InstanceStart(ctx))
+
+	require.NoError(t, c.SendCtrlAltDel(ctx))
+	require.NoError(t, c.FlushMetrics(ctx))
+
+	assert.Equal(t, []firecracker.ActionType{
+		firecracker.ActionSendCtrlAltDel,
+		firecracker.ActionFlushMetrics,
+	}, fc.Actions())
+}
+
+func TestClientBalloon(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	fc.SetState(firecracker.InstanceNotStarted)
+	require.NoError(t, c.PutBalloon(ctx, &firecracker.Balloon{AmountMib: 0, DeflateOnOOM: true, StatsPollingIntervalS: 5}))
+	require.NoError(t, c.InstanceStart(ctx))
+
+	require.NoError(t, c.UpdateBalloon(ctx, 256))
+
+	balloon, err := c.Balloon(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 256, balloon.AmountMib)
+
+	fc.SetBalloonStats(firecracker.BalloonStats{ActualMib: 128, FreeMemory: pointer.Int64(1 << 20)})
+
+	stats, err := c.BalloonStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(128), stats.ActualMib)
+	assert.Equal(t, int64(1<<20), *stats.FreeMemory)
+}
+
+func TestClientMMDS(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	fc.SetState(firecracker.InstanceNotStarted)
+	require.NoError(t, c.PutMMDSConfig(ctx, &firecracker.MMDSConfig{
+		Version:           firecracker.MMDSv2,
+		NetworkInterfaces: []string{"eth0"},
+	}))
+
+	require.NoError(t, c.PutMMDS(ctx, map[string]any{
+		"vm":     map[string]any{"id": "abc", "name": "web"},
+		"labels": map[string]any{"tier": "frontend"},
+	}))
+	require.NoError(t, c.PatchMMDS(ctx, map[string]any{
+		"vm":     map[string]any{"name": "api"},
+		"labels": nil,
+	}))
+
+	var got map[string]any
+	require.NoError(t, c.MMDS(ctx, &got))
+	assert.Equal(t, map[string]any{"vm": map[string]any{"id": "abc", "name": "api"}}, got)
+}
+
+func TestClientRateLimiters(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	limiter := &firecracker.RateLimiter{
+		Bandwidth: &firecracker.TokenBucket{Size: 10 << 20, RefillTime: 1000},
+		Ops:       &firecracker.TokenBucket{Size: 1000, OneTimeBurst: pointer.Int64(5000), RefillTime: 1000},
+	}
+
+	require.NoError(t, c.PatchDrive(ctx, &firecracker.PartialDrive{DriveID: "rootfs", RateLimiter: limiter}))
+	require.NoError(t, c.PatchNetworkInterface(ctx, &firecracker.PartialNetworkInterface{IfaceID: "eth0", TxRateLimiter: limiter}))
+
+	drive, ok := fc.Drive("rootfs")
+	require.True(t, ok)
+	assert.Equal(t, limiter, drive.RateLimiter)
+
+	iface, ok := fc.NetworkInterface("eth0")
+	require.True(t, ok)
+	assert.Nil(t, iface.RxRateLimiter)
+	assert.Equal(t, limiter, iface.TxRateLimiter)
+}
+
+func TestClientFault(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fc  = firecrackertest.NewServer(t)
+		c   = fc.Client()
+	)
+
+	fc.Fail(http.MethodPatch, "/vm", http.StatusInternalServerError, "vcpu thread is gone")
+
+	err := c.Pause(ctx)
+	var apiErr *firecracker.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	assert.Equal(t, "vcpu thread is gone", apiErr.FaultMessage)
+}
@@ -19,6 +19,8 @@ type Config struct {
 	MachineConfig     MachineConfig       `json:"machine-config"`
 	NetworkInterfaces []NetworkInterface  `json:"network-interfaces,omitempty"` // Optional
 	VsockDevices      []VsockDevice       `json:"vsock,omitempty"`              // Optional
+	Balloon           *Balloon            `json:"balloon,omitempty"`            // Optional
+	MMDSConfig        *MMDSConfig         `json:"mmds-config,omitempty"`        // Optional
 	Logger            *Logger             `json:"logger,omitempty"`             // Optional
 	Metrics           *FirecrackerMetrics `json:"metrics,omitempty"`            // Optional
 	Entropy           *string             `json:"entropy,omitempty"`            // Optional
@@ -60,31 +62,34 @@ type BootSource struct {
 
 // Drive represents a drive configuration.
 type Drive struct {
-	DriveID      string  `json:"drive_id"`
-	IsRootDevice bool    `json:"is_root_device"`
-	PathOnHost   string  `json:"path_on_host"`
-	CacheType    string  `json:"cache_type"`
-	IsReadOnly   bool    `json:"is_read_only"`
-	IOEngine     string  `json:"io_engine"`
-	RateLimiter  *string `json:"rate_limiter,omitempty"` // Optional field
-	Socket       *string `json:"socket,omitempty"`       // Optional field
-	PartUUID     *string `json:"partuuid,omitempty"`     // Optional field
+	DriveID      string       `json:"drive_id"`
+	IsRootDevice bool         `json:"is_root_device"`
+	PathOnHost   string       `json:"path_on_host"`
+	CacheType    string       `json:"cache_type"`
+	IsReadOnly   bool         `json:"is_read_only"`
+	IOEngine     string       `json:"io_engine"`
+	RateLimiter  *RateLimiter `json:"rate_limiter,omitempty"` // Optional field
+	Socket       *string      `json:"socket,omitempty"`       // Optional field
+	PartUUID     *string      `json:"partuuid,omitempty"`     // Optional field
 }
 
 // MachineConfig represents the VM machine configuration.
 type MachineConfig struct {
-	VCPUCount       int  `json:"vcpu_count"`
-	MemSizeMib      int  `json:"mem_size_mib"`
-	SMT             bool `json:"smt"`
-	TrackDirtyPages bool `json:"track_dirty_pages"`
-	HugePages       bool `json:"huge_pages"`
+	VCPUCount       int    `json:"vcpu_count"`
+	MemSizeMib      int    `json:"mem_size_mib"`
+	SMT             bool   `json:"smt"`
+	CPUTemplate     string `json:"cpu_template,omitempty"` // Optional field
+	TrackDirtyPages bool   `json:"track_dirty_pages"`
+	HugePages       bool   `json:"huge_pages"`
 }
 
 // NetworkInterface represents a network interface configuration.
 type NetworkInterface struct {
-	IfaceName string `json:"if_name"`
-	HostDev   string `json:"host_dev"`
-	Mac       string `json:"mac,omitempty"`
+	IfaceID       string       `json:"iface_id"`
+	HostDev       string       `json:"host_dev_name"`
+	Mac           string       `json:"guest_mac,omitempty"`
+	RxRateLimiter *RateLimiter `json:"rx_rate_limiter,omitempty"` // Optional field
+	TxRateLimiter *RateLimiter `json:"tx_rate_limiter,omitempty"` // Optional field
 }
 
 // VsockDevice represents a Virtio vsock device configuration.
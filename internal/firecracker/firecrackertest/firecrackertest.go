@@ -0,0 +1,532 @@
+// Package firecrackertest provides a fake Firecracker API server for tests.
+package firecrackertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+)
+
+// Version is the Firecracker version reported by the fake
+const Version = "1.10.1"
+
+// Server mimics the Firecracker API on a unix socket. It keeps enough state
+// to enforce the same ordering rules as Firecracker (no pausing a VM that
+// isn't running, no balloon changes before boot...).
+type Server struct {
+	SocketPath string
+
+	srv *httptest.Server
+
+	mu           sync.Mutex
+	state        firecracker.InstanceState
+	actions      []firecracker.ActionType
+	snapshots    []firecracker.SnapshotCreateParams
+	loaded       *firecracker.SnapshotLoadParams
+	balloon      *firecracker.Balloon
+	balloonStats firecracker.BalloonStats
+	mmdsConfig   *firecracker.MMDSConfig
+	mmds         map[string]any
+	drives       map[string]firecracker.PartialDrive
+	ifaces       map[string]firecracker.PartialNetworkInterface
+	faults       map[string]fault
+}
+
+type fault struct {
+	status  int
+	message string
+}
+
+// NewServer starts a fake Firecracker with a running microVM, it is shut
+// down when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	s := &Server{
+		SocketPath: filepath.Join(t.TempDir(), "firecracker.sock"),
+		state:      firecracker.InstanceRunning,
+		drives:     make(map[string]firecracker.PartialDrive),
+		ifaces:     make(map[string]firecracker.PartialNetworkInterface),
+		faults:     make(map[string]fault),
+	}
+
+	listener, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", s.SocketPath, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.instanceInfo)
+	mux.HandleFunc("GET /version", s.version)
+	mux.HandleFunc("PUT /actions", s.action)
+	mux.HandleFunc("PATCH /vm", s.patchVM)
+	mux.HandleFunc("PUT /snapshot/create", s.createSnapshot)
+	mux.HandleFunc("PUT /snapshot/load", s.loadSnapshot)
+	mux.HandleFunc("PUT /balloon", s.putBalloon)
+	mux.HandleFunc("GET /balloon", s.getBalloon)
+	mux.HandleFunc("PATCH /balloon", s.patchBalloon)
+	mux.HandleFunc("GET /balloon/statistics", s.getBalloonStats)
+	mux.HandleFunc("PATCH /balloon/statistics", s.patchBalloonStats)
+	mux.HandleFunc("PUT /mmds/config", s.putMMDSConfig)
+	mux.HandleFunc("PUT /mmds", s.putMMDS)
+	mux.HandleFunc("PATCH /mmds", s.patchMMDS)
+	mux.HandleFunc("GET /mmds", s.getMMDS)
+	mux.HandleFunc("PATCH /drives/{id}", s.patchDrive)
+	mux.HandleFunc("PATCH /network-interfaces/{id}", s.patchNetworkInterface)
+
+	s.srv = httptest.NewUnstartedServer(s.withFaults(mux))
+	s.srv.Listener = listener
+	s.srv.Start()
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client returns a firecracker client connected to the fake
+func (s *Server) Client() *firecracker.Client {
+	return firecracker.NewClient(s.SocketPath)
+}
+
+func (s *Server) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// SetState forces the instance state, for instance to NotStarted to test
+// pre-boot configuration or snapshot loading
+func (s *Server) SetState(state firecracker.InstanceState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+}
+
+func (s *Server) State() firecracker.InstanceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// Fail makes every request to method and path fail with the given status
+// and fault message, a zero status clears the fault
+func (s *Server) Fail(method, path string, status int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := method + " " + path
+	if status == 0 {
+		delete(s.faults, key)
+		return
+	}
+	s.faults[key] = fault{status: status, message: message}
+}
+
+// Actions returns the actions received so far
+func (s *Server) Actions() []firecracker.ActionType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]firecracker.ActionType(nil), s.actions...)
+}
+
+// Snapshots returns the snapshots created so far
+func (s *Server) Snapshots() []firecracker.SnapshotCreateParams {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]firecracker.SnapshotCreateParams(nil), s.snapshots...)
+}
+
+// LoadedSnapshot returns the snapshot the instance was restored from, if any
+func (s *Server) LoadedSnapshot() *firecracker.SnapshotLoadParams {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loaded
+}
+
+// SetBalloonStats sets the statistics reported once the balloon polls them
+func (s *Server) SetBalloonStats(stats firecracker.BalloonStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.balloonStats = stats
+}
+
+// MMDSConfig returns the metadata service configuration, if any
+func (s *Server) MMDSConfig() *firecracker.MMDSConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mmdsConfig
+}
+
+// Drive returns the last update applied to a drive
+func (s *Server) Drive(id string) (firecracker.PartialDrive, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drive, ok := s.drives[id]
+	return drive, ok
+}
+
+// NetworkInterface returns the last update applied to a network interface
+func (s *Server) NetworkInterface(id string) (firecracker.PartialNetworkInterface, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	iface, ok := s.ifaces[id]
+	return iface, ok
+}
+
+func (s *Server) withFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		f, ok := s.faults[r.Method+" "+r.URL.Path]
+		s.mu.Unlock()
+
+		if ok {
+			writeFault(w, f.status, f.message)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) instanceInfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, firecracker.InstanceInfo{
+		AppName:    "Firecracker",
+		ID:         "anonymous-instance",
+		State:      s.state,
+		VMMVersion: Version,
+	})
+}
+
+func (s *Server) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, firecracker.Version{FirecrackerVersion: Version})
+}
+
+func (s *Server) action(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.InstanceActionInfo
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.ActionType {
+	case firecracker.ActionInstanceStart:
+		if s.state != firecracker.InstanceNotStarted {
+			writeFault(w, http.StatusBadRequest, "The requested operation is not supported after starting the microVM.")
+			return
+		}
+		s.state = firecracker.InstanceRunning
+	case firecracker.ActionSendCtrlAltDel, firecracker.ActionFlushMetrics:
+		if s.state == firecracker.InstanceNotStarted {
+			writeFault(w, http.StatusBadRequest, "The requested operation is not supported before starting the microVM.")
+			return
+		}
+	default:
+		writeFault(w, http.StatusBadRequest, fmt.Sprintf("unknown action type %q", req.ActionType))
+		return
+	}
+
+	s.actions = append(s.actions, req.ActionType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) patchVM(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.VM
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.state == firecracker.InstanceNotStarted:
+		writeFault(w, http.StatusBadRequest, "The requested operation is not supported before starting the microVM.")
+		return
+	case req.State == firecracker.VMPaused:
+		s.state = firecracker.InstancePaused
+	case req.State == firecracker.VMResumed:
+		s.state = firecracker.InstanceRunning
+	default:
+		writeFault(w, http.StatusBadRequest, fmt.Sprintf("unknown vm state %q", req.State))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.SnapshotCreateParams
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != firecracker.InstancePaused {
+		writeFault(w, http.StatusBadRequest, "Cannot create snapshot: the microVM must be paused")
+		return
+	}
+	s.snapshots = append(s.snapshots, req)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) loadSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.SnapshotLoadParams
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != firecracker.InstanceNotStarted {
+		writeFault(w, http.StatusBadRequest, "Loading a microVM snapshot not allowed after configuring boot-specific resources.")
+		return
+	}
+	s.loaded = &req
+	s.state = firecracker.InstancePaused
+	if req.ResumeVM {
+		s.state = firecracker.InstanceRunning
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) putBalloon(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.Balloon
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != firecracker.InstanceNotStarted {
+		writeFault(w, http.StatusBadRequest, "The requested operation is not supported after starting the microVM.")
+		return
+	}
+	s.balloon = &req
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getBalloon(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.balloon == nil {
+		writeFault(w, http.StatusBadRequest, "No balloon device found.")
+		return
+	}
+	writeJSON(w, s.balloon)
+}
+
+func (s *Server) patchBalloon(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.BalloonUpdate
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.balloon == nil {
+		writeFault(w, http.StatusBadRequest, "No balloon device found.")
+		return
+	}
+	s.balloon.AmountMib = req.AmountMib
+	s.balloonStats.TargetMib = int64(req.AmountMib)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getBalloonStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.balloon == nil:
+		writeFault(w, http.StatusBadRequest, "No balloon device found.")
+	case s.balloon.StatsPollingIntervalS == 0:
+		writeFault(w, http.StatusBadRequest, "Statistics for the balloon device are not enabled")
+	default:
+		writeJSON(w, s.balloonStats)
+	}
+}
+
+func (s *Server) patchBalloonStats(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.BalloonStatsUpdate
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// like firecracker, stats can't be toggled after boot, only their interval changed
+	if s.balloon == nil || s.balloon.StatsPollingIntervalS == 0 || req.StatsPollingIntervalS == 0 {
+		writeFault(w, http.StatusBadRequest, "Cannot enable or disable balloon statistics after boot")
+		return
+	}
+	s.balloon.StatsPollingIntervalS = req.StatsPollingIntervalS
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) putMMDSConfig(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.MMDSConfig
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != firecracker.InstanceNotStarted {
+		writeFault(w, http.StatusBadRequest, "The requested operation is not supported after starting the microVM.")
+		return
+	}
+	if len(req.NetworkInterfaces) == 0 {
+		writeFault(w, http.StatusBadRequest, "The list of network interface IDs provided for MMDS is empty")
+		return
+	}
+	s.mmdsConfig = &req
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) putMMDS(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mmds = req
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) patchMMDS(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mmds == nil {
+		writeFault(w, http.StatusBadRequest, "The MMDS data store is not initialized.")
+		return
+	}
+	mergePatch(s.mmds, req)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getMMDS(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mmds == nil {
+		writeFault(w, http.StatusBadRequest, "The MMDS data store is not initialized.")
+		return
+	}
+	writeJSON(w, s.mmds)
+}
+
+func (s *Server) patchDrive(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.PartialDrive
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.DriveID != r.PathValue("id") {
+		writeFault(w, http.StatusBadRequest, "The id from the path does not match the id from the body!")
+		return
+	}
+	if s.state == firecracker.InstanceNotStarted {
+		writeFault(w, http.StatusBadRequest, "The requested operation is not supported before starting the microVM.")
+		return
+	}
+	s.drives[req.DriveID] = req
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) patchNetworkInterface(w http.ResponseWriter, r *http.Request) {
+	var req firecracker.PartialNetworkInterface
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.IfaceID != r.PathValue("id") {
+		writeFault(w, http.StatusBadRequest, "The id from the path does not match the id from the body!")
+		return
+	}
+	if s.state == firecracker.InstanceNotStarted {
+		writeFault(w, http.StatusBadRequest, "The requested operation is not supported before starting the microVM.")
+		return
+	}
+	s.ifaces[req.IfaceID] = req
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch, which is what PATCH /mmds implements
+func mergePatch(dst, patch map[string]any) {
+	for key, value := range patch {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		sub, ok := value.(map[string]any)
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		existing, ok := dst[key].(map[string]any)
+		if !ok {
+			existing = make(map[string]any)
+			dst[key] = existing
+		}
+		mergePatch(existing, sub)
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeFault(w, http.StatusBadRequest, fmt.Sprintf("An error occurred when deserializing the json body of a request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeFault(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(firecracker.Fault{FaultMessage: msg})
+}
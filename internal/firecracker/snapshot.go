@@ -0,0 +1,79 @@
+package firecracker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// RebaseSnapshot applies the memory pages of a diff snapshot onto a copy of
+// its base memory file, turning diffPath into a full memory file. Diff memory
+// files are sparse, only the pages dirtied since the base snapshot hold data.
+// This does what firecracker's rebase-snap tool does.
+func RebaseSnapshot(basePath, diffPath string) error {
+	diff, err := os.Open(diffPath)
+	if err != nil {
+		return fmt.Errorf("failed to open diff memory file: %w", err)
+	}
+	defer diff.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(diffPath), ".memory-")
+	if err != nil {
+		return fmt.Errorf("failed to create memory file: %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	base, err := os.Open(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to open base memory file: %w", err)
+	}
+	_, err = io.Copy(out, base)
+	base.Close()
+	if err != nil {
+		return fmt.Errorf("failed to copy base memory file: %w", err)
+	}
+
+	if err := copyDataSegments(out, diff); err != nil {
+		return fmt.Errorf("failed to apply diff memory file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), diffPath)
+}
+
+// copyDataSegments copies the non-hole regions of src to the same offsets in dst
+func copyDataSegments(dst, src *os.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	var offset int64
+	for offset < size {
+		start, err := unix.Seek(int(src.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// no data past offset
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end, err := unix.Seek(int(src.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(io.NewOffsetWriter(dst, start), io.NewSectionReader(src, start, end-start)); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package firecracker_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebaseSnapshot(t *testing.T) {
+	const page = 4096
+
+	var (
+		dir      = t.TempDir()
+		basePath = filepath.Join(dir, "base")
+		diffPath = filepath.Join(dir, "diff")
+	)
+
+	base := bytes.Repeat([]byte{'a'}, 4*page)
+	require.NoError(t, os.WriteFile(basePath, base, 0o600))
+
+	// a sparse diff with the second and last pages dirtied
+	diff, err := os.Create(diffPath)
+	require.NoError(t, err)
+	require.NoError(t, diff.Truncate(4*page))
+	_, err = diff.WriteAt(bytes.Repeat([]byte{'b'}, page), page)
+	require.NoError(t, err)
+	_, err = diff.WriteAt(bytes.Repeat([]byte{'c'}, page), 3*page)
+	require.NoError(t, err)
+	require.NoError(t, diff.Close())
+
+	require.NoError(t, firecracker.RebaseSnapshot(basePath, diffPath))
+
+	got, err := os.ReadFile(diffPath)
+	require.NoError(t, err)
+
+	want := bytes.Join([][]byte{
+		bytes.Repeat([]byte{'a'}, page),
+		bytes.Repeat([]byte{'b'}, page),
+		bytes.Repeat([]byte{'a'}, page),
+		bytes.Repeat([]byte{'c'}, page),
+	}, nil)
+	assert.Equal(t, want, got)
+
+	// the base is left alone
+	got, err = os.ReadFile(basePath)
+	require.NoError(t, err)
+	assert.Equal(t, base, got)
+}
@@ -26,6 +26,35 @@ type Config struct {
 	VsockAPIPort    int `json:"vsock_api_port"`    // serves a utility API in the guest init
 	VsockKeyPort    int `json:"vsock_key_port"`    // request encryption keys from the host
 
+	VsockHeartbeatPort int `json:"vsock_heartbeat_port,omitempty"` // send heartbeats to the host
+	HeartbeatIntervalS int `json:"heartbeat_interval_s,omitempty"` // 0 disables heartbeats
+
+	// MMDS is set when the host publishes a metadata document, see package mmds
+	MMDS bool `json:"mmds,omitempty"`
+
+	// WaitForIdentity holds the main process back until the host delivers an
+	// Identity through the init API, pooled VMs boot before they have one
+	WaitForIdentity bool `json:"wait_for_identity,omitempty"`
+}
+
+// Identity is what turns a pre-booted VM into a specific one
+type Identity struct {
+	ID    string            `json:"id"` // also the hostname
+	Env   map[string]string `json:"env,omitempty"`
+	IPs   []IPConfig        `json:"ips,omitempty"`
+	Files []File            `json:"files,omitempty"`
+}
+
+// BootFailure is the report init sends kiln when a boot stage fails, right
+// before it takes the VM down with it
+type BootFailure struct {
+	Stage     string `json:"stage"`
+	Error     string `json:"error"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+	// Kmsg are the last kernel messages, oldest first
+	Kmsg []string `json:"kmsg,omitempty"`
+	// ConfigHash is the sha256 of the run.json init booted with
+	ConfigHash string `json:"config_hash,omitempty"`
 }
 
 func (c *Config) Marshal() ([]byte, error) {
@@ -54,6 +54,8 @@ func (m *Manager) CreateConfig(ctx context.Context, imageName string) (*Config,
 		VsockStdoutPort: vsock.VsockStdoutPort,
 		VsockExitPort:   vsock.VsockExitPort,
 		VsockAPIPort:    vsock.VsockAPIPort,
+
+		VsockHeartbeatPort: vsock.VsockHeartbeatPort,
 	}, nil
 }
 
@@ -0,0 +1,133 @@
+package kiln
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+)
+
+// DefaultBalloonStatsIntervalS is how often the guest's balloon driver reports memory statistics
+const DefaultBalloonStatsIntervalS = 5
+
+// BalloonConfig tells kiln the VM has a balloon device and how often to read its statistics
+type BalloonConfig struct {
+	StatsIntervalS int `json:"stats_interval_s"`
+}
+
+func (b *BalloonConfig) interval() time.Duration {
+	if b.StatsIntervalS <= 0 {
+		return DefaultBalloonStatsIntervalS * time.Second
+	}
+	return time.Duration(b.StatsIntervalS) * time.Second
+}
+
+// BalloonStatus is the latest view of the VM's balloon. The target is how
+// much memory the balloon should take from the guest, the guest inflates
+// towards it at its own pace.
+type BalloonStatus struct {
+	TargetMiB int                       `json:"target_mib"`
+	Stats     *firecracker.BalloonStats `json:"stats,omitempty"`
+	// StatsAt is when the statistics were read
+	StatsAt *time.Time `json:"stats_at,omitempty"`
+}
+
+// BalloonRequest sets the balloon target, 0 deflates it completely
+type BalloonRequest struct {
+	TargetMiB int `json:"target_mib"`
+}
+
+// Validate checks the target against the memory the VM was booted with
+func (r BalloonRequest) Validate(memoryMB int) error {
+	if r.TargetMiB < 0 {
+		return fmt.Errorf("balloon target must not be negative")
+	}
+	if r.TargetMiB >= memoryMB {
+		return fmt.Errorf("balloon target must be below the vm's %dMB of memory", memoryMB)
+	}
+	return nil
+}
+
+// pollBalloon reads the balloon statistics until ctx is done. Firecracker
+// only has statistics once the guest driver reports, until then reads fail.
+func (c *controller) pollBalloon(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		state := c.state
+		c.mu.Unlock()
+
+		if state != StateRunning {
+			continue
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, controlRequestTimeout)
+		stats, err := c.firecracker.BalloonStats(reqCtx)
+		cancel()
+		if err != nil {
+			slog.Debug("Failed to read balloon statistics", "error", err)
+			continue
+		}
+
+		now := time.Now().UTC()
+		c.mu.Lock()
+		c.balloon.TargetMiB = int(stats.TargetMib)
+		c.balloon.Stats = stats
+		c.balloon.StatsAt = &now
+		c.mu.Unlock()
+	}
+}
+
+func (c *controller) handleBalloon(w http.ResponseWriter, r *http.Request) {
+	var req BalloonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, "invalid balloon request")
+		return
+	}
+
+	c.mu.Lock()
+	state := c.state
+	hasBalloon := c.balloon != nil
+	c.mu.Unlock()
+
+	if !hasBalloon {
+		writeControlError(w, http.StatusNotFound, "vm has no balloon device")
+		return
+	}
+	if err := req.Validate(c.memoryMB); err != nil {
+		writeControlError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if state != StateRunning && state != StatePaused {
+		writeControlError(w, http.StatusConflict, "vm is "+string(state))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	if err := c.firecracker.UpdateBalloon(ctx, req.TargetMiB); err != nil {
+		slog.Error("Failed to update balloon", "error", err)
+		writeControlError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.balloon.TargetMiB = req.TargetMiB
+	c.mu.Unlock()
+
+	slog.Info("Balloon target updated", "target_mib", req.TargetMiB)
+	writeControlJSON(w, http.StatusOK, c.status())
+}
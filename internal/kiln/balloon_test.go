@@ -0,0 +1,101 @@
+package kiln_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/firecracker/firecrackertest"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBalloonVM boots a fake firecracker with a deflated balloon
+func newBalloonVM(t *testing.T) *firecrackertest.Server {
+	fc := firecrackertest.NewServer(t)
+	fc.SetState(firecracker.InstanceNotStarted)
+	require.NoError(t, fc.Client().PutBalloon(context.Background(), &firecracker.Balloon{StatsPollingIntervalS: 1}))
+	fc.SetState(firecracker.InstanceRunning)
+	return fc
+}
+
+func patchBalloon(t *testing.T, h http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPatch, "/balloon", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestBalloon tests that balloon targets reach firecracker and come back in the status.
+func TestBalloon(t *testing.T) {
+	fc := newBalloonVM(t)
+	ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", kiln.StateRunning).WithBalloon(512)
+
+	rec := patchBalloon(t, ctrl.Handler(), `{"target_mib":256}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var status kiln.Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.NotNil(t, status.Balloon)
+	assert.Equal(t, 256, status.Balloon.TargetMiB)
+
+	balloon, err := fc.Client().Balloon(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 256, balloon.AmountMib)
+
+	// deflating works while paused too
+	ctrl.SetState(kiln.StatePaused)
+	rec = patchBalloon(t, ctrl.Handler(), `{"target_mib":0}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	balloon, err = fc.Client().Balloon(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, balloon.AmountMib)
+}
+
+// TestBalloonRejected tests the requests kiln refuses before reaching firecracker.
+func TestBalloonRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		balloon bool
+		state   kiln.State
+		body    string
+		fault   bool
+		want    int
+	}{
+		{name: "malformed", balloon: true, state: kiln.StateRunning, body: `{"target_mib":`, want: http.StatusBadRequest},
+		{name: "no balloon device", state: kiln.StateRunning, body: `{"target_mib":128}`, want: http.StatusNotFound},
+		{name: "target above memory", balloon: true, state: kiln.StateRunning, body: `{"target_mib":512}`, want: http.StatusBadRequest},
+		{name: "negative target", balloon: true, state: kiln.StateRunning, body: `{"target_mib":-1}`, want: http.StatusBadRequest},
+		{name: "stopping", balloon: true, state: kiln.StateStopping, body: `{"target_mib":128}`, want: http.StatusConflict},
+		{name: "firecracker fails", balloon: true, state: kiln.StateRunning, body: `{"target_mib":128}`, fault: true, want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newBalloonVM(t)
+			if tt.fault {
+				fc.Fail(http.MethodPatch, "/balloon", http.StatusBadRequest, "balloon is busy")
+			}
+			ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", tt.state)
+			if tt.balloon {
+				ctrl.WithBalloon(512)
+			}
+
+			rec := patchBalloon(t, ctrl.Handler(), tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			balloon, err := fc.Client().Balloon(context.Background())
+			require.NoError(t, err)
+			assert.Zero(t, balloon.AmountMib, "the balloon is left alone")
+		})
+	}
+}
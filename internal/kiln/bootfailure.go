@@ -0,0 +1,54 @@
+package kiln
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+)
+
+// BootFailureFile is where kiln keeps init's boot failure report, next to
+// the exit status
+const BootFailureFile = "boot_failure.json"
+
+// handleBootFailure persists the report straight away, kiln may not get to
+// write the exit status if it's killed while the VM goes down. Init powers
+// off after its report, only the first one is kept.
+func (c *controller) handleBootFailure(w http.ResponseWriter, r *http.Request) {
+	var report image.BootFailure
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeControlError(w, http.StatusBadRequest, "invalid boot failure report")
+		return
+	}
+	if report.Stage == "" {
+		writeControlError(w, http.StatusBadRequest, "boot failure report has no stage")
+		return
+	}
+
+	slog.Error("Guest failed to boot", "stage", report.Stage, "error", report.Error, "elapsed_ms", report.ElapsedMS)
+
+	c.mu.Lock()
+	if c.bootFailure != nil {
+		c.mu.Unlock()
+		writeControlError(w, http.StatusConflict, "boot failure already reported")
+		return
+	}
+	c.bootFailure = &report
+	c.mu.Unlock()
+
+	if err := writeJSONFile(BootFailureFile, report); err != nil {
+		slog.Error("Failed to write boot failure report", "error", err)
+		writeControlError(w, http.StatusInternalServerError, "failed to persist boot failure report")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// failedBoot returns init's boot failure report, nil when it didn't send one
+func (c *controller) failedBoot() *image.BootFailure {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bootFailure
+}
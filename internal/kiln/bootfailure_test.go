@@ -0,0 +1,68 @@
+package kiln_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker/firecrackertest"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBootFailure tests that init's boot failure report is persisted and
+// ends up in the exit status, and that malformed and repeated reports are
+// rejected.
+func TestBootFailure(t *testing.T) {
+	newChroot(t, false)
+
+	fc := firecrackertest.NewServer(t)
+	ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", kiln.StateRunning)
+	h := ctrl.BootFailureHandler()
+
+	for _, body := range []string{"", "{", `{"error":"no stage"}`} {
+		rec := control(t, h, http.MethodPost, "/boot-failure", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+	assert.Nil(t, ctrl.ExitBootFailure())
+	assert.NoFileExists(t, kiln.BootFailureFile)
+
+	report := image.BootFailure{
+		Stage:      "mount",
+		Error:      "failed to mount /dev/vdb: no such device",
+		ElapsedMS:  42,
+		Kmsg:       []string{"[    0.1] virtio_blk virtio1: [vdb] 0 512-byte logical blocks"},
+		ConfigHash: "abc123",
+	}
+	body, err := json.Marshal(report)
+	require.NoError(t, err)
+
+	rec := control(t, h, http.MethodPost, "/boot-failure", string(body))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	data, err := os.ReadFile(kiln.BootFailureFile)
+	require.NoError(t, err)
+	var persisted image.BootFailure
+	require.NoError(t, json.Unmarshal(data, &persisted))
+	assert.Equal(t, report, persisted)
+
+	require.NotNil(t, ctrl.ExitBootFailure())
+	assert.Equal(t, report, *ctrl.ExitBootFailure())
+
+	again := report
+	again.Stage = "exec"
+	body, err = json.Marshal(again)
+	require.NoError(t, err)
+
+	rec = control(t, h, http.MethodPost, "/boot-failure", string(body))
+	assert.Equal(t, http.StatusConflict, rec.Code, "only the first report is kept")
+	assert.Equal(t, report, *ctrl.ExitBootFailure())
+
+	data, err = os.ReadFile(kiln.BootFailureFile)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &persisted))
+	assert.Equal(t, report, persisted)
+}
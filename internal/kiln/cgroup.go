@@ -0,0 +1,391 @@
+package kiln
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// CgroupRoot is where the cgroup v2 hierarchy is mounted
+	CgroupRoot = "/sys/fs/cgroup"
+
+	// cpuPeriodUS is the cpu.max period, quotas are a share of it
+	cpuPeriodUS = 100000
+	// cgroupMemoryOverheadMB is what kiln and firecracker need on top of the guest's memory
+	cgroupMemoryOverheadMB = 64
+	// defaultPidsMax leaves room for firecracker's vCPU and API threads and kiln's own
+	defaultPidsMax = 256
+
+	// cgroupRemoveTimeout bounds the wait for a leaf's processes to exit,
+	// tearing down a large guest's memory takes a while
+	cgroupRemoveTimeout  = 5 * time.Second
+	cgroupRemoveInterval = 20 * time.Millisecond
+)
+
+// IOLimit throttles the block device holding the VM's root filesystem, zero
+// values are unlimited
+type IOLimit struct {
+	ReadBPS   int64 `json:"read_bps,omitempty"`
+	WriteBPS  int64 `json:"write_bps,omitempty"`
+	ReadIOPS  int64 `json:"read_iops,omitempty"`
+	WriteIOPS int64 `json:"write_iops,omitempty"`
+}
+
+func (l IOLimit) isZero() bool {
+	return l == IOLimit{}
+}
+
+// CgroupLimits are the values written to the cgroup's interface files
+type CgroupLimits struct {
+	CPUMax        string `json:"cpu.max"`
+	MemoryMax     string `json:"memory.max"`
+	MemorySwapMax string `json:"memory.swap.max"`
+	PidsMax       string `json:"pids.max"`
+	IOMax         string `json:"io.max,omitempty"`
+}
+
+// CgroupStatus is the cgroup kiln runs in and the limits read back from it
+type CgroupStatus struct {
+	Path   string       `json:"path"`
+	Limits CgroupLimits `json:"limits"`
+}
+
+// LimitsFor derives the cgroup limits from the VM's resources. dev is the
+// block device io.max applies to, it's only used when res has an IO limit.
+func LimitsFor(res Resources, dev string) CgroupLimits {
+	limits := CgroupLimits{
+		CPUMax:        "max " + strconv.Itoa(cpuPeriodUS),
+		MemoryMax:     "max",
+		MemorySwapMax: "0",
+		PidsMax:       strconv.Itoa(defaultPidsMax),
+	}
+	if res.CPUQuota > 0 && res.CPUCount > 0 {
+		quota := cpuPeriodUS * res.CPUCount * res.CPUQuota / 100
+		limits.CPUMax = fmt.Sprintf("%d %d", quota, cpuPeriodUS)
+	}
+	if res.MemoryMB > 0 {
+		limits.MemoryMax = strconv.FormatInt(int64(res.MemoryMB+cgroupMemoryOverheadMB)<<20, 10)
+	}
+	if res.PidsMax > 0 {
+		limits.PidsMax = strconv.Itoa(res.PidsMax)
+	}
+	if res.IO != nil && !res.IO.isZero() {
+		limits.IOMax = ioMax(dev, *res.IO)
+	}
+	return limits
+}
+
+func ioMax(dev string, l IOLimit) string {
+	value := func(v int64) string {
+		if v <= 0 {
+			return "max"
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s",
+		dev, value(l.ReadBPS), value(l.WriteBPS), value(l.ReadIOPS), value(l.WriteIOPS))
+}
+
+// blockDevice returns the major:minor of the device holding path
+func blockDevice(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	major, minor := unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))
+	if major == 0 {
+		return "", fmt.Errorf("%s is not on a block device", path)
+	}
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// Cgroup is a cgroup v2 leaf limiting a VM
+type Cgroup struct {
+	root string
+	path string // relative to root
+	dir  string // where the interface files are, usually root/path
+}
+
+// NewCgroup creates the leaf at path under root, enables the controllers it
+// needs on every ancestor and applies limits. The limits are read back so a
+// VM never runs with limits the kernel didn't take.
+func NewCgroup(root, path string, limits CgroupLimits) (*Cgroup, error) {
+	cg := &Cgroup{root: root, path: filepath.Clean(path)}
+	cg.dir = filepath.Join(root, cg.path)
+
+	controllers := []string{"cpu", "memory", "pids"}
+	if limits.IOMax != "" {
+		controllers = append(controllers, "io")
+	}
+
+	// controllers are delegated from the root down to the leaf's parent
+	dir := root
+	for _, part := range strings.Split(cg.path, string(filepath.Separator)) {
+		if err := enableControllers(dir, controllers); err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(dir, part)
+		if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create cgroup %s: %w", dir, err)
+		}
+	}
+
+	for _, l := range cg.files(limits) {
+		if l.value == "" {
+			continue
+		}
+		if err := cg.write(l.file, l.value); err != nil {
+			return nil, err
+		}
+	}
+	if err := cg.verify(limits); err != nil {
+		return nil, err
+	}
+	return cg, nil
+}
+
+type cgroupFile struct {
+	file  string
+	value string
+}
+
+func (cg *Cgroup) files(limits CgroupLimits) []cgroupFile {
+	return []cgroupFile{
+		{"cpu.max", limits.CPUMax},
+		{"memory.max", limits.MemoryMax},
+		{"memory.swap.max", limits.MemorySwapMax},
+		{"pids.max", limits.PidsMax},
+		{"io.max", limits.IOMax},
+	}
+}
+
+// Path is the cgroup's path in the hierarchy
+func (cg *Cgroup) Path() string {
+	return "/" + cg.path
+}
+
+// openCgroup reads the limits of a cgroup mounted at dir, like the one
+// kiln jail mounts into the chroot
+func openCgroup(dir, path string) *Cgroup {
+	return &Cgroup{path: filepath.Clean(path), dir: dir}
+}
+
+// Join moves the process into the cgroup, its children inherit it
+func (cg *Cgroup) Join(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// Limits reads the limits back from the cgroup
+func (cg *Cgroup) Limits() (CgroupLimits, error) {
+	var (
+		limits CgroupLimits
+		err    error
+	)
+	if limits.CPUMax, err = cg.read("cpu.max"); err != nil {
+		return limits, err
+	}
+	if limits.MemoryMax, err = cg.read("memory.max"); err != nil {
+		return limits, err
+	}
+	if limits.MemorySwapMax, err = cg.read("memory.swap.max"); err != nil {
+		return limits, err
+	}
+	if limits.PidsMax, err = cg.read("pids.max"); err != nil {
+		return limits, err
+	}
+	// io.max is only there when the io controller is enabled
+	if limits.IOMax, err = cg.read("io.max"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return limits, err
+	}
+	return limits, nil
+}
+
+// Status reports the cgroup with the limits currently applied
+func (cg *Cgroup) Status() (*CgroupStatus, error) {
+	limits, err := cg.Limits()
+	if err != nil {
+		return nil, err
+	}
+	return &CgroupStatus{Path: cg.Path(), Limits: limits}, nil
+}
+
+// OOMKilled reports whether the kernel OOM killed a process in the cgroup,
+// from the oom_kill count in memory.events
+func (cg *Cgroup) OOMKilled() (bool, error) {
+	events, err := cg.read("memory.events")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(events, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		if key != "oom_kill" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("cgroup %s: invalid oom_kill count %q", cg.Path(), value)
+		}
+		return n > 0, nil
+	}
+	return false, nil
+}
+
+// Remove moves the calling process up to the parent cgroup and removes the
+// leaf, it fails while other processes are still in it. The parent keeps
+// kiln under the limits of whatever delegated it, the root would escape them.
+func (cg *Cgroup) Remove() error {
+	parent := filepath.Dir(cg.dir)
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		return fmt.Errorf("failed to leave cgroup: %w", err)
+	}
+	if err := syscall.Rmdir(cg.dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove cgroup %s: %w", cg.dir, err)
+	}
+	return nil
+}
+
+// RemoveCgroup removes the leaf at path under root from outside of it, kiln
+// jail leaves its leaf behind for the server. The leaf stays busy until the
+// processes killed with kiln are gone, so that is waited out.
+func RemoveCgroup(root, path string) error {
+	var (
+		dir      = filepath.Join(root, filepath.Clean(path))
+		deadline = time.Now().Add(cgroupRemoveTimeout)
+	)
+	for {
+		err := syscall.Rmdir(dir)
+		switch {
+		case err == nil, errors.Is(err, os.ErrNotExist):
+			return nil
+		case !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline):
+			return fmt.Errorf("failed to remove cgroup %s: %w", dir, err)
+		}
+		time.Sleep(cgroupRemoveInterval)
+	}
+}
+
+// verify compares the limits the kernel reports with the ones written
+func (cg *Cgroup) verify(want CgroupLimits) error {
+	got, err := cg.Limits()
+	if err != nil {
+		return err
+	}
+
+	gotFiles := cg.files(got)
+	for i, w := range cg.files(want) {
+		if w.value == "" {
+			continue
+		}
+		g := gotFiles[i].value
+		if w.file == "io.max" {
+			if !ioMaxApplied(g, w.value) {
+				return fmt.Errorf("cgroup %s: io.max is %q, wrote %q", cg.Path(), g, w.value)
+			}
+			continue
+		}
+		if g != w.value {
+			return fmt.Errorf("cgroup %s: %s is %q, wrote %q", cg.Path(), w.file, g, w.value)
+		}
+	}
+	return nil
+}
+
+// ioMaxApplied reports whether io.max, which lists every throttled device,
+// has the line written for one device
+func ioMaxApplied(got, want string) bool {
+	dev, _, _ := strings.Cut(want, " ")
+	for _, line := range strings.Split(got, "\n") {
+		if d, _, _ := strings.Cut(line, " "); d == dev {
+			return line == want
+		}
+	}
+	return false
+}
+
+func (cg *Cgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.dir, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to write %s of cgroup %s: %w", file, cg.Path(), err)
+	}
+	return nil
+}
+
+func (cg *Cgroup) read(file string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(cg.dir, file))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s of cgroup %s: %w", file, cg.Path(), err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// enableControllers delegates the controllers to the children of dir
+func enableControllers(dir string, controllers []string) error {
+	path := filepath.Join(dir, "cgroup.subtree_control")
+
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	enabled := strings.Fields(string(current))
+
+	var missing []string
+	for _, c := range controllers {
+		if !slices.Contains(enabled, c) {
+			missing = append(missing, "+"+c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	slog.Debug("Enabling cgroup controllers", "cgroup", dir, "controllers", missing)
+	if err := os.WriteFile(path, []byte(strings.Join(missing, " ")), 0o644); err != nil {
+		return fmt.Errorf("failed to enable %v in %s: %w", missing, dir, err)
+	}
+	return nil
+}
+
+// joinCgroup creates the VM's cgroup under the configured parent and moves
+// kiln into it, firecracker inherits it when it's started
+func joinCgroup(config *Config) (*Cgroup, error) {
+	var dev string
+	if config.Resources.IO != nil && !config.Resources.IO.isZero() {
+		fcConfig, err := firecracker.ReadConfig(config.FirecrackerConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, drive := range fcConfig.Drives {
+			if drive.DriveID == RootFSDriveID {
+				if dev, err = blockDevice(drive.PathOnHost); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if dev == "" {
+			return nil, fmt.Errorf("io limits need a %s drive", RootFSDriveID)
+		}
+	}
+
+	limits := LimitsFor(config.Resources, dev)
+	cg, err := NewCgroup(CgroupRoot, filepath.Join(config.CgroupParent, config.JailID), limits)
+	if err != nil {
+		return nil, err
+	}
+	if err := cg.Join(os.Getpid()); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Joined cgroup", "cgroup", cg.Path(), "cpu.max", limits.CPUMax, "memory.max", limits.MemoryMax,
+		"pids.max", limits.PidsMax, "io.max", limits.IOMax)
+	return cg, nil
+}
@@ -0,0 +1,120 @@
+package kiln_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLimitsFor tests that the VM's resources translate into cgroup limits.
+func TestLimitsFor(t *testing.T) {
+	limits := kiln.LimitsFor(kiln.Resources{CPUCount: 2, MemoryMB: 256, CPUQuota: 25}, "")
+	assert.Equal(t, kiln.CgroupLimits{
+		CPUMax:        "50000 100000",
+		MemoryMax:     "335544320", // 256MB for the guest and 64MB of overhead
+		MemorySwapMax: "0",
+		PidsMax:       "256",
+	}, limits)
+
+	limits = kiln.LimitsFor(kiln.Resources{
+		CPUCount: 1,
+		PidsMax:  64,
+		IO:       &kiln.IOLimit{ReadBPS: 1 << 20, WriteIOPS: 100},
+	}, "259:0")
+	assert.Equal(t, "max 100000", limits.CPUMax, "no quota is unthrottled")
+	assert.Equal(t, "max", limits.MemoryMax)
+	assert.Equal(t, "64", limits.PidsMax)
+	assert.Equal(t, "259:0 rbps=1048576 wbps=max riops=max wiops=100", limits.IOMax)
+}
+
+// TestNewCgroup tests that the leaf is created with its limits and the
+// controllers are delegated down to it.
+func TestNewCgroup(t *testing.T) {
+	root := t.TempDir()
+	limits := kiln.LimitsFor(kiln.Resources{CPUCount: 1, MemoryMB: 128, CPUQuota: 50}, "")
+
+	cg, err := kiln.NewCgroup(root, "inferno/abc123", limits)
+	require.NoError(t, err)
+	assert.Equal(t, "/inferno/abc123", cg.Path())
+
+	for _, dir := range []string{root, filepath.Join(root, "inferno")} {
+		b, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+		require.NoError(t, err)
+		assert.Equal(t, "+cpu +memory +pids", string(b), "controllers are enabled in %s", dir)
+	}
+
+	applied, err := cg.Limits()
+	require.NoError(t, err)
+	assert.Equal(t, limits, applied)
+
+	require.NoError(t, cg.Join(1234))
+	b, err := os.ReadFile(filepath.Join(root, "inferno", "abc123", "cgroup.procs"))
+	require.NoError(t, err)
+	assert.Equal(t, "1234", string(b))
+}
+
+// TestCgroupOOMKilled tests that memory.events only reports an OOM once the
+// kernel has killed something.
+func TestCgroupOOMKilled(t *testing.T) {
+	root := t.TempDir()
+	cg, err := kiln.NewCgroup(root, "inferno/abc123", kiln.LimitsFor(kiln.Resources{MemoryMB: 128}, ""))
+	require.NoError(t, err)
+
+	events := filepath.Join(root, "inferno", "abc123", "memory.events")
+	require.NoError(t, os.WriteFile(events, []byte("low 0\nhigh 0\nmax 12\noom 1\noom_kill 0\n"), 0o644))
+	killed, err := cg.OOMKilled()
+	require.NoError(t, err)
+	assert.False(t, killed, "hitting the limit isn't a kill")
+
+	require.NoError(t, os.WriteFile(events, []byte("low 0\nhigh 0\nmax 20\noom 2\noom_kill 1\n"), 0o644))
+	killed, err = cg.OOMKilled()
+	require.NoError(t, err)
+	assert.True(t, killed)
+}
+
+// TestCgroupRemove tests that kiln leaves the leaf for its parent, not the
+// root, before removing it.
+func TestCgroupRemove(t *testing.T) {
+	root := t.TempDir()
+	cg, err := kiln.NewCgroup(root, "inferno/abc123", kiln.LimitsFor(kiln.Resources{MemoryMB: 128}, ""))
+	require.NoError(t, err)
+
+	// a real cgroup's interface files go away with it
+	leaf := filepath.Join(root, "inferno", "abc123")
+	entries, err := os.ReadDir(leaf)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NoError(t, os.Remove(filepath.Join(leaf, e.Name())))
+	}
+
+	require.NoError(t, cg.Remove())
+	assert.NoDirExists(t, leaf)
+
+	b, err := os.ReadFile(filepath.Join(root, "inferno", "cgroup.procs"))
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), string(b))
+	assert.NoFileExists(t, filepath.Join(root, "cgroup.procs"))
+}
+
+// TestRemoveCgroup tests that the server can remove a jailed VM's leaf once
+// it's empty and that removing it twice is fine.
+func TestRemoveCgroup(t *testing.T) {
+	root := t.TempDir()
+	leaf := filepath.Join(root, "inferno", "abc123")
+	require.NoError(t, os.MkdirAll(leaf, 0o755))
+
+	require.NoError(t, kiln.RemoveCgroup(root, "inferno/abc123"))
+	assert.NoDirExists(t, leaf)
+	assert.DirExists(t, filepath.Join(root, "inferno"))
+
+	require.NoError(t, kiln.RemoveCgroup(root, "inferno/abc123"))
+
+	// only a busy cgroup is worth waiting for
+	require.NoError(t, os.MkdirAll(filepath.Join(leaf, "child"), 0o755))
+	assert.Error(t, kiln.RemoveCgroup(root, "inferno/abc123"))
+}
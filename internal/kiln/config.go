@@ -5,17 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/rugwirobaker/inferno/internal/firecracker"
 	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/rugwirobaker/inferno/internal/mmds"
 	"github.com/rugwirobaker/inferno/internal/vsock"
 )
 
 // Resources defines the CPU and Memory limits for the VM.
 type Resources struct {
-	CPUCount int    `json:"cpu_count"`
-	MemoryMB int    `json:"memory_mb"`
-	CPUKind  string `json:"cpu_kind"`
+	CPUCount int      `json:"cpu_count"`
+	MemoryMB int      `json:"memory_mb"`
+	CPUKind  string   `json:"cpu_kind"`
+	CPUQuota int      `json:"cpu_quota_percent,omitempty"` // share of each vCPU the VM may use, 0 is unthrottled
+	PidsMax  int      `json:"pids_max,omitempty"`          // processes and threads kiln and firecracker may create
+	IO       *IOLimit `json:"io,omitempty"`                // throttles the disk holding the root filesystem
 }
 
 // Config defines the full configuration for the Kiln jailer.
@@ -31,15 +36,39 @@ type Config struct {
 	FirecrackerConfigPath   string `json:"firecracker_config_path"`
 	FirecrackerVsockUDSPath string `json:"firecracker_vsock_uds_path"`
 
+	ControlSocketPath string `json:"control_socket_path"` // kiln's control API
+
 	VsockStdoutPort int `json:"vsock_stdout_port"` // receive stdout/stderr send over by the init
 	VsockExitPort   int `json:"vsock_exit_port"`   // receive exit code info from the init
 
+	VsockHeartbeatPort int              `json:"vsock_heartbeat_port,omitempty"` // receive heartbeats from the init
+	Heartbeat          *HeartbeatConfig `json:"heartbeat,omitempty"`            // nil disables hung guest detection
+
 	ExitStatusPath string `json:"exit_status_path"`
 
 	LogDir      string      `json:"log_dir"`      // directory for log files
 	LogRotation LogRotation `json:"log_rotation"` // log rotation settings
 
-	Resources Resources `json:"resources"`
+	Resources  Resources      `json:"resources"`
+	RateLimits *RateLimits    `json:"rate_limits,omitempty"` // root drive and network throttling
+	Balloon    *BalloonConfig `json:"balloon,omitempty"`     // set when the VM has a balloon device
+	Stop       StopConfig     `json:"stop"`
+
+	// CgroupParent is where kiln creates the VM's cgroup, relative to the
+	// cgroup root. Kiln leaves cgroups alone when it's empty.
+	CgroupParent string `json:"cgroup_parent,omitempty"`
+
+	// Jail has the server start kiln through kiln jail, which leaves the
+	// cgroup behind for the server to remove
+	Jail bool `json:"jail,omitempty"`
+
+	// Metadata is published to the VM's metadata service once firecracker
+	// is up, the firecracker config must enable the service
+	Metadata *mmds.Metadata `json:"metadata,omitempty"`
+
+	// Restore loads the VM from a snapshot rather than booting it, kiln clears
+	// it once the snapshot is loaded so a restart boots from the disk
+	Restore *RestoreConfig `json:"restore,omitempty"`
 
 	// Encryption support
 	KMSSocket string            `json:"kms_socket,omitempty"` // path to KMS unix socket (relative to chroot)
@@ -69,17 +98,22 @@ func Default() *Config {
 		Resources: Resources{
 			CPUCount: 1,
 			MemoryMB: 128,
-			CPUKind:  "C3",
+			CPUKind:  "shared-cpu-1x", // the server's default cpu kind
 		},
 		FirecrackerSocketPath:   "firecracker.sock",
 		FirecrackerConfigPath:   "firecracker.json",
 		FirecrackerVsockUDSPath: "firecracker.sock",
+		ControlSocketPath:       DefaultControlSocket,
 
 		VsockStdoutPort: vsock.VsockStdoutPort,
 		VsockExitPort:   vsock.VsockExitPort,
 
+		VsockHeartbeatPort: vsock.VsockHeartbeatPort,
+
 		ExitStatusPath: "exit_status.json",
 
+		Stop: DefaultStopConfig(),
+
 		LogDir: "/var/lib/inferno/logs", // default, will be overridden
 
 		LogRotation: LogRotation{
@@ -97,7 +131,8 @@ func Default() *Config {
 	}
 }
 
-func configFromFile(path string) (*Config, error) {
+// ReadConfig reads a kiln config written by WriteConfig
+func ReadConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open kiln config: %w", err)
@@ -108,20 +143,44 @@ func configFromFile(path string) (*Config, error) {
 	if err := json.NewDecoder(file).Decode(cfg); err != nil {
 		return nil, fmt.Errorf("failed to decode kiln config: %w", err)
 	}
+	// configs written before the control socket existed don't set it
+	if cfg.ControlSocketPath == "" {
+		cfg.ControlSocketPath = DefaultControlSocket
+	}
 	return cfg, nil
 }
 
+// configMu serialises changes to kiln configs, the control API, restores
+// and the server all update kiln.json
+var configMu sync.Mutex
+
+// WriteConfig replaces the config at path, readers never see it half written
 func WriteConfig(path string, cfg *Config) error {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return writeConfig(path, cfg)
+}
+
+// UpdateConfig applies fn to the config at path and writes it back, nothing
+// is written when fn fails
+func UpdateConfig(path string, fn func(cfg *Config) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	cfg, err := ReadConfig(path)
 	if err != nil {
-		return fmt.Errorf("failed to create kiln config: %w", err)
+		return err
 	}
-	defer file.Close()
+	if err := fn(cfg); err != nil {
+		return err
+	}
+	return writeConfig(path, cfg)
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(cfg); err != nil {
-		return fmt.Errorf("failed to encode kiln config: %w", err)
+func writeConfig(path string, cfg *Config) error {
+	if err := writeJSONFile(path, cfg); err != nil {
+		return fmt.Errorf("failed to write kiln config: %w", err)
 	}
 	return nil
 }
@@ -142,6 +201,9 @@ func configWithFlags(ctx context.Context, cfg *Config) *Config {
 	if mem := flag.GetInt(ctx, "mem"); mem != 0 {
 		cfg.Resources.MemoryMB = mem
 	}
+	if parent := flag.GetString(ctx, "cgroup-parent"); parent != "" {
+		cfg.CgroupParent = parent
+	}
 	if firecrackerAPI := flag.GetString(ctx, "firecracker-api"); firecrackerAPI != "" {
 		cfg.FirecrackerSocketPath = firecrackerAPI
 	}
@@ -0,0 +1,62 @@
+package kiln_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUpdateConfig tests that concurrent updates of kiln.json don't lose
+// each other's changes and a failed update leaves the file alone.
+func TestUpdateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kiln.json")
+
+	cfg := kiln.Default()
+	cfg.Metadata = &mmds.Metadata{ID: "abcd1234"}
+	require.NoError(t, kiln.WriteConfig(path, cfg))
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := kiln.UpdateConfig(path, func(cfg *kiln.Config) error {
+				if cfg.Metadata.Labels == nil {
+					cfg.Metadata.Labels = make(map[string]string)
+				}
+				cfg.Metadata.Labels[fmt.Sprintf("label-%d", i)] = "set"
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	got, err := kiln.ReadConfig(path)
+	require.NoError(t, err)
+	assert.Len(t, got.Metadata.Labels, 20)
+
+	errFailed := errors.New("failed")
+	err = kiln.UpdateConfig(path, func(cfg *kiln.Config) error {
+		cfg.Metadata = nil
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed)
+
+	got, err = kiln.ReadConfig(path)
+	require.NoError(t, err)
+	assert.NotNil(t, got.Metadata)
+
+	// only kiln.json is left, no temporary files
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,191 @@
+package kiln
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ConsoleBufferLines is how many console lines kiln keeps in memory
+	ConsoleBufferLines = 1000
+
+	// faultContextLines is how much of the console leading up to a fault is kept with it
+	faultContextLines = 20
+
+	// consoleDrainTimeout bounds waiting for the last console lines once firecracker exited
+	consoleDrainTimeout = 2 * time.Second
+)
+
+// FaultReason is what kiln found on the guest console
+type FaultReason string
+
+const (
+	FaultKernelPanic FaultReason = "kernel_panic" // also oopses and other kernel BUGs
+	FaultGuestOOM    FaultReason = "guest_oom"    // the guest kernel's OOM killer ran
+)
+
+// Fault is a kernel panic or OOM kill seen on the guest console
+type Fault struct {
+	Reason FaultReason `json:"reason"`
+	Line   string      `json:"line"`
+	At     time.Time   `json:"at"`
+	// Console is the output leading up to and including Line
+	Console []string `json:"console,omitempty"`
+}
+
+var faultPatterns = []struct {
+	reason FaultReason
+	re     *regexp.Regexp
+}{
+	{FaultKernelPanic, regexp.MustCompile(`Kernel panic - not syncing|\bOops\b|\bBUG: |general protection fault`)},
+	{FaultGuestOOM, regexp.MustCompile(`invoked oom-killer|Out of memory: Kill|Memory cgroup out of memory`)},
+}
+
+// initExited matches the panic the kernel raises when init exits. It's not a
+// fault of its own, the exit status or boot failure report says why init went.
+var initExited = regexp.MustCompile(`Attempted to kill init!`)
+
+// firecrackerLogLine matches firecracker's own log lines, they share stdout
+// with the serial console
+var firecrackerLogLine = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d+ \[[^\]]*:[^\]]*\]`)
+
+// Console keeps the guest's serial console in a log file and a ring buffer,
+// and watches it for kernel panics and OOM kills
+type Console struct {
+	mu    sync.Mutex
+	out   io.Writer
+	lines []string
+	next  int
+	full  bool
+	fault *Fault
+	done  chan struct{}
+}
+
+// NewConsole writes the console to out and keeps its last size lines
+func NewConsole(out io.Writer, size int) *Console {
+	return &Console{
+		out:   out,
+		lines: make([]string, size),
+		done:  make(chan struct{}),
+	}
+}
+
+// Stream reads firecracker's stdout until it's closed. Firecracker's own log
+// lines go to the kiln log, everything else is the guest's console.
+func (c *Console) Stream(r io.Reader) {
+	defer close(c.done)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if firecrackerLogLine.MatchString(line) {
+			slog.Info(line, "source", "firecracker", "stream", "stdout")
+			continue
+		}
+		c.Line(line)
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Error reading Firecracker output", "error", err, "stream", "stdout")
+	}
+}
+
+// Line records a line of console output
+func (c *Console) Line(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := io.WriteString(c.out, line+"\n"); err != nil {
+		slog.Debug("Failed to write console log", "error", err)
+	}
+
+	c.lines[c.next] = line
+	c.next = (c.next + 1) % len(c.lines)
+	if c.next == 0 {
+		c.full = true
+	}
+
+	if initExited.MatchString(line) {
+		return
+	}
+	for _, p := range faultPatterns {
+		if !p.re.MatchString(line) {
+			continue
+		}
+		// a panic outranks an earlier OOM kill, it's often what the OOM led to
+		if c.fault != nil && (c.fault.Reason == FaultKernelPanic || p.reason != FaultKernelPanic) {
+			break
+		}
+		slog.Warn("Guest fault on console", "reason", p.reason, "line", line)
+		c.fault = &Fault{
+			Reason:  p.reason,
+			Line:    line,
+			At:      time.Now().UTC(),
+			Console: c.tail(faultContextLines),
+		}
+		break
+	}
+}
+
+// Fault returns the most severe fault seen so far, nil when there was none
+func (c *Console) Fault() *Fault {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.fault
+}
+
+// Tail returns up to n of the most recent lines, oldest first
+func (c *Console) Tail(n int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tail(n)
+}
+
+func (c *Console) tail(n int) []string {
+	size := c.next
+	if c.full {
+		size = len(c.lines)
+	}
+	n = min(n, size)
+
+	out := make([]string, 0, n)
+	for i := c.next - n; i < c.next; i++ {
+		out = append(out, c.lines[(i+len(c.lines))%len(c.lines)])
+	}
+	return out
+}
+
+// drain waits for Stream to reach the end of firecracker's output
+func (c *Console) drain(timeout time.Duration) {
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+		slog.Warn("Timed out reading the rest of the console")
+	}
+}
+
+func (c *controller) handleConsole(w http.ResponseWriter, r *http.Request) {
+	if c.console == nil {
+		writeControlError(w, http.StatusNotFound, "console is not captured")
+		return
+	}
+
+	n := ConsoleBufferLines
+	if v := r.URL.Query().Get("lines"); v != "" {
+		lines, err := strconv.Atoi(v)
+		if err != nil || lines < 0 {
+			writeControlError(w, http.StatusBadRequest, "invalid line count")
+			return
+		}
+		n = lines
+	}
+	writeControlJSON(w, http.StatusOK, c.console.Tail(n))
+}
@@ -0,0 +1,94 @@
+package kiln_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConsoleFault tests that panics and OOM kills on the console are recognised.
+func TestConsoleFault(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		reason kiln.FaultReason
+	}{
+		{
+			name:  "clean boot",
+			lines: []string{"[    0.000000] Linux version 6.1.102", "[    0.512000] Run /inferno/init as init process"},
+		},
+		{
+			name:   "panic",
+			lines:  []string{"[    1.204000] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)"},
+			reason: kiln.FaultKernelPanic,
+		},
+		{
+			name:  "init exited",
+			lines: []string{"[   30.010000] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000000"},
+		},
+		{
+			name:   "oops",
+			lines:  []string{"[   12.001000] Oops: 0002 [#1] SMP NOPTI"},
+			reason: kiln.FaultKernelPanic,
+		},
+		{
+			name: "oom kill",
+			lines: []string{
+				"[   40.100000] app invoked oom-killer: gfp_mask=0xcc0(GFP_KERNEL), order=0, oom_score_adj=0",
+				"[   40.100900] Out of memory: Killed process 212 (app) total-vm:812340kB",
+			},
+			reason: kiln.FaultGuestOOM,
+		},
+		{
+			name: "oom then panic",
+			lines: []string{
+				"[   40.100000] Out of memory: Killed process 1 (init) total-vm:2020kB",
+				"[   40.200000] Kernel panic - not syncing: System is deadlocked on memory",
+			},
+			reason: kiln.FaultKernelPanic,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			console := kiln.NewConsole(new(bytes.Buffer), 10)
+			for _, line := range tt.lines {
+				console.Line(line)
+			}
+
+			fault := console.Fault()
+			if tt.reason == "" {
+				assert.Nil(t, fault)
+				return
+			}
+			require.NotNil(t, fault)
+			assert.Equal(t, tt.reason, fault.Reason)
+			assert.Equal(t, fault.Line, fault.Console[len(fault.Console)-1])
+		})
+	}
+}
+
+// TestConsoleStream tests that firecracker's logs are split from the console and the buffer is bounded.
+func TestConsoleStream(t *testing.T) {
+	var (
+		out     = new(bytes.Buffer)
+		console = kiln.NewConsole(out, 3)
+		input   strings.Builder
+	)
+
+	input.WriteString("2024-06-01T10:00:00.123456789 [vm1:main] Running Firecracker v1.7.0\n")
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&input, "line %d\r\n", i)
+	}
+	console.Stream(strings.NewReader(input.String()))
+
+	assert.Equal(t, []string{"line 3", "line 4", "line 5"}, console.Tail(10))
+	assert.Equal(t, []string{"line 5"}, console.Tail(1))
+	assert.NotContains(t, out.String(), "Running Firecracker")
+	assert.Contains(t, out.String(), "line 1\n")
+}
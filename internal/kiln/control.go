@@ -0,0 +1,282 @@
+package kiln
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+)
+
+// DefaultControlSocket is where kiln serves its control API, relative to the chroot
+const DefaultControlSocket = "kiln.sock"
+
+// controlRequestTimeout bounds the calls made to Firecracker on behalf of a control request
+const controlRequestTimeout = 5 * time.Second
+
+// State is the lifecycle state of the VM as seen by kiln
+type State string
+
+const (
+	StateStarting State = "starting" // firecracker is starting, the guest hasn't reported in yet
+	StateRunning  State = "running"
+	StatePaused   State = "paused"
+	StateStopping State = "stopping"
+)
+
+// Status is what kiln reports on its control socket
+type Status struct {
+	ID             string    `json:"id"`
+	State          State     `json:"state"`
+	PID            int       `json:"pid"`
+	FirecrackerPID int       `json:"firecracker_pid,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	// BootedAt is when the guest's init first connected back over vsock
+	BootedAt       *time.Time `json:"booted_at,omitempty"`
+	BootDurationMS int64      `json:"boot_duration_ms,omitempty"`
+	UptimeSeconds  int64      `json:"uptime_seconds"`
+	// Cgroup is only set when kiln manages the VM's cgroup
+	Cgroup     *CgroupStatus `json:"cgroup,omitempty"`
+	RateLimits *RateLimits   `json:"rate_limits,omitempty"`
+	// Balloon is only set when the VM has a balloon device
+	Balloon *BalloonStatus `json:"balloon,omitempty"`
+	// Health is only set when the guest sends heartbeats
+	Health *Health `json:"health,omitempty"`
+}
+
+// ShutdownRequest asks kiln to stop the VM. Unless Force is set the guest's
+// main process gets Signal (SIGTERM by default) and kiln escalates from there.
+type ShutdownRequest struct {
+	Reason string `json:"reason,omitempty"`
+	Signal int    `json:"signal,omitempty"`
+	Force  bool   `json:"force,omitempty"` // skip straight to killing firecracker
+}
+
+func (r ShutdownRequest) signal() syscall.Signal {
+	if r.Signal == 0 {
+		return syscall.SIGTERM
+	}
+	return syscall.Signal(r.Signal)
+}
+
+// controller tracks the VM's state and serves the control API
+type controller struct {
+	mu        sync.Mutex
+	id        string
+	state     State
+	startedAt time.Time
+	bootedAt  *time.Time
+	fcPID     int
+	// snapshotting is set while a snapshot is being written
+	snapshotting bool
+
+	firecracker  *firecracker.Client
+	fcConfigPath string
+	cgroup       *Cgroup
+	rateLimits   *RateLimits
+	// balloon is nil when the VM has no balloon device
+	balloon  *BalloonStatus
+	memoryMB int
+	metadata *mmds.Metadata
+	// bootFailure is set once init reports that it failed to boot
+	bootFailure *image.BootFailure
+	// health is nil when heartbeats are disabled, beat is set by every
+	// heartbeat and cleared by the monitor
+	health  *Health
+	beat    bool
+	console *Console
+	// shutdown is signalled when a graceful shutdown is requested
+	shutdown chan ShutdownRequest
+}
+
+func newController(id string, fc *firecracker.Client, fcConfigPath string) *controller {
+	return &controller{
+		id:           id,
+		state:        StateStarting,
+		startedAt:    time.Now().UTC(),
+		firecracker:  fc,
+		fcConfigPath: fcConfigPath,
+		shutdown:     make(chan ShutdownRequest, 1),
+	}
+}
+
+// started records the pid of the firecracker process
+func (c *controller) started(pid int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fcPID = pid
+}
+
+// booted records the first sign of life from the guest, later calls are no-ops
+func (c *controller) booted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.bootedAt != nil {
+		return
+	}
+	now := time.Now().UTC()
+	c.bootedAt = &now
+	if c.state == StateStarting {
+		c.state = StateRunning
+	}
+	slog.Info("Guest booted", "duration", now.Sub(c.startedAt))
+}
+
+// timings returns when kiln started the VM and when the guest booted
+func (c *controller) timings() (time.Time, *time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.startedAt, c.bootedAt
+}
+
+func (c *controller) setState(state State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = state
+}
+
+func (c *controller) status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := Status{
+		ID:             c.id,
+		State:          c.state,
+		PID:            os.Getpid(),
+		FirecrackerPID: c.fcPID,
+		StartedAt:      c.startedAt,
+		BootedAt:       c.bootedAt,
+		UptimeSeconds:  int64(time.Since(c.startedAt).Seconds()),
+		RateLimits:     c.rateLimits,
+	}
+	if c.balloon != nil {
+		balloon := *c.balloon
+		status.Balloon = &balloon
+	}
+	if c.health != nil {
+		health := *c.health
+		status.Health = &health
+	}
+	if c.bootedAt != nil {
+		status.BootDurationMS = c.bootedAt.Sub(c.startedAt).Milliseconds()
+	}
+	if c.cgroup != nil {
+		cgroup, err := c.cgroup.Status()
+		if err != nil {
+			slog.Warn("Failed to read cgroup limits", "error", err)
+		}
+		status.Cgroup = cgroup
+	}
+	return status
+}
+
+func (c *controller) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("POST /pause", c.handlePause)
+	mux.HandleFunc("POST /resume", c.handleResume)
+	mux.HandleFunc("POST /shutdown", c.handleShutdown)
+	mux.HandleFunc("POST /snapshot", c.handleSnapshot)
+	mux.HandleFunc("PATCH /rate-limits", c.handleRateLimits)
+	mux.HandleFunc("PATCH /balloon", c.handleBalloon)
+	mux.HandleFunc("PUT /metadata", c.handleMetadata)
+	mux.HandleFunc("GET /console", c.handleConsole)
+	return mux
+}
+
+func (c *controller) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, http.StatusOK, c.status())
+}
+
+func (c *controller) handlePause(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+
+	if state != StateRunning {
+		writeControlError(w, http.StatusConflict, "vm is "+string(state))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	if err := c.firecracker.Pause(ctx); err != nil {
+		slog.Error("Failed to pause VM", "error", err)
+		writeControlError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	c.setState(StatePaused)
+
+	slog.Info("VM paused")
+	writeControlJSON(w, http.StatusOK, c.status())
+}
+
+func (c *controller) handleResume(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+
+	if state != StatePaused {
+		writeControlError(w, http.StatusConflict, "vm is "+string(state))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	if err := c.firecracker.Resume(ctx); err != nil {
+		slog.Error("Failed to resume VM", "error", err)
+		writeControlError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	c.setState(StateRunning)
+
+	slog.Info("VM resumed")
+	writeControlJSON(w, http.StatusOK, c.status())
+}
+
+func (c *controller) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	var req ShutdownRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeControlError(w, http.StatusBadRequest, "invalid shutdown request")
+		return
+	}
+
+	select {
+	case c.shutdown <- req:
+		slog.Info("Shutdown requested", "reason", req.Reason)
+	default:
+		// a shutdown is already in progress
+	}
+	writeControlJSON(w, http.StatusAccepted, c.status())
+}
+
+func writeControlJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode control response", "error", err)
+	}
+}
+
+func writeControlError(w http.ResponseWriter, status int, msg string) {
+	writeControlJSON(w, status, controlError{Error: msg})
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,150 @@
+package kiln
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rugwirobaker/inferno/internal/mmds"
+)
+
+// ControlClient talks to kiln's control socket
+type ControlClient struct {
+	client *http.Client
+}
+
+// NewControlClient returns a client for the control socket at socketPath
+func NewControlClient(socketPath string) *ControlClient {
+	var dialer net.Dialer
+
+	return &ControlClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// ErrUnreachable is returned when nothing answers on the control socket
+var ErrUnreachable = errors.New("failed to reach kiln")
+
+// ControlError is returned when kiln rejects a control request
+type ControlError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ControlError) Error() string {
+	return fmt.Sprintf("kiln: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// Status returns the state of the VM as seen by kiln
+func (c *ControlClient) Status(ctx context.Context) (*Status, error) {
+	return c.status(ctx, http.MethodGet, "/status", nil)
+}
+
+// Pause freezes the VM's vCPUs
+func (c *ControlClient) Pause(ctx context.Context) (*Status, error) {
+	return c.status(ctx, http.MethodPost, "/pause", nil)
+}
+
+// Resume unfreezes a paused VM
+func (c *ControlClient) Resume(ctx context.Context) (*Status, error) {
+	return c.status(ctx, http.MethodPost, "/resume", nil)
+}
+
+// Shutdown asks kiln to stop the VM gracefully, it returns before the VM has exited
+func (c *ControlClient) Shutdown(ctx context.Context, req *ShutdownRequest) (*Status, error) {
+	return c.status(ctx, http.MethodPost, "/shutdown", req)
+}
+
+// UpdateRateLimits replaces the limiters set in limits on the running VM
+func (c *ControlClient) UpdateRateLimits(ctx context.Context, limits *RateLimits) (*Status, error) {
+	return c.status(ctx, http.MethodPatch, "/rate-limits", limits)
+}
+
+// UpdateBalloon sets the balloon target, memory the guest gives back to the host
+func (c *ControlClient) UpdateBalloon(ctx context.Context, req *BalloonRequest) (*Status, error) {
+	return c.status(ctx, http.MethodPatch, "/balloon", req)
+}
+
+// UpdateMetadata replaces the document served by the VM's metadata service
+func (c *ControlClient) UpdateMetadata(ctx context.Context, md *mmds.Metadata) (*Status, error) {
+	return c.status(ctx, http.MethodPut, "/metadata", md)
+}
+
+// Console returns up to lines of the guest's most recent console output
+func (c *ControlClient) Console(ctx context.Context, lines int) ([]string, error) {
+	var out []string
+	if err := c.do(ctx, http.MethodGet, "/console?lines="+strconv.Itoa(lines), nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Snapshot pauses the VM, writes a snapshot into req.Dir and resumes it
+func (c *ControlClient) Snapshot(ctx context.Context, req *SnapshotRequest) (*SnapshotResult, error) {
+	var result SnapshotResult
+	if err := c.do(ctx, http.MethodPost, "/snapshot", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *ControlClient) status(ctx context.Context, method, path string, in any) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, method, path, in, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *ControlClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(in); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://kiln"+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+		var e controlError
+		if err := json.Unmarshal(data, &e); err == nil && e.Error != "" {
+			return &ControlError{StatusCode: resp.StatusCode, Message: e.Error}
+		}
+		return &ControlError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package kiln_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/firecracker/firecrackertest"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newChroot moves the test into a chroot holding kiln.json, a firecracker
+// config and the files it points at, the way kiln finds them when it runs
+func newChroot(t *testing.T, trackDirtyPages bool) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	require.NoError(t, kiln.WriteConfig("kiln.json", kiln.Default()))
+	require.NoError(t, os.WriteFile("rootfs.ext4", []byte("rootfs"), 0o644))
+	require.NoError(t, os.WriteFile("initrd.img", []byte("initrd"), 0o644))
+
+	initrd := "initrd.img"
+	require.NoError(t, firecracker.WriteConfig("firecracker.json", &firecracker.Config{
+		BootSource:        firecracker.BootSource{KernelImagePath: "vmlinux", InitrdPath: &initrd},
+		Drives:            []firecracker.Drive{{DriveID: kiln.RootFSDriveID, PathOnHost: "rootfs.ext4", IsRootDevice: true}},
+		MachineConfig:     firecracker.MachineConfig{VCPUCount: 1, MemSizeMib: 128, TrackDirtyPages: trackDirtyPages},
+		NetworkInterfaces: []firecracker.NetworkInterface{{IfaceID: kiln.NetworkIfaceID, HostDev: "tap0"}},
+	}))
+}
+
+func control(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeStatus(t *testing.T, rec *httptest.ResponseRecorder) kiln.Status {
+	t.Helper()
+
+	var status kiln.Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	return status
+}
+
+// TestPauseResume tests that pausing and resuming reach firecracker and only
+// happen from the state they leave.
+func TestPauseResume(t *testing.T) {
+	fc := firecrackertest.NewServer(t)
+	ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", kiln.StateRunning)
+	h := ctrl.Handler()
+
+	rec := control(t, h, http.MethodPost, "/resume", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "a running VM can't be resumed")
+
+	rec = control(t, h, http.MethodPost, "/pause", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, kiln.StatePaused, decodeStatus(t, rec).State)
+	assert.Equal(t, firecracker.InstancePaused, fc.State())
+
+	rec = control(t, h, http.MethodPost, "/pause", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "a paused VM can't be paused")
+
+	rec = control(t, h, http.MethodPost, "/resume", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, kiln.StateRunning, decodeStatus(t, rec).State)
+	assert.Equal(t, firecracker.InstanceRunning, fc.State())
+
+	fc.Fail(http.MethodPatch, "/vm", http.StatusBadRequest, "vcpus are busy")
+	rec = control(t, h, http.MethodPost, "/pause", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), "vcpus are busy")
+
+	rec = control(t, h, http.MethodGet, "/status", "")
+	assert.Equal(t, kiln.StateRunning, decodeStatus(t, rec).State, "a failed pause leaves the VM running")
+}
+
+// TestRateLimits tests that rate limits are applied live and recorded for the next start.
+func TestRateLimits(t *testing.T) {
+	newChroot(t, false)
+
+	fc := firecrackertest.NewServer(t)
+	ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", kiln.StateRunning)
+	h := ctrl.Handler()
+
+	rec := control(t, h, http.MethodPatch, "/rate-limits", `{"drive":{"bandwidth":{"size":1048576,"refill_time":1000}}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = control(t, h, http.MethodPatch, "/rate-limits", `{"network_rx":{"ops":{"size":100,"refill_time":1000}}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	status := decodeStatus(t, rec)
+	require.NotNil(t, status.RateLimits)
+	require.NotNil(t, status.RateLimits.Drive, "earlier limits are kept")
+	require.NotNil(t, status.RateLimits.NetworkRx)
+	assert.Nil(t, status.RateLimits.NetworkTx)
+
+	drive, ok := fc.Drive(kiln.RootFSDriveID)
+	require.True(t, ok)
+	assert.Equal(t, int64(1048576), drive.RateLimiter.Bandwidth.Size)
+
+	iface, ok := fc.NetworkInterface(kiln.NetworkIfaceID)
+	require.True(t, ok)
+	assert.Equal(t, int64(100), iface.RxRateLimiter.Ops.Size)
+	assert.Nil(t, iface.TxRateLimiter)
+
+	cfg, err := kiln.ReadConfig("kiln.json")
+	require.NoError(t, err)
+	assert.Equal(t, status.RateLimits, cfg.RateLimits)
+
+	fcConfig, err := firecracker.ReadConfig("firecracker.json")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1048576), fcConfig.Drives[0].RateLimiter.Bandwidth.Size)
+	assert.Equal(t, int64(100), fcConfig.NetworkInterfaces[0].RxRateLimiter.Ops.Size)
+}
+
+// TestRateLimitsRejected tests the rate limit updates kiln refuses.
+func TestRateLimitsRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		state kiln.State
+		body  string
+		fault bool
+		want  int
+	}{
+		{name: "malformed", state: kiln.StateRunning, body: `{"drive":`, want: http.StatusBadRequest},
+		{name: "invalid bucket", state: kiln.StateRunning, body: `{"drive":{"bandwidth":{"size":-1,"refill_time":1000}}}`, want: http.StatusBadRequest},
+		{name: "starting", state: kiln.StateStarting, body: `{"drive":{"bandwidth":{"size":1024,"refill_time":1000}}}`, want: http.StatusConflict},
+		{name: "firecracker fails", state: kiln.StateRunning, body: `{"drive":{"bandwidth":{"size":1024,"refill_time":1000}}}`, fault: true, want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newChroot(t, false)
+
+			fc := firecrackertest.NewServer(t)
+			if tt.fault {
+				fc.Fail(http.MethodPatch, "/drives/"+kiln.RootFSDriveID, http.StatusBadRequest, "drive is busy")
+			}
+			ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", tt.state)
+
+			rec := control(t, ctrl.Handler(), http.MethodPatch, "/rate-limits", tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+
+			cfg, err := kiln.ReadConfig("kiln.json")
+			require.NoError(t, err)
+			assert.Nil(t, cfg.RateLimits, "nothing is persisted")
+		})
+	}
+}
+
+// TestMetadata tests that metadata is published to the guest and recorded for the next start.
+func TestMetadata(t *testing.T) {
+	newChroot(t, false)
+
+	fc := firecrackertest.NewServer(t)
+	ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", kiln.StateRunning)
+	h := ctrl.Handler()
+
+	rec := control(t, h, http.MethodPut, "/metadata", `{"id":"vm1","name":"web","labels":{"env":"prod"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var published mmds.Metadata
+	require.NoError(t, fc.Client().MMDS(context.Background(), &published))
+	assert.Equal(t, "web", published.Name)
+	assert.Equal(t, map[string]string{"env": "prod"}, published.Labels)
+
+	cfg, err := kiln.ReadConfig("kiln.json")
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Metadata)
+	assert.Equal(t, published, *cfg.Metadata)
+
+	ctrl.SetState(kiln.StateStopping)
+	rec = control(t, h, http.MethodPut, "/metadata", `{"id":"vm1","name":"db"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	ctrl.SetState(kiln.StateRunning)
+	rec = control(t, h, http.MethodPut, "/metadata", `{"id":`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	fc.Fail(http.MethodPut, "/mmds", http.StatusBadRequest, "mmds is full")
+	rec = control(t, h, http.MethodPut, "/metadata", `{"id":"vm1","name":"db"}`)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+
+	cfg, err = kiln.ReadConfig("kiln.json")
+	require.NoError(t, err)
+	assert.Equal(t, "web", cfg.Metadata.Name, "rejected metadata isn't persisted")
+}
+
+// TestSnapshot tests that a snapshot pauses the VM, lands next to copies of
+// its boot files and resumes the VM.
+func TestSnapshot(t *testing.T) {
+	newChroot(t, false)
+
+	fc := firecrackertest.NewServer(t)
+	ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", kiln.StateRunning)
+	h := ctrl.Handler()
+
+	rec := control(t, h, http.MethodPost, "/snapshot", `{"dir":"snapshots/snap1"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var result kiln.SnapshotResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+	assert.Equal(t, firecracker.SnapshotFull, result.Type)
+	assert.Equal(t, "snapshots/snap1", result.Dir)
+	assert.Equal(t, 128, result.MachineConfig.MemSizeMib)
+	assert.NotEmpty(t, result.FirecrackerVersion)
+
+	require.Len(t, fc.Snapshots(), 1)
+	assert.Equal(t, firecracker.SnapshotCreateParams{
+		SnapshotType: firecracker.SnapshotFull,
+		SnapshotPath: filepath.Join("snapshots/snap1", kiln.SnapshotStateFile),
+		MemFilePath:  filepath.Join("snapshots/snap1", kiln.SnapshotMemoryFile),
+	}, fc.Snapshots()[0])
+
+	for file, want := range map[string]string{
+		kiln.SnapshotRootFSFile: "rootfs",
+		kiln.SnapshotInitrdFile: "initrd",
+	} {
+		data, err := os.ReadFile(filepath.Join("snapshots/snap1", file))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+	assert.FileExists(t, filepath.Join("snapshots/snap1", kiln.SnapshotConfigFile))
+
+	assert.Equal(t, firecracker.InstanceRunning, fc.State())
+	rec = control(t, h, http.MethodGet, "/status", "")
+	assert.Equal(t, kiln.StateRunning, decodeStatus(t, rec).State)
+
+	// a paused VM stays paused
+	ctrl.SetState(kiln.StatePaused)
+	fc.SetState(firecracker.InstancePaused)
+	rec = control(t, h, http.MethodPost, "/snapshot", `{"dir":"snapshots/snap2"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, firecracker.InstancePaused, fc.State())
+}
+
+// TestSnapshotRejected tests the snapshots kiln refuses to take.
+func TestSnapshotRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		state kiln.State
+		body  string
+		fault bool
+		want  int
+	}{
+		{name: "malformed", state: kiln.StateRunning, body: `{"dir":`, want: http.StatusBadRequest},
+		{name: "absolute dir", state: kiln.StateRunning, body: `{"dir":"/tmp/snap"}`, want: http.StatusBadRequest},
+		{name: "dir outside the chroot", state: kiln.StateRunning, body: `{"dir":"../snap"}`, want: http.StatusBadRequest},
+		{name: "unknown type", state: kiln.StateRunning, body: `{"type":"Partial","dir":"snap"}`, want: http.StatusBadRequest},
+		{name: "starting", state: kiln.StateStarting, body: `{"dir":"snap"}`, want: http.StatusConflict},
+		{name: "diff without dirty page tracking", state: kiln.StateRunning, body: `{"type":"Diff","dir":"snap"}`, want: http.StatusBadGateway},
+		{name: "firecracker fails", state: kiln.StateRunning, body: `{"dir":"snap"}`, fault: true, want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newChroot(t, false)
+
+			fc := firecrackertest.NewServer(t)
+			if tt.fault {
+				fc.Fail(http.MethodPut, "/snapshot/create", http.StatusBadRequest, "disk is full")
+			}
+			ctrl := kiln.NewTestController("vm1", fc.Client(), "firecracker.json", tt.state)
+
+			rec := control(t, ctrl.Handler(), http.MethodPost, "/snapshot", tt.body)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+			assert.Empty(t, fc.Snapshots())
+
+			if tt.state == kiln.StateRunning {
+				assert.Equal(t, firecracker.InstanceRunning, fc.State(), "the VM is left running")
+			}
+		})
+	}
+}
@@ -6,21 +6,67 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/image"
 )
 
+// ExitStatusVersion is bumped whenever fields of KilnExitStatus change
+// meaning, records without a version predate the timings
+const ExitStatusVersion = 2
+
 // KilnExitStatus stores the exit status of the kiln process
 // At the end of the kiln process, we write to exit_status.json
 type KilnExitStatus struct {
+	Version int `json:"version"`
+
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// BootedAt is unset when the guest never finished booting
+	BootedAt *time.Time `json:"booted_at,omitempty"`
+	ExitedAt *time.Time `json:"exited_at,omitempty"`
+
 	// from the VM
 	VMExitCode *int64  `json:"vm_exit_code"`
 	VMError    *string `json:"vm_error,omitempty"`
 	VMSignal   *int64  `json:"vm_signal,omitempty"`
+	// CgroupOOM is set when the kernel OOM killed a process in the VM's cgroup,
+	// nil when kiln doesn't manage the cgroup
+	CgroupOOM *bool `json:"cgroup_oom,omitempty"`
 
 	// from the guest main process
 	ExitCode  *int64  `json:"exit_code,omitempty"`
 	Signal    *int64  `json:"signal,omitempty"`
 	Error     *string `json:"error,omitempty"`
 	OOMKilled *bool   `json:"oom_killed,omitempty"`
+
+	// StopRequest is what asked kiln to stop the VM, nil when it exited on its own
+	StopRequest *StopRequest `json:"stop_request,omitempty"`
+	// StopSteps are the steps kiln took to stop the VM, empty when it exited on its own
+	StopSteps []StopStep `json:"stop_steps,omitempty"`
+	// Health is set when the guest had stopped sending heartbeats
+	Health *Health `json:"health,omitempty"`
+	// Fault is set when the guest console showed a kernel panic or OOM kill
+	Fault *Fault `json:"fault,omitempty"`
+	// BootFailure is the report init sent when it failed to boot the guest
+	BootFailure *image.BootFailure `json:"boot_failure,omitempty"`
+}
+
+type StopSource string
+
+const (
+	// StopSourceSignal is a signal sent to kiln
+	StopSourceSignal StopSource = "signal"
+	// StopSourceControl is a shutdown request on the control socket
+	StopSourceControl StopSource = "control"
+)
+
+// StopRequest records the first request to stop the VM
+type StopRequest struct {
+	Source StopSource `json:"source"`
+	Signal int        `json:"signal,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	Force  bool       `json:"force,omitempty"`
+	At     time.Time  `json:"at"`
 }
 
 type FinalizerFunc func() error
@@ -28,6 +74,7 @@ type FinalizerFunc func() error
 // finalize cleans up the kiln process and writes the exit status to exit_status.json
 func finalize(config *Config, exitStatus KilnExitStatus, finalizers ...FinalizerFunc) (err error) {
 	slog.Info("Finalizing kiln process")
+	exitStatus.Version = ExitStatusVersion
 
 	// log the number of finalizers
 	slog.Debug("Number of finalizers", "count", len(finalizers))
@@ -46,29 +93,52 @@ func finalize(config *Config, exitStatus KilnExitStatus, finalizers ...Finalizer
 }
 
 func writeExitStatus(path string, exitStatus KilnExitStatus) (err error) {
-	file, err := os.CreateTemp(".", "exit_status.json")
+	if err := writeJSONFile(path, exitStatus); err != nil {
+		return fmt.Errorf("could not write exit status file, %w", err)
+	}
+	slog.Info("Exit status written to file", "filePath", path)
+	return nil
+}
+
+// writeJSONFile replaces the file at path with a rename, so readers never
+// see it half written
+func writeJSONFile(path string, v any) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
 	if err != nil {
-		return fmt.Errorf("failed to create exit status file: %w", err)
+		return fmt.Errorf("failed to create %s: %w", path, err)
 	}
+	defer os.Remove(file.Name()) // a no-op once renamed
 	defer file.Close()
-	if err := json.NewEncoder(file).Encode(exitStatus); err != nil {
-		return fmt.Errorf("could not encode exit status file, %w", err)
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("could not encode %s, %w", path, err)
 	}
 	if err := file.Chmod(0644); err != nil {
-		return fmt.Errorf("could chmod exit status file, %w", err)
+		return fmt.Errorf("could chmod %s, %w", path, err)
 	}
-
-	dir, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("could not get current working directory, %w", err)
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not write %s, %w", path, err)
 	}
 
-	path = filepath.Join(dir, path)
 	if err := os.Rename(file.Name(), path); err != nil {
-		return fmt.Errorf("could not rename exit status file, %w", err)
+		return fmt.Errorf("could not rename %s, %w", path, err)
 	}
+	return nil
+}
 
-	slog.Info("Exit status written to file", "filePath", path)
+// ReadExitStatus reads the exit status kiln wrote to path.
+func ReadExitStatus(path string) (*KilnExitStatus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	return
+	var status KilnExitStatus
+	if err := json.NewDecoder(file).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode exit status: %w", err)
+	}
+	return &status, nil
 }
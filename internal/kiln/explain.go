@@ -0,0 +1,135 @@
+package kiln
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Explain tells in plain words why the VM stopped: the cause first, then
+// what became of the main process and how long the VM lived
+func Explain(status *KilnExitStatus) string {
+	if status == nil {
+		return "Kiln exited without recording why the VM stopped."
+	}
+
+	var sentences []string
+	cause, byProcess := exitCause(status)
+	sentences = append(sentences, cause)
+
+	if process := processOutcome(status); process != "" && !byProcess {
+		sentences = append(sentences, process)
+	}
+	if timing := exitTiming(status); timing != "" {
+		sentences = append(sentences, timing)
+	}
+	return strings.Join(sentences, " ")
+}
+
+// exitCause is the most telling reason the VM stopped, byProcess is set when
+// that reason is the main process exiting. A stop request explains whatever
+// came after it, and the guest's own exit status outranks what was seen on
+// the console: init exiting panics the kernel even on a clean shutdown.
+func exitCause(status *KilnExitStatus) (string, bool) {
+	fault := status.Fault
+	switch {
+	case status.StopRequest != nil && status.Health != nil && !status.Health.Healthy:
+		return hungCause(status.Health), false
+	case status.StopRequest != nil:
+		return stopCause(status.StopRequest, status.VMSignal), false
+	case status.BootFailure != nil:
+		return fmt.Sprintf("Init failed to boot the guest at the %s stage: %s.", status.BootFailure.Stage, status.BootFailure.Error), false
+	case processOutcome(status) != "":
+		return processOutcome(status), true
+	case isTrue(status.CgroupOOM):
+		return "The VM ran out of memory on the host and the kernel OOM killer killed it.", false
+	case status.Health != nil && !status.Health.Healthy:
+		return hungCause(status.Health), false
+	case status.VMError != nil:
+		return fmt.Sprintf("Firecracker failed: %s.", *status.VMError), false
+	case status.VMSignal != nil:
+		return fmt.Sprintf("Firecracker was killed by %s.", signalName(*status.VMSignal)), false
+	case status.VMExitCode != nil && *status.VMExitCode != 0:
+		return fmt.Sprintf("Firecracker exited with code %d.", *status.VMExitCode), false
+	case fault != nil && fault.Reason == FaultKernelPanic:
+		return fmt.Sprintf("The guest kernel panicked: %q.", fault.Line), false
+	case fault != nil && fault.Reason == FaultGuestOOM:
+		return fmt.Sprintf("The guest ran out of memory: %q.", fault.Line), false
+	default:
+		return "The VM shut down on its own.", false
+	}
+}
+
+func hungCause(health *Health) string {
+	cause := fmt.Sprintf("The guest stopped responding after missing %d heartbeats", health.Misses)
+	if health.LastHeartbeat != nil {
+		cause += fmt.Sprintf(", the last one was at %s", health.LastHeartbeat.Format(time.RFC3339))
+	}
+	return cause + "."
+}
+
+func stopCause(req *StopRequest, vmSignal *int64) string {
+	var cause string
+	switch req.Source {
+	case StopSourceSignal:
+		cause = fmt.Sprintf("Kiln was sent %s", signalName(int64(req.Signal)))
+	default:
+		cause = "A stop was requested"
+		if req.Reason != "" {
+			cause += fmt.Sprintf(" (%s)", req.Reason)
+		}
+	}
+
+	switch {
+	case req.Force:
+		cause += " and firecracker was killed right away"
+	case vmSignal != nil:
+		cause += fmt.Sprintf(", the guest didn't shut down in time and firecracker was killed by %s", signalName(*vmSignal))
+	}
+	return cause + "."
+}
+
+// processOutcome is how the guest's main process ended, empty when init
+// never reported it
+func processOutcome(status *KilnExitStatus) string {
+	switch {
+	case isTrue(status.OOMKilled):
+		return "The main process was killed by the guest's OOM killer."
+	case status.Signal != nil && *status.Signal != 0:
+		return fmt.Sprintf("The main process was killed by %s.", signalName(*status.Signal))
+	case status.ExitCode != nil:
+		outcome := fmt.Sprintf("The main process exited with code %d", *status.ExitCode)
+		if status.Error != nil && *status.Error != "" {
+			outcome += fmt.Sprintf(": %s", *status.Error)
+		}
+		return outcome + "."
+	default:
+		return ""
+	}
+}
+
+func exitTiming(status *KilnExitStatus) string {
+	if status.StartedAt == nil || status.ExitedAt == nil {
+		return ""
+	}
+	ran := status.ExitedAt.Sub(*status.StartedAt).Round(time.Millisecond)
+	if status.BootedAt == nil {
+		return fmt.Sprintf("It never finished booting and stopped after %s.", ran)
+	}
+	boot := status.BootedAt.Sub(*status.StartedAt).Round(time.Millisecond)
+	return fmt.Sprintf("It booted in %s and ran for %s.", boot, ran)
+}
+
+func signalName(sig int64) string {
+	if name := unix.SignalName(syscall.Signal(sig)); name != "" {
+		return name
+	}
+	return fmt.Sprintf("signal %d", sig)
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
@@ -0,0 +1,146 @@
+package kiln_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/pointer"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestExplain tests that the most telling cause leads the explanation.
+func TestExplain(t *testing.T) {
+	var (
+		started = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+		booted  = started.Add(1200 * time.Millisecond)
+		exited  = started.Add(3 * time.Minute)
+	)
+	exitedWith := func(code int64) *kiln.KilnExitStatus {
+		return &kiln.KilnExitStatus{
+			Version:    kiln.ExitStatusVersion,
+			StartedAt:  &started,
+			BootedAt:   &booted,
+			ExitedAt:   &exited,
+			VMExitCode: pointer.Int64(0),
+			ExitCode:   pointer.Int64(code),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		status *kiln.KilnExitStatus
+		want   string
+	}{
+		{
+			name: "no status",
+			want: "Kiln exited without recording why the VM stopped.",
+		},
+		{
+			name:   "clean exit",
+			status: exitedWith(0),
+			want:   "The main process exited with code 0. It booted in 1.2s and ran for 3m0s.",
+		},
+		{
+			name: "stopped by signal",
+			status: func() *kiln.KilnExitStatus {
+				s := exitedWith(0)
+				s.Signal = pointer.Int64(int64(syscall.SIGTERM))
+				s.StopRequest = &kiln.StopRequest{Source: kiln.StopSourceSignal, Signal: int(syscall.SIGTERM)}
+				return s
+			}(),
+			want: "Kiln was sent SIGTERM. The main process was killed by SIGTERM. It booted in 1.2s and ran for 3m0s.",
+		},
+		{
+			name: "stop escalated to a kill",
+			status: func() *kiln.KilnExitStatus {
+				s := exitedWith(0)
+				s.ExitCode = nil
+				s.VMExitCode = pointer.Int64(-1)
+				s.VMSignal = pointer.Int64(int64(syscall.SIGKILL))
+				s.StopRequest = &kiln.StopRequest{Source: kiln.StopSourceControl, Reason: "user"}
+				return s
+			}(),
+			want: "A stop was requested (user), the guest didn't shut down in time and firecracker was killed by SIGKILL. It booted in 1.2s and ran for 3m0s.",
+		},
+		{
+			name: "clean exit with init's panic on the console",
+			status: func() *kiln.KilnExitStatus {
+				s := exitedWith(0)
+				s.Fault = &kiln.Fault{Reason: kiln.FaultKernelPanic, Line: "Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000000"}
+				return s
+			}(),
+			want: "The main process exited with code 0. It booted in 1.2s and ran for 3m0s.",
+		},
+		{
+			name: "firecracker killed",
+			status: &kiln.KilnExitStatus{
+				VMExitCode: pointer.Int64(-1),
+				VMSignal:   pointer.Int64(int64(syscall.SIGSEGV)),
+			},
+			want: "Firecracker was killed by SIGSEGV.",
+		},
+		{
+			name: "host oom",
+			status: func() *kiln.KilnExitStatus {
+				s := exitedWith(0)
+				s.ExitCode = nil
+				s.VMSignal = pointer.Int64(int64(syscall.SIGKILL))
+				s.CgroupOOM = pointer.Bool(true)
+				return s
+			}(),
+			want: "The VM ran out of memory on the host and the kernel OOM killer killed it. It booted in 1.2s and ran for 3m0s.",
+		},
+		{
+			name: "panic while booting",
+			status: &kiln.KilnExitStatus{
+				StartedAt:  &started,
+				ExitedAt:   &booted,
+				VMExitCode: pointer.Int64(0),
+				Fault:      &kiln.Fault{Reason: kiln.FaultKernelPanic, Line: "Kernel panic - not syncing: VFS: Unable to mount root fs"},
+			},
+			want: `The guest kernel panicked: "Kernel panic - not syncing: VFS: Unable to mount root fs". It never finished booting and stopped after 1.2s.`,
+		},
+		{
+			name: "boot failure",
+			status: &kiln.KilnExitStatus{
+				StartedAt:   &started,
+				ExitedAt:    &booted,
+				VMExitCode:  pointer.Int64(0),
+				Fault:       &kiln.Fault{Reason: kiln.FaultKernelPanic, Line: "Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000100"},
+				BootFailure: &image.BootFailure{Stage: "unlock_volumes", Error: "vsock connection failed"},
+			},
+			want: "Init failed to boot the guest at the unlock_volumes stage: vsock connection failed. It never finished booting and stopped after 1.2s.",
+		},
+		{
+			name: "hung",
+			status: func() *kiln.KilnExitStatus {
+				s := exitedWith(0)
+				s.ExitCode = nil
+				s.Health = &kiln.Health{Misses: 3, LastHeartbeat: &booted}
+				return s
+			}(),
+			want: "The guest stopped responding after missing 3 heartbeats, the last one was at 2026-10-01T12:00:01Z. It booted in 1.2s and ran for 3m0s.",
+		},
+		{
+			name: "hung and stopped by kiln",
+			status: func() *kiln.KilnExitStatus {
+				s := exitedWith(0)
+				s.ExitCode = nil
+				s.VMSignal = pointer.Int64(int64(syscall.SIGKILL))
+				s.Health = &kiln.Health{Misses: 3}
+				s.StopRequest = &kiln.StopRequest{Source: kiln.StopSourceControl, Reason: "guest is unhealthy", Force: true}
+				return s
+			}(),
+			want: "The guest stopped responding after missing 3 heartbeats. It booted in 1.2s and ran for 3m0s.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, kiln.Explain(tt.status))
+		})
+	}
+}
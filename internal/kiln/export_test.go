@@ -0,0 +1,89 @@
+package kiln
+
+import (
+	"context"
+	"net/http"
+	"syscall"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/image"
+)
+
+var (
+	NewStopper         = newStopper
+	JailFiles          = jailFiles
+	JailNetwork        = jailNetwork
+	FirecrackerCommand = firecrackerCommand
+)
+
+func (s *stopper) Stop(sig syscall.Signal, force bool) {
+	s.stop(context.Background(), sig, force)
+}
+
+func (s *stopper) GuestDone() { s.guestDone() }
+
+func (s *stopper) VMDone() { s.vmDone() }
+
+// TestController serves kiln's control API for a VM backed by a fake firecracker
+type TestController struct {
+	c *controller
+}
+
+func NewTestController(id string, fc *firecracker.Client, fcConfigPath string, state State) *TestController {
+	c := newController(id, fc, fcConfigPath)
+	c.state = state
+	return &TestController{c: c}
+}
+
+func (t *TestController) Handler() http.Handler {
+	return t.c.handler()
+}
+
+// WithBalloon gives the VM a balloon device and memoryMB of memory
+func (t *TestController) WithBalloon(memoryMB int) *TestController {
+	t.c.memoryMB = memoryMB
+	t.c.balloon = &BalloonStatus{}
+	return t
+}
+
+func (t *TestController) SetState(state State) {
+	t.c.setState(state)
+}
+
+// WithHeartbeats has the guest send heartbeats
+func (t *TestController) WithHeartbeats() *TestController {
+	t.c.health = &Health{Healthy: true}
+	return t
+}
+
+func (t *TestController) Heartbeat() { t.c.heartbeat() }
+
+// CheckHeartbeat ticks the heartbeat monitor once
+func (t *TestController) CheckHeartbeat(config HeartbeatConfig) { t.c.checkHeartbeat(config) }
+
+func (t *TestController) SetSnapshotting(snapshotting bool) {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.c.snapshotting = snapshotting
+}
+
+// ExitHealth is the health kiln writes to the exit status
+func (t *TestController) ExitHealth() *Health { return t.c.unhealthy() }
+
+// ShutdownRequested returns the shutdown request waiting to be handled, if any
+func (t *TestController) ShutdownRequested() (ShutdownRequest, bool) {
+	select {
+	case req := <-t.c.shutdown:
+		return req, true
+	default:
+		return ShutdownRequest{}, false
+	}
+}
+
+// BootFailureHandler serves the boot failure reports init sends over vsock
+func (t *TestController) BootFailureHandler() http.Handler {
+	return http.HandlerFunc(t.c.handleBootFailure)
+}
+
+// ExitBootFailure is the boot failure kiln writes to the exit status
+func (t *TestController) ExitBootFailure() *image.BootFailure { return t.c.failedBoot() }
@@ -0,0 +1,157 @@
+package kiln
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// HeartbeatConfig sets how often the guest's init reports in and how many
+// missed heartbeats make kiln consider the guest hung
+type HeartbeatConfig struct {
+	IntervalS int `json:"interval_s"`
+	MaxMisses int `json:"max_misses"`
+	// ForceStop kills a hung VM instead of only reporting it
+	ForceStop bool `json:"force_stop,omitempty"`
+}
+
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		IntervalS: 5,
+		MaxMisses: 3,
+	}
+}
+
+func (c HeartbeatConfig) interval() time.Duration {
+	if c.IntervalS <= 0 {
+		return time.Duration(DefaultHeartbeatConfig().IntervalS) * time.Second
+	}
+	return time.Duration(c.IntervalS) * time.Second
+}
+
+func (c HeartbeatConfig) maxMisses() int {
+	if c.MaxMisses <= 0 {
+		return DefaultHeartbeatConfig().MaxMisses
+	}
+	return c.MaxMisses
+}
+
+// Health is what kiln makes of the guest's heartbeats. Misses only count
+// while the VM runs, a paused guest can't send any.
+type Health struct {
+	Healthy        bool       `json:"healthy"`
+	LastHeartbeat  *time.Time `json:"last_heartbeat,omitempty"`
+	Misses         int        `json:"misses"`
+	UnhealthySince *time.Time `json:"unhealthy_since,omitempty"`
+}
+
+// serveHeartbeats counts every line the guest sends on listener as a heartbeat
+func (c *controller) serveHeartbeats(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			slog.Debug("Stopped accepting heartbeats", "error", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				c.heartbeat()
+			}
+		}()
+	}
+}
+
+func (c *controller) heartbeat() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UTC()
+	c.health.LastHeartbeat = &now
+	c.health.Misses = 0
+	c.beat = true
+
+	if !c.health.Healthy {
+		slog.Info("Guest is healthy again")
+		c.health.Healthy = true
+		c.health.UnhealthySince = nil
+	}
+}
+
+// monitorHeartbeats counts a miss for every interval without a heartbeat.
+// Monitoring starts with the first heartbeat, guests that never send any
+// run an init without heartbeats.
+func (c *controller) monitorHeartbeats(ctx context.Context, config HeartbeatConfig) {
+	ticker := time.NewTicker(config.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.checkHeartbeat(config)
+	}
+}
+
+// checkHeartbeat records a tick of the monitor and forces a shutdown if it
+// made the guest unhealthy and config asks for it
+func (c *controller) checkHeartbeat(config HeartbeatConfig) {
+	if !c.missedHeartbeat(config.maxMisses()) || !config.ForceStop {
+		return
+	}
+	req := ShutdownRequest{Reason: "guest stopped sending heartbeats", Force: true}
+	select {
+	case c.shutdown <- req:
+	default: // a shutdown is already on its way
+	}
+}
+
+// missedHeartbeat records a tick of the monitor and reports whether it made the guest unhealthy
+func (c *controller) missedHeartbeat(maxMisses int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.health.LastHeartbeat == nil:
+		return false
+	case c.beat:
+		c.beat = false
+		return false
+	case c.state != StateRunning || c.snapshotting:
+		return false
+	}
+
+	c.health.Misses++
+	if c.health.Misses < maxMisses || !c.health.Healthy {
+		return false
+	}
+
+	now := time.Now().UTC()
+	c.health.Healthy = false
+	c.health.UnhealthySince = &now
+	slog.Warn("Guest is unhealthy", "misses", c.health.Misses, "last_heartbeat", c.health.LastHeartbeat)
+	return true
+}
+
+// unhealthy returns the guest's health if it was considered hung
+func (c *controller) unhealthy() *Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.health == nil || c.health.Healthy {
+		return nil
+	}
+	health := *c.health
+	return &health
+}
+
+func heartbeatSocket(config *Config) string {
+	return fmt.Sprintf("%s_%d", config.FirecrackerVsockUDSPath, config.VsockHeartbeatPort)
+}
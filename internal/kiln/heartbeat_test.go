@@ -0,0 +1,81 @@
+package kiln_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker/firecrackertest"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHeartbeats tests that intervals without a heartbeat count as misses
+// while the VM runs, that enough of them make the guest unhealthy and stop it
+// when asked to, and that the health ends up in the exit status.
+func TestHeartbeats(t *testing.T) {
+	tests := []struct {
+		name         string
+		state        kiln.State
+		snapshotting bool
+		forceStop    bool
+		// ticks are the monitor's intervals, b is one with a heartbeat
+		ticks       string
+		wantMisses  int
+		wantHealthy bool
+		wantStops   int
+	}{
+		{name: "no heartbeats yet", state: kiln.StateRunning, ticks: "....", wantHealthy: true},
+		{name: "heartbeats", state: kiln.StateRunning, ticks: "bbbb", wantHealthy: true},
+		{name: "misses", state: kiln.StateRunning, ticks: "b..", wantMisses: 2, wantHealthy: true},
+		{name: "hung", state: kiln.StateRunning, ticks: "b...", wantMisses: 3},
+		{name: "hung keeps counting", state: kiln.StateRunning, ticks: "b.....", wantMisses: 5},
+		{name: "hung force stop", state: kiln.StateRunning, forceStop: true, ticks: "b...", wantMisses: 3, wantStops: 1},
+		{name: "force stop once", state: kiln.StateRunning, forceStop: true, ticks: "b......", wantMisses: 6, wantStops: 1},
+		{name: "recovered", state: kiln.StateRunning, forceStop: true, ticks: "b...b", wantHealthy: true, wantStops: 1},
+		{name: "paused", state: kiln.StatePaused, forceStop: true, ticks: "b.....", wantHealthy: true},
+		{name: "snapshotting", state: kiln.StateRunning, snapshotting: true, forceStop: true, ticks: "b.....", wantHealthy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				fc     = firecrackertest.NewServer(t)
+				ctrl   = kiln.NewTestController("vm1", fc.Client(), "firecracker.json", tt.state).WithHeartbeats()
+				config = kiln.HeartbeatConfig{IntervalS: 1, MaxMisses: 3, ForceStop: tt.forceStop}
+				stops  int
+			)
+			ctrl.SetSnapshotting(tt.snapshotting)
+
+			for _, tick := range tt.ticks {
+				if tick == 'b' {
+					ctrl.Heartbeat()
+				}
+				ctrl.CheckHeartbeat(config)
+
+				if req, ok := ctrl.ShutdownRequested(); ok {
+					stops++
+					assert.True(t, req.Force, "a hung guest can't stop itself")
+				}
+			}
+			assert.Equal(t, tt.wantStops, stops)
+
+			rec := control(t, ctrl.Handler(), http.MethodGet, "/status", "")
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			health := decodeStatus(t, rec).Health
+			require.NotNil(t, health)
+			assert.Equal(t, tt.wantMisses, health.Misses)
+			assert.Equal(t, tt.wantHealthy, health.Healthy)
+
+			exit := ctrl.ExitHealth()
+			if tt.wantHealthy {
+				assert.Nil(t, exit, "a healthy guest leaves no health in the exit status")
+				return
+			}
+			require.NotNil(t, exit)
+			assert.False(t, exit.Healthy)
+			assert.Equal(t, tt.wantMisses, exit.Misses)
+			assert.NotNil(t, exit.LastHeartbeat)
+			assert.NotNil(t, exit.UnhealthySince)
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package kiln
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+
+	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/flag"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// jailCgroupDir is where the VM's cgroup is mounted inside the jail so kiln
+// can report its limits
+const jailCgroupDir = "cgroup"
+
+// device is a device node created inside the jail
+type device struct {
+	path  string
+	major uint32
+	minor uint32
+	mode  uint32
+}
+
+// jailDevices are the only devices firecracker gets to see
+var jailDevices = []device{
+	{"dev/null", 1, 3, 0o666},
+	{"dev/zero", 1, 5, 0o666},
+	{"dev/urandom", 1, 9, 0o666},
+	{"dev/kvm", 10, 232, 0o660},
+	{"dev/net/tun", 10, 200, 0o660},
+}
+
+func newJailCommand() *cobra.Command {
+	const (
+		long = "Sets up the VM's cgroup, namespaces, mounts and /dev, then execs kiln chrooted and " +
+			"unprivileged. Arguments after -- are passed on to kiln."
+		short = "Run kiln in a jail"
+	)
+
+	cmd := command.New("jail", short, long, runJail)
+
+	flag.Add(cmd,
+		flag.String{
+			Name:        "chroot",
+			Description: "Directory to jail kiln in, it must hold kiln.json",
+			Default:     ".",
+		},
+		flag.Int{
+			Name:        "uid",
+			Description: "UID to run kiln and Firecracker as",
+			Default:     firecracker.DefaultJailerUID,
+		},
+		flag.Int{
+			Name:        "gid",
+			Description: "GID to run kiln and Firecracker as",
+			Default:     firecracker.DefaultJailerGID,
+		},
+		flag.String{
+			Name:        "exec-file",
+			Description: "Path of the kiln binary inside the jail",
+			Default:     "/kiln",
+		},
+	)
+
+	return cmd
+}
+
+// runJail does what the Firecracker jailer does: join the cgroup, unshare
+// the mount and network namespaces, populate /dev and exec kiln in the
+// chroot, as its root, and without privileges. kiln keeps the PID the server
+// started the jail with.
+//
+// kiln starts firecracker as the init of a new PID namespace, the jail can't
+// unshare it for kiln: a Go process can't start threads once its children's
+// PID namespace isn't its own. The VM's TAP devices are moved into the
+// network namespace and go away with it, the server creates them again for
+// the next start.
+func runJail(ctx context.Context) error {
+	var (
+		chroot   = flag.GetString(ctx, "chroot")
+		uid      = flag.GetInt(ctx, "uid")
+		gid      = flag.GetInt(ctx, "gid")
+		execFile = flag.GetString(ctx, "exec-file")
+		args     = command.FromContext(ctx).Flags().Args()
+	)
+
+	chroot, err := filepath.Abs(chroot)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(chroot); err != nil {
+		return fmt.Errorf("failed to enter chroot: %w", err)
+	}
+
+	config, err := ReadConfig("kiln.json")
+	if err != nil {
+		return err
+	}
+	fcConfig, err := firecracker.ReadConfig(config.FirecrackerConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read firecracker config: %w", err)
+	}
+
+	// the namespaces and the root are per thread, kiln is exec'd from this
+	// one so it's never unlocked
+	runtime.LockOSThread()
+
+	if config.CgroupParent != "" {
+		if _, err := joinCgroup(config); err != nil {
+			return fmt.Errorf("failed to set up cgroup: %w", err)
+		}
+	}
+
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("failed to unshare mount namespace: %w", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	if err := jailMounts(chroot, config, uid, gid); err != nil {
+		return err
+	}
+	if err := jailFiles(chroot, uid, gid); err != nil {
+		return err
+	}
+	if err := jailNetwork(jailTaps(config, fcConfig)); err != nil {
+		return err
+	}
+
+	// nothing kiln execs regains privileges through setuid binaries
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+
+	if err := pivotRoot(chroot); err != nil {
+		return err
+	}
+	if err := dropPrivileges(uid, gid); err != nil {
+		return err
+	}
+
+	argv := append([]string{execFile, "--jailed"}, args...)
+	if err := syscall.Exec(execFile, argv, os.Environ()); err != nil {
+		return fmt.Errorf("failed to exec %s: %w", execFile, err)
+	}
+	return nil
+}
+
+// pivotRoot makes chroot the root of the jail's mount namespace. Unlike a
+// chroot it leaves none of the host's mounts reachable, and the kernel lets
+// kiln start firecracker in user and PID namespaces of its own, which it
+// refuses to chrooted processes.
+func pivotRoot(chroot string) error {
+	// the new root has to be a mount point
+	if err := unix.Mount(chroot, chroot, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount chroot: %w", err)
+	}
+	if err := os.Chdir(chroot); err != nil {
+		return err
+	}
+	// the old root ends up stacked under the new one and is detached
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach old root: %w", err)
+	}
+	return os.Chdir("/")
+}
+
+// dropPrivileges switches the process to uid and gid
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid: %w", err)
+	}
+	return nil
+}
+
+// jailTaps lists the TAP devices firecracker attaches the VM to, a restored
+// VM's may be overridden
+func jailTaps(config *Config, fcConfig *firecracker.Config) []string {
+	var taps []string
+	for _, iface := range fcConfig.NetworkInterfaces {
+		taps = append(taps, iface.HostDev)
+	}
+	if config.Restore != nil {
+		for _, override := range config.Restore.NetworkOverrides {
+			if !slices.Contains(taps, override.HostDevName) {
+				taps = append(taps, override.HostDevName)
+			}
+		}
+	}
+	return taps
+}
+
+// jailNetwork unshares the network namespace of the calling thread, moves the
+// TAP devices into it from the host's and brings them and the loopback up
+func jailNetwork(taps []string) error {
+	// the devices are moved through a socket in the host's namespace
+	host, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer host.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("failed to unshare network namespace: %w", err)
+	}
+	ns, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer unix.Close(ns)
+
+	for _, name := range taps {
+		link, err := host.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find tap device %s: %w", name, err)
+		}
+		if err := host.LinkSetNsFd(link, ns); err != nil {
+			return fmt.Errorf("failed to move tap device %s: %w", name, err)
+		}
+	}
+
+	for _, name := range append([]string{"lo"}, taps...) {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find %s in the jail: %w", name, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to bring up %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// jailMounts bind mounts what kiln needs from outside the chroot: the log
+// directory at the same path and the VM's cgroup. They only exist in the
+// jail's mount namespace.
+func jailMounts(chroot string, config *Config, uid, gid int) error {
+	if config.LogDir != "" {
+		for _, dir := range []string{config.LogDir, filepath.Join(config.LogDir, "vm"), filepath.Join(config.LogDir, "console")} {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return fmt.Errorf("failed to create log dir: %w", err)
+			}
+			if err := os.Chown(dir, uid, gid); err != nil {
+				return fmt.Errorf("failed to chown log dir: %w", err)
+			}
+		}
+		if err := bindMount(config.LogDir, filepath.Join(chroot, config.LogDir), 0); err != nil {
+			return err
+		}
+	}
+
+	if config.CgroupParent != "" {
+		leaf := filepath.Join(CgroupRoot, config.CgroupParent, config.JailID)
+		if err := bindMount(leaf, filepath.Join(chroot, jailCgroupDir), unix.MS_RDONLY); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bindMount(src, dst string, flags uintptr) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %w", dst, err)
+	}
+	if err := unix.Mount(src, dst, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %w", src, err)
+	}
+	// the read-only flag only takes on a remount
+	if flags != 0 {
+		if err := unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|flags, ""); err != nil {
+			return fmt.Errorf("failed to remount %s: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+// jailFiles creates the device nodes and hands the files at the top of the
+// chroot to the jailed user: kiln rewrites its config and firecracker opens
+// the disks
+func jailFiles(chroot string, uid, gid int) error {
+	for _, dev := range jailDevices {
+		path := filepath.Join(chroot, dev.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+		}
+		err := unix.Mknod(path, unix.S_IFCHR|dev.mode, int(unix.Mkdev(dev.major, dev.minor)))
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create /%s: %w", dev.path, err)
+		}
+		// mknod is subject to the umask
+		if err := os.Chmod(path, os.FileMode(dev.mode)); err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown /%s: %w", dev.path, err)
+		}
+	}
+
+	entries, err := os.ReadDir(chroot)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		// binaries stay root's so the jailed user can't swap them
+		if info.Mode().Perm()&0o111 != 0 {
+			continue
+		}
+		if err := os.Chown(filepath.Join(chroot, entry.Name()), uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package kiln_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	// the main thread isn't ended by a goroutine that exits locked to it, the
+	// tests below need theirs to go
+	runtime.LockOSThread()
+}
+
+// TestFirecrackerCommand tests that jailed firecracker is the init of its own
+// PID namespace and that it goes down along with what it started once kiln's
+// thread exits.
+func TestFirecrackerCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	var (
+		started = make(chan *exec.Cmd)
+		failed  = make(chan error)
+		release = make(chan struct{})
+	)
+	go func() {
+		// the thread stands in for kiln and exits with the goroutine
+		runtime.LockOSThread()
+
+		script := "sleep 60 & echo $$ > " + filepath.Join(dir, "pid") + "; wait"
+		cmd := kiln.FirecrackerCommand("/bin/sh", true, "-c", script)
+		if err := cmd.Start(); err != nil {
+			failed <- err
+			return
+		}
+		started <- cmd
+		<-release
+	}()
+
+	var cmd *exec.Cmd
+	select {
+	case cmd = <-started:
+	case err := <-failed:
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("creating PID namespaces needs root")
+		}
+		require.NoError(t, err)
+	}
+
+	var child int
+	require.Eventually(t, func() bool {
+		children, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", cmd.Process.Pid, cmd.Process.Pid))
+		if err != nil || len(strings.Fields(string(children))) == 0 {
+			return false
+		}
+		child, err = strconv.Atoi(strings.Fields(string(children))[0])
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		pid, err := os.ReadFile(filepath.Join(dir, "pid"))
+		return err == nil && len(pid) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	pid, err := os.ReadFile(filepath.Join(dir, "pid"))
+	require.NoError(t, err)
+	assert.Equal(t, "1\n", string(pid), "firecracker is the namespace's init")
+
+	// kiln exits
+	close(release)
+
+	exited := make(chan error)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("firecracker outlived kiln")
+	}
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(fmt.Sprintf("/proc/%d", child))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond, "what firecracker started outlived it")
+}
+
+// TestJailNetwork tests that the TAP device is moved from the host's network
+// namespace into the jail's and brought up there.
+func TestJailNetwork(t *testing.T) {
+	const name = "vmjailtest"
+
+	tap := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}, Mode: netlink.TUNTAP_MODE_TAP}
+	err := netlink.LinkAdd(tap)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("creating TAP devices needs root")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if link, err := netlink.LinkByName(name); err == nil {
+			netlink.LinkDel(link)
+		}
+	})
+
+	type jailed struct {
+		up  bool
+		err error
+	}
+	done := make(chan jailed)
+	go func() {
+		// the thread is left in the jail's namespace and exits with the goroutine
+		runtime.LockOSThread()
+
+		if err := kiln.JailNetwork([]string{name}); err != nil {
+			done <- jailed{err: err}
+			return
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			done <- jailed{err: err}
+			return
+		}
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			done <- jailed{err: err}
+			return
+		}
+		done <- jailed{up: link.Attrs().Flags&net.FlagUp != 0 && lo.Attrs().Flags&net.FlagUp != 0}
+	}()
+
+	got := <-done
+	require.NoError(t, got.err)
+	assert.True(t, got.up, "the tap device and loopback are up in the jail")
+
+	_, err = netlink.LinkByName(name)
+	assert.ErrorAs(t, err, new(netlink.LinkNotFoundError), "the tap device left the host")
+}
+
+// TestJailFiles tests that the jail gets its device nodes and that the jailed
+// user owns the chroot's files but not its binaries.
+func TestJailFiles(t *testing.T) {
+	chroot := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(chroot, "kiln.json"), []byte("{}"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(chroot, "kiln"), []byte("#!/bin/sh\n"), 0o755))
+
+	err := kiln.JailFiles(chroot, 123, 456)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("creating device nodes needs root")
+	}
+	require.NoError(t, err)
+
+	stat := func(name string) unix.Stat_t {
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat(filepath.Join(chroot, name), &st))
+		return st
+	}
+
+	kvm := stat("dev/kvm")
+	assert.Equal(t, uint32(unix.S_IFCHR), kvm.Mode&unix.S_IFMT)
+	assert.Equal(t, unix.Mkdev(10, 232), uint64(kvm.Rdev))
+	assert.Equal(t, uint32(0o660), kvm.Mode&0o777, "the umask doesn't apply")
+	assert.Equal(t, uint32(123), kvm.Uid)
+	assert.Equal(t, uint32(456), kvm.Gid)
+
+	assert.Equal(t, uint32(123), stat("kiln.json").Uid)
+	assert.Equal(t, uint32(0), stat("kiln").Uid, "the jailed user can't replace kiln")
+
+	// a restart jails the same chroot again
+	require.NoError(t, kiln.JailFiles(chroot, 123, 456))
+}
@@ -13,12 +13,14 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rugwirobaker/inferno/internal/command"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
 	"github.com/rugwirobaker/inferno/internal/flag"
 	"github.com/rugwirobaker/inferno/internal/iostreams"
 	"github.com/rugwirobaker/inferno/internal/pointer"
@@ -76,6 +78,10 @@ func New() *cobra.Command {
 			Description: "Memory limit in MB (cgroups)",
 			Default:     0,
 		},
+		flag.String{
+			Name:        "cgroup-parent",
+			Description: "Cgroup v2 parent to create the VM's cgroup in, kiln doesn't manage cgroups without it",
+		},
 		flag.String{
 			Name:        "chroot-base-dir",
 			Description: " represents the base folder where chroot jails are built.",
@@ -86,6 +92,12 @@ func New() *cobra.Command {
 			Description: "Hijacks the command flow to generate a kiln.json file for testing",
 		},
 
+		flag.Bool{
+			Name:        "jailed",
+			Description: "Set by kiln jail, the cgroup and namespaces are already set up",
+			Hidden:      true,
+		},
+
 		flag.String{Name: "start-time-us", Description: "Firecracker start time (jailer passthrough)"},
 		flag.String{Name: "start-time-cpu-us", Description: "Firecracker parent CPU start time (jailer passthrough)"},
 		flag.String{Name: "parent-cpu-time-us", Description: "Firecracker parent CPU time us (jailer passthrough)"},
@@ -93,6 +105,8 @@ func New() *cobra.Command {
 		flag.String{Name: "api-sock", Description: "Firecracker API socket path (jailer passthrough)"},
 	)
 
+	cmd.AddCommand(newJailCommand())
+
 	return cmd
 }
 
@@ -111,7 +125,7 @@ func run(ctx context.Context) error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 
-	config, err := configFromFile("./kiln.json")
+	config, err := ReadConfig("./kiln.json")
 	if err != nil {
 		slog.Error("Failed to load kiln config", "error", err)
 		return err
@@ -132,6 +146,11 @@ func run(ctx context.Context) error {
 		return err
 	}
 
+	var vmID = config.JailID
+
+	// some clean tasks to run at the end
+	var finalizers []FinalizerFunc
+
 	// Write PID file for process management
 	pid := os.Getpid()
 	pidFile := "kiln.pid"
@@ -140,17 +159,88 @@ func run(ctx context.Context) error {
 		// Don't fail - this is not critical
 	}
 
-	var vmID = config.JailID
+	// Clean up PID file on exit
+	finalizers = append(finalizers, func() error {
+		os.Remove(pidFile)
+		return nil
+	})
+
+	ctrl := newController(vmID, firecracker.NewClient(config.FirecrackerSocketPath), config.FirecrackerConfigPath)
+	ctrl.rateLimits = config.RateLimits
+	ctrl.memoryMB = config.Resources.MemoryMB
+	ctrl.metadata = config.Metadata
+	if config.Heartbeat != nil {
+		ctrl.health = &Health{Healthy: true}
+	}
+	if config.Balloon != nil {
+		ctrl.balloon = &BalloonStatus{}
+	}
+
+	// without a cgroup parent whatever launched kiln is responsible for limits
+	switch {
+	case config.CgroupParent != "" && flag.GetBool(ctx, "jailed"):
+		// kiln jail joined the cgroup and mounted it for us
+		ctrl.cgroup = openCgroup("/"+jailCgroupDir, filepath.Join(config.CgroupParent, config.JailID))
+	case config.CgroupParent != "":
+		cgroup, err := joinCgroup(config)
+		if err != nil {
+			slog.Error("Failed to set up cgroup", "error", err)
+			return err
+		}
+		ctrl.cgroup = cgroup
+
+		finalizers = append(finalizers, func() error {
+			slog.Info("Removing cgroup", "cgroup", cgroup.Path())
+			return cgroup.Remove()
+		})
+	}
+
+	// the guest's serial console, kept apart from kiln's own log
+	consoleLog := &lumberjack.Logger{
+		Filename:   filepath.Join(config.LogDir, "console", logFilename(config)+".log"),
+		MaxSize:    config.LogRotation.MaxSizeMB,
+		MaxBackups: config.LogRotation.MaxFiles,
+		MaxAge:     config.LogRotation.MaxAgeDays,
+		Compress:   config.LogRotation.Compress,
+	}
+	defer consoleLog.Close()
+
+	console := NewConsole(consoleLog, ConsoleBufferLines)
+	ctrl.console = console
+
+	controlServer, err := serveControl(config, ctrl)
+	if err != nil {
+		slog.Error("Failed to start control socket", "error", err)
+		return err
+	}
+	finalizers = append(finalizers, func() error {
+		slog.Info("Stopping control server")
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		defer os.Remove(config.ControlSocketPath)
+		return controlServer.Shutdown(ctx)
+	})
 
 	slog.Info("Running Firecracker", "vmID", vmID)
 
+	// firecracker refuses to start over sockets left behind by a previous run
+	for _, path := range []string{config.FirecrackerSocketPath, config.FirecrackerVsockUDSPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed to remove stale socket", "path", path, "error", err)
+			return err
+		}
+	}
+
 	// Prepare arguments for Firecracker execution
 	args := []string{
 		"--id", vmID,
 		"--api-sock", config.FirecrackerSocketPath,
-		"--config-file", config.FirecrackerConfigPath,
 		// "--level", "Debug",
 	}
+	// a restored VM is configured by the snapshot, not the config file
+	if config.Restore == nil {
+		args = append(args, "--config-file", config.FirecrackerConfigPath)
+	}
 
 	if v := flag.GetString(ctx, "start-time-us"); v != "" {
 		args = append(args, "--start-time-us", v)
@@ -167,29 +257,23 @@ func run(ctx context.Context) error {
 
 	slog.Debug("Firecracker arguments", "args", args)
 
-	// Start Firecracker using exec.Command
-	cmd := exec.Command("/firecracker", args...)
-	// cmd.Dir = chroot // Ensure we run Firecracker within the chroot directory
+	cmd := firecrackerCommand("/firecracker", flag.GetBool(ctx, "jailed"), args...)
 
-	// Set output to stdout/stderr for logging
-	stdoutReader, stdoutWriter := io.Pipe()
-	stderrReader, stderrWriter := io.Pipe()
-
-	cmd.Stdout = stdoutWriter
-	cmd.Stderr = stderrWriter
-
-	// Stream Firecracker stdout/stderr as JSON logs to inferno.log
-	go streamFirecrackerLogs(stdoutReader, "stdout")
-	go streamFirecrackerLogs(stderrReader, "stderr")
+	// stdout carries the guest's serial console along with firecracker's
+	// logs, the pipes are closed once firecracker exits
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		slog.Error("Failed to create stdout pipe", "error", err)
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		slog.Error("Failed to create stderr pipe", "error", err)
+		return err
+	}
 
-	// some clean tasks to run at the end
-	var finalizers []FinalizerFunc
-
-	// Clean up PID file on exit
-	finalizers = append(finalizers, func() error {
-		os.Remove(pidFile)
-		return nil
-	})
+	go console.Stream(stdout)
+	go streamFirecrackerLogs(stderr, "stderr")
 
 	vsockExitPath := fmt.Sprintf("%s_%d", config.FirecrackerVsockUDSPath, config.VsockExitPort)
 	exitListener, err := vsock.NewVsockUnixListener(vsockExitPath)
@@ -201,27 +285,28 @@ func run(ctx context.Context) error {
 
 	exitStatusChan := make(chan InitExitStatus)
 
-	// Start the server that handles exit status requests
+	// Start the server that handles exit status requests, finalizers are
+	// registered before the goroutines start so the exits see all of them
+	exitMux := http.NewServeMux()
+	exitMux.HandleFunc("/exit", ExitStatusHandler(exitStatusChan))
+	exitMux.HandleFunc("POST /boot-failure", ctrl.handleBootFailure)
+	exitServer := &http.Server{
+		Handler:      exitMux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+	finalizers = append(finalizers, func() error {
+		slog.Info("Stopping vsock server")
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return exitServer.Shutdown(ctx)
+	})
+
 	go func() {
 		slog.Info("Serving exit status on vsock")
 
-		mux := http.NewServeMux()
-		mux.HandleFunc("/exit", ExitStatusHandler(exitStatusChan))
-		server := &http.Server{
-			Handler:      mux,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
-			IdleTimeout:  120 * time.Second,
-		}
-
-		finalizers = append(finalizers, func() error {
-			slog.Info("Stopping vsock server")
-			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			defer cancel()
-			return server.Shutdown(ctx)
-		})
-
-		if err := server.Serve(exitListener); err != nil && err != http.ErrServerClosed {
+		if err := exitServer.Serve(exitListener); err != nil && err != http.ErrServerClosed {
 			slog.Error("Error serving exit status", "error", err)
 		}
 	}()
@@ -233,42 +318,34 @@ func run(ctx context.Context) error {
 		return err
 	}
 
-	// Start the server that handles logs
-	go func() {
-		slog.Info("Serving logs on vsock")
-
-		ctx, cancel := context.WithCancel(ctx)
-		defer cancel()
+	// Create log file writer with rotation using lumberjack
+	vmLogFile := &lumberjack.Logger{
+		Filename:   filepath.Join(config.LogDir, "vm", logFilename(config)+".log"),
+		MaxSize:    config.LogRotation.MaxSizeMB,
+		MaxBackups: config.LogRotation.MaxFiles,
+		MaxAge:     config.LogRotation.MaxAgeDays,
+		Compress:   config.LogRotation.Compress,
+	}
 
-		// Create log file writer with rotation using lumberjack
-		// Use MachineID for filename if available, otherwise fall back to JailID
-		logFilename := config.MachineID
-		if logFilename == "" {
-			logFilename = config.JailID
-		}
-		vmLogFile := &lumberjack.Logger{
-			Filename:   filepath.Join(config.LogDir, "vm", logFilename+".log"),
-			MaxSize:    config.LogRotation.MaxSizeMB,
-			MaxBackups: config.LogRotation.MaxFiles,
-			MaxAge:     config.LogRotation.MaxAgeDays,
-			Compress:   config.LogRotation.Compress,
-		}
+	// Create WriterFactory that returns the lumberjack logger
+	factory := func(ctx context.Context) (io.WriteCloser, error) {
+		return vmLogFile, nil
+	}
 
-		// Create WriterFactory that returns the lumberjack logger
-		factory := func(ctx context.Context) (io.WriteCloser, error) {
-			return vmLogFile, nil
-		}
+	logSink, err := vm.NewLogSink(ctx, factory)
+	if err != nil {
+		slog.Error("Failed to create log sink", "error", err)
+		return err
+	}
+	// add a finalizer to close the log sink
+	finalizers = append(finalizers, func() error {
+		logSink.Close()
+		return nil
+	})
 
-		logSink, err := vm.NewLogSink(ctx, factory)
-		if err != nil {
-			slog.Error("Failed to create log sink", "error", err)
-			return
-		}
-		// add a finalizer to close the log sink
-		finalizers = append(finalizers, func() error {
-			logSink.Close()
-			return nil
-		})
+	// Start the server that handles logs
+	go func() {
+		slog.Info("Serving logs on vsock")
 
 		for {
 			conn, err := logListener.Accept()
@@ -278,12 +355,26 @@ func run(ctx context.Context) error {
 			}
 			slog.Debug("Accepted connection", "conn", conn)
 
+			// init connects to stream the guest's output as soon as it starts
+			ctrl.booted()
+
 			go func() {
 				handleVMLogs(conn, logSink)
 			}()
 		}
 	}()
 
+	if config.Heartbeat != nil {
+		heartbeatListener, err := vsock.NewVsockUnixListener(heartbeatSocket(config))
+		if err != nil {
+			slog.Error("Failed to start heartbeat vsock listener", "error", err)
+			return err
+		}
+		defer heartbeatListener.Close()
+
+		go ctrl.serveHeartbeats(heartbeatListener)
+	}
+
 	// Start the server that handles encryption key requests (port 10003)
 	// Only start if volumes are configured (indicating encrypted volumes may be present)
 	if len(config.Volumes) > 0 {
@@ -295,31 +386,35 @@ func run(ctx context.Context) error {
 		}
 		defer keyListener.Close()
 
+		keyMux := http.NewServeMux()
+		keyMux.HandleFunc("/v1/volume/key", KeyRequestHandler(config))
+		keyServer := &http.Server{
+			Handler:      keyMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		}
+		finalizers = append(finalizers, func() error {
+			slog.Info("Stopping key vsock server")
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			return keyServer.Shutdown(ctx)
+		})
+
 		go func() {
 			slog.Info("Serving encryption keys on vsock", "port", vsock.VsockKeyPort)
 
-			mux := http.NewServeMux()
-			mux.HandleFunc("/v1/volume/key", KeyRequestHandler(config))
-			server := &http.Server{
-				Handler:      mux,
-				ReadTimeout:  5 * time.Second,
-				WriteTimeout: 10 * time.Second,
-				IdleTimeout:  120 * time.Second,
-			}
-
-			finalizers = append(finalizers, func() error {
-				slog.Info("Stopping key vsock server")
-				ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-				defer cancel()
-				return server.Shutdown(ctx)
-			})
-
-			if err := server.Serve(keyListener); err != nil && err != http.ErrServerClosed {
+			if err := keyServer.Serve(keyListener); err != nil && err != http.ErrServerClosed {
 				slog.Error("Error serving encryption keys", "error", err)
 			}
 		}()
 	}
 
+	// the parent death signal fires when the thread that forked firecracker
+	// exits, keep it around for as long as kiln runs
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
 	// Run the Firecracker process
 	if err := cmd.Start(); err != nil {
 		slog.Error("Failed to run Firecracker", "error", err)
@@ -328,6 +423,7 @@ func run(ctx context.Context) error {
 
 	// Wait for the Firecracker process to complete
 	ps := cmd.Process
+	ctrl.started(ps.Pid)
 	waitErr := make(chan error)
 	waitState := make(chan *os.ProcessState)
 	go func() {
@@ -341,14 +437,101 @@ func run(ctx context.Context) error {
 
 	kilnExitStatus := KilnExitStatus{}
 
+	recordTimings := func() {
+		startedAt, bootedAt := ctrl.timings()
+		exitedAt := time.Now().UTC()
+		kilnExitStatus.StartedAt = &startedAt
+		kilnExitStatus.BootedAt = bootedAt
+		kilnExitStatus.ExitedAt = &exitedAt
+	}
+	// only the first request explains the stop, later ones escalate it
+	requestStop := func(req StopRequest) {
+		if kilnExitStatus.StopRequest == nil {
+			req.At = time.Now().UTC()
+			kilnExitStatus.StopRequest = &req
+		}
+	}
+
+	if config.Balloon != nil {
+		pollCtx, stopPolling := context.WithCancel(ctx)
+		defer stopPolling()
+		go ctrl.pollBalloon(pollCtx, config.Balloon.interval())
+	}
+	if config.Heartbeat != nil {
+		monitorCtx, stopMonitor := context.WithCancel(ctx)
+		defer stopMonitor()
+		go ctrl.monitorHeartbeats(monitorCtx, *config.Heartbeat)
+	}
+
+	if config.Restore != nil {
+		if err := restoreSnapshot(ctx, ctrl.firecracker, config.Restore); err != nil {
+			slog.Error("Failed to restore snapshot", "error", err)
+			ps.Kill()
+			select {
+			case <-waitState:
+			case <-waitErr:
+			}
+			recordTimings()
+			kilnExitStatus.VMError = pointer.String(fmt.Sprintf("failed to restore snapshot: %v", err))
+			return finalize(config, kilnExitStatus, finalizers...)
+		}
+		slog.Info("Snapshot restored")
+		// the guest is running off the restored disk now
+		ctrl.booted()
+
+		config.Restore = nil
+		err := UpdateConfig("kiln.json", func(config *Config) error {
+			config.Restore = nil
+			return nil
+		})
+		if err != nil {
+			slog.Warn("Failed to clear restore from kiln config", "error", err)
+		}
+	}
+
+	// the guest retries until the document shows up
+	if err := ctrl.publishMetadata(ctx); err != nil {
+		slog.Warn("Failed to publish metadata", "error", err)
+	}
+
+	guest := vsock.NewGuestClientAt(config.FirecrackerVsockUDSPath, vsock.VsockAPIPort)
+	stop := newStopper(config.Stop, ctrl.firecracker, guest, ps)
+
+	// vmExited records the steps taken to stop the VM once firecracker is gone
+	vmExited := func() {
+		stop.vmDone()
+		recordTimings()
+		kilnExitStatus.StopSteps = stop.Steps()
+		kilnExitStatus.Health = ctrl.unhealthy()
+
+		// a panic is usually the last thing the guest printed
+		console.drain(consoleDrainTimeout)
+		kilnExitStatus.Fault = console.Fault()
+		kilnExitStatus.BootFailure = ctrl.failedBoot()
+
+		if ctrl.cgroup != nil {
+			killed, err := ctrl.cgroup.OOMKilled()
+			if err != nil {
+				slog.Warn("Failed to read cgroup memory events", "error", err)
+			} else {
+				kilnExitStatus.CgroupOOM = pointer.Bool(killed)
+			}
+		}
+	}
+
 	for {
 
 		select {
 		case sig := <-sigChan: // we received a signal
-			slog.Info("Relaying signal to Firecracker", "signal", sig)
-			if err := ps.Signal(sig); err != nil {
-				slog.Error("Failed to stop Firecracker", "error", err)
-			}
+			ctrl.setState(StateStopping)
+			slog.Info("Stopping VM", "signal", sig)
+			requestStop(StopRequest{Source: StopSourceSignal, Signal: int(sig.(syscall.Signal))})
+			stop.stop(ctx, sig.(syscall.Signal), false)
+		case req := <-ctrl.shutdown: // shutdown requested over the control socket
+			ctrl.setState(StateStopping)
+			slog.Info("Stopping VM", "reason", req.Reason, "signal", req.Signal, "force", req.Force)
+			requestStop(StopRequest{Source: StopSourceControl, Signal: int(req.signal()), Reason: req.Reason, Force: req.Force})
+			stop.stop(ctx, req.signal(), req.Force)
 		case exitStatus := <-exitStatusChan: // the main process has exited
 			slog.Info("Received exit status", "exitCode", exitStatus.ExitCode, "oomKilled", exitStatus.OOMKilled, "message", exitStatus.Message)
 
@@ -356,13 +539,20 @@ func run(ctx context.Context) error {
 			kilnExitStatus.OOMKilled = pointer.Bool(exitStatus.OOMKilled)
 			kilnExitStatus.Error = pointer.String(exitStatus.Message)
 			kilnExitStatus.Signal = pointer.Int64(int64(exitStatus.Signal))
+			stop.guestDone()
 
 		case err := <-waitErr: // firecracker process failed
 			slog.Error("Firecracker execution failed", "error", err)
+			vmExited()
 			kilnExitStatus.VMError = pointer.String(err.Error())
-			return finalize(config, kilnExitStatus)
+			return finalize(config, kilnExitStatus, finalizers...)
 
 		case state := <-waitState: // firecracker process completed
+			vmExited()
+			if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				slog.Error("Firecracker was killed", "pid", state.Pid(), "signal", ws.Signal())
+				kilnExitStatus.VMSignal = pointer.Int64(int64(ws.Signal()))
+			}
 			if !state.Success() {
 				slog.Error("Firecracker execution failed", "pid", state.Pid(), "exitCode", state.ExitCode())
 				kilnExitStatus.VMExitCode = pointer.Int64(int64(state.ExitCode()))
@@ -376,6 +566,39 @@ func run(ctx context.Context) error {
 	}
 }
 
+// serveControl starts the control API on the control socket
+func serveControl(config *Config, ctrl *controller) (*http.Server, error) {
+	// a previous kiln may have left its socket behind
+	if err := os.Remove(config.ControlSocketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", config.ControlSocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(config.ControlSocketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to chmod control socket: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:      ctrl.handler(),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Serving control API", "socket", config.ControlSocketPath)
+
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Error serving control API", "error", err)
+		}
+	}()
+	return server, nil
+}
+
 func handleVMLogs(src net.Conn, logSink *vm.LogSink) {
 	defer src.Close()
 
@@ -421,6 +644,14 @@ func handleVMLogs(src net.Conn, logSink *vm.LogSink) {
 	}
 }
 
+// logFilename names the VM's log files, by machine name when it has one
+func logFilename(config *Config) string {
+	if config.MachineID != "" {
+		return config.MachineID
+	}
+	return config.JailID
+}
+
 // streamFirecrackerLogs reads from a Firecracker stdout/stderr pipe and logs each line
 // using slog with source="firecracker". Since slog is configured to write to inferno.log,
 // this effectively sends Firecracker logs to the infrastructure log file.
@@ -496,3 +727,18 @@ func initConfig(ctx context.Context, configPath string) (err error) {
 
 	return
 }
+
+// firecrackerCommand prepares firecracker so that it can't outlive kiln, the
+// server would otherwise start a second VM on the same chroot and TAP device.
+// Under kiln jail it's the init of a PID namespace of its own, the kernel
+// kills whatever it started along with it. kiln is unprivileged there, the
+// PID namespace comes with a user namespace that maps no one: firecracker
+// keeps kiln's user on the host and has no capabilities in either.
+func firecrackerCommand(bin string, jailed bool, args ...string) *exec.Cmd {
+	cmd := exec.Command(bin, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	if jailed {
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID
+	}
+	return cmd
+}
@@ -0,0 +1,75 @@
+package kiln
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/rugwirobaker/inferno/internal/mmds"
+)
+
+// publishMetadata pushes the metadata document to firecracker's metadata service
+func (c *controller) publishMetadata(ctx context.Context) error {
+	c.mu.Lock()
+	md := c.metadata
+	c.mu.Unlock()
+
+	if md == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, restoreAPITimeout)
+	defer cancel()
+
+	if err := waitForAPI(ctx, c.firecracker, restoreAPITimeout); err != nil {
+		return err
+	}
+	if err := c.firecracker.PutMMDS(ctx, md); err != nil {
+		return fmt.Errorf("failed to publish metadata: %w", err)
+	}
+	return nil
+}
+
+func (c *controller) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	var md mmds.Metadata
+	if err := json.NewDecoder(r.Body).Decode(&md); err != nil {
+		writeControlError(w, http.StatusBadRequest, "invalid metadata")
+		return
+	}
+
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+
+	if state == StateStopping {
+		writeControlError(w, http.StatusConflict, "vm is "+string(state))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	if err := c.firecracker.PutMMDS(ctx, &md); err != nil {
+		slog.Error("Failed to update metadata", "error", err)
+		writeControlError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.metadata = &md
+	c.mu.Unlock()
+
+	// the next start publishes the same document
+	err := UpdateConfig("kiln.json", func(config *Config) error {
+		config.Metadata = &md
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Failed to persist metadata", "error", err)
+	}
+
+	slog.Info("Metadata updated")
+	writeControlJSON(w, http.StatusOK, c.status())
+}
@@ -0,0 +1,164 @@
+package kiln
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+)
+
+// NetworkIfaceID is the firecracker network interface backing the guest's eth0
+const NetworkIfaceID = "eth0"
+
+// RateLimits throttles the VM's root drive and network interface. A nil
+// limiter leaves the device unthrottled, or unchanged in an update.
+type RateLimits struct {
+	Drive     *firecracker.RateLimiter `json:"drive,omitempty"`
+	NetworkRx *firecracker.RateLimiter `json:"network_rx,omitempty"`
+	NetworkTx *firecracker.RateLimiter `json:"network_tx,omitempty"`
+}
+
+func (l *RateLimits) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.Drive.Validate(); err != nil {
+		return fmt.Errorf("drive rate limiter: %w", err)
+	}
+	if err := l.NetworkRx.Validate(); err != nil {
+		return fmt.Errorf("network rx rate limiter: %w", err)
+	}
+	if err := l.NetworkTx.Validate(); err != nil {
+		return fmt.Errorf("network tx rate limiter: %w", err)
+	}
+	return nil
+}
+
+// Merge returns l with the limiters set in update replacing its own
+func (l *RateLimits) Merge(update RateLimits) *RateLimits {
+	var merged RateLimits
+	if l != nil {
+		merged = *l
+	}
+	if update.Drive != nil {
+		merged.Drive = update.Drive
+	}
+	if update.NetworkRx != nil {
+		merged.NetworkRx = update.NetworkRx
+	}
+	if update.NetworkTx != nil {
+		merged.NetworkTx = update.NetworkTx
+	}
+	return &merged
+}
+
+// ApplyTo sets the limiters on the root drive and network interface of cfg
+func (l *RateLimits) ApplyTo(cfg *firecracker.Config) {
+	if l == nil {
+		return
+	}
+	for i := range cfg.Drives {
+		if cfg.Drives[i].DriveID == RootFSDriveID && l.Drive != nil {
+			cfg.Drives[i].RateLimiter = l.Drive
+		}
+	}
+	for i := range cfg.NetworkInterfaces {
+		if cfg.NetworkInterfaces[i].IfaceID != NetworkIfaceID {
+			continue
+		}
+		if l.NetworkRx != nil {
+			cfg.NetworkInterfaces[i].RxRateLimiter = l.NetworkRx
+		}
+		if l.NetworkTx != nil {
+			cfg.NetworkInterfaces[i].TxRateLimiter = l.NetworkTx
+		}
+	}
+}
+
+func (c *controller) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	var update RateLimits
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeControlError(w, http.StatusBadRequest, "invalid rate limits")
+		return
+	}
+	if err := update.Validate(); err != nil {
+		writeControlError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+
+	// firecracker only patches devices of a started VM
+	if state != StateRunning && state != StatePaused {
+		writeControlError(w, http.StatusConflict, "vm is "+string(state))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	if err := c.patchRateLimits(ctx, update); err != nil {
+		slog.Error("Failed to update rate limits", "error", err)
+		writeControlError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.rateLimits = c.rateLimits.Merge(update)
+	limits := c.rateLimits
+	c.mu.Unlock()
+
+	// a cold restart picks up where the live update left off
+	if err := c.persistRateLimits(limits); err != nil {
+		slog.Warn("Failed to persist rate limits", "error", err)
+	}
+
+	slog.Info("Rate limits updated")
+	writeControlJSON(w, http.StatusOK, c.status())
+}
+
+func (c *controller) patchRateLimits(ctx context.Context, update RateLimits) error {
+	if update.Drive != nil {
+		err := c.firecracker.PatchDrive(ctx, &firecracker.PartialDrive{
+			DriveID:     RootFSDriveID,
+			RateLimiter: update.Drive,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update drive: %w", err)
+		}
+	}
+	if update.NetworkRx != nil || update.NetworkTx != nil {
+		err := c.firecracker.PatchNetworkInterface(ctx, &firecracker.PartialNetworkInterface{
+			IfaceID:       NetworkIfaceID,
+			RxRateLimiter: update.NetworkRx,
+			TxRateLimiter: update.NetworkTx,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update network interface: %w", err)
+		}
+	}
+	return nil
+}
+
+// persistRateLimits records the limits in kiln.json and the firecracker config
+func (c *controller) persistRateLimits(limits *RateLimits) error {
+	err := UpdateConfig("kiln.json", func(config *Config) error {
+		config.RateLimits = limits
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fcConfig, err := firecracker.ReadConfig(c.fcConfigPath)
+	if err != nil {
+		return err
+	}
+	limits.ApplyTo(fcConfig)
+	return firecracker.WriteConfig(c.fcConfigPath, fcConfig)
+}
@@ -0,0 +1,53 @@
+package kiln_test
+
+import (
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimitsApplyTo tests that the limiters land on the root drive and eth0 only.
+func TestRateLimitsApplyTo(t *testing.T) {
+	var (
+		disk = firecracker.NewRateLimiter(10<<20, 500)
+		rx   = firecracker.NewRateLimiter(1<<20, 0)
+		cfg  = &firecracker.Config{
+			Drives: []firecracker.Drive{
+				{DriveID: kiln.RootFSDriveID},
+				{DriveID: "data"},
+			},
+			NetworkInterfaces: []firecracker.NetworkInterface{
+				{IfaceID: kiln.NetworkIfaceID},
+			},
+		}
+	)
+
+	limits := &kiln.RateLimits{Drive: disk, NetworkRx: rx}
+	limits.ApplyTo(cfg)
+
+	assert.Equal(t, disk, cfg.Drives[0].RateLimiter)
+	assert.Nil(t, cfg.Drives[1].RateLimiter)
+	assert.Equal(t, rx, cfg.NetworkInterfaces[0].RxRateLimiter)
+	assert.Nil(t, cfg.NetworkInterfaces[0].TxRateLimiter)
+}
+
+// TestRateLimitsMerge tests that an update only replaces the limiters it sets.
+func TestRateLimitsMerge(t *testing.T) {
+	var (
+		disk = firecracker.NewRateLimiter(10<<20, 500)
+		nic  = firecracker.NewRateLimiter(1<<20, 0)
+	)
+
+	var current *kiln.RateLimits
+	merged := current.Merge(kiln.RateLimits{Drive: disk})
+	assert.Equal(t, &kiln.RateLimits{Drive: disk}, merged)
+
+	merged = merged.Merge(kiln.RateLimits{NetworkTx: nic})
+	assert.Equal(t, &kiln.RateLimits{Drive: disk, NetworkTx: nic}, merged)
+
+	bad := &kiln.RateLimits{Drive: &firecracker.RateLimiter{Ops: &firecracker.TokenBucket{Size: -1}}}
+	assert.Error(t, bad.Validate())
+	assert.NoError(t, merged.Validate())
+}
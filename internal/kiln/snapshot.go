@@ -0,0 +1,261 @@
+package kiln
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/sys"
+)
+
+// Files written into a snapshot directory
+const (
+	SnapshotStateFile  = "vmstate"
+	SnapshotMemoryFile = "memory"
+	SnapshotRootFSFile = "rootfs.ext4"
+	SnapshotInitrdFile = "initrd.img"
+	SnapshotConfigFile = "firecracker.json"
+)
+
+// RootFSDriveID is the firecracker drive holding the VM's root filesystem
+const RootFSDriveID = "rootfs"
+
+const (
+	// snapshotTimeout bounds writing the memory file, which may be large
+	snapshotTimeout = 5 * time.Minute
+	// restoreAPITimeout is how long firecracker gets to open its API socket
+	restoreAPITimeout = 5 * time.Second
+)
+
+// SnapshotRequest asks kiln to snapshot the VM into Dir, relative to the chroot
+type SnapshotRequest struct {
+	Type firecracker.SnapshotType `json:"type,omitempty"` // Full by default
+	Dir  string                   `json:"dir"`
+}
+
+// SnapshotResult describes a snapshot kiln wrote
+type SnapshotResult struct {
+	Type               firecracker.SnapshotType  `json:"type"`
+	Dir                string                    `json:"dir"`
+	FirecrackerVersion string                    `json:"firecracker_version"`
+	MachineConfig      firecracker.MachineConfig `json:"machine_config"`
+	CreatedAt          time.Time                 `json:"created_at"`
+	// PausedMS is how long the guest was paused for the snapshot
+	PausedMS int64 `json:"paused_ms"`
+}
+
+// RestoreConfig makes kiln load a snapshot instead of booting the VM from
+// its firecracker config. Paths are relative to the chroot.
+type RestoreConfig struct {
+	StatePath        string                        `json:"state_path"`
+	MemoryPath       string                        `json:"memory_path"`
+	TrackDirtyPages  bool                          `json:"track_dirty_pages,omitempty"`
+	NetworkOverrides []firecracker.NetworkOverride `json:"network_overrides,omitempty"`
+}
+
+func (r SnapshotRequest) validate() error {
+	switch r.Type {
+	case "", firecracker.SnapshotFull, firecracker.SnapshotDiff:
+	default:
+		return fmt.Errorf("unknown snapshot type %q", r.Type)
+	}
+	if r.Dir == "" || filepath.IsAbs(r.Dir) || strings.HasPrefix(filepath.Clean(r.Dir), "..") {
+		return fmt.Errorf("snapshot dir must be relative to the chroot")
+	}
+	return nil
+}
+
+func (c *controller) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, "invalid snapshot request")
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeControlError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Type == "" {
+		req.Type = firecracker.SnapshotFull
+	}
+
+	c.mu.Lock()
+	state := c.state
+	busy := c.snapshotting
+	if (state == StateRunning || state == StatePaused) && !busy {
+		c.snapshotting = true
+	}
+	c.mu.Unlock()
+
+	if busy {
+		writeControlError(w, http.StatusConflict, "a snapshot is already in progress")
+		return
+	}
+	if state != StateRunning && state != StatePaused {
+		writeControlError(w, http.StatusConflict, "vm is "+string(state))
+		return
+	}
+	defer func() {
+		c.mu.Lock()
+		c.snapshotting = false
+		c.mu.Unlock()
+	}()
+
+	// writing the memory file outlasts the control server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(snapshotTimeout))
+
+	result, err := c.snapshot(r.Context(), req, state == StateRunning)
+	if err != nil {
+		slog.Error("Failed to snapshot VM", "error", err)
+		writeControlError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	slog.Info("VM snapshotted", "type", result.Type, "dir", result.Dir, "paused", time.Duration(result.PausedMS)*time.Millisecond)
+	writeControlJSON(w, http.StatusCreated, result)
+}
+
+// snapshot writes the VM's device state, memory, disk and boot files into
+// req.Dir. A running VM is paused for the duration and resumed afterwards.
+func (c *controller) snapshot(ctx context.Context, req SnapshotRequest, running bool) (*SnapshotResult, error) {
+	cfg, err := firecracker.ReadConfig(c.fcConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if req.Type == firecracker.SnapshotDiff && !cfg.MachineConfig.TrackDirtyPages {
+		return nil, errors.New("diff snapshots need dirty page tracking")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	version, err := c.firecracker.Version(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get firecracker version: %w", err)
+	}
+
+	if err := os.MkdirAll(req.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+
+	pausedAt := time.Now()
+	if running {
+		if err := c.firecracker.Pause(ctx); err != nil {
+			return nil, fmt.Errorf("failed to pause VM: %w", err)
+		}
+		c.setState(StatePaused)
+
+		defer func() {
+			// resume even if the request went away, the guest must not stay frozen
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), controlRequestTimeout)
+			defer cancel()
+
+			if err := c.firecracker.Resume(ctx); err != nil {
+				slog.Error("Failed to resume VM after snapshot", "error", err)
+				return
+			}
+			c.setState(StateRunning)
+		}()
+	}
+
+	err = c.firecracker.CreateSnapshot(ctx, &firecracker.SnapshotCreateParams{
+		SnapshotType: req.Type,
+		SnapshotPath: filepath.Join(req.Dir, SnapshotStateFile),
+		MemFilePath:  filepath.Join(req.Dir, SnapshotMemoryFile),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	// the disk has to be copied while the guest can't write to it
+	if err := copySnapshotFiles(cfg, c.fcConfigPath, req.Dir); err != nil {
+		return nil, err
+	}
+
+	return &SnapshotResult{
+		Type:               req.Type,
+		Dir:                req.Dir,
+		FirecrackerVersion: version.FirecrackerVersion,
+		MachineConfig:      cfg.MachineConfig,
+		CreatedAt:          time.Now().UTC(),
+		PausedMS:           time.Since(pausedAt).Milliseconds(),
+	}, nil
+}
+
+// copySnapshotFiles copies the root drive, the initrd and the firecracker
+// config next to the snapshot so it can be restored into a fresh chroot
+func copySnapshotFiles(cfg *firecracker.Config, cfgPath, dir string) error {
+	copied := false
+	for _, drive := range cfg.Drives {
+		if drive.DriveID != RootFSDriveID {
+			continue
+		}
+		if err := sys.CopyFile(drive.PathOnHost, filepath.Join(dir, SnapshotRootFSFile), 0o644); err != nil {
+			return fmt.Errorf("failed to copy root drive: %w", err)
+		}
+		copied = true
+	}
+	if !copied {
+		return fmt.Errorf("no %q drive to snapshot", RootFSDriveID)
+	}
+	if cfg.BootSource.InitrdPath != nil {
+		if err := sys.CopyFile(*cfg.BootSource.InitrdPath, filepath.Join(dir, SnapshotInitrdFile), 0o644); err != nil {
+			return fmt.Errorf("failed to copy initrd: %w", err)
+		}
+	}
+	if err := sys.CopyFile(cfgPath, filepath.Join(dir, SnapshotConfigFile), 0o644); err != nil {
+		return fmt.Errorf("failed to copy firecracker config: %w", err)
+	}
+	return nil
+}
+
+// restoreSnapshot loads the snapshot into a freshly started firecracker and
+// resumes the guest
+func restoreSnapshot(ctx context.Context, fc *firecracker.Client, restore *RestoreConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	if err := waitForAPI(ctx, fc, restoreAPITimeout); err != nil {
+		return err
+	}
+
+	slog.Info("Loading snapshot", "state", restore.StatePath, "memory", restore.MemoryPath)
+
+	return fc.LoadSnapshot(ctx, &firecracker.SnapshotLoadParams{
+		SnapshotPath: restore.StatePath,
+		MemBackend: &firecracker.MemoryBackend{
+			BackendType: firecracker.MemoryBackendFile,
+			BackendPath: restore.MemoryPath,
+		},
+		EnableDiffSnapshots: restore.TrackDirtyPages,
+		ResumeVM:            true,
+		NetworkOverrides:    restore.NetworkOverrides,
+	})
+}
+
+// waitForAPI polls firecracker until its API answers
+func waitForAPI(ctx context.Context, fc *firecracker.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := fc.InstanceInfo(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("firecracker API not ready: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
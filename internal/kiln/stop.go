@@ -0,0 +1,238 @@
+package kiln
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+)
+
+const (
+	defaultStopGracePeriod   = 10 * time.Second
+	defaultCtrlAltDelTimeout = 5 * time.Second
+)
+
+// StopConfig controls how long each step of a graceful stop may take
+type StopConfig struct {
+	GracePeriodS       int `json:"grace_period_s"`         // time the guest's main process gets to exit once signalled
+	CtrlAltDelTimeoutS int `json:"ctrl_alt_del_timeout_s"` // time firecracker gets to exit after Ctrl+Alt+Del
+}
+
+// DefaultStopConfig gives the guest 10s to exit and firecracker 5s to shut down
+func DefaultStopConfig() StopConfig {
+	return StopConfig{
+		GracePeriodS:       int(defaultStopGracePeriod.Seconds()),
+		CtrlAltDelTimeoutS: int(defaultCtrlAltDelTimeout.Seconds()),
+	}
+}
+
+func (c StopConfig) gracePeriod() time.Duration {
+	if c.GracePeriodS <= 0 {
+		return defaultStopGracePeriod
+	}
+	return time.Duration(c.GracePeriodS) * time.Second
+}
+
+func (c StopConfig) ctrlAltDelTimeout() time.Duration {
+	if c.CtrlAltDelTimeoutS <= 0 {
+		return defaultCtrlAltDelTimeout
+	}
+	return time.Duration(c.CtrlAltDelTimeoutS) * time.Second
+}
+
+type StopStepName string
+
+const (
+	// StopStepGuestSignal signals the guest's main process through the init API
+	StopStepGuestSignal StopStepName = "guest_signal"
+	// StopStepCtrlAltDel asks the guest kernel to shut down through Firecracker
+	StopStepCtrlAltDel StopStepName = "ctrl_alt_del"
+	// StopStepSIGKILL kills the firecracker process
+	StopStepSIGKILL StopStepName = "sigkill"
+)
+
+// StopStep records one step kiln took to stop the VM
+type StopStep struct {
+	Step   StopStepName `json:"step"`
+	At     time.Time    `json:"at"`
+	Signal int          `json:"signal,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// stopper escalates from asking the guest to stop to killing firecracker,
+// moving on whenever a step fails or times out
+type stopper struct {
+	cfg         StopConfig
+	firecracker *firecracker.Client
+	guest       *http.Client
+	ps          *os.Process
+
+	// guestExited is closed once init reported the main process' exit status
+	guestExited chan struct{}
+	// vmExited is closed once firecracker has exited
+	vmExited chan struct{}
+
+	start     sync.Once
+	guestOnce sync.Once
+	vmOnce    sync.Once
+
+	mu    sync.Mutex
+	steps []StopStep
+}
+
+func newStopper(cfg StopConfig, fc *firecracker.Client, guest *http.Client, ps *os.Process) *stopper {
+	return &stopper{
+		cfg:         cfg,
+		firecracker: fc,
+		guest:       guest,
+		ps:          ps,
+		guestExited: make(chan struct{}),
+		vmExited:    make(chan struct{}),
+	}
+}
+
+// stop starts the escalation in the background, later calls are ignored.
+// With force set firecracker is killed right away.
+func (s *stopper) stop(ctx context.Context, sig syscall.Signal, force bool) {
+	started := false
+	s.start.Do(func() {
+		started = true
+		go s.escalate(ctx, sig, force)
+	})
+	if !started {
+		slog.Info("Stop already in progress", "signal", sig)
+	}
+}
+
+func (s *stopper) guestDone() {
+	s.guestOnce.Do(func() { close(s.guestExited) })
+}
+
+func (s *stopper) vmDone() {
+	s.vmOnce.Do(func() { close(s.vmExited) })
+}
+
+// Steps returns the steps taken so far
+func (s *stopper) Steps() []StopStep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]StopStep(nil), s.steps...)
+}
+
+func (s *stopper) escalate(ctx context.Context, sig syscall.Signal, force bool) {
+	if !force && s.signalGuest(ctx, sig) {
+		select {
+		case <-s.vmExited:
+			return
+		case <-s.guestExited:
+			// init shuts the VM down once the main process is gone, give it
+			// the Ctrl+Alt+Del window before forcing it
+			if s.wait(s.cfg.ctrlAltDelTimeout()) {
+				return
+			}
+		case <-time.After(s.cfg.gracePeriod()):
+			slog.Warn("Guest did not exit within the grace period", "grace-period", s.cfg.gracePeriod())
+		}
+	}
+
+	if !force && s.ctrlAltDel(ctx) && s.wait(s.cfg.ctrlAltDelTimeout()) {
+		return
+	}
+
+	s.kill()
+}
+
+// signalGuest asks init to relay sig to the main process
+func (s *stopper) signalGuest(ctx context.Context, sig syscall.Signal) bool {
+	slog.Info("Signalling guest", "signal", sig)
+
+	err := postSignal(ctx, s.guest, sig)
+	s.record(StopStepGuestSignal, int(sig), err)
+	if err != nil {
+		slog.Warn("Failed to signal guest", "error", err)
+		return false
+	}
+	return true
+}
+
+func (s *stopper) ctrlAltDel(ctx context.Context) bool {
+	slog.Info("Sending Ctrl+Alt+Del")
+
+	ctx, cancel := context.WithTimeout(ctx, controlRequestTimeout)
+	defer cancel()
+
+	err := s.firecracker.SendCtrlAltDel(ctx)
+	s.record(StopStepCtrlAltDel, 0, err)
+	if err != nil {
+		slog.Warn("Failed to send Ctrl+Alt+Del", "error", err)
+		return false
+	}
+	return true
+}
+
+func (s *stopper) kill() {
+	slog.Warn("Killing Firecracker")
+
+	err := s.ps.Signal(syscall.SIGKILL)
+	s.record(StopStepSIGKILL, int(syscall.SIGKILL), err)
+	if err != nil {
+		slog.Error("Failed to kill Firecracker", "error", err)
+	}
+}
+
+// wait reports whether firecracker exited within d
+func (s *stopper) wait(d time.Duration) bool {
+	select {
+	case <-s.vmExited:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (s *stopper) record(step StopStepName, sig int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := StopStep{Step: step, At: time.Now().UTC(), Signal: sig}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	s.steps = append(s.steps, st)
+}
+
+// postSignal calls the init API's /signal endpoint
+func postSignal(ctx context.Context, client *http.Client, sig syscall.Signal) error {
+	body, err := json.Marshal(struct {
+		Signal int32 `json:"signal"`
+	}{Signal: int32(sig)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://firecracker/signal", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach init: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("init rejected signal: %s", resp.Status)
+	}
+	return nil
+}
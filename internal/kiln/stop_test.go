@@ -0,0 +1,196 @@
+package kiln_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/firecracker/firecrackertest"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeInit serves init's /signal endpoint with the given status and returns
+// a client for it along with the signals it received
+func fakeInit(t *testing.T, status int) (*http.Client, chan int) {
+	t.Helper()
+
+	signals := make(chan int, 4)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /signal", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Signal int `json:"signal"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
+			signals <- req.Signal
+		}
+		w.WriteHeader(status)
+	})
+
+	socket := filepath.Join(t.TempDir(), "init.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}, signals
+}
+
+// fakeFirecracker is a process standing in for firecracker, it only dies when killed
+func fakeFirecracker(t *testing.T) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return cmd
+}
+
+func stepNames(steps []kiln.StopStep) []kiln.StopStepName {
+	var names []kiln.StopStepName
+	for _, st := range steps {
+		names = append(names, st.Step)
+	}
+	return names
+}
+
+// quickStop keeps the escalation tests short
+var quickStop = kiln.StopConfig{GracePeriodS: 1, CtrlAltDelTimeoutS: 1}
+
+// TestStopGraceful tests that a guest exiting on its signal ends the escalation.
+func TestStopGraceful(t *testing.T) {
+	var (
+		fc          = firecrackertest.NewServer(t)
+		guest, sigs = fakeInit(t, http.StatusOK)
+		proc        = fakeFirecracker(t)
+		stopper     = kiln.NewStopper(quickStop, fc.Client(), guest, proc.Process)
+	)
+
+	stopper.Stop(syscall.SIGHUP, false)
+	assert.Equal(t, int(syscall.SIGHUP), <-sigs, "the requested signal is relayed")
+
+	// init reports the exit and the VM goes down on its own
+	stopper.GuestDone()
+	stopper.VMDone()
+
+	time.Sleep(100 * time.Millisecond)
+	steps := stopper.Steps()
+	assert.Equal(t, []kiln.StopStepName{kiln.StopStepGuestSignal}, stepNames(steps))
+	assert.Equal(t, int(syscall.SIGHUP), steps[0].Signal)
+	assert.Empty(t, steps[0].Error)
+	assert.Empty(t, fc.Actions())
+}
+
+// TestStopEscalation tests each rung of the ladder from signalling the guest
+// to killing firecracker.
+func TestStopEscalation(t *testing.T) {
+	tests := []struct {
+		name string
+		// initStatus is how init answers the signal
+		initStatus int
+		force      bool
+		// exitsOnCtrlAltDel makes firecracker exit once Ctrl+Alt+Del was sent
+		exitsOnCtrlAltDel bool
+		want              []kiln.StopStepName
+		killed            bool
+	}{
+		{
+			name:              "init rejects the signal",
+			initStatus:        http.StatusBadRequest,
+			exitsOnCtrlAltDel: true,
+			want:              []kiln.StopStepName{kiln.StopStepGuestSignal, kiln.StopStepCtrlAltDel},
+		},
+		{
+			name:              "guest ignores the signal",
+			initStatus:        http.StatusOK,
+			exitsOnCtrlAltDel: true,
+			want:              []kiln.StopStepName{kiln.StopStepGuestSignal, kiln.StopStepCtrlAltDel},
+		},
+		{
+			name:       "guest ignores ctrl+alt+del",
+			initStatus: http.StatusOK,
+			want:       []kiln.StopStepName{kiln.StopStepGuestSignal, kiln.StopStepCtrlAltDel, kiln.StopStepSIGKILL},
+			killed:     true,
+		},
+		{
+			name:       "forced",
+			initStatus: http.StatusOK,
+			force:      true,
+			want:       []kiln.StopStepName{kiln.StopStepSIGKILL},
+			killed:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				fc       = firecrackertest.NewServer(t)
+				guest, _ = fakeInit(t, tt.initStatus)
+				proc     = fakeFirecracker(t)
+				stopper  = kiln.NewStopper(quickStop, fc.Client(), guest, proc.Process)
+			)
+
+			stopper.Stop(syscall.SIGTERM, tt.force)
+
+			if tt.exitsOnCtrlAltDel {
+				require.Eventually(t, func() bool { return len(fc.Actions()) > 0 }, 3*time.Second, 10*time.Millisecond)
+				assert.Equal(t, []firecracker.ActionType{firecracker.ActionSendCtrlAltDel}, fc.Actions())
+				stopper.VMDone()
+			}
+
+			require.Eventually(t, func() bool { return len(stopper.Steps()) == len(tt.want) }, 5*time.Second, 10*time.Millisecond)
+			time.Sleep(100 * time.Millisecond)
+			steps := stopper.Steps()
+			assert.Equal(t, tt.want, stepNames(steps))
+			if !tt.force {
+				assert.Equal(t, int(syscall.SIGTERM), steps[0].Signal)
+				assert.Equal(t, tt.initStatus != http.StatusOK, steps[0].Error != "", "a failed step records its error")
+			}
+
+			if tt.killed {
+				err := proc.Wait()
+				var exitErr *exec.ExitError
+				require.ErrorAs(t, err, &exitErr)
+				assert.Equal(t, syscall.SIGKILL, exitErr.Sys().(syscall.WaitStatus).Signal())
+			}
+		})
+	}
+}
+
+// TestStopOnce tests that a second stop request doesn't start another escalation.
+func TestStopOnce(t *testing.T) {
+	var (
+		fc          = firecrackertest.NewServer(t)
+		guest, sigs = fakeInit(t, http.StatusOK)
+		proc        = fakeFirecracker(t)
+		stopper     = kiln.NewStopper(quickStop, fc.Client(), guest, proc.Process)
+	)
+
+	stopper.Stop(syscall.SIGTERM, false)
+	stopper.Stop(syscall.SIGKILL, true)
+
+	assert.Equal(t, int(syscall.SIGTERM), <-sigs)
+	stopper.GuestDone()
+	stopper.VMDone()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []kiln.StopStepName{kiln.StopStepGuestSignal}, stepNames(stopper.Steps()))
+}
@@ -0,0 +1,83 @@
+// Package mmds holds the metadata document the host publishes through
+// Firecracker's microVM metadata service, and the guest side of reading it.
+package mmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+)
+
+const (
+	// Address is where guests reach the metadata service over eth0
+	Address = "169.254.169.254"
+
+	// tokenTTL is how long a session token stays valid, in seconds
+	tokenTTL = 60
+)
+
+// Metadata is the document served to the guest
+type Metadata struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name,omitempty"`
+	Image  string            `json:"image"`
+	IPs    []image.IPConfig  `json:"ips,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// UserData is passed through untouched
+	UserData json.RawMessage `json:"user_data,omitempty"`
+}
+
+// Fetch reads the metadata document from the service at addr. The service
+// runs MMDS v2, every read needs a session token.
+func Fetch(ctx context.Context, client *http.Client, addr string) (*Metadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://"+addr+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-metadata-token-ttl-seconds", strconv.Itoa(tokenTTL))
+
+	token, err := send(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata token: %w", err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-metadata-token", string(token))
+	req.Header.Set("Accept", "application/json")
+
+	body, err := send(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var md Metadata
+	if err := json.Unmarshal(body, &md); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	return &md, nil
+}
+
+func send(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service returned %s", resp.Status)
+	}
+	return body, nil
+}
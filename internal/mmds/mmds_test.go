@@ -0,0 +1,50 @@
+package mmds_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetch tests that the metadata is read with a session token like MMDS v2 requires.
+func TestFetch(t *testing.T) {
+	want := mmds.Metadata{
+		ID:       "abcd1234",
+		Name:     "web",
+		Image:    "nginx:latest",
+		Labels:   map[string]string{"team": "edge"},
+		UserData: json.RawMessage(`{"replicas":2}`),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("secret"))
+	})
+	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-metadata-token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(want)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	md, err := mmds.Fetch(context.Background(), srv.Client(), strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	assert.Equal(t, want.ID, md.ID)
+	assert.Equal(t, want.Labels, md.Labels)
+	assert.JSONEq(t, string(want.UserData), string(md.UserData))
+}
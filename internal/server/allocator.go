@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+// ErrInsufficientCapacity is returned when admitting a VM would overcommit the host
+var ErrInsufficientCapacity = errors.New("insufficient host capacity")
+
+// Capacity is an amount of vCPUs and memory
+type Capacity struct {
+	CPUs     int `json:"cpus"`
+	MemoryMB int `json:"memory_mb"`
+}
+
+// Allocator admits VMs as long as the vCPUs and memory committed to active
+// VMs stay within what the host can schedule
+type Allocator struct {
+	mu    sync.Mutex
+	vms   *Registry
+	total Capacity
+}
+
+// NewAllocator derives the schedulable capacity from the host's capacity,
+// the reserved headroom and the overcommit ratios
+func NewAllocator(vms *Registry, host Capacity, cfg config.Capacity) *Allocator {
+	cpus := float64(host.CPUs-cfg.ReservedCPUs) * cfg.CPUOvercommit
+	memory := float64(host.MemoryMB-cfg.ReservedMemoryMB) * cfg.MemoryOvercommit
+
+	return &Allocator{
+		vms: vms,
+		total: Capacity{
+			CPUs:     max(int(cpus), 0),
+			MemoryMB: max(int(memory), 0),
+		},
+	}
+}
+
+// Admit runs commit if the host has room for res. Commit should make the VM
+// active (register or start it), it runs under the allocator's lock so
+// concurrent admissions can't both claim the same headroom.
+func (a *Allocator) Admit(res kiln.Resources, commit func() error) error {
+	return a.admit("", res, commit)
+}
+
+// Replace admits res in place of the VM with the given id, what that VM
+// still has committed doesn't count against it. A restart uses it, the old
+// run may not have been recorded as stopped yet.
+func (a *Allocator) Replace(id string, res kiln.Resources, commit func() error) error {
+	return a.admit(id, res, commit)
+}
+
+func (a *Allocator) admit(replaces string, res kiln.Resources, commit func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	available := a.available(replaces)
+	if res.CPUCount > available.CPUs || res.MemoryMB > available.MemoryMB {
+		return fmt.Errorf("%w: requested %d vCPUs and %d MB, available %d vCPUs and %d MB",
+			ErrInsufficientCapacity, res.CPUCount, res.MemoryMB, available.CPUs, available.MemoryMB)
+	}
+	return commit()
+}
+
+// Total returns the schedulable capacity of the host
+func (a *Allocator) Total() Capacity {
+	return a.total
+}
+
+// Committed returns the capacity used by active VMs
+func (a *Allocator) Committed() Capacity {
+	return a.committed("")
+}
+
+// committed is the capacity used by active VMs other than except
+func (a *Allocator) committed(except string) Capacity {
+	var committed Capacity
+	for _, rec := range a.vms.List() {
+		if !isActive(rec.State) || rec.ID == except {
+			continue
+		}
+		committed.CPUs += rec.Resources.CPUCount
+		committed.MemoryMB += rec.Resources.MemoryMB
+	}
+	return committed
+}
+
+func (a *Allocator) available(except string) Capacity {
+	committed := a.committed(except)
+	return Capacity{
+		CPUs:     a.total.CPUs - committed.CPUs,
+		MemoryMB: a.total.MemoryMB - committed.MemoryMB,
+	}
+}
+
+// HostCapacity reads the number of CPUs and the total memory of the host from /proc
+func HostCapacity() (Capacity, error) {
+	cpuinfo, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return Capacity{}, err
+	}
+	defer cpuinfo.Close()
+
+	cpus, err := parseCPUInfo(cpuinfo)
+	if err != nil {
+		return Capacity{}, fmt.Errorf("failed to parse /proc/cpuinfo: %w", err)
+	}
+
+	meminfo, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return Capacity{}, err
+	}
+	defer meminfo.Close()
+
+	memory, err := parseMemInfo(meminfo)
+	if err != nil {
+		return Capacity{}, fmt.Errorf("failed to parse /proc/meminfo: %w", err)
+	}
+
+	return Capacity{CPUs: cpus, MemoryMB: memory}, nil
+}
+
+// parseCPUInfo counts the processor entries of /proc/cpuinfo
+func parseCPUInfo(r io.Reader) (int, error) {
+	var cpus int
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if key, _, ok := strings.Cut(scanner.Text(), ":"); ok && strings.TrimSpace(key) == "processor" {
+			cpus++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if cpus == 0 {
+		return 0, errors.New("no processors found")
+	}
+	return cpus, nil
+}
+
+// parseMemInfo returns MemTotal from /proc/meminfo in MB
+func parseMemInfo(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || key != "MemTotal" {
+			continue
+		}
+		kb, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), " kB"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid MemTotal %q: %w", value, err)
+		}
+		return kb / 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("MemTotal not found")
+}
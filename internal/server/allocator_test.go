@@ -0,0 +1,84 @@
+package server_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAllocatorAdmit tests that VMs are admitted until the schedulable capacity is used up.
+func TestAllocatorAdmit(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		host  = server.Capacity{CPUs: 2, MemoryMB: 4096}
+		alloc = server.NewAllocator(vms, host, config.Capacity{
+			CPUOvercommit:    2,
+			MemoryOvercommit: 1,
+			ReservedMemoryMB: 1024,
+		})
+	)
+	require.Equal(t, server.Capacity{CPUs: 4, MemoryMB: 3072}, alloc.Total())
+
+	admit := func(id string, cpus, memory int) error {
+		res := kiln.Resources{CPUCount: cpus, MemoryMB: memory}
+		require.NoError(t, os.MkdirAll(vms.Chroot(id), 0o755))
+
+		return alloc.Admit(res, func() error {
+			return vms.Put(&api.VM{ID: id, State: vm.StateInitializing, Resources: res, CreatedAt: time.Now()})
+		})
+	}
+
+	require.NoError(t, admit("a", 2, 1024))
+	require.NoError(t, admit("b", 2, 1024))
+
+	err := admit("c", 1, 512)
+	assert.ErrorIs(t, err, server.ErrInsufficientCapacity, "vCPUs are used up")
+
+	_, err = vms.Update("a", func(rec *api.VM) { rec.State = vm.StateStopped })
+	require.NoError(t, err)
+
+	assert.NoError(t, admit("c", 1, 512), "stopped VMs release their resources")
+
+	err = admit("d", 1, 2048)
+	assert.ErrorIs(t, err, server.ErrInsufficientCapacity, "memory is used up")
+
+	assert.Equal(t, server.Capacity{CPUs: 3, MemoryMB: 1536}, alloc.Committed())
+}
+
+// TestAllocatorReplace tests that a VM being restarted doesn't count against itself.
+func TestAllocatorReplace(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		alloc = server.NewAllocator(vms, server.Capacity{CPUs: 2, MemoryMB: 1024}, config.Capacity{
+			CPUOvercommit:    1,
+			MemoryOvercommit: 1,
+		})
+		res = kiln.Resources{CPUCount: 2, MemoryMB: 1024}
+	)
+	require.NoError(t, os.MkdirAll(vms.Chroot("a"), 0o755))
+	require.NoError(t, vms.Put(&api.VM{ID: "a", State: vm.StateRunning, Resources: res, CreatedAt: time.Now()}))
+
+	var started bool
+	commit := func() error {
+		started = true
+		return nil
+	}
+
+	err := alloc.Admit(res, commit)
+	assert.ErrorIs(t, err, server.ErrInsufficientCapacity)
+
+	err = alloc.Replace("b", res, commit)
+	assert.ErrorIs(t, err, server.ErrInsufficientCapacity, "only the VM's own capacity is discounted")
+	assert.False(t, started)
+
+	require.NoError(t, alloc.Replace("a", res, commit))
+	assert.True(t, started)
+}
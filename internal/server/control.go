@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+// VMStatus reports the live state of a VM from its kiln
+func VMStatus(vms *Registry) http.HandlerFunc {
+	return controlVM(vms, (*kiln.ControlClient).Status)
+}
+
+// PauseVM freezes a running VM's vCPUs, its memory stays allocated
+func PauseVM(vms *Registry) http.HandlerFunc {
+	return controlVM(vms, (*kiln.ControlClient).Pause)
+}
+
+// ResumeVM unfreezes a paused VM
+func ResumeVM(vms *Registry) http.HandlerFunc {
+	return controlVM(vms, (*kiln.ControlClient).Resume)
+}
+
+// UpdateRateLimits changes a running VM's disk and network limits, limiters
+// missing from the request are left as they are
+func UpdateRateLimits(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id = r.PathValue("id")
+
+		var limits kiln.RateLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid rate limits")
+			return
+		}
+		if err := limits.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if !isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is not running")
+			return
+		}
+
+		status, err := vms.Control(id).UpdateRateLimits(r.Context(), &limits)
+		if err != nil {
+			writeControlError(w, id, err)
+			return
+		}
+
+		rec, err = vms.Update(id, func(rec *api.VM) {
+			rec.RateLimits = status.RateLimits
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+// UpdateBalloon sets the balloon target of a running VM, inflating it hands
+// guest memory back to the host without a restart
+func UpdateBalloon(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id = r.PathValue("id")
+
+		var req kiln.BalloonRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid balloon request")
+			return
+		}
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if err := req.Validate(rec.Resources.MemoryMB); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is not running")
+			return
+		}
+
+		status, err := vms.Control(id).UpdateBalloon(r.Context(), &req)
+		if err != nil {
+			writeControlError(w, id, err)
+			return
+		}
+
+		rec, err = vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		rec.Balloon = status.Balloon
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+func controlVM(vms *Registry, fn func(*kiln.ControlClient, context.Context) (*kiln.Status, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id = r.PathValue("id")
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if !isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is not running")
+			return
+		}
+
+		status, err := fn(vms.Control(id), r.Context())
+		if err != nil {
+			writeControlError(w, id, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// writeControlError passes kiln's rejections through, failing to reach kiln is a bad gateway
+func writeControlError(w http.ResponseWriter, id string, err error) {
+	var ce *kiln.ControlError
+	if errors.As(err, &ce) {
+		writeError(w, ce.StatusCode, ce.Message)
+		return
+	}
+	slog.Error("Failed to reach kiln", "vm-id", id, "error", err)
+	writeError(w, http.StatusBadGateway, err.Error())
+}
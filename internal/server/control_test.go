@@ -0,0 +1,268 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addVM registers rec, its chroot holds whatever the test puts there
+func addVM(t *testing.T, vms *server.Registry, rec *api.VM) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(vms.Chroot(rec.ID), 0o755))
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now().UTC()
+	}
+	require.NoError(t, vms.Put(rec))
+}
+
+// serveKiln serves a kiln control API on the VM's control socket
+func serveKiln(t *testing.T, vms *server.Registry, id string, h http.Handler) {
+	t.Helper()
+
+	listener, err := net.Listen("unix", filepath.Join(vms.Chroot(id), kiln.DefaultControlSocket))
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: h}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+}
+
+// serve routes a single request to handler like the server's mux does
+func serve(handler http.HandlerFunc, pattern, method, target, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// TestUpdateBalloon tests that balloon updates go through kiln and answer with the VM.
+func TestUpdateBalloon(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning, Resources: kiln.Resources{MemoryMB: 512}})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped, Resources: kiln.Resources{MemoryMB: 512}})
+
+	// kiln's side of the balloon is tested in package kiln
+	var target int
+	serveKiln(t, vms, "vm1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req kiln.BalloonRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		target = req.TargetMiB
+		json.NewEncoder(w).Encode(kiln.Status{ID: "vm1", State: kiln.StateRunning, Balloon: &kiln.BalloonStatus{TargetMiB: req.TargetMiB}})
+	}))
+
+	const pattern = "PATCH /vms/{id}/balloon"
+	handler := server.UpdateBalloon(vms)
+
+	rec := serve(handler, pattern, http.MethodPatch, "/vms/vm1/balloon", `{"target_mib":256}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var got api.VM
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, "vm1", got.ID)
+	require.NotNil(t, got.Balloon)
+	assert.Equal(t, 256, got.Balloon.TargetMiB)
+	assert.Equal(t, 256, target)
+
+	// the live balloon isn't persisted with the record
+	stored, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Nil(t, stored.Balloon)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm1/balloon", `{"target_mib":512}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm2/balloon", `{"target_mib":128}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/nope/balloon", `{"target_mib":128}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestPauseResumeVM tests that pause and resume are passed through to kiln.
+func TestPauseResumeVM(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped})
+	addVM(t, vms, &api.VM{ID: "vm3", State: vm.StateRunning})
+
+	// kiln's side of pausing is tested in package kiln
+	var paused bool
+	kilnMux := http.NewServeMux()
+	kilnMux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		if paused {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "vm is paused"})
+			return
+		}
+		paused = true
+		json.NewEncoder(w).Encode(kiln.Status{ID: "vm1", State: kiln.StatePaused})
+	})
+	kilnMux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		paused = false
+		json.NewEncoder(w).Encode(kiln.Status{ID: "vm1", State: kiln.StateRunning})
+	})
+	serveKiln(t, vms, "vm1", kilnMux)
+
+	pause := server.PauseVM(vms)
+	const pattern = "POST /vms/{id}/pause"
+
+	rec := serve(pause, pattern, http.MethodPost, "/vms/vm1/pause", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var status kiln.Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, kiln.StatePaused, status.State)
+
+	rec = serve(pause, pattern, http.MethodPost, "/vms/vm1/pause", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "kiln's rejection is passed through")
+	assert.Contains(t, rec.Body.String(), "vm is paused")
+
+	rec = serve(server.ResumeVM(vms), "POST /vms/{id}/resume", http.MethodPost, "/vms/vm1/resume", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, kiln.StateRunning, status.State)
+
+	rec = serve(pause, pattern, http.MethodPost, "/vms/vm2/pause", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(pause, pattern, http.MethodPost, "/vms/vm3/pause", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "vm3 has no kiln listening")
+
+	rec = serve(pause, pattern, http.MethodPost, "/vms/nope/pause", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestUpdateRateLimits tests that the limits kiln applied are recorded with the VM.
+func TestUpdateRateLimits(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped})
+
+	// kiln merges the update into what it already applied
+	serveKiln(t, vms, "vm1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var update kiln.RateLimits
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&update))
+		limits := (&kiln.RateLimits{NetworkTx: firecracker.NewRateLimiter(1024, 10)}).Merge(update)
+		json.NewEncoder(w).Encode(kiln.Status{ID: "vm1", State: kiln.StateRunning, RateLimits: limits})
+	}))
+
+	const pattern = "PATCH /vms/{id}/rate-limits"
+	handler := server.UpdateRateLimits(vms)
+
+	rec := serve(handler, pattern, http.MethodPatch, "/vms/vm1/rate-limits", `{"drive":{"bandwidth":{"size":1048576,"refill_time":1000}}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var got api.VM
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	require.NotNil(t, got.RateLimits)
+	assert.Equal(t, int64(1048576), got.RateLimits.Drive.Bandwidth.Size)
+	assert.NotNil(t, got.RateLimits.NetworkTx)
+
+	stored, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, got.RateLimits, stored.RateLimits)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm1/rate-limits", `{"drive":{"bandwidth":{"size":-1,"refill_time":1000}}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm2/rate-limits", `{}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/nope/rate-limits", `{}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// writeKilnMetadata gives the VM a kiln.json serving md
+func writeKilnMetadata(t *testing.T, vms *server.Registry, id string, md *mmds.Metadata) {
+	t.Helper()
+
+	cfg := kiln.Default()
+	cfg.Metadata = md
+	require.NoError(t, kiln.WriteConfig(filepath.Join(vms.Chroot(id), "kiln.json"), cfg))
+}
+
+// TestUpdateMetadata tests that metadata goes through kiln while the VM runs
+// and into kiln.json while it doesn't.
+func TestUpdateMetadata(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning, Labels: map[string]string{"env": "dev", "team": "web"}})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped})
+	addVM(t, vms, &api.VM{ID: "vm3", State: vm.StateStopped})
+	addVM(t, vms, &api.VM{ID: "vm4", State: vm.StateRunning})
+	addVM(t, vms, &api.VM{ID: "vm5", State: vm.StateRunning})
+	writeKilnMetadata(t, vms, "vm1", &mmds.Metadata{ID: "vm1", Labels: map[string]string{"env": "dev", "team": "web"}})
+	writeKilnMetadata(t, vms, "vm2", &mmds.Metadata{ID: "vm2"})
+	writeKilnMetadata(t, vms, "vm4", &mmds.Metadata{ID: "vm4"})
+	writeKilnMetadata(t, vms, "vm5", &mmds.Metadata{ID: "vm5"})
+
+	var published mmds.Metadata
+	serveKiln(t, vms, "vm1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&published))
+		json.NewEncoder(w).Encode(kiln.Status{ID: "vm1", State: kiln.StateRunning})
+	}))
+	serveKiln(t, vms, "vm4", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "vm is stopping"})
+	}))
+
+	const pattern = "PATCH /vms/{id}/metadata"
+	handler := server.UpdateMetadata(vms)
+
+	rec := serve(handler, pattern, http.MethodPatch, "/vms/vm1/metadata", `{"labels":{"env":"prod","team":""}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var got api.VM
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, map[string]string{"env": "prod"}, got.Labels, "an empty value removes the label")
+	assert.Equal(t, "vm1", published.ID)
+	assert.Equal(t, map[string]string{"env": "prod"}, published.Labels)
+
+	// a stopped VM picks the change up from kiln.json when it starts
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm2/metadata", `{"user_data":{"port":8080}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	cfg, err := kiln.ReadConfig(filepath.Join(vms.Chroot("vm2"), "kiln.json"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"port":8080}`, string(cfg.Metadata.UserData))
+
+	stored, err := vms.Get("vm2")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"port":8080}`, string(stored.UserData))
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm3/metadata", `{"labels":{"env":"prod"}}`)
+	assert.Equal(t, http.StatusConflict, rec.Code, "vm3 predates the metadata service")
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm4/metadata", `{"labels":{"env":"prod"}}`)
+	assert.Equal(t, http.StatusConflict, rec.Code, "kiln's rejection is passed through")
+	stored, err = vms.Get("vm4")
+	require.NoError(t, err)
+	assert.Empty(t, stored.Labels, "a rejected update isn't recorded")
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm1/metadata", `{"labels":{"":"x"}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/vm5/metadata", `{"labels":{"env":"prod"}}`)
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "vm5 has no kiln listening")
+
+	rec = serve(handler, pattern, http.MethodPatch, "/vms/nope/metadata", `{}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+// subscriberBuffer is how many events a slow subscriber may lag behind before
+// it starts missing events
+const subscriberBuffer = 64
+
+// Events fans VM lifecycle events out to subscribers
+type Events struct {
+	mu   sync.Mutex
+	subs map[chan api.Event]struct{}
+}
+
+func NewEvents() *Events {
+	return &Events{
+		subs: make(map[chan api.Event]struct{}),
+	}
+}
+
+// Publish delivers an event to every subscriber without blocking
+func (e *Events) Publish(event api.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for sub := range e.subs {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function to unsubscribe
+func (e *Events) Subscribe() (<-chan api.Event, func()) {
+	sub := make(chan api.Event, subscriberBuffer)
+
+	e.mu.Lock()
+	e.subs[sub] = struct{}{}
+	e.mu.Unlock()
+
+	return sub, func() {
+		e.mu.Lock()
+		delete(e.subs, sub)
+		e.mu.Unlock()
+	}
+}
+
+// transitionEvents derives the events implied by a change to a VM record
+func transitionEvents(old, rec *api.VM) []api.Event {
+	var (
+		now    = time.Now().UTC()
+		events []api.Event
+	)
+
+	if rec.RestartCount > old.RestartCount && len(rec.Restarts) > 0 {
+		events = append(events, api.Event{Time: now, VMID: rec.ID, Type: api.EventRestarted, Message: rec.Restarts[len(rec.Restarts)-1].Reason})
+	}
+	if rec.UserStopped && !old.UserStopped {
+		events = append(events, api.Event{Time: now, VMID: rec.ID, Type: api.EventStopping})
+	}
+	if rec.State != old.State {
+		switch rec.State {
+		case vm.StateRunning:
+			events = append(events, api.Event{Time: now, VMID: rec.ID, Type: api.EventStarted})
+		case vm.StateStopped:
+			events = append(events, api.Event{Time: now, VMID: rec.ID, Type: api.EventExited})
+		case vm.StateFailed:
+			events = append(events, api.Event{Time: now, VMID: rec.ID, Type: api.EventFailed})
+		}
+	}
+	return events
+}
+
+// StreamEvents streams lifecycle events as JSON lines until the client goes away,
+// the vm query parameter limits the stream to a single VM
+func StreamEvents(events *Events) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ctx    = r.Context()
+			vmID   = r.URL.Query().Get("vm")
+			rc     = http.NewResponseController(w)
+			stream = json.NewEncoder(w)
+		)
+
+		sub, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		_ = rc.Flush()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-sub:
+				if vmID != "" && event.VMID != vmID {
+					continue
+				}
+				if err := stream.Encode(event); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
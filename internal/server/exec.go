@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/rugwirobaker/inferno/internal/vsock"
+)
+
+const (
+	// defaultExecTimeout mirrors the default the guest init applies
+	defaultExecTimeout = 30 * time.Second
+	// maxExecTimeout bounds how long a command may run in the guest
+	maxExecTimeout = 10 * time.Minute
+)
+
+// Exec runs a command in the guest through the init API and returns its output
+func Exec(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			id  = r.PathValue("id")
+			ctx = r.Context()
+		)
+
+		var req api.ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decode request")
+			return
+		}
+		if len(req.Cmd) == 0 {
+			writeError(w, http.StatusBadRequest, "cmd is required")
+			return
+		}
+
+		timeout := defaultExecTimeout
+		if req.Timeout > 0 {
+			timeout = time.Duration(req.Timeout) * time.Second
+		}
+		if timeout > maxExecTimeout {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("timeout must not exceed %s", maxExecTimeout))
+			return
+		}
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if rec.State != vm.StateRunning {
+			writeError(w, http.StatusConflict, "vm is not running")
+			return
+		}
+
+		resp, err := execGuest(ctx, vms.Chroot(id), &req, timeout)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// execGuest forwards an exec request to the guest's init API
+func execGuest(ctx context.Context, chroot string, req *api.ExecRequest, timeout time.Duration) (*api.ExecResponse, error) {
+	client := vsock.NewGuestClient(chroot, vsock.VsockAPIPort)
+	// leave the guest time to report a timed out command
+	client.Timeout = timeout + 5*time.Second
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://firecracker/exec", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec in guest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err == nil && e.Error != "" {
+			return nil, fmt.Errorf("guest failed to exec: %s", e.Error)
+		}
+		return nil, fmt.Errorf("guest failed to exec: %s", resp.Status)
+	}
+
+	var out api.ExecResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode exec response: %w", err)
+	}
+	return &out, nil
+}
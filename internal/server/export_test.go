@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// exported for the server_test package
+var (
+	IdentityFor      = identityFor
+	ResolveResources = resolveResources
+	OwnsChroot       = ownsChroot
+	SettleRestarts   = settleRestarts
+	KillVM           = killVM
+	Reattach         = reattach
+)
+
+type Rollback = rollback
+
+func NewRollback(logger *slog.Logger, keep bool) *Rollback {
+	return newRollback(logger, keep)
+}
+
+func (r *rollback) Add(name string, fn func() error) { r.add(name, fn) }
+
+func (r *rollback) Run() { r.run() }
+
+// SetCgroupRoot points the removal of jailed VMs' cgroups at dir for the test
+func SetCgroupRoot(t *testing.T, dir string) {
+	old := cgroupRoot
+	cgroupRoot = dir
+	t.Cleanup(func() { cgroupRoot = old })
+}
+
+func (i *Idler) Check(ctx context.Context, now time.Time) { i.check(ctx, now) }
+
+func (i *Idler) SyncPorts(ctx context.Context) { i.syncPorts(ctx) }
+
+func (i *Idler) CloseListeners() { i.closeListeners() }
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+
+	"github.com/rugwirobaker/inferno/internal/image"
+)
+
+// Host builds the parts of a VM that kiln doesn't: the root filesystem and
+// run config from its image, and the TAP device its network attaches to
+type Host interface {
+	FetchImage(ctx context.Context, name string) error
+	CreateConfig(ctx context.Context, name string) (*image.Config, error)
+	CreateRootFS(ctx context.Context, name, path string) error
+	CreateTap(name string) error
+}
+
+// NewHost builds images with docker and TAP devices with netlink
+func NewHost(images *image.Manager) Host {
+	return &host{Manager: images}
+}
+
+type host struct {
+	*image.Manager
+}
+
+func (h *host) CreateTap(name string) error {
+	return createTap(name)
+}
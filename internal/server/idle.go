@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+const (
+	// idleCheckInterval is how often VMs are checked for idleness and their
+	// routes are synced
+	idleCheckInterval = 30 * time.Second
+	// idleStopTimeout bounds how long an idle VM gets to stop
+	idleStopTimeout = 30 * time.Second
+)
+
+// Idler publishes the VMs' ports and scales the VMs with an idle policy to
+// zero. It listens on the ports on the host and splices connections through
+// to the guest, a VM is idle once its ports carried no traffic for the
+// policy's timeout. Only traffic the Idler proxies is seen, a VM with a port
+// it couldn't publish is never scaled down. The next connection starts a VM
+// that was scaled to zero. With the snapshot action the VM is snapshotted
+// before it's stopped and it resumes from the snapshot instead of booting.
+type Idler struct {
+	vms   *Registry
+	alloc *Allocator
+	snaps *Snapshots
+
+	mu      sync.Mutex
+	traffic map[string]*traffic
+	// listeners are keyed by host address
+	listeners map[string]*portListener
+}
+
+// traffic is what went through a VM's routes
+type traffic struct {
+	conns atomic.Int64
+	// last is when bytes last went through, in unix nanoseconds
+	last atomic.Int64
+}
+
+func (t *traffic) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func NewIdler(vms *Registry, alloc *Allocator, snaps *Snapshots) *Idler {
+	return &Idler{
+		vms:       vms,
+		alloc:     alloc,
+		snaps:     snaps,
+		traffic:   make(map[string]*traffic),
+		listeners: make(map[string]*portListener),
+	}
+}
+
+// Run publishes ports and checks for idle VMs until ctx is cancelled, the
+// listeners are closed when it returns. A VM's ports are published once it
+// started.
+func (i *Idler) Run(ctx context.Context) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	defer i.closeListeners()
+
+	events, unsubscribe := i.vms.Events().Subscribe()
+	defer unsubscribe()
+
+	i.syncPorts(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Type == api.EventStarted {
+				i.syncPorts(ctx)
+			}
+		case now := <-ticker.C:
+			i.syncPorts(ctx)
+			i.check(ctx, now)
+		}
+	}
+}
+
+func (i *Idler) check(ctx context.Context, now time.Time) {
+	var idle []string
+
+	i.mu.Lock()
+	known := make(map[string]bool)
+	for _, rec := range i.vms.List() {
+		known[rec.ID] = true
+		if i.idle(rec, now) {
+			idle = append(idle, rec.ID)
+		}
+	}
+	for id, t := range i.traffic {
+		if !known[id] && t.conns.Load() == 0 {
+			delete(i.traffic, id)
+		}
+	}
+	i.mu.Unlock()
+
+	for _, id := range idle {
+		if err := i.scaleDown(ctx, id, now); err != nil {
+			slog.Error("Failed to scale idle VM to zero", "vm-id", id, "error", err)
+		}
+	}
+}
+
+// idle reports whether a running VM with an idle policy had no open
+// connections and no traffic for the policy's timeout on ports that are all
+// published, i.mu must be held
+func (i *Idler) idle(rec *api.VM, now time.Time) bool {
+	if rec.Idle == nil || rec.State != vm.StateRunning || rec.StartedAt == nil || rec.Pool != "" {
+		return false
+	}
+	if len(rec.Ports) == 0 || !i.published(rec) {
+		return false
+	}
+
+	// a restart starts the clock over
+	last := *rec.StartedAt
+	if t, ok := i.traffic[rec.ID]; ok {
+		if t.conns.Load() > 0 {
+			return false
+		}
+		if active := time.Unix(0, t.last.Load()); active.After(last) {
+			last = active
+		}
+	}
+	return now.Sub(last) >= rec.Idle.Timeout()
+}
+
+// trafficOf returns the traffic tracked for a VM
+func (i *Idler) trafficOf(id string) *traffic {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t, ok := i.traffic[id]
+	if !ok {
+		t = new(traffic)
+		i.traffic[id] = t
+	}
+	return t
+}
+
+// scaleDown stops an idle VM, snapshotting it first if its policy says so.
+// The VM's lock is held throughout, connections coming in meanwhile wake it
+// once it's down.
+func (i *Idler) scaleDown(ctx context.Context, id string, now time.Time) error {
+	unlock := i.vms.Lock(id)
+	defer unlock()
+
+	rec, err := i.vms.Get(id)
+	if err != nil {
+		return err
+	}
+
+	// a connection may have come in since the check
+	i.mu.Lock()
+	idle := i.idle(rec, now)
+	i.mu.Unlock()
+	if !idle {
+		return nil
+	}
+
+	logger := slog.With("system", "idler", "vm-id", id)
+	logger.Info("VM is idle, scaling to zero", "timeout", rec.Idle.Timeout(), "action", rec.Idle.Action)
+
+	var snap *api.Snapshot
+	if rec.Idle.Action == api.IdleSnapshot {
+		if snap, err = snapshotVM(ctx, i.vms, i.snaps, rec, api.SnapshotFull, nil); err != nil {
+			return fmt.Errorf("failed to snapshot: %w", err)
+		}
+		// the files are copied into the chroot once the VM is down
+		defer func() {
+			if err := i.snaps.Delete(snap.ID); err != nil {
+				logger.Warn("Failed to delete idle snapshot", "snapshot", snap.ID, "error", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, idleStopTimeout)
+	defer cancel()
+
+	if err := stopVM(ctx, i.vms, id, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to stop: %w", err)
+	}
+	if machine := i.vms.Machine(id); machine != nil {
+		select {
+		case <-machine.Done():
+		case <-ctx.Done():
+			return fmt.Errorf("vm did not stop: %w", ctx.Err())
+		}
+	}
+
+	// a restart the exit scheduled waits for the lock and finds it stopped
+	idledAt := time.Now().UTC()
+	if _, err := i.vms.Update(id, func(rec *api.VM) {
+		rec.UserStopped = true
+		rec.IdledAt = &idledAt
+	}); err != nil {
+		return err
+	}
+
+	if snap == nil {
+		return nil
+	}
+	return prepareWake(i.vms.Chroot(id), tapName(id), i.snaps.Dir(snap.ID), snap)
+}
+
+// prepareWake lays the snapshot out in the chroot of the stopped VM and points
+// kiln at it, whatever starts the VM next resumes it from the snapshot
+func prepareWake(chroot, tap, snapDir string, snap *api.Snapshot) error {
+	if err := restoreFiles(snapDir, chroot, tap); err != nil {
+		return err
+	}
+
+	err := kiln.UpdateConfig(filepath.Join(chroot, "kiln.json"), func(cfg *kiln.Config) error {
+		cfg.Restore = restoreConfig(snap, tap)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update kiln config: %w", err)
+	}
+	return nil
+}
+
+// wake starts a VM the Idler scaled to zero, a VM stopped any other way is
+// left alone
+func (i *Idler) wake(id string) error {
+	unlock := i.vms.Lock(id)
+	defer unlock()
+
+	rec, err := i.vms.Get(id)
+	if err != nil {
+		return err
+	}
+	if isActive(rec.State) {
+		return nil
+	}
+	if rec.IdledAt == nil {
+		return fmt.Errorf("vm is %s and was not scaled to zero", rec.State)
+	}
+
+	slog.Info("Waking idle VM", "system", "idler", "vm-id", id)
+
+	if _, err := i.vms.Update(id, resetRestarts); err != nil {
+		return err
+	}
+	return i.alloc.Admit(rec.Resources, func() error { return startVM(i.vms, i.alloc, id) })
+}
+
+// countingConn records the traffic going through a proxied connection
+type countingConn struct {
+	net.Conn
+	traffic *traffic
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.traffic.touch()
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.traffic.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,226 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newIdler(t *testing.T, vms *server.Registry) *server.Idler {
+	t.Helper()
+
+	idler := server.NewIdler(vms, newAllocator(vms, 8, 8192), server.NewSnapshots(t.TempDir()))
+	t.Cleanup(idler.CloseListeners)
+	return idler
+}
+
+// echoGuest serves an echo server on 127.0.0.1, the VM's guest address, and
+// returns its port
+func echoGuest(t *testing.T, vms *server.Registry, id string) int {
+	t.Helper()
+
+	config := kiln.Default()
+	config.JailID = id
+	config.Metadata = &mmds.Metadata{ID: id, IPs: []image.IPConfig{{IP: net.IPv4(127, 0, 0, 1)}}}
+	require.NoError(t, kiln.WriteConfig(filepath.Join(vms.Chroot(id), "kiln.json"), config))
+
+	guest, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { guest.Close() })
+	go func() {
+		for {
+			conn, err := guest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return guest.Addr().(*net.TCPAddr).Port
+}
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestIdlerScaleDown tests that a VM without traffic on its ports is stopped
+// once its idle timeout passed and kept from restarting, and that a VM whose
+// ports aren't all published is left running.
+func TestIdlerScaleDown(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		vms    = server.NewRegistry(t.TempDir())
+		alloc  = newAllocator(vms, 8, 8192)
+		policy = &api.IdlePolicy{TimeoutS: 60, Action: api.IdleStop}
+	)
+
+	// vm2's port is taken, its traffic can't be seen
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	for id, hostPort := range map[string]int{"vm1": freePort(t), "vm2": taken.Addr().(*net.TCPAddr).Port} {
+		addVM(t, vms, &api.VM{
+			ID:            id,
+			State:         vm.StateStopped,
+			Ports:         []api.PortMapping{{HostIP: "127.0.0.1", HostPort: hostPort, GuestPort: 80}},
+			Idle:          policy,
+			RestartPolicy: api.RestartPolicy{Name: api.RestartAlways},
+		})
+		fakeKiln(t, vms, id)
+
+		rec := serve(server.StartVM(vms, alloc), "POST /vms/{id}/start", http.MethodPost, "/vms/"+id+"/start", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	started, err := vms.Get("vm1")
+	require.NoError(t, err)
+
+	idler := newIdler(t, vms)
+	idler.SyncPorts(ctx)
+
+	idler.Check(ctx, started.StartedAt.Add(59*time.Second))
+	got, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, got.State, "the timeout hasn't passed")
+
+	idler.Check(ctx, started.StartedAt.Add(time.Hour))
+	waitState(t, vms, "vm1", vm.StateFailed)
+
+	got, err = vms.Get("vm1")
+	require.NoError(t, err)
+	assert.True(t, got.UserStopped, "the restart policy leaves it stopped")
+	assert.NotNil(t, got.IdledAt)
+
+	got, err = vms.Get("vm2")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, got.State, "unseen traffic doesn't make a VM idle")
+	assert.Nil(t, got.IdledAt)
+}
+
+// TestIdlerScaleDownFails tests that a VM that couldn't be stopped isn't
+// marked as scaled to zero.
+func TestIdlerScaleDownFails(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		vms       = server.NewRegistry(t.TempDir())
+		startedAt = time.Now().UTC().Add(-time.Hour)
+	)
+	// no kiln and no guest to stop
+	addVM(t, vms, &api.VM{
+		ID:        "vm1",
+		State:     vm.StateRunning,
+		StartedAt: &startedAt,
+		Ports:     []api.PortMapping{{HostIP: "127.0.0.1", HostPort: freePort(t), GuestPort: 80}},
+		Idle:      &api.IdlePolicy{TimeoutS: 60, Action: api.IdleStop},
+	})
+
+	idler := newIdler(t, vms)
+	idler.SyncPorts(ctx)
+	idler.Check(ctx, time.Now())
+
+	got, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, got.State)
+	assert.False(t, got.UserStopped)
+	assert.Nil(t, got.IdledAt)
+}
+
+// TestIdlerWake tests that a connection to a port of a VM scaled to zero
+// starts it and is spliced through to the guest, and that open connections
+// keep the VM up.
+func TestIdlerWake(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		vms     = server.NewRegistry(t.TempDir())
+		idledAt = time.Now().UTC().Add(-time.Hour)
+		policy  = &api.IdlePolicy{TimeoutS: 60, Action: api.IdleStop}
+	)
+
+	var ports = make(map[string]api.PortMapping)
+	for _, id := range []string{"vm1", "vm2"} {
+		addVM(t, vms, &api.VM{ID: id, State: vm.StateStopped})
+		ports[id] = api.PortMapping{HostIP: "127.0.0.1", HostPort: freePort(t), GuestPort: echoGuest(t, vms, id)}
+		fakeKiln(t, vms, id)
+	}
+	// vm2 was stopped through the API
+	for id, idled := range map[string]*time.Time{"vm1": &idledAt, "vm2": nil} {
+		_, err := vms.Update(id, func(rec *api.VM) {
+			rec.Ports = []api.PortMapping{ports[id]}
+			rec.Idle = policy
+			rec.UserStopped = true
+			rec.IdledAt = idled
+		})
+		require.NoError(t, err)
+	}
+
+	idler := newIdler(t, vms)
+	idler.SyncPorts(ctx)
+
+	conn, err := net.Dial("tcp", ports["vm1"].HostAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	got, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, got.State)
+	assert.False(t, got.UserStopped)
+	assert.Nil(t, got.IdledAt)
+
+	idler.Check(ctx, time.Now().Add(time.Hour))
+	got, err = vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, got.State, "an open connection keeps the VM up")
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		idler.Check(ctx, time.Now().Add(time.Hour))
+		got, err := vms.Get("vm1")
+		return err == nil && got.IdledAt != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a VM stopped through the API stays stopped
+	conn, err = net.Dial("tcp", ports["vm2"].HostAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+
+	got, err = vms.Get("vm2")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateStopped, got.State)
+
+	require.NoError(t, vms.Delete("vm2"))
+	idler.SyncPorts(ctx)
+	_, err = net.Dial("tcp", ports["vm2"].HostAddr())
+	assert.Error(t, err, "the ports of a deleted VM are closed")
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/config"
+)
+
+// logPollInterval is how often a followed log file is checked for new lines
+const logPollInterval = 250 * time.Millisecond
+
+// vmLogPath is where kiln writes the guest's output, see the kiln log listener
+func vmLogPath(cfg *config.Config, id string) string {
+	return filepath.Join(cfg.LogDir, "vm", id+".log")
+}
+
+// Logs streams the output of the guest, with follow=true it keeps streaming
+// new lines until the VM stops or the client goes away
+func Logs(cfg *config.Config, vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			id     = r.PathValue("id")
+			ctx    = r.Context()
+			follow = r.URL.Query().Get("follow") == "true"
+			path   = vmLogPath(cfg, id)
+			rc     = http.NewResponseController(w)
+		)
+
+		if _, err := vms.Get(id); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+
+		file, err := openLog(path)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer func() {
+			if file != nil {
+				file.Close()
+			}
+		}()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		for {
+			if file != nil {
+				if _, err := io.Copy(w, file); err != nil {
+					return
+				}
+			}
+			_ = rc.Flush()
+
+			if !follow {
+				return
+			}
+
+			// the VM is gone and we've sent everything it wrote
+			if rec, err := vms.Get(id); err != nil || !isActive(rec.State) {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(logPollInterval):
+			}
+
+			// the log file was rotated or created since we opened it
+			if rotated(file, path) {
+				if file != nil {
+					// drain what was written before the rotation
+					if _, err := io.Copy(w, file); err != nil {
+						return
+					}
+					file.Close()
+				}
+				if file, err = openLog(path); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// openLog opens the log file, a VM that hasn't written anything yet has none
+func openLog(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return file, err
+}
+
+func rotated(file *os.File, path string) bool {
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if file == nil {
+		return true
+	}
+	opened, err := file.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(opened, current)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+// errNoMetadata is returned for VMs created before the metadata service was enabled
+var errNoMetadata = errors.New("vm has no metadata service")
+
+// UpdateMetadata changes what a VM's metadata service serves. A running VM
+// sees the change right away, a stopped one when it starts.
+func UpdateMetadata(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id = r.PathValue("id")
+
+		var update api.MetadataUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid metadata update")
+			return
+		}
+		if _, ok := update.Labels[""]; ok {
+			writeError(w, http.StatusBadRequest, "label keys must not be empty")
+			return
+		}
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if rec.State == vm.StateInitializing {
+			writeError(w, http.StatusConflict, "vm is initializing")
+			return
+		}
+
+		labels := maps.Clone(rec.Labels)
+		for k, v := range update.Labels {
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			if v == "" {
+				delete(labels, k)
+				continue
+			}
+			labels[k] = v
+		}
+		userData := rec.UserData
+		if update.UserData != nil {
+			userData = update.UserData
+		}
+
+		err = publishMetadata(r.Context(), vms, rec, func(md *mmds.Metadata) {
+			md.Labels = labels
+			md.UserData = userData
+		})
+		var ce *kiln.ControlError
+		switch {
+		case errors.Is(err, errNoMetadata):
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		case errors.As(err, &ce), errors.Is(err, kiln.ErrUnreachable):
+			writeControlError(w, id, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rec, err = vms.Update(id, func(rec *api.VM) {
+			rec.Labels = labels
+			rec.UserData = userData
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+// publishMetadata applies fn to the VM's metadata document. Kiln serves and
+// persists it while the VM runs, otherwise it's written to kiln.json for the
+// next start.
+func publishMetadata(ctx context.Context, vms *Registry, rec *api.VM, fn func(*mmds.Metadata)) error {
+	configPath := filepath.Join(vms.Chroot(rec.ID), "kiln.json")
+
+	if rec.State == vm.StateRunning {
+		config, err := kiln.ReadConfig(configPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return errNoMetadata
+		}
+		if err != nil {
+			return err
+		}
+		if config.Metadata == nil {
+			return errNoMetadata
+		}
+		fn(config.Metadata)
+
+		if _, err := vms.Control(rec.ID).UpdateMetadata(ctx, config.Metadata); err != nil {
+			return fmt.Errorf("failed to update metadata: %w", err)
+		}
+		return nil
+	}
+
+	// kiln isn't running, UpdateConfig keeps the server's own writers apart
+	err := kiln.UpdateConfig(configPath, func(config *kiln.Config) error {
+		if config.Metadata == nil {
+			return errNoMetadata
+		}
+		fn(config.Metadata)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return errNoMetadata
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/vishvananda/netlink"
+)
+
+// tapName is the host side device firecracker attaches the guest eth0 to
+func tapName(id string) string {
+	return fmt.Sprintf("vm%s", id)
+}
+
+// createTap creates a TAP device owned by the jailer user and brings it up
+func createTap(name string) error {
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Owner:     firecracker.DefaultJailerUID,
+		Group:     firecracker.DefaultJailerGID,
+	}
+	if err := netlink.LinkAdd(tap); err != nil {
+		return fmt.Errorf("failed to create tap device %s: %w", name, err)
+	}
+	if err := netlink.LinkSetUp(tap); err != nil {
+		netlink.LinkDel(tap)
+		return fmt.Errorf("failed to bring up tap device %s: %w", name, err)
+	}
+	return nil
+}
+
+// ensureTap creates a TAP device unless it's there, a jailed VM's goes away
+// with the jail's network namespace
+func ensureTap(name string) error {
+	_, err := netlink.LinkByName(name)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return createTap(name)
+	}
+	return err
+}
+
+// deleteTap removes a TAP device, it's not an error if it's already gone
+func deleteTap(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete tap device %s: %w", name, err)
+	}
+	return nil
+}
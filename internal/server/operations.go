@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/rugwirobaker/inferno/internal/api"
+)
+
+// operationTTL is how long finished operations are kept around for polling
+const operationTTL = time.Hour
+
+var ErrOperationNotFound = errors.New("operation not found")
+
+// operation guards an Operation while it's being updated
+type operation struct {
+	mu sync.Mutex
+	op api.Operation
+}
+
+// phase runs fn as the named phase and records its outcome and duration
+func (o *operation) phase(name string, fn func() error) error {
+	o.mu.Lock()
+	o.op.Status = api.OperationRunning
+	o.op.Phases = append(o.op.Phases, api.Phase{
+		Name:      name,
+		Status:    api.OperationRunning,
+		StartedAt: time.Now().UTC(),
+	})
+	idx := len(o.op.Phases) - 1
+	o.mu.Unlock()
+
+	err := fn()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	p := &o.op.Phases[idx]
+	p.CompletedAt = &now
+	p.DurationMS = now.Sub(p.StartedAt).Milliseconds()
+	p.Status = api.OperationSucceeded
+	if err != nil {
+		p.Status = api.OperationFailed
+		p.Error = err.Error()
+	}
+	return err
+}
+
+// record adds a phase that already ran, starting at startedAt
+func (o *operation) record(name string, startedAt time.Time, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	p := api.Phase{
+		Name:        name,
+		Status:      api.OperationSucceeded,
+		StartedAt:   startedAt.UTC(),
+		CompletedAt: &now,
+		DurationMS:  now.Sub(startedAt).Milliseconds(),
+	}
+	if err != nil {
+		p.Status = api.OperationFailed
+		p.Error = err.Error()
+	}
+	o.op.Phases = append(o.op.Phases, p)
+}
+
+// finish marks the operation as completed
+func (o *operation) finish(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	o.op.CompletedAt = &now
+	o.op.Status = api.OperationSucceeded
+	if err != nil {
+		o.op.Status = api.OperationFailed
+		o.op.Error = err.Error()
+	}
+}
+
+func (o *operation) snapshot() *api.Operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	cp := o.op
+	cp.Phases = append([]api.Phase(nil), o.op.Phases...)
+	return &cp
+}
+
+// Operations keeps track of in-flight and recently finished operations
+type Operations struct {
+	mu  sync.RWMutex
+	ops map[string]*operation
+}
+
+func NewOperations() *Operations {
+	return &Operations{
+		ops: make(map[string]*operation),
+	}
+}
+
+// Create registers a new pending operation for the given VM
+func (o *Operations) Create(vmID string) (*operation, error) {
+	id, err := nanoid.Generate(HEX_ALPHABET, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &operation{
+		op: api.Operation{
+			ID:        id,
+			VMID:      vmID,
+			Status:    api.OperationPending,
+			Phases:    []api.Phase{},
+			CreatedAt: time.Now().UTC(),
+		},
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.prune()
+	o.ops[id] = op
+	return op, nil
+}
+
+// Get returns a snapshot of the operation with the given id
+func (o *Operations) Get(id string) (*api.Operation, error) {
+	o.mu.RLock()
+	op, ok := o.ops[id]
+	o.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrOperationNotFound
+	}
+	return op.snapshot(), nil
+}
+
+// prune drops finished operations older than operationTTL, callers must hold the lock
+func (o *Operations) prune() {
+	cutoff := time.Now().Add(-operationTTL)
+	for id, op := range o.ops {
+		snap := op.snapshot()
+		if snap.CompletedAt != nil && snap.CompletedAt.Before(cutoff) {
+			delete(o.ops, id)
+		}
+	}
+}
+
+func GetOperation(ops *Operations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := ops.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, op)
+	}
+}
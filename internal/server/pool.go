@@ -0,0 +1,440 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/rugwirobaker/inferno/internal/vsock"
+)
+
+const (
+	// poolBootTimeout is how long a pooled VM gets to boot before it's discarded
+	poolBootTimeout = time.Minute
+	// poolRetryDelay spaces out refills after a VM failed to boot
+	poolRetryDelay = 30 * time.Second
+	// identityTimeout is how long init gets to accept an identity after resuming
+	identityTimeout = 10 * time.Second
+	// discardTimeout is how long a discarded VM gets to go away
+	discardTimeout = 10 * time.Second
+)
+
+// errUnusable is a pooled VM that has to be discarded rather than handed out
+var errUnusable = errors.New("pooled vm is unusable")
+
+// Pool keeps paused, pre-booted VMs for the templates in the config. A run
+// request matching a template is handed one of them instead of a cold boot,
+// the pool then refills in the background.
+type Pool struct {
+	cfg    *config.Config
+	host   Host
+	vms    *Registry
+	ops    *Operations
+	alloc  *Allocator
+	logger *slog.Logger
+
+	// ctx bounds the background refills, it's set by Start
+	ctx context.Context
+
+	mu        sync.Mutex
+	templates map[string]*poolTemplate
+}
+
+type poolTemplate struct {
+	key       string
+	image     string
+	size      int
+	resources kiln.Resources
+	machine   firecracker.MachineConfig
+
+	ready   []string // ids of paused VMs, oldest first
+	filling bool
+}
+
+// NewPool resolves the pool templates in the config
+func NewPool(cfg *config.Config, host Host, vms *Registry, ops *Operations, alloc *Allocator) (*Pool, error) {
+	p := &Pool{
+		cfg:       cfg,
+		host:      host,
+		vms:       vms,
+		ops:       ops,
+		alloc:     alloc,
+		logger:    slog.With("system", "pool"),
+		ctx:       context.Background(),
+		templates: make(map[string]*poolTemplate),
+	}
+
+	for _, pc := range cfg.Pools {
+		resources, machine, err := resolveResources(cfg, api.RunRequest{Image: pc.Image, CPUKind: pc.CPUKind, MemoryMB: pc.MemoryMB})
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool for %s: %w", pc.Image, err)
+		}
+
+		key := poolKey(pc.Image, resources)
+		if _, ok := p.templates[key]; ok {
+			return nil, fmt.Errorf("duplicate pool for %s", key)
+		}
+		p.templates[key] = &poolTemplate{
+			key:       key,
+			image:     pc.Image,
+			size:      pc.Size,
+			resources: resources,
+			machine:   machine,
+		}
+	}
+	return p, nil
+}
+
+// poolKey identifies the template a run request or VM belongs to
+func poolKey(image string, res kiln.Resources) string {
+	return fmt.Sprintf("%s|%s|%dMB", image, res.CPUKind, res.MemoryMB)
+}
+
+// Start adopts the pooled VMs that survived a daemon restart and starts
+// filling the templates until ctx is cancelled
+func (p *Pool) Start(ctx context.Context) {
+	p.mu.Lock()
+	p.ctx = ctx
+
+	var stale []string
+	for _, rec := range p.vms.List() {
+		if rec.Pool == "" {
+			continue
+		}
+		t, ok := p.templates[rec.Pool]
+		if !ok || rec.State != vm.StateRunning || len(t.ready) >= t.size {
+			stale = append(stale, rec.ID)
+			continue
+		}
+		t.ready = append(t.ready, rec.ID)
+	}
+	p.mu.Unlock()
+
+	for _, id := range stale {
+		go p.discard(id)
+	}
+	for _, t := range p.templates {
+		go p.fill(t)
+	}
+}
+
+// Claim hands out a pooled VM matching the request, resumed and carrying its
+// identity. It returns nil when no VM is ready. ErrNameInUse and registry
+// failures leave the VM in the pool.
+func (p *Pool) Claim(ctx context.Context, req api.RunRequest, resources kiln.Resources) (*api.VM, error) {
+	// pooled VMs don't track dirty pages
+	if p == nil || req.TrackDirtyPages {
+		return nil, nil
+	}
+
+	for {
+		p.mu.Lock()
+		t, ok := p.templates[poolKey(req.Image, resources)]
+		if !ok || len(t.ready) == 0 {
+			p.mu.Unlock()
+			return nil, nil
+		}
+		id := t.ready[0]
+		t.ready = t.ready[1:]
+		p.mu.Unlock()
+
+		// take the name first so a conflict leaves the VM untouched
+		err := p.take(id, req)
+		if err != nil && !errors.Is(err, errUnusable) {
+			p.mu.Lock()
+			t.ready = append([]string{id}, t.ready...)
+			p.mu.Unlock()
+
+			if errors.Is(err, ErrNameInUse) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to claim pooled vm %s of %s: %w", id, t.key, err)
+		}
+
+		var rec *api.VM
+		if err == nil {
+			rec, err = p.handOut(ctx, id, req)
+		}
+		go p.fill(t)
+
+		if err != nil {
+			p.logger.Warn("Discarding pooled VM", "vm-id", id, "error", err)
+			go p.discard(id)
+			continue
+		}
+
+		p.logger.Info("Handed out pooled VM", "vm-id", id, "template", t.key)
+		return rec, nil
+	}
+}
+
+// take gives a pooled VM the request's name and policy. A VM that can't be
+// handed out is reported with errUnusable, any other failure leaves it
+// untouched.
+func (p *Pool) take(id string, req api.RunRequest) error {
+	rec, err := p.vms.Get(id)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnusable, err)
+	}
+	if rec.State != vm.StateRunning {
+		return fmt.Errorf("%w: it is %s", errUnusable, rec.State)
+	}
+
+	_, err = p.vms.Update(id, func(rec *api.VM) {
+		rec.Name = req.Name
+		rec.RestartPolicy = req.RestartPolicy
+		rec.Ports = req.Ports
+		rec.Idle = req.Idle
+		rec.RateLimits = req.RateLimits
+		rec.Labels = req.Labels
+		rec.UserData = req.UserData
+		rec.Pool = ""
+	})
+	return err
+}
+
+// handOut resumes a VM taken from the pool and delivers its identity
+func (p *Pool) handOut(ctx context.Context, id string, req api.RunRequest) (*api.VM, error) {
+	rec, err := p.vms.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.vms.Control(id).Resume(ctx); err != nil {
+		return nil, fmt.Errorf("failed to resume: %w", err)
+	}
+	// pooled VMs boot unthrottled
+	if req.RateLimits != nil {
+		if _, err := p.vms.Control(id).UpdateRateLimits(ctx, req.RateLimits); err != nil {
+			return nil, fmt.Errorf("failed to apply rate limits: %w", err)
+		}
+	}
+
+	// init reads the metadata once it has its identity
+	err = publishMetadata(ctx, p.vms, rec, func(md *mmds.Metadata) {
+		md.Name = req.Name
+		md.Labels = req.Labels
+		md.UserData = req.UserData
+		if len(req.IPs) > 0 {
+			md.IPs = req.IPs
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := deliverIdentity(ctx, p.vms.Chroot(id), identityFor(id, req)); err != nil {
+		return nil, err
+	}
+	return p.vms.Get(id)
+}
+
+// fill boots VMs until the template is full, only one fill runs per template
+func (p *Pool) fill(t *poolTemplate) {
+	p.mu.Lock()
+	if t.filling {
+		p.mu.Unlock()
+		return
+	}
+	t.filling = true
+	p.mu.Unlock()
+
+	for {
+		p.mu.Lock()
+		ctx := p.ctx
+		if len(t.ready) >= t.size || ctx.Err() != nil {
+			t.filling = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		id, err := p.boot(ctx, t)
+		if err != nil {
+			p.logger.Warn("Failed to boot pooled VM", "template", t.key, "error", err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(poolRetryDelay):
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		t.ready = append(t.ready, id)
+		p.mu.Unlock()
+
+		p.logger.Info("Pooled VM ready", "vm-id", id, "template", t.key)
+	}
+}
+
+// boot provisions a VM for the template and pauses it once the guest is up
+func (p *Pool) boot(ctx context.Context, t *poolTemplate) (string, error) {
+	id, err := nanoid.Generate(HEX_ALPHABET, 8)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		chroot = p.vms.Chroot(id)
+		rb     = newRollback(p.logger.With("vm-id", id), p.cfg.KeepOnFailure)
+	)
+
+	if err := createChroot(chroot, rb); err != nil {
+		rb.run()
+		return "", err
+	}
+
+	rec := &api.VM{
+		ID:        id,
+		Image:     t.image,
+		State:     vm.StateInitializing,
+		Resources: t.resources,
+		CreatedAt: time.Now().UTC(),
+		Pool:      t.key,
+	}
+	if err := p.alloc.Admit(t.resources, func() error { return p.vms.Put(rec) }); err != nil {
+		rb.run()
+		return "", err
+	}
+	rb.add("record", func() error { return p.vms.Delete(id) })
+
+	op, err := p.ops.Create(id)
+	if err != nil {
+		rb.run()
+		return "", err
+	}
+
+	provision(ctx, p.cfg, p.host, p.vms, p.alloc, op, rb, api.RunRequest{Image: t.image}, t.resources, t.machine, true)
+	if snap := op.snapshot(); snap.Status == api.OperationFailed {
+		return "", errors.New(snap.Error)
+	}
+
+	if err := p.park(ctx, id); err != nil {
+		go p.discard(id)
+		return "", err
+	}
+	return id, nil
+}
+
+// park waits for the guest's init to report in, then pauses the VM. Init is
+// holding the main process back until it gets an identity.
+func (p *Pool) park(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, poolBootTimeout)
+	defer cancel()
+
+	ctrl := p.vms.Control(id)
+	for {
+		status, err := ctrl.Status(ctx)
+		if err == nil && status.BootedAt != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("vm did not boot: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if _, err := ctrl.Pause(ctx); err != nil {
+		return fmt.Errorf("failed to pause: %w", err)
+	}
+	return nil
+}
+
+// discard kills a pooled VM and removes it
+func (p *Pool) discard(id string) {
+	var logger = p.logger.With("vm-id", id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), discardTimeout)
+	defer cancel()
+
+	if machine := p.vms.Machine(id); machine != nil {
+		_, err := p.vms.Control(id).Shutdown(ctx, &kiln.ShutdownRequest{Reason: "discarding pooled VM", Force: true})
+		if err != nil {
+			logger.Warn("Failed to stop pooled VM, killing kiln", "error", err)
+			_ = machine.Kill()
+		}
+		select {
+		case <-machine.Done():
+		case <-ctx.Done():
+			logger.Error("Pooled VM did not stop")
+			return
+		}
+	}
+
+	if err := deleteTap(tapName(id)); err != nil {
+		logger.Warn("Failed to delete tap device", "error", err)
+	}
+	if err := p.vms.Delete(id); err != nil && !errors.Is(err, ErrNotFound) {
+		logger.Error("Failed to delete pooled VM", "error", err)
+	}
+}
+
+// identityFor is what turns a pooled VM into the one req asked for
+func identityFor(id string, req api.RunRequest) image.Identity {
+	identity := image.Identity{ID: id, Env: req.Env, IPs: req.IPs, Files: req.Files}
+	if req.Name != "" {
+		identity.ID = req.Name
+	}
+	return identity
+}
+
+// deliverIdentity posts the identity to init, retrying while the guest's API
+// comes back up after the resume
+func deliverIdentity(ctx context.Context, chroot string, identity image.Identity) error {
+	client := vsock.NewGuestClient(chroot, vsock.VsockAPIPort)
+
+	body, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, identityTimeout)
+	defer cancel()
+
+	for {
+		err := postIdentity(ctx, client, body)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to deliver identity: %w", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func postIdentity(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://firecracker/identity", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("init rejected identity: %s", resp.Status)
+	}
+	return nil
+}
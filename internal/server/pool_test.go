@@ -0,0 +1,70 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPoolTemplates tests that pools resolve their resources like run requests do.
+func TestPoolTemplates(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		alloc = server.NewAllocator(vms, server.Capacity{CPUs: 4, MemoryMB: 8192}, config.DefaultCapacity())
+		cfg   = config.Default()
+	)
+
+	cfg.Pools = []config.Pool{
+		{Image: "nginx:latest", Size: 2},
+		{Image: "nginx:latest", CPUKind: "shared-cpu-2x", Size: 1},
+	}
+	pool, err := server.NewPool(cfg, nil, vms, server.NewOperations(), alloc)
+	require.NoError(t, err)
+
+	// nothing has booted yet, the run request falls through to a cold boot
+	res := kiln.Resources{CPUKind: cfg.DefaultCPUKind, CPUCount: 1, MemoryMB: 128}
+	rec, err := pool.Claim(context.Background(), api.RunRequest{Image: "nginx:latest"}, res)
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	// the default cpu kind and its minimum memory are the same template
+	cfg.Pools = append(cfg.Pools, config.Pool{Image: "nginx:latest", CPUKind: cfg.DefaultCPUKind, MemoryMB: 128, Size: 1})
+	_, err = server.NewPool(cfg, nil, vms, server.NewOperations(), alloc)
+	assert.ErrorContains(t, err, "duplicate pool")
+
+	cfg.Pools = []config.Pool{{Image: "nginx:latest", MemoryMB: 1 << 20, Size: 1}}
+	_, err = server.NewPool(cfg, nil, vms, server.NewOperations(), alloc)
+	assert.ErrorContains(t, err, "supports 128 to")
+
+	var nilPool *server.Pool
+	rec, err = nilPool.Claim(context.Background(), api.RunRequest{Image: "nginx:latest"}, res)
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+}
+
+// TestPoolIdentity tests that a pooled VM gets everything of the run request
+// that it booted without.
+func TestPoolIdentity(t *testing.T) {
+	req := api.RunRequest{
+		Name:  "web",
+		Env:   map[string]string{"PORT": "8080"},
+		IPs:   []image.IPConfig{{IP: net.IPv4(172, 16, 0, 2), Gateway: net.IPv4(172, 16, 0, 1), Mask: 30}},
+		Files: []image.File{{Path: "/etc/app.conf", Mode: 0o644, Content: "listen 8080"}},
+	}
+
+	identity := server.IdentityFor("abcd1234", req)
+	assert.Equal(t, "web", identity.ID)
+	assert.Equal(t, req.Env, identity.Env)
+	assert.Equal(t, req.IPs, identity.IPs)
+	assert.Equal(t, req.Files, identity.Files)
+
+	assert.Equal(t, "abcd1234", server.IdentityFor("abcd1234", api.RunRequest{}).ID)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+// reattach resumes monitoring the VMs whose kiln is still running after a
+// daemon restart and settles the state of those that exited in the meantime
+func reattach(vms *Registry, alloc *Allocator) {
+	for _, rec := range vms.List() {
+		if !isActive(rec.State) {
+			continue
+		}
+
+		var (
+			logger = slog.With("vm-id", rec.ID)
+			chroot = vms.Chroot(rec.ID)
+		)
+
+		if pid := vms.KilnPID(rec.ID); pid != 0 && ownsChroot(pid, chroot) {
+			machine := vm.New(rec.ID, &vm.Config{Chroot: chroot})
+
+			if err := machine.Attach(pid); err == nil {
+				vms.SetMachine(rec.ID, machine)
+
+				_, err := vms.Update(rec.ID, func(rec *api.VM) {
+					rec.State = vm.StateRunning
+					rec.PID = pid
+				})
+				if err != nil {
+					logger.Error("Failed to update VM record", "error", err)
+				}
+
+				go monitorVM(vms, alloc, machine)
+
+				logger.Info("Reattached to VM", "pid", pid)
+				continue
+			}
+		}
+
+		// a VM that never finished booting was interrupted by the restart
+		state := vm.StateFailed
+		if rec.State == vm.StateRunning {
+			state = exitState(rec.ExitStatus)
+		}
+
+		now := time.Now().UTC()
+		_, err := vms.Update(rec.ID, func(rec *api.VM) {
+			rec.State = state
+			rec.PID = 0
+			rec.StoppedAt = &now
+		})
+		if err != nil {
+			logger.Error("Failed to update VM record", "error", err)
+			continue
+		}
+		logger.Info("VM exited while the daemon was down", "state", state)
+	}
+
+	// restart policies also apply to VMs that exited while the daemon was down
+	for _, rec := range vms.List() {
+		if isActive(rec.State) {
+			continue
+		}
+		// a connection wakes VMs scaled to zero, the pool replaces its own
+		if rec.IdledAt != nil || rec.Pool != "" {
+			continue
+		}
+
+		// unlike unless-stopped, always brings back VMs that were stopped through the API
+		if rec.RestartPolicy.Name == api.RestartAlways && rec.UserStopped {
+			updated, err := vms.Update(rec.ID, func(rec *api.VM) {
+				rec.UserStopped = false
+			})
+			if err != nil {
+				slog.Error("Failed to update VM record", "vm-id", rec.ID, "error", err)
+				continue
+			}
+			updated.ExitStatus = rec.ExitStatus
+			rec = updated
+		}
+
+		if restart, reason := ShouldRestart(rec.RestartPolicy, rec.ExitStatus, rec.RestartCount, rec.UserStopped); restart {
+			scheduleRestart(vms, alloc, rec.ID, rec.RestartCount, reason)
+		}
+	}
+}
+
+// ownsChroot guards against pid reuse, kiln always runs from within the VM's chroot
+func ownsChroot(pid int, chroot string) bool {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(chroot)
+	if err != nil {
+		return false
+	}
+	// the kernel reports the resolved path, the state dir may be a symlink
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return false
+	}
+	return cwd == resolved
+}
@@ -0,0 +1,54 @@
+package server_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOwnsChroot tests that a kiln is recognised through a symlinked state dir.
+func TestOwnsChroot(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		chroot = filepath.Join(dir, "vms", "abcd1234")
+		link   = filepath.Join(dir, "state")
+	)
+	require.NoError(t, os.MkdirAll(chroot, 0o755))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "vms"), link))
+
+	// kiln runs from within its chroot, so does this test
+	t.Chdir(chroot)
+
+	assert.True(t, server.OwnsChroot(os.Getpid(), chroot))
+	assert.True(t, server.OwnsChroot(os.Getpid(), filepath.Join(link, "abcd1234")))
+	assert.False(t, server.OwnsChroot(os.Getpid(), dir))
+	assert.False(t, server.OwnsChroot(os.Getpid(), filepath.Join(link, "gone")))
+}
+
+// TestReattachLeavesIdled tests that a daemon restart doesn't bring back VMs
+// the idle policy scaled to zero or pooled VMs, even with restart=always.
+func TestReattachLeavesIdled(t *testing.T) {
+	var (
+		vms     = server.NewRegistry(t.TempDir())
+		idledAt = time.Now().UTC()
+		always  = api.RestartPolicy{Name: api.RestartAlways}
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateStopped, RestartPolicy: always, UserStopped: true, IdledAt: &idledAt})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped, RestartPolicy: always, UserStopped: true, Pool: "shared"})
+
+	server.Reattach(vms, newAllocator(vms, 8, 8192))
+
+	for _, id := range []string{"vm1", "vm2"} {
+		rec, err := vms.Get(id)
+		require.NoError(t, err)
+		assert.True(t, rec.UserStopped, "%s is left for whoever brings it back", id)
+		assert.Equal(t, vm.StateStopped, rec.State)
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+const (
+	// recordFile is where the registry persists a VM record inside its chroot
+	recordFile = "vm.json"
+	// exitStatusFile is where kiln writes the exit status inside the chroot
+	exitStatusFile = "exit_status.json"
+	// pidFile is where kiln writes its pid inside the chroot, it's removed when kiln exits
+	pidFile = "kiln.pid"
+)
+
+var (
+	// ErrNotFound is returned when a VM is not known to the registry
+	ErrNotFound = errors.New("vm not found")
+	// ErrNameInUse is returned when another VM already has the requested name
+	ErrNameInUse = errors.New("vm name already in use")
+)
+
+// Registry keeps track of the VMs managed by the daemon.
+// Records live in memory and are persisted as vm.json inside each VM's chroot.
+type Registry struct {
+	mu       sync.RWMutex
+	dir      string
+	records  map[string]*api.VM
+	machines map[string]*vm.VM
+	// locks serialise lifecycle changes per VM
+	locks  map[string]*sync.Mutex
+	events *Events
+}
+
+// NewRegistry creates a registry rooted at dir (usually StateBaseDir/vms)
+func NewRegistry(dir string) *Registry {
+	return &Registry{
+		dir:      dir,
+		records:  make(map[string]*api.VM),
+		machines: make(map[string]*vm.VM),
+		locks:    make(map[string]*sync.Mutex),
+		events:   NewEvents(),
+	}
+}
+
+// Events returns the lifecycle events published as records change
+func (r *Registry) Events() *Events {
+	return r.events
+}
+
+// Load rebuilds the registry from the records persisted under its directory.
+// Chroots without a record are skipped, they were never fully registered.
+func (r *Registry) Load() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read vms directory: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(r.dir, entry.Name(), recordFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read vm record %s: %w", entry.Name(), err)
+		}
+
+		var rec api.VM
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("failed to decode vm record %s: %w", entry.Name(), err)
+		}
+		r.records[rec.ID] = &rec
+	}
+	return nil
+}
+
+// KilnPID returns the pid kiln recorded in the VM's chroot, or 0 if there is none
+func (r *Registry) KilnPID(id string) int {
+	data, err := os.ReadFile(filepath.Join(r.Chroot(id), pidFile))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Chroot returns the chroot directory of the VM with the given id
+func (r *Registry) Chroot(id string) string {
+	return filepath.Join(r.dir, id)
+}
+
+// Control returns a client for the control socket of the kiln supervising a VM
+func (r *Registry) Control(id string) *kiln.ControlClient {
+	return kiln.NewControlClient(filepath.Join(r.Chroot(id), kiln.DefaultControlSocket))
+}
+
+// Put adds or replaces a record and persists it, names must be unique
+func (r *Registry) Put(rec *api.VM) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rec.Name != "" {
+		for id, other := range r.records {
+			if id != rec.ID && other.Name == rec.Name {
+				return fmt.Errorf("%w: %s", ErrNameInUse, rec.Name)
+			}
+		}
+	}
+
+	if err := r.save(rec); err != nil {
+		return err
+	}
+	if _, ok := r.records[rec.ID]; !ok {
+		r.events.Publish(api.Event{Time: time.Now().UTC(), VMID: rec.ID, Type: api.EventCreated})
+	}
+	r.records[rec.ID] = rec
+	return nil
+}
+
+// Get returns a copy of the record with the given id, along with its exit status
+func (r *Registry) Get(id string) (*api.VM, error) {
+	r.mu.RLock()
+	rec, ok := r.records[id]
+	if !ok {
+		r.mu.RUnlock()
+		return nil, ErrNotFound
+	}
+	cp := *rec
+	r.mu.RUnlock()
+
+	r.readExit(&cp)
+	return &cp, nil
+}
+
+// List returns copies of all records ordered by creation time
+func (r *Registry) List() []*api.VM {
+	r.mu.RLock()
+	records := make([]*api.VM, 0, len(r.records))
+	for _, rec := range r.records {
+		cp := *rec
+		records = append(records, &cp)
+	}
+	r.mu.RUnlock()
+
+	for _, rec := range records {
+		r.readExit(rec)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records
+}
+
+// Update applies fn to the record with the given id and persists the result
+func (r *Registry) Update(id string, fn func(*api.VM)) (*api.VM, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *rec
+	fn(&cp)
+
+	if cp.Name != "" && cp.Name != rec.Name {
+		for other, o := range r.records {
+			if other != id && o.Name == cp.Name {
+				return nil, fmt.Errorf("%w: %s", ErrNameInUse, cp.Name)
+			}
+		}
+	}
+
+	if err := r.save(&cp); err != nil {
+		return nil, err
+	}
+	r.records[id] = &cp
+
+	for _, event := range transitionEvents(rec, &cp) {
+		r.events.Publish(event)
+	}
+
+	out := cp
+	return &out, nil
+}
+
+// Delete forgets a VM and removes its chroot
+func (r *Registry) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.records[id]; !ok {
+		return ErrNotFound
+	}
+	if err := os.RemoveAll(r.Chroot(id)); err != nil {
+		return fmt.Errorf("failed to remove chroot: %w", err)
+	}
+	delete(r.records, id)
+	delete(r.machines, id)
+	delete(r.locks, id)
+
+	r.events.Publish(api.Event{Time: time.Now().UTC(), VMID: id, Type: api.EventDeleted})
+	return nil
+}
+
+// Lock takes the lifecycle lock of a VM and returns the function releasing it.
+// Checking that a VM is stopped and starting it must happen under this lock
+// or two callers may both start kiln on the same chroot.
+func (r *Registry) Lock(id string) func() {
+	r.mu.Lock()
+	lock, ok := r.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.locks[id] = lock
+	}
+	r.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// SetMachine associates the running kiln process with a VM
+func (r *Registry) SetMachine(id string, machine *vm.VM) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.machines[id] = machine
+}
+
+// Machine returns the kiln process associated with a VM, if any
+func (r *Registry) Machine(id string) *vm.VM {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.machines[id]
+}
+
+func (r *Registry) save(rec *api.VM) error {
+	cp := *rec
+	cp.ExitStatus = nil
+	cp.ExitReason = ""
+	cp.Balloon = nil
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode vm record: %w", err)
+	}
+
+	path := filepath.Join(r.Chroot(rec.ID), recordFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write vm record: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename vm record: %w", err)
+	}
+	return nil
+}
+
+// readExit fills in how the VM last exited, if it has
+func (r *Registry) readExit(rec *api.VM) {
+	rec.ExitStatus = r.exitStatus(rec.ID)
+	if rec.ExitStatus != nil {
+		rec.ExitReason = kiln.Explain(rec.ExitStatus)
+	}
+}
+
+func (r *Registry) exitStatus(id string) *kiln.KilnExitStatus {
+	status, err := kiln.ReadExitStatus(filepath.Join(r.Chroot(id), exitStatusFile))
+	if err != nil {
+		return nil
+	}
+	return status
+}
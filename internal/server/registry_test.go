@@ -0,0 +1,81 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRegistry tests that records are persisted in their chroot and survive a reload.
+func TestRegistry(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		vms = server.NewRegistry(dir)
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", Name: "web", State: vm.StateStopped})
+	addVM(t, vms, &api.VM{ID: "vm2", Name: "db", State: vm.StateRunning})
+
+	err := vms.Put(&api.VM{ID: "vm3", Name: "web"})
+	assert.ErrorIs(t, err, server.ErrNameInUse)
+
+	_, err = vms.Update("vm2", func(rec *api.VM) { rec.Name = "web" })
+	assert.ErrorIs(t, err, server.ErrNameInUse)
+
+	rec, err := vms.Update("vm1", func(rec *api.VM) { rec.State = vm.StateRunning })
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, rec.State)
+
+	// records handed out are copies
+	rec.State = vm.StateFailed
+	rec, err = vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, rec.State)
+
+	reloaded := server.NewRegistry(dir)
+	require.NoError(t, reloaded.Load())
+	recs := reloaded.List()
+	require.Len(t, recs, 2)
+	assert.Equal(t, "vm1", recs[0].ID)
+	assert.Equal(t, vm.StateRunning, recs[0].State)
+	assert.Equal(t, "db", recs[1].Name)
+
+	require.NoError(t, vms.Delete("vm1"))
+	assert.NoDirExists(t, vms.Chroot("vm1"))
+	_, err = vms.Get("vm1")
+	assert.ErrorIs(t, err, server.ErrNotFound)
+	assert.ErrorIs(t, vms.Delete("vm1"), server.ErrNotFound)
+}
+
+// TestRegistryLock tests that a VM's lifecycle lock is held until released.
+func TestRegistryLock(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+
+	unlock := vms.Lock("vm1")
+
+	locked := make(chan struct{})
+	go func() {
+		defer vms.Lock("vm1")()
+		close(locked)
+	}()
+
+	// other VMs aren't held up
+	vms.Lock("vm2")()
+
+	select {
+	case <-locked:
+		t.Fatal("lock was taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lock was not released")
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+const (
+	// maxRestartEvents bounds the restart history kept in a VM record
+	maxRestartEvents = 10
+	// restartResetAfter is how long a VM has to stay up for its earlier
+	// restarts to be forgotten
+	restartResetAfter = 10 * time.Minute
+)
+
+// restartBackoff spaces out consecutive restarts of a crashing VM
+var restartBackoff = backoff.Backoff{
+	Min:    time.Second,
+	Max:    time.Minute,
+	Factor: 2,
+	Jitter: true,
+}
+
+// ShouldRestart applies the policy to the way a VM exited after restarts
+// consecutive restarts, it returns whether to restart it along with the reason
+func ShouldRestart(p api.RestartPolicy, status *kiln.KilnExitStatus, restarts int, userStopped bool) (bool, string) {
+	if userStopped {
+		return false, ""
+	}
+
+	reason, failed := exitReason(status)
+
+	switch p.Name {
+	case api.RestartAlways, api.RestartUnlessStopped:
+		return true, reason
+	case api.RestartOnFailure:
+		if !failed {
+			return false, ""
+		}
+		// zero means retry forever
+		if p.MaxRetries > 0 && restarts >= p.MaxRetries {
+			return false, ""
+		}
+		return true, reason
+	default:
+		return false, ""
+	}
+}
+
+// exitReason describes why a VM exited and whether that counts as a failure.
+// A stop request and init's own reports come first, then the main process's
+// exit status. What kiln saw on the console only matters without one, init
+// exiting panics the kernel even on a clean shutdown.
+func exitReason(status *kiln.KilnExitStatus) (string, bool) {
+	switch {
+	case status == nil:
+		return "kiln exited without an exit status", true
+	case status.StopRequest != nil && status.Health != nil && !status.Health.Healthy:
+		// kiln stopped a hung guest itself
+		return fmt.Sprintf("guest stopped responding after %d missed heartbeats", status.Health.Misses), true
+	case status.StopRequest != nil:
+		return "vm was stopped on request", false
+	case status.BootFailure != nil:
+		return fmt.Sprintf("init failed at the %s stage: %s", status.BootFailure.Stage, status.BootFailure.Error), true
+	case status.OOMKilled != nil && *status.OOMKilled:
+		return "process was killed by the OOM killer", true
+	case status.Signal != nil && *status.Signal != 0:
+		return fmt.Sprintf("process was killed by signal %d", *status.Signal), false
+	case status.ExitCode != nil && *status.ExitCode != 0:
+		return fmt.Sprintf("process exited with code %d", *status.ExitCode), true
+	case status.ExitCode != nil:
+		return "process exited with code 0", false
+	case status.CgroupOOM != nil && *status.CgroupOOM:
+		return "vm was killed by the host OOM killer", true
+	case status.Health != nil && !status.Health.Healthy:
+		return fmt.Sprintf("guest stopped responding after %d missed heartbeats", status.Health.Misses), true
+	case status.VMError != nil:
+		return fmt.Sprintf("vm error: %s", *status.VMError), true
+	case status.VMSignal != nil:
+		return fmt.Sprintf("vm was killed by signal %d", *status.VMSignal), true
+	case status.VMExitCode != nil && *status.VMExitCode != 0:
+		return fmt.Sprintf("vm exited with code %d", *status.VMExitCode), true
+	case status.Fault != nil && status.Fault.Reason == kiln.FaultKernelPanic:
+		return "guest kernel panicked", true
+	case status.Fault != nil && status.Fault.Reason == kiln.FaultGuestOOM:
+		return "guest ran out of memory", true
+	default:
+		return "guest shut down without reporting an exit status", true
+	}
+}
+
+// settleRestarts forgets the restarts of a VM that ran for restartResetAfter
+// before it exited, a crash after a healthy run starts the backoff and the
+// retry budget over
+func settleRestarts(rec *api.VM, stoppedAt time.Time) {
+	if rec.StartedAt != nil && stoppedAt.Sub(*rec.StartedAt) >= restartResetAfter {
+		resetRestarts(rec)
+	}
+}
+
+// scheduleRestart restarts the VM once its backoff delay has passed, it keeps
+// retrying while the host doesn't have room for the VM
+func scheduleRestart(vms *Registry, alloc *Allocator, id string, attempt int, reason string) {
+	var (
+		logger = slog.With("vm-id", id)
+		delay  = restartBackoff.ForAttempt(float64(attempt))
+	)
+
+	logger.Info("Scheduling VM restart", "reason", reason, "delay", delay, "attempt", attempt+1)
+
+	time.AfterFunc(delay, func() {
+		unlock := vms.Lock(id)
+		defer unlock()
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			logger.Debug("Skipping restart", "error", err)
+			return
+		}
+		// the VM was started or stopped through the API in the meantime
+		if isActive(rec.State) || rec.UserStopped {
+			return
+		}
+
+		err = alloc.Admit(rec.Resources, func() error {
+			_, err := vms.Update(id, func(rec *api.VM) {
+				rec.RestartCount++
+				rec.Restarts = append(rec.Restarts, api.RestartEvent{At: time.Now().UTC(), Reason: reason})
+				if n := len(rec.Restarts); n > maxRestartEvents {
+					rec.Restarts = rec.Restarts[n-maxRestartEvents:]
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("failed to record restart: %w", err)
+			}
+			return startVM(vms, alloc, id)
+		})
+		if errors.Is(err, ErrInsufficientCapacity) {
+			logger.Warn("Postponing VM restart", "error", err)
+			scheduleRestart(vms, alloc, id, attempt+1, reason)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to restart VM", "error", err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/image"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/pointer"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func exited(code int64) *kiln.KilnExitStatus {
+	return &kiln.KilnExitStatus{VMExitCode: pointer.Int64(0), ExitCode: pointer.Int64(code)}
+}
+
+// TestRestartPolicy tests restart decisions for each policy.
+func TestRestartPolicy(t *testing.T) {
+	oom := exited(137)
+	oom.OOMKilled = pointer.Bool(true)
+
+	killed := &kiln.KilnExitStatus{VMExitCode: pointer.Int64(-1), VMSignal: pointer.Int64(9)}
+	killedOnStop := &kiln.KilnExitStatus{
+		VMExitCode:  pointer.Int64(-1),
+		VMSignal:    pointer.Int64(9),
+		StopRequest: &kiln.StopRequest{Source: kiln.StopSourceSignal, Signal: 15},
+	}
+	// init exiting panics the kernel, the exit status is what counts
+	exitedThenPanicked := exited(0)
+	exitedThenPanicked.Fault = &kiln.Fault{Reason: kiln.FaultKernelPanic}
+	panicked := &kiln.KilnExitStatus{VMExitCode: pointer.Int64(0), Fault: &kiln.Fault{Reason: kiln.FaultKernelPanic}}
+	stoppedAfterPanic := exited(0)
+	stoppedAfterPanic.Fault = &kiln.Fault{Reason: kiln.FaultKernelPanic}
+	stoppedAfterPanic.StopRequest = &kiln.StopRequest{Source: kiln.StopSourceControl}
+	hungAndStopped := &kiln.KilnExitStatus{
+		VMExitCode:  pointer.Int64(-1),
+		VMSignal:    pointer.Int64(9),
+		Health:      &kiln.Health{Misses: 3},
+		StopRequest: &kiln.StopRequest{Source: kiln.StopSourceControl, Force: true},
+	}
+	bootFailed := exited(0)
+	bootFailed.ExitCode = nil
+	bootFailed.BootFailure = &image.BootFailure{Stage: "networking", Error: "no such device"}
+	hostOOM := &kiln.KilnExitStatus{VMExitCode: pointer.Int64(-1), VMSignal: pointer.Int64(9)}
+	hostOOM.CgroupOOM = pointer.Bool(true)
+
+	tests := []struct {
+		name        string
+		policy      api.RestartPolicy
+		status      *kiln.KilnExitStatus
+		restarts    int
+		userStopped bool
+		want        bool
+	}{
+		{"no policy", api.RestartPolicy{}, exited(1), 0, false, false},
+		{"no", api.RestartPolicy{Name: api.RestartNo}, exited(1), 0, false, false},
+		{"always after success", api.RestartPolicy{Name: api.RestartAlways}, exited(0), 5, false, true},
+		{"always after user stop", api.RestartPolicy{Name: api.RestartAlways}, exited(0), 0, true, false},
+		{"unless-stopped after failure", api.RestartPolicy{Name: api.RestartUnlessStopped}, exited(1), 0, false, true},
+		{"unless-stopped after user stop", api.RestartPolicy{Name: api.RestartUnlessStopped}, exited(1), 0, true, false},
+		{"on-failure after success", api.RestartPolicy{Name: api.RestartOnFailure}, exited(0), 0, false, false},
+		{"on-failure after failure", api.RestartPolicy{Name: api.RestartOnFailure, MaxRetries: 3}, exited(1), 2, false, true},
+		{"on-failure retries exhausted", api.RestartPolicy{Name: api.RestartOnFailure, MaxRetries: 3}, exited(1), 3, false, false},
+		{"on-failure unlimited", api.RestartPolicy{Name: api.RestartOnFailure}, exited(1), 100, false, true},
+		{"on-failure oom", api.RestartPolicy{Name: api.RestartOnFailure}, oom, 0, false, true},
+		{"on-failure vm crash", api.RestartPolicy{Name: api.RestartOnFailure}, &kiln.KilnExitStatus{VMExitCode: pointer.Int64(1)}, 0, false, true},
+		{"on-failure vm killed", api.RestartPolicy{Name: api.RestartOnFailure}, killed, 0, false, true},
+		{"on-failure vm killed after stop request", api.RestartPolicy{Name: api.RestartOnFailure}, killedOnStop, 0, false, false},
+		{"on-failure kernel panic", api.RestartPolicy{Name: api.RestartOnFailure}, panicked, 0, false, true},
+		{"on-failure clean exit with init's panic", api.RestartPolicy{Name: api.RestartOnFailure}, exitedThenPanicked, 0, false, false},
+		{"on-failure stop request with a panic", api.RestartPolicy{Name: api.RestartOnFailure}, stoppedAfterPanic, 0, false, false},
+		{"on-failure hung guest stopped by kiln", api.RestartPolicy{Name: api.RestartOnFailure}, hungAndStopped, 0, false, true},
+		{"on-failure boot failure", api.RestartPolicy{Name: api.RestartOnFailure}, bootFailed, 0, false, true},
+		{"on-failure host oom", api.RestartPolicy{Name: api.RestartOnFailure}, hostOOM, 0, false, true},
+		{"on-failure no exit status", api.RestartPolicy{Name: api.RestartOnFailure}, nil, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := server.ShouldRestart(tt.policy, tt.status, tt.restarts, tt.userStopped)
+			assert.Equal(t, tt.want, got)
+			if got {
+				assert.NotEmpty(t, reason)
+			}
+		})
+	}
+}
+
+// TestRestartPolicyValidate tests that malformed policies are rejected.
+func TestRestartPolicyValidate(t *testing.T) {
+	assert.NoError(t, api.RestartPolicy{}.Validate())
+	assert.NoError(t, api.RestartPolicy{Name: api.RestartOnFailure, MaxRetries: 5}.Validate())
+	assert.Error(t, api.RestartPolicy{Name: "sometimes"}.Validate())
+	assert.Error(t, api.RestartPolicy{Name: api.RestartAlways, MaxRetries: 5}.Validate())
+	assert.Error(t, api.RestartPolicy{Name: api.RestartOnFailure, MaxRetries: -1}.Validate())
+}
+
+// TestSettleRestarts tests that restarts are forgotten once a VM ran long enough.
+func TestSettleRestarts(t *testing.T) {
+	started := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		started *time.Time
+		ran     time.Duration
+		want    int
+	}{
+		{"crashed right away", &started, 5 * time.Second, 4},
+		{"crashed after a healthy run", &started, time.Hour, 0},
+		{"never started", nil, time.Hour, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &api.VM{StartedAt: tt.started, RestartCount: 4}
+			server.SettleRestarts(rec, started.Add(tt.ran))
+			assert.Equal(t, tt.want, rec.RestartCount)
+		})
+	}
+}
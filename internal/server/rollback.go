@@ -0,0 +1,51 @@
+package server
+
+import (
+	"log/slog"
+)
+
+// cleanup undoes a single step of VM creation
+type cleanup struct {
+	name string
+	fn   func() error
+}
+
+// rollback collects cleanups for every resource created while building a VM
+// and runs them in reverse order when creation fails
+type rollback struct {
+	logger   *slog.Logger
+	keep     bool
+	cleanups []cleanup
+}
+
+// newRollback returns a rollback, with keep set the cleanups are logged but
+// not run so the artifacts can be inspected
+func newRollback(logger *slog.Logger, keep bool) *rollback {
+	return &rollback{logger: logger, keep: keep}
+}
+
+// add registers fn to undo the named resource
+func (r *rollback) add(name string, fn func() error) {
+	r.cleanups = append(r.cleanups, cleanup{name: name, fn: fn})
+}
+
+// run executes the registered cleanups in reverse order, it keeps going when one fails
+func (r *rollback) run() {
+	if r.keep {
+		for _, c := range r.cleanups {
+			r.logger.Warn("Keeping artifact after failure", "resource", c.name)
+		}
+		r.cleanups = nil
+		return
+	}
+
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		c := r.cleanups[i]
+		if err := c.fn(); err != nil {
+			r.logger.Error("Failed to clean up", "resource", c.name, "error", err)
+			continue
+		}
+		r.logger.Debug("Cleaned up", "resource", c.name)
+	}
+	r.cleanups = nil
+}
@@ -0,0 +1,87 @@
+package server_test
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRollback tests that cleanups run in reverse order and a failing one doesn't stop the rest.
+func TestRollback(t *testing.T) {
+	var ran []string
+	cleanup := func(name string, err error) func() error {
+		return func() error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+
+	rb := server.NewRollback(slog.Default(), false)
+	rb.Add("chroot", cleanup("chroot", nil))
+	rb.Add("tap", cleanup("tap", errors.New("no such device")))
+	rb.Add("record", cleanup("record", nil))
+	rb.Run()
+	assert.Equal(t, []string{"record", "tap", "chroot"}, ran)
+
+	// cleanups only run once
+	rb.Run()
+	assert.Len(t, ran, 3)
+
+	ran = nil
+	rb = server.NewRollback(slog.Default(), true)
+	rb.Add("chroot", cleanup("chroot", nil))
+	rb.Run()
+	assert.Empty(t, ran, "kept artifacts are left alone")
+}
+
+// TestRollbackKillsVM tests that a VM that was started is killed before its chroot is removed.
+func TestRollbackKillsVM(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		alloc = newAllocator(vms, 8, 8192)
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateStopped})
+	fakeKiln(t, vms, "vm1")
+
+	rec := serve(server.StartVM(vms, alloc), "POST /vms/{id}/start", http.MethodPost, "/vms/vm1/start", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	machine := vms.Machine("vm1")
+
+	// the order the create handler registers them in
+	var removedUnderKiln bool
+	running := func() bool {
+		select {
+		case <-machine.Done():
+			return false
+		default:
+			return true
+		}
+	}
+	rb := server.NewRollback(slog.Default(), false)
+	rb.Add("chroot", func() error {
+		removedUnderKiln = removedUnderKiln || running()
+		return os.RemoveAll(vms.Chroot("vm1"))
+	})
+	// removes the chroot as well
+	rb.Add("record", func() error {
+		removedUnderKiln = removedUnderKiln || running()
+		return vms.Delete("vm1")
+	})
+	rb.Add("kiln", func() error { return server.KillVM(vms, "vm1") })
+
+	rb.Run()
+
+	assert.False(t, removedUnderKiln, "the chroot was removed from under kiln")
+	assert.NoDirExists(t, vms.Chroot("vm1"))
+
+	// nothing to kill
+	assert.NoError(t, server.KillVM(vms, "vm1"))
+}
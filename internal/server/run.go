@@ -2,22 +2,28 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/cavaliergopher/cpio"
 	"github.com/klauspost/compress/zstd"
 	nanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/rugwirobaker/inferno/internal/api"
 	"github.com/rugwirobaker/inferno/internal/config"
 	"github.com/rugwirobaker/inferno/internal/firecracker"
 	"github.com/rugwirobaker/inferno/internal/image"
 	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/mmds"
 	"github.com/rugwirobaker/inferno/internal/pointer"
 	"github.com/rugwirobaker/inferno/internal/sys"
 	"github.com/rugwirobaker/inferno/internal/vm"
@@ -30,20 +36,11 @@ const (
 
 const HEX_ALPHABET = "1234567890abcdef"
 
-type runRequest struct {
-	Image    string `json:"image"`
-	CPUKind  string `json:"cpu_kind"`
-	CPUCount int    `json:"cpu_count"`
-	MemoryMB int    `json:"memory_mb"`
-}
-
-func Run(cfg *config.Config, images *image.Manager) http.HandlerFunc {
+func Run(cfg *config.Config, host Host, vms *Registry, ops *Operations, alloc *Allocator, pool *Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			logger = slog.With("system", "server")
-			ctx    = r.Context()
-		)
-		var req runRequest
+		var logger = slog.With("system", "server")
+
+		var req api.RunRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			logger.Error("Failed to decode request", "error", err)
 
@@ -51,162 +48,375 @@ func Run(cfg *config.Config, images *image.Manager) http.HandlerFunc {
 			return
 		}
 
-		id, err := nanoid.Generate(HEX_ALPHABET, 8)
-		if err != nil {
-			logger.Error("Failed to generate VM ID", "error", err)
-
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := validateName(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		var chroot = filepath.Join(cfg.StateBaseDir, "vms", id)
-
-		if err := os.MkdirAll(chroot, 0o755); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to create chroot", "error", err)
-
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := req.RestartPolicy.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		if err := os.Chown(chroot, firecracker.DefaultJailerUID, firecracker.DefaultJailerGID); err != nil {
-			slog.With(slog.String("vm-id", id)).Error("Failed to chown chroot", "error", err)
-
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := api.ValidatePorts(req.Ports); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Copy the kernel and init to the chroot
-		if err := sys.CopyFile(cfg.KernelPath, filepath.Join(chroot, "vmlinux"), 0644); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to copy kernel", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if req.Idle != nil {
+			if err := req.Idle.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// traffic is only seen on the ports the daemon proxies
+			if len(req.Ports) == 0 {
+				http.Error(w, "an idle policy needs published ports", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := req.RateLimits.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// copy the firecracker binary to the chroot
-		if err := sys.CopyFile(cfg.FirecrackerBinPath, filepath.Join(chroot, "firecracker"), 0755); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to copy firecracker", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if _, ok := req.Labels[""]; ok {
+			http.Error(w, "label keys must not be empty", http.StatusBadRequest)
 			return
 		}
 
-		// copy kiln binary to the chroot
-		if err := sys.CopyFile(cfg.KilnBinPath, filepath.Join(chroot, "kiln"), 0755); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to copy kiln", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		resources, machine, err := resolveResources(cfg, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// ensure the image is cached locally at /var
-		if err := images.FetchImage(ctx, req.Image); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to fetch image", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// a pre-booted VM skips everything below
+		claimedAt := time.Now()
+		pooled, err := pool.Claim(r.Context(), req, resources)
+		if errors.Is(err, ErrNameInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
-
-		// extract the image from manifest
-		img, err := images.CreateConfig(ctx, req.Image)
 		if err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to create image config", "error", err)
+			logger.Error("Failed to claim pooled VM", "image", req.Image, "error", err)
+
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if pooled != nil {
+			op, err := ops.Create(pooled.ID)
+			if err != nil {
+				logger.With(slog.String("vm-id", pooled.ID)).Error("Failed to create operation", "error", err)
 
-		// package init files
-		files := make(map[string][]byte)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			op.record(api.PhaseClaimPooled, claimedAt, nil)
+			op.finish(nil)
 
-		initBinaryPath := filepath.Join(chroot, "init") // Assuming init binary is copied to vmdir
+			snap := op.snapshot()
 
-		initContent, err := os.ReadFile(initBinaryPath)
-		if err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to read init binary", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			w.Header().Set("Location", "/operations/"+snap.ID)
+			writeJSON(w, http.StatusAccepted, api.RunResponse{ID: pooled.ID, OperationID: snap.ID})
 			return
 		}
-		files["inferno/init"] = initContent
 
-		// Convert run configuration to bytes (JSON)
-		imageConfigJSON, err := img.Marshal()
+		id, err := nanoid.Generate(HEX_ALPHABET, 8)
 		if err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to marshal image config", "error", err)
+			logger.Error("Failed to generate VM ID", "error", err)
+
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		files["inferno/run.json"] = imageConfigJSON
 
-		_, err = createInitrd(chroot, files)
-		if err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to create initrd", "error", err)
+		var (
+			chroot = vms.Chroot(id)
+			rb     = newRollback(logger.With("vm-id", id), cfg.KeepOnFailure)
+		)
+
+		// copying the binaries in is left to provision
+		if err := createChroot(chroot, rb); err != nil {
+			logger.With(slog.String("vm-id", id)).Error("Failed to create chroot", "error", err)
+			rb.run()
+
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// create the rootfs device
-		if err := images.CreateRootFS(ctx, req.Image, filepath.Join(chroot, "rootfs.ext4")); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to create rootfs", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		rec := &api.VM{
+			ID:        id,
+			Name:      req.Name,
+			Image:     req.Image,
+			State:     vm.StateInitializing,
+			Resources: resources,
+			CreatedAt: time.Now().UTC(),
+
+			RestartPolicy: req.RestartPolicy,
+			Ports:         req.Ports,
+			Idle:          req.Idle,
+			RateLimits:    req.RateLimits,
+			Labels:        req.Labels,
+			UserData:      req.UserData,
 		}
 
-		// create the firecracker config
-		fcConfig, err := firecrackerConfig(id, chroot, filepath.Join(chroot, initDeviceName))
-		if err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to create firecracker config", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// registering the VM as initializing commits its resources
+		err = alloc.Admit(resources, func() error { return vms.Put(rec) })
+		if errors.Is(err, ErrInsufficientCapacity) || errors.Is(err, ErrNameInUse) {
+			logger.With(slog.String("vm-id", id)).Warn("Rejected VM", "error", err)
+			rb.run()
+
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
+		if err != nil {
+			logger.With(slog.String("vm-id", id)).Error("Failed to register VM", "error", err)
+			rb.run()
 
-		// write the firecracker config to a file
-		fcConfigPath := filepath.Join(chroot, "firecracker.json")
-
-		if err := firecracker.WriteConfig(fcConfigPath, fcConfig); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to write firecracker config", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		rb.add("record", func() error { return vms.Delete(id) })
+
+		op, err := ops.Create(id)
+		if err != nil {
+			logger.With(slog.String("vm-id", id)).Error("Failed to create operation", "error", err)
+			rb.run()
 
-		if err := os.Chown(fcConfigPath, firecracker.DefaultJailerUID, firecracker.DefaultJailerGID); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to chown firecracker config", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// create kiln config
-		kilnConfig, err := kilnConfig(id, cfg.LogDir, kiln.Resources{
-			CPUKind:  req.CPUKind,
-			CPUCount: req.CPUCount,
-			MemoryMB: req.MemoryMB,
+		// the rest of the work outlives the request so it must not use its context
+		go provision(context.Background(), cfg, host, vms, alloc, op, rb, req, resources, machine, false)
+
+		snap := op.snapshot()
+
+		w.Header().Set("Location", "/operations/"+snap.ID)
+		writeJSON(w, http.StatusAccepted, api.RunResponse{ID: id, OperationID: snap.ID})
+	}
+}
+
+// namePattern restricts VM names to something safe to use in paths and host names
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// validateName checks an optional VM name
+func validateName(name string) error {
+	if name != "" && !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid name %q: must start with a letter or digit and contain at most 63 letters, digits, '_', '.' or '-'", name)
+	}
+	return nil
+}
+
+// prepareChroot creates the VM's chroot and copies the kernel, init, firecracker and kiln into it
+func prepareChroot(cfg *config.Config, chroot string, rb *rollback) error {
+	if err := createChroot(chroot, rb); err != nil {
+		return err
+	}
+	return installBinaries(cfg, chroot)
+}
+
+// createChroot creates the VM's chroot owned by the jailer user
+func createChroot(chroot string, rb *rollback) error {
+	if err := os.MkdirAll(chroot, 0o755); err != nil {
+		return fmt.Errorf("failed to create chroot: %w", err)
+	}
+	rb.add("chroot", func() error { return os.RemoveAll(chroot) })
+
+	if err := os.Chown(chroot, firecracker.DefaultJailerUID, firecracker.DefaultJailerGID); err != nil {
+		return fmt.Errorf("failed to chown chroot: %w", err)
+	}
+	return nil
+}
+
+// installBinaries copies the kernel, init, firecracker and kiln into the chroot
+func installBinaries(cfg *config.Config, chroot string) error {
+	// Copy the kernel and init to the chroot
+	if err := sys.CopyFile(cfg.KernelPath, filepath.Join(chroot, "vmlinux"), 0644); err != nil {
+		return fmt.Errorf("failed to copy kernel: %w", err)
+	}
+	if err := sys.CopyFile(cfg.InitPath, filepath.Join(chroot, "init"), 0755); err != nil {
+		return fmt.Errorf("failed to copy init: %w", err)
+	}
+
+	// copy the firecracker binary to the chroot
+	if err := sys.CopyFile(cfg.FirecrackerBinPath, filepath.Join(chroot, "firecracker"), 0755); err != nil {
+		return fmt.Errorf("failed to copy firecracker: %w", err)
+	}
+
+	// copy kiln binary to the chroot
+	if err := sys.CopyFile(cfg.KilnBinPath, filepath.Join(chroot, "kiln"), 0755); err != nil {
+		return fmt.Errorf("failed to copy kiln: %w", err)
+	}
+	return nil
+}
+
+// provision runs the slow part of creating a VM, each step is reported as a phase of op.
+// Every resource it creates is registered with rb so a failure leaves nothing behind.
+// A pooled VM boots without an identity, init waits for one before starting the main process.
+func provision(ctx context.Context, cfg *config.Config, host Host, vms *Registry, alloc *Allocator, op *operation, rb *rollback, req api.RunRequest, resources kiln.Resources, machine firecracker.MachineConfig, pooled bool) {
+	var (
+		id     = op.snapshot().VMID
+		chroot = vms.Chroot(id)
+		logger = slog.With("system", "server", "vm-id", id)
+		img    *image.Config
+	)
+
+	err := func() error {
+		err := op.phase(api.PhasePrepareChroot, func() error {
+			return installBinaries(cfg, chroot)
 		})
 		if err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to create kiln config", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
 
-		// write the kiln config to a file
-		if err := kiln.WriteConfig(filepath.Join(chroot, "kiln.json"), kilnConfig); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to write kiln config", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		err = op.phase(api.PhaseFetchImage, func() (err error) {
+			// ensure the image is cached locally at /var
+			if err := host.FetchImage(ctx, req.Image); err != nil {
+				return fmt.Errorf("failed to fetch image: %w", err)
+			}
+			// extract the image from manifest
+			img, err = host.CreateConfig(ctx, req.Image)
+			if err != nil {
+				return fmt.Errorf("failed to create image config: %w", err)
+			}
+
+			if len(req.Env) > 0 && img.Env == nil {
+				img.Env = make(map[string]string, len(req.Env))
+			}
+			for k, v := range req.Env {
+				img.Env[k] = v
+			}
+			if len(req.IPs) > 0 {
+				img.IPs = req.IPs
+			}
+			img.Files = append(img.Files, req.Files...)
+			img.WaitForIdentity = pooled
+			img.MMDS = true
+			img.HeartbeatIntervalS = cfg.Heartbeat.IntervalS
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		vm := vm.New(id, &vm.Config{
-			Chroot: chroot,
+		err = op.phase(api.PhaseBuildInitrd, func() error {
+			// package init files
+			files := make(map[string][]byte)
+
+			initBinaryPath := filepath.Join(chroot, "init")
+
+			initContent, err := os.ReadFile(initBinaryPath)
+			if err != nil {
+				return fmt.Errorf("failed to read init binary: %w", err)
+			}
+			files["inferno/init"] = initContent
+
+			// Convert run configuration to bytes (JSON)
+			imageConfigJSON, err := img.Marshal()
+			if err != nil {
+				return fmt.Errorf("failed to marshal image config: %w", err)
+			}
+			files["inferno/run.json"] = imageConfigJSON
+
+			rb.add("initrd", func() error { return os.RemoveAll(filepath.Join(chroot, initDeviceName)) })
+
+			if _, err := createInitrd(chroot, files); err != nil {
+				return fmt.Errorf("failed to create initrd: %w", err)
+			}
+			return nil
 		})
+		if err != nil {
+			return err
+		}
 
-		if err := vm.Start(ctx); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to start VM", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		err = op.phase(api.PhaseCreateRootFS, func() error {
+			rootfs := filepath.Join(chroot, "rootfs.ext4")
+
+			// a partially written rootfs must be removed as well
+			rb.add("rootfs", func() error { return os.RemoveAll(rootfs) })
+
+			if err := host.CreateRootFS(ctx, req.Image, rootfs); err != nil {
+				return fmt.Errorf("failed to create rootfs: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(map[string]string{"id": id}); err != nil {
-			logger.With(slog.String("vm-id", id)).Error("Failed to encode response", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		err = op.phase(api.PhaseWriteConfigs, func() error {
+			tap := tapName(id)
+			if err := host.CreateTap(tap); err != nil {
+				return err
+			}
+			rb.add("tap", func() error { return deleteTap(tap) })
+
+			fcConfig, err := firecrackerConfig(id, initDeviceName, machine)
+			if err != nil {
+				return fmt.Errorf("failed to create firecracker config: %w", err)
+			}
+			req.RateLimits.ApplyTo(fcConfig)
+
+			fcConfigPath := filepath.Join(chroot, "firecracker.json")
+
+			if err := firecracker.WriteConfig(fcConfigPath, fcConfig); err != nil {
+				return fmt.Errorf("failed to write firecracker config: %w", err)
+			}
+
+			if err := os.Chown(fcConfigPath, firecracker.DefaultJailerUID, firecracker.DefaultJailerGID); err != nil {
+				return fmt.Errorf("failed to chown firecracker config: %w", err)
+			}
+
+			kilnConfig, err := kilnConfig(cfg, id, resources)
+			if err != nil {
+				return fmt.Errorf("failed to create kiln config: %w", err)
+			}
+			kilnConfig.RateLimits = req.RateLimits
+			kilnConfig.Metadata = &mmds.Metadata{
+				ID:       id,
+				Name:     req.Name,
+				Image:    req.Image,
+				IPs:      img.IPs,
+				Labels:   req.Labels,
+				UserData: req.UserData,
+			}
+
+			if err := kiln.WriteConfig(filepath.Join(chroot, "kiln.json"), kilnConfig); err != nil {
+				return fmt.Errorf("failed to write kiln config: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
+
+		return op.phase(api.PhaseBoot, func() error {
+			// registered last so it runs before the chroot is removed
+			rb.add("kiln", func() error { return killVM(vms, id) })
+
+			if err := startVM(vms, alloc, id); err != nil {
+				return fmt.Errorf("failed to start VM: %w", err)
+			}
+			return nil
+		})
+	}()
+
+	op.finish(err)
+
+	if err == nil {
+		logger.Info("VM provisioned", "operation", op.snapshot().ID)
+		return
+	}
+
+	logger.Error("Failed to provision VM", "error", err)
+
+	_, uerr := vms.Update(id, func(rec *api.VM) {
+		now := time.Now().UTC()
+		rec.State = vm.StateFailed
+		rec.StoppedAt = &now
+	})
+	if uerr != nil {
+		logger.Error("Failed to mark VM as failed", "error", uerr)
 	}
+
+	rb.run()
 }
 
 func createInitrd(chroot string, files map[string][]byte) (string, error) {
@@ -251,7 +461,46 @@ func createInitrd(chroot string, files map[string][]byte) (string, error) {
 	return path, nil
 }
 
-func firecrackerConfig(id, chroot, initrdPath string) (*firecracker.Config, error) {
+// resolveResources validates the requested resources against the CPU kind catalog
+func resolveResources(cfg *config.Config, req api.RunRequest) (kiln.Resources, firecracker.MachineConfig, error) {
+	name, kind, err := cfg.ResolveCPUKind(req.CPUKind)
+	if err != nil {
+		return kiln.Resources{}, firecracker.MachineConfig{}, err
+	}
+
+	if req.CPUCount != 0 && req.CPUCount != kind.VCPUs {
+		return kiln.Resources{}, firecracker.MachineConfig{}, fmt.Errorf("cpu kind %s has %d vCPUs, got cpu_count %d", name, kind.VCPUs, req.CPUCount)
+	}
+
+	memory := req.MemoryMB
+	if memory == 0 {
+		memory = kind.MinMemoryMB
+	}
+	if memory < kind.MinMemoryMB || memory > kind.MaxMemoryMB {
+		return kiln.Resources{}, firecracker.MachineConfig{}, fmt.Errorf("cpu kind %s supports %d to %d MB of memory, got %d", name, kind.MinMemoryMB, kind.MaxMemoryMB, memory)
+	}
+
+	resources := kiln.Resources{
+		CPUKind:  name,
+		CPUCount: kind.VCPUs,
+		MemoryMB: memory,
+		CPUQuota: kind.CPUQuotaPercent,
+	}
+	machine := firecracker.MachineConfig{
+		VCPUCount:   kind.VCPUs,
+		MemSizeMib:  memory,
+		SMT:         kind.SMT,
+		CPUTemplate: kind.CPUTemplate,
+		// needed for diff snapshots
+		TrackDirtyPages: req.TrackDirtyPages,
+	}
+	return resources, machine, nil
+}
+
+// firecrackerConfig builds the VM's firecracker config. Paths are relative to
+// the chroot firecracker runs in, snapshots record them and are restored into
+// other chroots.
+func firecrackerConfig(id, initrdPath string, machine firecracker.MachineConfig) (*firecracker.Config, error) {
 	mac, err := generateMAC()
 	if err != nil {
 		return nil, err
@@ -264,27 +513,24 @@ func firecrackerConfig(id, chroot, initrdPath string) (*firecracker.Config, erro
 
 	fcConfig := &firecracker.Config{
 		BootSource: firecracker.BootSource{
-			KernelImagePath: filepath.Join(chroot, "vmlinux"),
+			KernelImagePath: "vmlinux",
 			InitrdPath:      pointer.String(initrdPath),
 			BootArgs:        strings.Join(kargs, " "),
 		},
 		Drives: []firecracker.Drive{
 			{
-				DriveID:      "rootfs",
-				PathOnHost:   filepath.Join(chroot, "rootfs.ext4"),
+				DriveID:      kiln.RootFSDriveID,
+				PathOnHost:   "rootfs.ext4",
 				IsRootDevice: false,
 				IsReadOnly:   false,
 			},
 		},
-		MachineConfig: firecracker.MachineConfig{
-			VCPUCount:  2,
-			MemSizeMib: 1024,
-		},
+		MachineConfig: machine,
 		NetworkInterfaces: []firecracker.NetworkInterface{
 			{
-				IfaceName: "eth0",
-				HostDev:   fmt.Sprintf("vm%s", id),
-				Mac:       mac,
+				IfaceID: kiln.NetworkIfaceID,
+				HostDev: tapName(id),
+				Mac:     mac,
 			},
 		},
 		VsockDevices: []firecracker.VsockDevice{
@@ -294,31 +540,55 @@ func firecrackerConfig(id, chroot, initrdPath string) (*firecracker.Config, erro
 				UDSPath:  "control.sock",
 			},
 		},
+		// kiln publishes the metadata document once firecracker is up
+		MMDSConfig: &firecracker.MMDSConfig{
+			Version:           firecracker.MMDSv2,
+			NetworkInterfaces: []string{kiln.NetworkIfaceID},
+			IPv4Address:       mmds.Address,
+		},
+		// starts deflated, the balloon is inflated through the API to reclaim memory
+		Balloon: &firecracker.Balloon{
+			DeflateOnOOM:          true,
+			StatsPollingIntervalS: kiln.DefaultBalloonStatsIntervalS,
+		},
 	}
 	return fcConfig, nil
 }
 
-func kilnConfig(id, logDir string, resources kiln.Resources) (*kiln.Config, error) {
+func kilnConfig(cfg *config.Config, id string, resources kiln.Resources) (*kiln.Config, error) {
 	return &kiln.Config{
 		JailID:                  id,
 		UID:                     firecracker.DefaultJailerUID,
 		GID:                     firecracker.DefaultJailerGID,
-		FirecrackerSocketPath:   "/firecracker.sock",
+		FirecrackerSocketPath:   "firecracker.sock",
 		FirecrackerConfigPath:   "firecracker.json",
 		FirecrackerVsockUDSPath: "control.sock",
+		ControlSocketPath:       kiln.DefaultControlSocket,
 
 		VsockStdoutPort: vsock.VsockStdoutPort,
 		VsockExitPort:   vsock.VsockExitPort,
 
-		LogDir:      logDir,
+		VsockHeartbeatPort: vsock.VsockHeartbeatPort,
+
+		LogDir:      cfg.LogDir,
 		LogRotation: kiln.LogRotation{
 			MaxSizeMB:  100,
 			MaxFiles:   5,
 			MaxAgeDays: 30,
 			Compress:   true,
 		},
-		ExitStatusPath: "exit-status.json",
+		ExitStatusPath: exitStatusFile,
 		Resources:      resources,
+		Balloon:        &kiln.BalloonConfig{StatsIntervalS: kiln.DefaultBalloonStatsIntervalS},
+		Stop:           kiln.DefaultStopConfig(),
+		CgroupParent:   cfg.CgroupParent,
+		Jail:           cfg.Jail,
+
+		Heartbeat: &kiln.HeartbeatConfig{
+			IntervalS: cfg.Heartbeat.IntervalS,
+			MaxMisses: cfg.Heartbeat.MaxMisses,
+			ForceStop: cfg.Heartbeat.ForceStop,
+		},
 	}, nil
 }
 
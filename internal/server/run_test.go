@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// TestResolveResources tests that run requests are sized from the cpu kind catalog.
+func TestResolveResources(t *testing.T) {
+	cfg := config.Default()
+
+	tests := []struct {
+		name      string
+		req       api.RunRequest
+		resources kiln.Resources
+		machine   firecracker.MachineConfig
+		wantErr   string
+	}{
+		{
+			name:      "defaults",
+			req:       api.RunRequest{},
+			resources: kiln.Resources{CPUKind: "shared-cpu-1x", CPUCount: 1, MemoryMB: 128, CPUQuota: 25},
+			machine:   firecracker.MachineConfig{VCPUCount: 1, MemSizeMib: 128},
+		},
+		{
+			name:      "kind with memory",
+			req:       api.RunRequest{CPUKind: "performance-2x", MemoryMB: 4096, TrackDirtyPages: true},
+			resources: kiln.Resources{CPUKind: "performance-2x", CPUCount: 2, MemoryMB: 4096, CPUQuota: 100},
+			machine:   firecracker.MachineConfig{VCPUCount: 2, MemSizeMib: 4096, TrackDirtyPages: true},
+		},
+		{
+			name:      "matching cpu count",
+			req:       api.RunRequest{CPUKind: "shared-cpu-2x", CPUCount: 2},
+			resources: kiln.Resources{CPUKind: "shared-cpu-2x", CPUCount: 2, MemoryMB: 256, CPUQuota: 25},
+			machine:   firecracker.MachineConfig{VCPUCount: 2, MemSizeMib: 256},
+		},
+		{
+			name:    "unknown kind",
+			req:     api.RunRequest{CPUKind: "C3"},
+			wantErr: `unknown cpu kind "C3"`,
+		},
+		{
+			name:    "cpu count of another kind",
+			req:     api.RunRequest{CPUKind: "shared-cpu-1x", CPUCount: 4},
+			wantErr: "has 1 vCPUs, got cpu_count 4",
+		},
+		{
+			name:    "too little memory",
+			req:     api.RunRequest{CPUKind: "performance-1x", MemoryMB: 512},
+			wantErr: "supports 1024 to 8192 MB of memory, got 512",
+		},
+		{
+			name:    "too much memory",
+			req:     api.RunRequest{MemoryMB: 4096},
+			wantErr: "supports 128 to 2048 MB of memory, got 4096",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, machine, err := server.ResolveResources(cfg, tt.req)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.resources, resources)
+			assert.Equal(t, tt.machine, machine)
+		})
+	}
+}
+
+// TestRunProvisionsInBackground tests that /run answers before the chroot is
+// filled and a failure to fill it is reported on the operation.
+func TestRunProvisionsInBackground(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		vms   = server.NewRegistry(filepath.Join(dir, "vms"))
+		ops   = server.NewOperations()
+		alloc = newAllocator(vms, 8, 8192)
+		cfg   = config.Default()
+	)
+	// opening the kernel blocks until the test lets it through
+	cfg.KernelPath = filepath.Join(dir, "vmlinux")
+	require.NoError(t, unix.Mkfifo(cfg.KernelPath, 0o644))
+	cfg.InitPath = filepath.Join(dir, "initrd.img")
+	require.NoError(t, os.WriteFile(cfg.InitPath, nil, 0o644))
+	cfg.FirecrackerBinPath = filepath.Join(dir, "missing")
+
+	handler := server.Run(cfg, nil, vms, ops, alloc, nil)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(handler, "POST /run", http.MethodPost, "/run", `{"image":"alpine:latest"}`)
+	}()
+
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler waited on the kernel copy")
+	}
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	var resp api.RunResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+	created, err := vms.Get(resp.ID)
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateInitializing, created.State)
+
+	var op *api.Operation
+	require.Eventually(t, func() bool {
+		op, err = ops.Get(resp.OperationID)
+		return err == nil && len(op.Phases) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, api.PhasePrepareChroot, op.Phases[0].Name)
+	assert.Equal(t, api.OperationRunning, op.Phases[0].Status)
+
+	kernel, err := os.OpenFile(cfg.KernelPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, kernel.Close())
+
+	require.Eventually(t, func() bool {
+		op, err = ops.Get(resp.OperationID)
+		return err == nil && op.Status == api.OperationFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, op.Error, "failed to copy firecracker")
+	assert.Len(t, op.Phases, 1)
+
+	_, err = vms.Get(resp.ID)
+	assert.ErrorIs(t, err, server.ErrNotFound, "the failed VM is rolled back")
+	assert.NoDirExists(t, vms.Chroot(resp.ID))
+}
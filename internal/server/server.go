@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/rugwirobaker/inferno/internal/config"
 	"github.com/rugwirobaker/inferno/internal/image"
@@ -19,21 +23,129 @@ type Server struct {
 	handler http.Handler
 	ls      net.Listener
 	cfg     *config.Config
+	vms     *Registry
+	ops     *Operations
+	pool    *Pool
+	idler   *Idler
 }
 
-func New(listener net.Listener, cfg *config.Config, images *image.Manager) *Server {
-	mux := http.NewServeMux()
+// shutdownTimeout bounds how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 10 * time.Second
 
-	mux.HandleFunc("/run", Run(cfg, images))
-	mux.HandleFunc("/stop", Stop(cfg))
+func New(listener net.Listener, cfg *config.Config, images *image.Manager) (*Server, error) {
+	vms := NewRegistry(filepath.Join(cfg.StateBaseDir, "vms"))
+	if err := vms.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load vms: %w", err)
+	}
+
+	capacity, err := HostCapacity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host capacity: %w", err)
+	}
+	alloc := NewAllocator(vms, capacity, cfg.Capacity)
+
+	slog.Info("Host capacity", "cpus", capacity.CPUs, "memory-mb", capacity.MemoryMB,
+		"schedulable-cpus", alloc.Total().CPUs, "schedulable-memory-mb", alloc.Total().MemoryMB)
+
+	reattach(vms, alloc)
+
+	snaps := NewSnapshots(filepath.Join(cfg.StateBaseDir, "snapshots"))
+	if err := snaps.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load snapshots: %w", err)
+	}
+
+	var (
+		ops  = NewOperations()
+		host = NewHost(images)
+	)
+
+	pool, err := NewPool(cfg, host, vms, ops, alloc)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Server{
-		handler: mux,
+		handler: NewHandler(cfg, host, vms, ops, alloc, pool, snaps),
 		ls:      listener,
 		cfg:     cfg,
-	}
+		vms:     vms,
+		ops:     ops,
+		pool:    pool,
+		idler:   NewIdler(vms, alloc, snaps),
+	}, nil
 }
 
-func (s *Server) Run() error {
-	return http.Serve(s.ls, s.handler)
+// NewHandler routes the API to the handlers, pool may be nil
+func NewHandler(cfg *config.Config, host Host, vms *Registry, ops *Operations, alloc *Allocator, pool *Pool, snaps *Snapshots) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/run", Run(cfg, host, vms, ops, alloc, pool))
+	mux.HandleFunc("/stop", Stop(cfg))
+
+	mux.HandleFunc("GET /vms", ListVMs(vms))
+	mux.HandleFunc("GET /vms/{id}", InspectVM(vms))
+	mux.HandleFunc("DELETE /vms/{id}", DeleteVM(vms))
+	mux.HandleFunc("POST /vms/{id}/start", StartVM(vms, alloc))
+	mux.HandleFunc("POST /vms/{id}/stop", StopVM(vms))
+	mux.HandleFunc("POST /vms/{id}/restart", RestartVM(vms, alloc))
+	mux.HandleFunc("POST /vms/{id}/pause", PauseVM(vms))
+	mux.HandleFunc("POST /vms/{id}/resume", ResumeVM(vms))
+	mux.HandleFunc("GET /vms/{id}/status", VMStatus(vms))
+	mux.HandleFunc("PATCH /vms/{id}/rate-limits", UpdateRateLimits(vms))
+	mux.HandleFunc("PATCH /vms/{id}/balloon", UpdateBalloon(vms))
+	mux.HandleFunc("PATCH /vms/{id}/metadata", UpdateMetadata(vms))
+	mux.HandleFunc("POST /vms/{id}/snapshots", CreateSnapshot(vms, snaps))
+	mux.HandleFunc("GET /vms/{id}/snapshots", ListSnapshots(snaps))
+
+	mux.HandleFunc("GET /snapshots", ListSnapshots(snaps))
+	mux.HandleFunc("GET /snapshots/{id}", InspectSnapshot(snaps))
+	mux.HandleFunc("DELETE /snapshots/{id}", DeleteSnapshot(snaps))
+	mux.HandleFunc("POST /snapshots/{id}/restore", RestoreSnapshot(cfg, host, vms, alloc, snaps))
+
+	mux.HandleFunc("GET /vms/{id}/logs", Logs(cfg, vms))
+	mux.HandleFunc("POST /vms/{id}/exec", Exec(vms))
+	mux.HandleFunc("GET /events", StreamEvents(vms.Events()))
+
+	mux.HandleFunc("GET /operations/{id}", GetOperation(ops))
+
+	return mux
+}
+
+// Run serves requests until ctx is cancelled, then shuts down gracefully.
+// VMs are left running so a restarted daemon can reattach to them.
+func (s *Server) Run(ctx context.Context) error {
+	base, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	srv := &http.Server{
+		Handler:     s.handler,
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	// streaming requests (logs, events) only end when their context does
+	srv.RegisterOnShutdown(cancelBase)
+
+	// pooled VMs keep booting until the daemon shuts down
+	s.pool.Start(ctx)
+	go s.idler.Run(ctx)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(s.ls)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server, VMs are left running")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,623 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/sys"
+	"github.com/rugwirobaker/inferno/internal/vm"
+)
+
+const (
+	// snapshotMetaFile is where a snapshot's metadata is persisted inside its directory
+	snapshotMetaFile = "meta.json"
+	// restoreDir is where a restored VM's snapshot files live inside its chroot
+	restoreDir = "snapshot"
+)
+
+// ErrSnapshotNotFound is returned when a snapshot is not known to the store
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshots keeps track of the snapshots taken by the daemon. Each lives in
+// its own directory with the files kiln wrote and a meta.json.
+type Snapshots struct {
+	mu      sync.RWMutex
+	dir     string
+	records map[string]*api.Snapshot
+}
+
+// NewSnapshots creates a snapshot store rooted at dir (usually StateBaseDir/snapshots)
+func NewSnapshots(dir string) *Snapshots {
+	return &Snapshots{
+		dir:     dir,
+		records: make(map[string]*api.Snapshot),
+	}
+}
+
+// Load rebuilds the store from the metadata persisted under its directory
+func (s *Snapshots) Load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read snapshots directory: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name(), snapshotMetaFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read snapshot %s: %w", entry.Name(), err)
+		}
+
+		var snap api.Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("failed to decode snapshot %s: %w", entry.Name(), err)
+		}
+		s.records[snap.ID] = &snap
+	}
+	return nil
+}
+
+// Dir returns the directory holding the snapshot's files
+func (s *Snapshots) Dir(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// Put adds a snapshot and persists its metadata
+func (s *Snapshots) Put(snap *api.Snapshot) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.Dir(snap.ID), snapshotMetaFile), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp := *snap
+	s.records[snap.ID] = &cp
+	return nil
+}
+
+func (s *Snapshots) Get(id string) (*api.Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap, ok := s.records[id]
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	cp := *snap
+	return &cp, nil
+}
+
+// List returns the snapshots of a VM, or all of them when vmID is empty, oldest first
+func (s *Snapshots) List(vmID string) []*api.Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*api.Snapshot, 0, len(s.records))
+	for _, snap := range s.records {
+		if vmID != "" && snap.VMID != vmID {
+			continue
+		}
+		cp := *snap
+		list = append(list, &cp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Latest returns the most recent snapshot of a VM, or nil
+func (s *Snapshots) Latest(vmID string) *api.Snapshot {
+	list := s.List(vmID)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[len(list)-1]
+}
+
+// Delete removes a snapshot and its files
+func (s *Snapshots) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[id]; !ok {
+		return ErrSnapshotNotFound
+	}
+	if err := os.RemoveAll(s.Dir(id)); err != nil {
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+	delete(s.records, id)
+	return nil
+}
+
+// CreateSnapshot snapshots a running VM. The VM is paused while kiln writes
+// its memory and copies its disk, then resumed.
+func CreateSnapshot(vms *Registry, snaps *Snapshots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			id     = r.PathValue("id")
+			logger = slog.With("system", "server", "vm-id", id)
+		)
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if !isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is not running")
+			return
+		}
+
+		var req api.SnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var parent *api.Snapshot
+		switch req.Type {
+		case "":
+			req.Type = api.SnapshotFull
+		case api.SnapshotFull:
+		case api.SnapshotDiff:
+			// dirty pages are tracked from boot, an older snapshot can't be the base
+			parent = snaps.Latest(id)
+			if parent == nil || rec.StartedAt == nil || parent.CreatedAt.Before(*rec.StartedAt) {
+				writeError(w, http.StatusConflict, "a diff snapshot needs a previous snapshot taken since the vm started")
+				return
+			}
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown snapshot type %q", req.Type))
+			return
+		}
+
+		snap, err := snapshotVM(r.Context(), vms, snaps, rec, req.Type, parent)
+		var ce *kiln.ControlError
+		if errors.As(err, &ce) || errors.Is(err, kiln.ErrUnreachable) {
+			writeControlError(w, id, err)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to snapshot VM", "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		logger.Info("VM snapshotted", "snapshot", snap.ID, "type", snap.Type, "paused-ms", snap.PausedMS)
+		writeJSON(w, http.StatusCreated, snap)
+	}
+}
+
+// snapshotVM has kiln snapshot the VM and adds the result to the store, a
+// diff snapshot is merged onto its parent
+func snapshotVM(ctx context.Context, vms *Registry, snaps *Snapshots, rec *api.VM, typ api.SnapshotType, parent *api.Snapshot) (*api.Snapshot, error) {
+	var (
+		id     = rec.ID
+		fcType = firecracker.SnapshotFull
+		logger = slog.With("system", "server", "vm-id", id)
+	)
+	if typ == api.SnapshotDiff {
+		fcType = firecracker.SnapshotDiff
+	}
+
+	snapID, err := nanoid.Generate(HEX_ALPHABET, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	// kiln writes into the chroot, the result is moved into the store
+	rel := filepath.Join("snapshots", snapID)
+	result, err := vms.Control(id).Snapshot(ctx, &kiln.SnapshotRequest{Type: fcType, Dir: rel})
+	if err != nil {
+		os.RemoveAll(filepath.Join(vms.Chroot(id), rel))
+		return nil, err
+	}
+
+	dir := snaps.Dir(snapID)
+	if err := moveSnapshot(filepath.Join(vms.Chroot(id), rel), dir); err != nil {
+		return nil, fmt.Errorf("failed to store snapshot: %w", err)
+	}
+
+	if parent != nil {
+		err := firecracker.RebaseSnapshot(
+			filepath.Join(snaps.Dir(parent.ID), kiln.SnapshotMemoryFile),
+			filepath.Join(dir, kiln.SnapshotMemoryFile),
+		)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to merge diff snapshot: %w", err)
+		}
+	}
+
+	kernelSHA, err := fileSHA256(filepath.Join(vms.Chroot(id), "vmlinux"))
+	if err != nil {
+		logger.Warn("Failed to hash kernel", "error", err)
+	}
+
+	snap := &api.Snapshot{
+		ID:            snapID,
+		VMID:          id,
+		Type:          typ,
+		CreatedAt:     result.CreatedAt,
+		Image:         rec.Image,
+		Resources:     rec.Resources,
+		MachineConfig: result.MachineConfig,
+		Host: api.SnapshotHost{
+			FirecrackerVersion: result.FirecrackerVersion,
+			KernelSHA256:       kernelSHA,
+			Arch:               runtime.GOARCH,
+			CPUModel:           hostCPUModel(),
+		},
+		SizeBytes: dirSize(dir),
+		PausedMS:  result.PausedMS,
+	}
+	if parent != nil {
+		snap.Parent = parent.ID
+	}
+
+	if err := snaps.Put(snap); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// ListSnapshots lists the snapshots of the VM in the path, or all snapshots
+func ListSnapshots(snaps *Snapshots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, snaps.List(r.PathValue("id")))
+	}
+}
+
+func InspectSnapshot(snaps *Snapshots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap, err := snaps.Get(r.PathValue("id"))
+		if err != nil {
+			writeSnapshotError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, snap)
+	}
+}
+
+func DeleteSnapshot(snaps *Snapshots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := snaps.Delete(r.PathValue("id")); err != nil {
+			writeSnapshotError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RestoreSnapshot creates a new VM from a snapshot. The snapshot's files are
+// copied into a fresh chroot and the network interface is pointed at the new
+// VM's TAP device.
+func RestoreSnapshot(cfg *config.Config, host Host, vms *Registry, alloc *Allocator, snaps *Snapshots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var logger = slog.With("system", "server")
+
+		snap, err := snaps.Get(r.PathValue("id"))
+		if err != nil {
+			writeSnapshotError(w, err)
+			return
+		}
+
+		var req api.RestoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateName(req.Name); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		current, err := snapshotHost(cfg)
+		if err != nil {
+			logger.Error("Failed to inspect host", "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := SnapshotCompatible(snap.Host, current); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		id, err := nanoid.Generate(HEX_ALPHABET, 8)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var (
+			chroot = vms.Chroot(id)
+			tap    = tapName(id)
+			rb     = newRollback(logger.With("vm-id", id), cfg.KeepOnFailure)
+		)
+		logger = logger.With("vm-id", id, "snapshot", snap.ID)
+
+		err = func() error {
+			if err := prepareChroot(cfg, chroot, rb); err != nil {
+				return fmt.Errorf("failed to prepare chroot: %w", err)
+			}
+			if err := restoreFiles(snaps.Dir(snap.ID), chroot, tap); err != nil {
+				return err
+			}
+
+			if err := host.CreateTap(tap); err != nil {
+				return err
+			}
+			rb.add("tap", func() error { return deleteTap(tap) })
+
+			kilnConfig, err := kilnConfig(cfg, id, snap.Resources)
+			if err != nil {
+				return fmt.Errorf("failed to create kiln config: %w", err)
+			}
+			kilnConfig.Restore = restoreConfig(snap, tap)
+			if err := kiln.WriteConfig(filepath.Join(chroot, "kiln.json"), kilnConfig); err != nil {
+				return fmt.Errorf("failed to write kiln config: %w", err)
+			}
+			return nil
+		}()
+		if err != nil {
+			logger.Error("Failed to prepare restore", "error", err)
+			rb.run()
+
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rec := &api.VM{
+			ID:           id,
+			Name:         req.Name,
+			Image:        snap.Image,
+			State:        vm.StateInitializing,
+			Resources:    snap.Resources,
+			CreatedAt:    time.Now().UTC(),
+			RestoredFrom: snap.ID,
+		}
+
+		err = alloc.Admit(snap.Resources, func() error { return vms.Put(rec) })
+		if errors.Is(err, ErrInsufficientCapacity) || errors.Is(err, ErrNameInUse) {
+			logger.Warn("Rejected VM", "error", err)
+			rb.run()
+
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to register VM", "error", err)
+			rb.run()
+
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rb.add("record", func() error { return vms.Delete(id) })
+		rb.add("kiln", func() error { return killVM(vms, id) })
+
+		if err := startVM(vms, alloc, id); err != nil {
+			logger.Error("Failed to start restored VM", "error", err)
+			rb.run()
+
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		logger.Info("VM restored")
+
+		rec, err = vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, rec)
+	}
+}
+
+// SnapshotCompatible reports why a snapshot taken on one host can't be
+// restored on another. Firecracker only loads snapshots written by the same
+// version, and the guest's saved CPU state must match the host's CPU. The
+// guest kernel is part of the snapshot's memory so it isn't compared.
+func SnapshotCompatible(snap, host api.SnapshotHost) error {
+	if snap.FirecrackerVersion != host.FirecrackerVersion {
+		return fmt.Errorf("snapshot was taken with firecracker %s, host runs %s", snap.FirecrackerVersion, host.FirecrackerVersion)
+	}
+	if snap.Arch != host.Arch {
+		return fmt.Errorf("snapshot was taken on %s, host is %s", snap.Arch, host.Arch)
+	}
+	if snap.CPUModel != "" && host.CPUModel != "" && snap.CPUModel != host.CPUModel {
+		return fmt.Errorf("snapshot was taken on a %q CPU, host has a %q", snap.CPUModel, host.CPUModel)
+	}
+	return nil
+}
+
+// snapshotHost describes the host a snapshot would be restored on
+func snapshotHost(cfg *config.Config) (api.SnapshotHost, error) {
+	out, err := exec.Command(cfg.FirecrackerBinPath, "--version").Output()
+	if err != nil {
+		return api.SnapshotHost{}, fmt.Errorf("failed to get firecracker version: %w", err)
+	}
+	return api.SnapshotHost{
+		FirecrackerVersion: parseFirecrackerVersion(string(out)),
+		Arch:               runtime.GOARCH,
+		CPUModel:           hostCPUModel(),
+	}, nil
+}
+
+// parseFirecrackerVersion turns "Firecracker v1.10.1" into "1.10.1", the
+// form the API reports
+func parseFirecrackerVersion(out string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(fields[len(fields)-1], "v")
+}
+
+// hostCPUModel returns the model name from /proc/cpuinfo, empty if unknown
+func hostCPUModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	return parseCPUModel(f)
+}
+
+func parseCPUModel(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), ":"); ok && strings.TrimSpace(key) == "model name" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// restoreFiles lays a snapshot out in a new chroot: the disk, initrd and
+// firecracker config where a cold boot expects them, the state and memory
+// under restoreDir
+func restoreFiles(snapDir, chroot, tap string) error {
+	if err := os.MkdirAll(filepath.Join(chroot, restoreDir), 0o755); err != nil {
+		return fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+
+	copies := map[string]string{
+		kiln.SnapshotStateFile:  filepath.Join(restoreDir, kiln.SnapshotStateFile),
+		kiln.SnapshotRootFSFile: "rootfs.ext4",
+		kiln.SnapshotInitrdFile: initDeviceName,
+	}
+	for src, dst := range copies {
+		if err := sys.CopyFile(filepath.Join(snapDir, src), filepath.Join(chroot, dst), 0o644); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+	}
+
+	// firecracker maps the memory file privately, the snapshot's copy is never written
+	memory := filepath.Join(chroot, restoreDir, kiln.SnapshotMemoryFile)
+	if err := os.Link(filepath.Join(snapDir, kiln.SnapshotMemoryFile), memory); err != nil {
+		if err := sys.CopyFile(filepath.Join(snapDir, kiln.SnapshotMemoryFile), memory, 0o644); err != nil {
+			return fmt.Errorf("failed to copy memory: %w", err)
+		}
+	}
+
+	// a cold boot after the restore uses the snapshot's config, on the new TAP
+	fcConfig, err := firecracker.ReadConfig(filepath.Join(snapDir, kiln.SnapshotConfigFile))
+	if err != nil {
+		return err
+	}
+	for i := range fcConfig.NetworkInterfaces {
+		fcConfig.NetworkInterfaces[i].HostDev = tap
+	}
+
+	fcConfigPath := filepath.Join(chroot, "firecracker.json")
+	if err := firecracker.WriteConfig(fcConfigPath, fcConfig); err != nil {
+		return fmt.Errorf("failed to write firecracker config: %w", err)
+	}
+	if err := os.Chown(fcConfigPath, firecracker.DefaultJailerUID, firecracker.DefaultJailerGID); err != nil {
+		return fmt.Errorf("failed to chown firecracker config: %w", err)
+	}
+	return nil
+}
+
+// restoreConfig has kiln load the files laid out by restoreFiles
+func restoreConfig(snap *api.Snapshot, tap string) *kiln.RestoreConfig {
+	return &kiln.RestoreConfig{
+		StatePath:       filepath.Join(restoreDir, kiln.SnapshotStateFile),
+		MemoryPath:      filepath.Join(restoreDir, kiln.SnapshotMemoryFile),
+		TrackDirtyPages: snap.MachineConfig.TrackDirtyPages,
+		NetworkOverrides: []firecracker.NetworkOverride{
+			{IfaceID: kiln.NetworkIfaceID, HostDevName: tap},
+		},
+	}
+}
+
+// moveSnapshot moves the files kiln wrote into the store
+func moveSnapshot(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create snapshots dir: %w", err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.RemoveAll(src)
+		return fmt.Errorf("failed to move snapshot: %w", err)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dirSize adds up the space used by the files in dir
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func writeSnapshotError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrSnapshotNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,214 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/firecracker"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSnapshotCompatible tests which hosts a snapshot may be restored on.
+func TestSnapshotCompatible(t *testing.T) {
+	snap := api.SnapshotHost{
+		FirecrackerVersion: "1.10.1",
+		KernelSHA256:       "abc",
+		Arch:               "amd64",
+		CPUModel:           "AMD EPYC 7R13 Processor",
+	}
+
+	tests := []struct {
+		name string
+		host api.SnapshotHost
+		ok   bool
+	}{
+		{"same host", snap, true},
+		{"other kernel", api.SnapshotHost{FirecrackerVersion: "1.10.1", KernelSHA256: "def", Arch: "amd64", CPUModel: snap.CPUModel}, true},
+		{"unknown cpu model", api.SnapshotHost{FirecrackerVersion: "1.10.1", Arch: "amd64"}, true},
+		{"other firecracker", api.SnapshotHost{FirecrackerVersion: "1.11.0", Arch: "amd64", CPUModel: snap.CPUModel}, false},
+		{"other arch", api.SnapshotHost{FirecrackerVersion: "1.10.1", Arch: "arm64"}, false},
+		{"other cpu model", api.SnapshotHost{FirecrackerVersion: "1.10.1", Arch: "amd64", CPUModel: "Intel(R) Xeon(R) Platinum 8375C"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := server.SnapshotCompatible(snap, tt.host)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+// snapshotKiln answers snapshot requests like kiln, writing memory into the
+// requested directory of the VM's chroot
+func snapshotKiln(t *testing.T, vms *server.Registry, id string, memory string) {
+	t.Helper()
+
+	serveKiln(t, vms, id, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req kiln.SnapshotRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		dir := filepath.Join(vms.Chroot(id), req.Dir)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, kiln.SnapshotStateFile), []byte("state"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, kiln.SnapshotMemoryFile), []byte(memory), 0o644))
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(kiln.SnapshotResult{
+			Type:               req.Type,
+			Dir:                req.Dir,
+			FirecrackerVersion: "1.10.1",
+			MachineConfig:      firecracker.MachineConfig{VCPUCount: 1, MemSizeMib: 128, TrackDirtyPages: true},
+			CreatedAt:          time.Now().UTC(),
+			PausedMS:           12,
+		})
+	}))
+}
+
+// TestCreateSnapshot tests that the snapshot kiln writes is moved into the
+// store and a diff snapshot is merged onto the one before it.
+func TestCreateSnapshot(t *testing.T) {
+	var (
+		vms     = server.NewRegistry(t.TempDir())
+		snaps   = server.NewSnapshots(t.TempDir())
+		started = time.Now().UTC().Add(-time.Minute)
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning, Image: "nginx", StartedAt: &started})
+	snapshotKiln(t, vms, "vm1", "memory")
+
+	const pattern = "POST /vms/{id}/snapshots"
+	handler := server.CreateSnapshot(vms, snaps)
+
+	rec := serve(handler, pattern, http.MethodPost, "/vms/vm1/snapshots", "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var full api.Snapshot
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&full))
+	assert.Equal(t, "vm1", full.VMID)
+	assert.Equal(t, api.SnapshotFull, full.Type)
+	assert.Equal(t, "nginx", full.Image)
+	assert.Equal(t, "1.10.1", full.Host.FirecrackerVersion)
+	assert.Equal(t, runtime.GOARCH, full.Host.Arch)
+	assert.Equal(t, int64(12), full.PausedMS)
+	assert.Positive(t, full.SizeBytes)
+
+	assert.FileExists(t, filepath.Join(snaps.Dir(full.ID), kiln.SnapshotStateFile))
+	assert.FileExists(t, filepath.Join(snaps.Dir(full.ID), "meta.json"))
+	assert.NoDirExists(t, filepath.Join(vms.Chroot("vm1"), "snapshots", full.ID), "the snapshot left the chroot")
+
+	stored, err := snaps.Get(full.ID)
+	require.NoError(t, err)
+	assert.Equal(t, full, *stored)
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/snapshots", `{"type":"diff"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var diff api.Snapshot
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&diff))
+	assert.Equal(t, api.SnapshotDiff, diff.Type)
+	assert.Equal(t, full.ID, diff.Parent)
+
+	memory, err := os.ReadFile(filepath.Join(snaps.Dir(diff.ID), kiln.SnapshotMemoryFile))
+	require.NoError(t, err)
+	assert.Equal(t, "memory", string(memory))
+
+	assert.Len(t, snaps.List("vm1"), 2)
+}
+
+// TestCreateSnapshotRejected tests the snapshots the server refuses or kiln fails to take.
+func TestCreateSnapshotRejected(t *testing.T) {
+	var (
+		vms     = server.NewRegistry(t.TempDir())
+		snaps   = server.NewSnapshots(t.TempDir())
+		started = time.Now().UTC()
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning, StartedAt: &started})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped})
+	addVM(t, vms, &api.VM{ID: "vm3", State: vm.StateRunning, StartedAt: &started})
+
+	serveKiln(t, vms, "vm1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req kiln.SnapshotRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		// kiln failed half way through
+		require.NoError(t, os.MkdirAll(filepath.Join(vms.Chroot("vm1"), req.Dir), 0o755))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a snapshot is already in progress"})
+	}))
+
+	const pattern = "POST /vms/{id}/snapshots"
+	handler := server.CreateSnapshot(vms, snaps)
+
+	rec := serve(handler, pattern, http.MethodPost, "/vms/vm1/snapshots", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "kiln's rejection is passed through")
+	assert.Contains(t, rec.Body.String(), "a snapshot is already in progress")
+	entries, err := os.ReadDir(filepath.Join(vms.Chroot("vm1"), "snapshots"))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "kiln's leftovers are removed")
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/snapshots", `{"type":"diff"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code, "a diff needs a snapshot to build on")
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/snapshots", `{"type":"partial"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm2/snapshots", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm3/snapshots", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "vm3 has no kiln listening")
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/nope/snapshots", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	assert.Empty(t, snaps.List(""))
+}
+
+// TestRestoreSnapshotRejected tests the restores refused before a VM is created.
+func TestRestoreSnapshotRejected(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		snaps = server.NewSnapshots(t.TempDir())
+		bin   = filepath.Join(t.TempDir(), "firecracker")
+	)
+	require.NoError(t, os.WriteFile(bin, []byte("#!/bin/sh\necho Firecracker v1.10.1\n"), 0o755))
+	cfg := &config.Config{FirecrackerBinPath: bin}
+
+	for id, version := range map[string]string{"snap1": "1.10.1", "snap2": "1.9.0"} {
+		require.NoError(t, os.MkdirAll(snaps.Dir(id), 0o755))
+		require.NoError(t, snaps.Put(&api.Snapshot{
+			ID:   id,
+			VMID: "vm1",
+			Host: api.SnapshotHost{FirecrackerVersion: version, Arch: runtime.GOARCH},
+		}))
+	}
+
+	const pattern = "POST /snapshots/{id}/restore"
+	handler := server.RestoreSnapshot(cfg, nil, vms, newAllocator(vms, 8, 8192), snaps)
+
+	rec := serve(handler, pattern, http.MethodPost, "/snapshots/nope/restore", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPost, "/snapshots/snap1/restore", `{"name":"-web"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPost, "/snapshots/snap2/restore", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "the snapshot was taken with another firecracker")
+	assert.Contains(t, rec.Body.String(), "1.9.0")
+
+	assert.Empty(t, vms.List(), "no VM was created")
+}
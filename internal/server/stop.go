@@ -2,25 +2,24 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"path/filepath"
+	"syscall"
 
+	"github.com/rugwirobaker/inferno/internal/api"
 	"github.com/rugwirobaker/inferno/internal/config"
 	"github.com/rugwirobaker/inferno/internal/vsock"
 )
 
-type StopRequest struct {
-	ID     string `json:"id"`
-	Signal int32  `json:"signal"`
-}
-
 func Stop(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var ctx = r.Context()
 
-		var req StopRequest
+		var req api.StopRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			slog.Error("failed to decode request", "error", err)
@@ -30,36 +29,11 @@ func Stop(cfg *config.Config) http.HandlerFunc {
 
 		var chroot = filepath.Join(cfg.StateBaseDir, "vms", req.ID)
 
-		client := vsock.NewGuestClient(chroot, vsock.VsockAPIPort)
-
-		signal := signalVm{
-			Signal: req.Signal,
-		}
-
-		buf := new(bytes.Buffer)
-
-		_ = json.NewEncoder(buf).Encode(signal)
-
-		stopReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://firecracker/signal", buf)
-		if err != nil {
-			slog.Error("failed to create request", "error", err)
-			http.Error(w, "failed to create request", http.StatusInternalServerError)
-			return
-		}
-		stopReq.Header.Set("Content-Type", "application/json")
-
-		resp, err := client.Do(stopReq)
-		if err != nil {
+		if err := signalGuest(ctx, chroot, syscall.Signal(req.Signal)); err != nil {
 			slog.Error("failed to send signal", "error", err)
 			http.Error(w, "failed to send signal", http.StatusInternalServerError)
 			return
 		}
-
-		if resp.StatusCode != http.StatusOK {
-			slog.Error("failed to send signal", "status", resp.Status)
-			http.Error(w, "failed to send signal", http.StatusInternalServerError)
-			return
-		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -67,3 +41,33 @@ func Stop(cfg *config.Config) http.HandlerFunc {
 type signalVm struct {
 	Signal int32 `json:"signal"`
 }
+
+// signalGuest delivers a signal to the guest's primary process through the init API
+func signalGuest(ctx context.Context, chroot string, sig syscall.Signal) error {
+	client := vsock.NewGuestClient(chroot, vsock.VsockAPIPort)
+
+	signal := signalVm{
+		Signal: int32(sig),
+	}
+
+	buf := new(bytes.Buffer)
+
+	_ = json.NewEncoder(buf).Encode(signal)
+
+	stopReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://firecracker/signal", buf)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	stopReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(stopReq)
+	if err != nil {
+		return fmt.Errorf("failed to send signal: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send signal: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is where the cgroups of jailed VMs are removed from
+var cgroupRoot = kiln.CgroupRoot
+
+const (
+	// restartTimeout is how long a restart waits for the VM to stop before killing kiln
+	restartTimeout = 30 * time.Second
+	// killTimeout is how long a killed VM gets to exit
+	killTimeout = 10 * time.Second
+)
+
+// ListVMs lists the VMs, pooled VMs waiting to be claimed are only included
+// with ?all=true
+func ListVMs(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recs := vms.List()
+		if r.URL.Query().Get("all") != "true" {
+			recs = slices.DeleteFunc(recs, func(rec *api.VM) bool { return rec.Pool != "" })
+		}
+		writeJSON(w, http.StatusOK, recs)
+	}
+}
+
+func InspectVM(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, err := vms.Get(r.PathValue("id"))
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+func DeleteVM(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id = r.PathValue("id")
+
+		unlock := vms.Lock(id)
+		defer unlock()
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is running, stop it first")
+			return
+		}
+
+		if err := deleteTap(tapName(id)); err != nil {
+			slog.Error("Failed to delete tap device", "vm-id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if err := vms.Delete(id); err != nil {
+			slog.Error("Failed to delete VM", "vm-id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func StartVM(vms *Registry, alloc *Allocator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id = r.PathValue("id")
+
+		unlock := vms.Lock(id)
+		defer unlock()
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is already running")
+			return
+		}
+
+		if _, err := vms.Update(id, resetRestarts); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+
+		err = alloc.Admit(rec.Resources, func() error { return startVM(vms, alloc, id) })
+		if errors.Is(err, ErrInsufficientCapacity) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to start VM", "vm-id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rec, err = vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+func StopVM(vms *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			id  = r.PathValue("id")
+			ctx = r.Context()
+		)
+
+		var req api.StopRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "failed to decode request")
+			return
+		}
+
+		sig, err := stopSignal(req.Signal)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// held until the stop is issued so nothing starts it in between
+		unlock := vms.Lock(id)
+		defer unlock()
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if rec.State != vm.StateRunning {
+			writeError(w, http.StatusConflict, "vm is not running")
+			return
+		}
+
+		if err := stopVM(ctx, vms, id, sig); err != nil {
+			slog.Error("Failed to stop VM", "vm-id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// keep the restart policy from bringing it back, a restart the exit
+		// scheduled waits for the lock and finds it stopped
+		rec, err = vms.Update(id, func(rec *api.VM) {
+			rec.UserStopped = true
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, rec)
+	}
+}
+
+func RestartVM(vms *Registry, alloc *Allocator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			id  = r.PathValue("id")
+			ctx = r.Context()
+		)
+
+		// held until the VM is back up so nothing else starts it in between
+		unlock := vms.Lock(id)
+		defer unlock()
+
+		rec, err := vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+
+		if _, err := vms.Update(id, func(rec *api.VM) {
+			resetRestarts(rec)
+			// keep the restart policy from racing us
+			rec.UserStopped = true
+		}); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+
+		machine := vms.Machine(id)
+		// nothing to stop, e.g. the VM is still being created
+		if machine == nil && isActive(rec.State) {
+			writeError(w, http.StatusConflict, "vm is "+string(rec.State))
+			return
+		}
+
+		if machine != nil && rec.State == vm.StateRunning {
+			if err := stopVM(ctx, vms, id, syscall.SIGTERM); err != nil {
+				slog.Warn("Failed to stop VM gracefully", "vm-id", id, "error", err)
+			}
+
+			select {
+			case <-machine.Done():
+			case <-time.After(restartTimeout):
+				slog.Warn("VM did not stop in time, killing kiln", "vm-id", id)
+				_ = machine.Kill()
+				<-machine.Done()
+			case <-ctx.Done():
+				writeError(w, http.StatusRequestTimeout, ctx.Err().Error())
+				return
+			}
+		}
+
+		// the old run is gone but may not be recorded as stopped yet
+		err = alloc.Replace(id, rec.Resources, func() error { return startVM(vms, alloc, id) })
+		if errors.Is(err, ErrInsufficientCapacity) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to restart VM", "vm-id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rec, err = vms.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+// startVM launches kiln for the VM and monitors it until it exits
+func startVM(vms *Registry, alloc *Allocator, id string) error {
+	var chroot = vms.Chroot(id)
+
+	// a stale exit status would otherwise be attributed to this run
+	for _, file := range []string{exitStatusFile, kiln.BootFailureFile} {
+		if err := os.Remove(filepath.Join(chroot, file)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale %s: %w", file, err)
+		}
+	}
+
+	config, err := kiln.ReadConfig(filepath.Join(chroot, "kiln.json"))
+	if err != nil {
+		return err
+	}
+	if config.Jail {
+		if err := ensureTap(tapName(id)); err != nil {
+			return err
+		}
+	}
+
+	machine := vm.New(id, &vm.Config{
+		Chroot: chroot,
+		Jail:   config.Jail,
+	})
+
+	if err := machine.Start(context.Background()); err != nil {
+		_, _ = vms.Update(id, func(rec *api.VM) {
+			rec.State = vm.StateFailed
+		})
+		return err
+	}
+	vms.SetMachine(id, machine)
+
+	now := time.Now().UTC()
+	_, err = vms.Update(id, func(rec *api.VM) {
+		rec.State = vm.StateRunning
+		rec.PID = machine.PID
+		rec.StartedAt = &now
+		rec.StoppedAt = nil
+		rec.UserStopped = false
+		rec.IdledAt = nil
+	})
+
+	go monitorVM(vms, alloc, machine)
+
+	if err != nil {
+		// a VM that isn't recorded as running mustn't be left running
+		if kerr := killVM(vms, id); kerr != nil {
+			slog.Error("Failed to kill unrecorded VM", "vm-id", id, "error", kerr)
+		}
+		return fmt.Errorf("failed to record VM as running: %w", err)
+	}
+	return nil
+}
+
+// monitorVM waits for kiln to exit and records the final state of the VM
+func monitorVM(vms *Registry, alloc *Allocator, machine *vm.VM) {
+	<-machine.Done()
+
+	var (
+		logger = slog.With("vm-id", machine.ID)
+		now    = time.Now().UTC()
+	)
+
+	// before a restart creates the cgroup again
+	if err := removeJailCgroup(vms, machine.ID); err != nil {
+		logger.Warn("Failed to remove cgroup", "error", err)
+	}
+
+	status, err := kiln.ReadExitStatus(filepath.Join(vms.Chroot(machine.ID), exitStatusFile))
+	if err != nil {
+		logger.Warn("Failed to read exit status", "error", err)
+	}
+	state := exitState(status)
+
+	var exited bool
+	rec, err := vms.Update(machine.ID, func(rec *api.VM) {
+		// the VM was started again in the meantime
+		if rec.PID != machine.PID {
+			return
+		}
+		rec.State = state
+		rec.PID = 0
+		rec.StoppedAt = &now
+		settleRestarts(rec, now)
+		exited = true
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			logger.Error("Failed to update VM record", "error", err)
+		}
+		return
+	}
+	logger.Info("VM exited", "state", state)
+
+	if !exited {
+		return
+	}
+	if restart, reason := ShouldRestart(rec.RestartPolicy, status, rec.RestartCount, rec.UserStopped); restart {
+		scheduleRestart(vms, alloc, machine.ID, rec.RestartCount, reason)
+	}
+}
+
+// removeJailCgroup removes the cgroup kiln jail created for the VM, kiln
+// can't remove the cgroup it ran in
+func removeJailCgroup(vms *Registry, id string) error {
+	config, err := kiln.ReadConfig(filepath.Join(vms.Chroot(id), "kiln.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !config.Jail || config.CgroupParent == "" {
+		return nil
+	}
+	return kiln.RemoveCgroup(cgroupRoot, filepath.Join(config.CgroupParent, config.JailID))
+}
+
+// stopVM asks the guest to stop, falling back to signalling kiln directly
+func stopVM(ctx context.Context, vms *Registry, id string, sig syscall.Signal) error {
+	// kiln escalates from signalling the guest to killing firecracker
+	_, err := vms.Control(id).Shutdown(ctx, &kiln.ShutdownRequest{
+		Reason: "stop requested through the API",
+		Signal: int(sig),
+		Force:  sig == syscall.SIGKILL,
+	})
+	if err == nil {
+		return nil
+	}
+	slog.Warn("Kiln control socket not reachable, signalling guest", "vm-id", id, "error", err)
+
+	err = signalGuest(ctx, vms.Chroot(id), sig)
+	if err == nil {
+		return nil
+	}
+
+	machine := vms.Machine(id)
+	if machine == nil {
+		return err
+	}
+	slog.Warn("Guest API not reachable, signalling kiln", "vm-id", id, "error", err)
+
+	// kiln can't relay a SIGKILL, firecracker has to be killed along with it
+	if sig == syscall.SIGKILL {
+		return machine.Kill()
+	}
+	return machine.Signal(sig)
+}
+
+// killVM kills kiln and firecracker and waits for them to exit, the VM's
+// chroot must not be removed from under them
+func killVM(vms *Registry, id string) error {
+	machine := vms.Machine(id)
+	if machine == nil {
+		return nil
+	}
+	select {
+	case <-machine.Done():
+		return nil
+	default:
+	}
+
+	if err := machine.Kill(); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to kill kiln: %w", err)
+	}
+	select {
+	case <-machine.Done():
+		return nil
+	case <-time.After(killTimeout):
+		return fmt.Errorf("kiln did not exit within %s of being killed", killTimeout)
+	}
+}
+
+// exitState derives the final state of a VM from its kiln exit status
+func exitState(status *kiln.KilnExitStatus) vm.State {
+	if _, failed := exitReason(status); failed {
+		return vm.StateFailed
+	}
+	return vm.StateStopped
+}
+
+// resetRestarts starts the restart policy afresh, used when the VM is (re)started through the API
+func resetRestarts(rec *api.VM) {
+	rec.RestartCount = 0
+}
+
+// stopSignal is the signal a stop request asks for, SIGTERM when it names none
+func stopSignal(sig int32) (syscall.Signal, error) {
+	if sig == 0 {
+		return syscall.SIGTERM, nil
+	}
+	if unix.SignalName(syscall.Signal(sig)) == "" {
+		return 0, fmt.Errorf("unknown signal %d", sig)
+	}
+	return syscall.Signal(sig), nil
+}
+
+func isActive(state vm.State) bool {
+	return state == vm.StateRunning || state == vm.StateInitializing
+}
+
+func writeRegistryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,296 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/config"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+	"github.com/rugwirobaker/inferno/internal/server"
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeKiln puts a kiln in the VM's chroot that records its arguments and
+// sleeps until it's signalled. The chroot gets a kiln.json unless it has one.
+func fakeKiln(t *testing.T, vms *server.Registry, id string) {
+	t.Helper()
+
+	configPath := filepath.Join(vms.Chroot(id), "kiln.json")
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		config := kiln.Default()
+		config.JailID = id
+		require.NoError(t, kiln.WriteConfig(configPath, config))
+	}
+
+	script := "#!/bin/sh\necho \"$@\" > args\nexec sleep 60\n"
+	require.NoError(t, os.WriteFile(filepath.Join(vms.Chroot(id), "kiln"), []byte(script), 0o755))
+
+	t.Cleanup(func() {
+		machine := vms.Machine(id)
+		if machine == nil {
+			return
+		}
+		_ = machine.Kill()
+		<-machine.Done()
+
+		// the exit is recorded in the chroot, let it land before it's removed
+		require.Eventually(t, func() bool {
+			rec, err := vms.Get(id)
+			return err != nil || rec.PID != machine.PID
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+// waitState waits for the VM's record to reach state
+func waitState(t *testing.T, vms *server.Registry, id string, state vm.State) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		rec, err := vms.Get(id)
+		return err == nil && rec.State == state
+	}, 5*time.Second, 10*time.Millisecond, "vm %s never became %s", id, state)
+}
+
+func newAllocator(vms *server.Registry, cpus, memory int) *server.Allocator {
+	return server.NewAllocator(vms, server.Capacity{CPUs: cpus, MemoryMB: memory}, config.Capacity{
+		CPUOvercommit:    1,
+		MemoryOvercommit: 1,
+	})
+}
+
+// TestStartVM tests that concurrent starts of a VM only launch kiln once.
+func TestStartVM(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		alloc = newAllocator(vms, 8, 8192)
+		res   = kiln.Resources{CPUCount: 1, MemoryMB: 512}
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateStopped, Resources: res, RestartCount: 3})
+	fakeKiln(t, vms, "vm1")
+
+	const pattern = "POST /vms/{id}/start"
+	handler := server.StartVM(vms, alloc)
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = make(map[int]int)
+	)
+	// hold the allocator so the requests pile up between checking the VM
+	// is stopped and starting it
+	var (
+		admitting = make(chan struct{})
+		release   = make(chan struct{})
+	)
+	go alloc.Admit(kiln.Resources{}, func() error {
+		close(admitting)
+		<-release
+		return nil
+	})
+	<-admitting
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := serve(handler, pattern, http.MethodPost, "/vms/vm1/start", "")
+			mu.Lock()
+			codes[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusConflict: 3}, codes)
+
+	rec, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, vm.StateRunning, rec.State)
+	assert.Equal(t, vms.Machine("vm1").PID, rec.PID)
+	assert.Zero(t, rec.RestartCount, "starting through the API resets the restart policy")
+
+	rec2 := serve(handler, pattern, http.MethodPost, "/vms/nope/start", "")
+	assert.Equal(t, http.StatusNotFound, rec2.Code)
+}
+
+// TestStartVMJailed tests that a jailed VM is started through kiln jail and
+// its cgroup is removed once kiln exits.
+func TestStartVMJailed(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("a jailed VM's TAP device is created on start, which needs root")
+	}
+
+	var (
+		vms    = server.NewRegistry(t.TempDir())
+		alloc  = newAllocator(vms, 8, 8192)
+		cgroup = t.TempDir()
+	)
+	server.SetCgroupRoot(t, cgroup)
+
+	for _, id := range []string{"vm1", "vm2"} {
+		addVM(t, vms, &api.VM{ID: id, State: vm.StateStopped})
+
+		config := kiln.Default()
+		config.JailID = id
+		config.CgroupParent = "inferno"
+		config.Jail = id == "vm1"
+		require.NoError(t, kiln.WriteConfig(filepath.Join(vms.Chroot(id), "kiln.json"), config))
+		fakeKiln(t, vms, id)
+
+		// what kiln jail would have created
+		require.NoError(t, os.MkdirAll(filepath.Join(cgroup, "inferno", id), 0o755))
+	}
+
+	for _, id := range []string{"vm1", "vm2"} {
+		rec := serve(server.StartVM(vms, alloc), "POST /vms/{id}/start", http.MethodPost, "/vms/"+id+"/start", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// the jail took the TAP device of its last run down with it
+	tap, err := netlink.LinkByName("vmvm1")
+	require.NoError(t, err)
+	t.Cleanup(func() { netlink.LinkDel(tap) })
+	_, err = netlink.LinkByName("vmvm2")
+	assert.ErrorAs(t, err, new(netlink.LinkNotFoundError), "an unjailed VM's TAP device is left alone")
+
+	args := func(id string) string {
+		data, _ := os.ReadFile(filepath.Join(vms.Chroot(id), "args"))
+		return string(data)
+	}
+	require.Eventually(t, func() bool { return args("vm1") != "" && args("vm2") != "" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "jail --chroot "+vms.Chroot("vm1")+"\n", args("vm1"))
+	assert.Equal(t, "\n", args("vm2"), "kiln runs unjailed")
+
+	for _, id := range []string{"vm1", "vm2"} {
+		require.NoError(t, vms.Machine(id).Kill())
+		waitState(t, vms, id, vm.StateFailed)
+	}
+
+	assert.NoDirExists(t, filepath.Join(cgroup, "inferno", "vm1"))
+	assert.DirExists(t, filepath.Join(cgroup, "inferno", "vm2"), "kiln removes its own cgroup")
+	assert.DirExists(t, filepath.Join(cgroup, "inferno"))
+}
+
+// TestStopVM tests that a VM without a reachable kiln or guest is stopped by signalling kiln.
+func TestStopVM(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		alloc = newAllocator(vms, 8, 8192)
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateStopped, RestartPolicy: api.RestartPolicy{Name: api.RestartAlways}})
+	fakeKiln(t, vms, "vm1")
+
+	rec := serve(server.StartVM(vms, alloc), "POST /vms/{id}/start", http.MethodPost, "/vms/vm1/start", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	const pattern = "POST /vms/{id}/stop"
+	handler := server.StopVM(vms)
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/stop", `{"signal":99}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "unknown signals are rejected")
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/stop", `{"signal":15}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	<-vms.Machine("vm1").Done()
+	waitState(t, vms, "vm1", vm.StateFailed)
+
+	stopped, err := vms.Get("vm1")
+	require.NoError(t, err)
+	assert.True(t, stopped.UserStopped, "the restart policy leaves it stopped")
+	assert.Zero(t, stopped.PID)
+	assert.NotNil(t, stopped.StoppedAt)
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/stop", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+// TestStopVMFails tests that a VM that couldn't be stopped, or wasn't running,
+// is left to its restart policy.
+func TestStopVMFails(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+	// no kiln and no guest to stop
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateStopped})
+
+	const pattern = "POST /vms/{id}/stop"
+	handler := server.StopVM(vms)
+
+	rec := serve(handler, pattern, http.MethodPost, "/vms/vm1/stop", "")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm2/stop", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	for _, id := range []string{"vm1", "vm2"} {
+		got, err := vms.Get(id)
+		require.NoError(t, err)
+		assert.False(t, got.UserStopped, id)
+	}
+}
+
+// TestRestartVM tests that a restart brings the VM back up on a host only it fits on.
+func TestRestartVM(t *testing.T) {
+	var (
+		vms   = server.NewRegistry(t.TempDir())
+		alloc = newAllocator(vms, 1, 512)
+		res   = kiln.Resources{CPUCount: 1, MemoryMB: 512}
+	)
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateStopped, Resources: res})
+	addVM(t, vms, &api.VM{ID: "vm2", State: vm.StateInitializing})
+	fakeKiln(t, vms, "vm1")
+
+	rec := serve(server.StartVM(vms, alloc), "POST /vms/{id}/start", http.MethodPost, "/vms/vm1/start", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	first := vms.Machine("vm1")
+
+	const pattern = "POST /vms/{id}/restart"
+	handler := server.RestartVM(vms, alloc)
+
+	for range 3 {
+		rec = serve(handler, pattern, http.MethodPost, "/vms/vm1/restart", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var got api.VM
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, vm.StateRunning, got.State)
+	assert.NotEqual(t, first.PID, got.PID)
+	assert.Equal(t, vms.Machine("vm1").PID, got.PID)
+	assert.False(t, got.UserStopped)
+
+	select {
+	case <-first.Done():
+	default:
+		t.Fatal("the first kiln is still running")
+	}
+
+	rec = serve(handler, pattern, http.MethodPost, "/vms/vm2/restart", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "a VM being created can't be restarted")
+}
+
+// TestDeleteVM tests that only stopped VMs can be deleted.
+func TestDeleteVM(t *testing.T) {
+	vms := server.NewRegistry(t.TempDir())
+	addVM(t, vms, &api.VM{ID: "vm1", State: vm.StateRunning})
+
+	const pattern = "DELETE /vms/{id}"
+	handler := server.DeleteVM(vms)
+
+	rec := serve(handler, pattern, http.MethodDelete, "/vms/vm1", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(handler, pattern, http.MethodDelete, "/vms/nope", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/api"
+	"github.com/rugwirobaker/inferno/internal/kiln"
+)
+
+const (
+	// wakeTimeout bounds how long a connection waits for its VM to come up
+	wakeTimeout = 30 * time.Second
+	// dialInterval is how often a waking guest is dialed
+	dialInterval = 100 * time.Millisecond
+)
+
+// portListener publishes a VM's port on the host
+type portListener struct {
+	net.Listener
+	vmID string
+	port api.PortMapping
+}
+
+// syncPorts listens on the ports the VMs publish and closes the listeners of
+// the ports that went away. A host address published by two VMs goes to the
+// one created first.
+func (i *Idler) syncPorts(ctx context.Context) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	wanted := make(map[string]*portListener)
+	for _, rec := range i.vms.List() {
+		if rec.Pool != "" {
+			continue
+		}
+		for _, port := range rec.Ports {
+			addr := port.HostAddr()
+			if owner, ok := wanted[addr]; ok {
+				slog.Warn("Port is already published", "system", "idler", "vm-id", rec.ID, "addr", addr, "owner", owner.vmID)
+				continue
+			}
+			wanted[addr] = &portListener{vmID: rec.ID, port: port}
+		}
+	}
+
+	for addr, l := range i.listeners {
+		if want, ok := wanted[addr]; !ok || want.vmID != l.vmID || want.port != l.port {
+			l.Close()
+			delete(i.listeners, addr)
+		}
+	}
+
+	for addr, want := range wanted {
+		if _, ok := i.listeners[addr]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			slog.Warn("Failed to publish port", "system", "idler", "vm-id", want.vmID, "addr", addr, "error", err)
+			continue
+		}
+		want.Listener = l
+		i.listeners[addr] = want
+		go i.serve(ctx, want)
+	}
+}
+
+// published reports whether all of the VM's ports are listened on, i.mu must
+// be held
+func (i *Idler) published(rec *api.VM) bool {
+	for _, port := range rec.Ports {
+		l, ok := i.listeners[port.HostAddr()]
+		if !ok || l.vmID != rec.ID {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *Idler) closeListeners() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for addr, l := range i.listeners {
+		l.Close()
+		delete(i.listeners, addr)
+	}
+}
+
+// serve accepts connections on a port until its listener is closed
+func (i *Idler) serve(ctx context.Context, l *portListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Failed to accept connection", "system", "idler", "vm-id", l.vmID, "error", err)
+			}
+			return
+		}
+		go i.proxy(ctx, l, conn)
+	}
+}
+
+// proxy wakes the port's VM if it was scaled to zero and splices the
+// connection through to the guest
+func (i *Idler) proxy(ctx context.Context, l *portListener, conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		logger  = slog.With("system", "idler", "vm-id", l.vmID)
+		traffic = i.trafficOf(l.vmID)
+	)
+
+	// an open connection keeps the VM from being scaled down while it wakes
+	traffic.conns.Add(1)
+	defer traffic.conns.Add(-1)
+	traffic.touch()
+
+	if err := i.wake(l.vmID); err != nil {
+		logger.Warn("Failed to wake VM", "error", err)
+		return
+	}
+
+	ip, err := guestIP(i.vms.Chroot(l.vmID))
+	if err != nil {
+		logger.Warn("Failed to find guest address", "error", err)
+		return
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(l.port.GuestPort))
+
+	ctx, cancel := context.WithTimeout(ctx, wakeTimeout)
+	upstream, err := dialGuest(ctx, addr)
+	cancel()
+	if err != nil {
+		logger.Warn("Failed to reach guest", "addr", addr, "error", err)
+		return
+	}
+	defer upstream.Close()
+
+	splice(&countingConn{Conn: conn, traffic: traffic}, upstream)
+}
+
+// guestIP is the first address the guest's network is configured with
+func guestIP(chroot string) (net.IP, error) {
+	config, err := kiln.ReadConfig(filepath.Join(chroot, "kiln.json"))
+	if err != nil {
+		return nil, err
+	}
+	if config.Metadata == nil || len(config.Metadata.IPs) == 0 {
+		return nil, errors.New("vm has no ip address")
+	}
+	return config.Metadata.IPs[0].IP, nil
+}
+
+// dialGuest dials addr until the guest accepts or ctx is done, a guest that
+// was just woken takes a moment to listen
+func dialGuest(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-time.After(dialInterval):
+		}
+	}
+}
+
+// splice copies between a and b until both directions are done, each side is
+// told when the other stopped writing
+func splice(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(a, b)
+		closeWrite(a)
+	}()
+	io.Copy(b, a)
+	closeWrite(b)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(*countingConn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Image is a row of the images table
+type Image struct {
+	ID           int64     `json:"id"`
+	ImageID      string    `json:"image_id"`
+	Name         string    `json:"name"`
+	SourceImage  string    `json:"source_image"`
+	RootfsPath   string    `json:"rootfs_path"`
+	ManifestPath string    `json:"manifest_path"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const imageColumns = `id, image_id, name, source_image, rootfs_path, manifest_path, created_at`
+
+// CreateImage inserts an image and fills in its generated fields
+func (q *Queries) CreateImage(ctx context.Context, img *Image) error {
+	err := q.q.QueryRowContext(ctx, `
+		INSERT INTO images (image_id, name, source_image, rootfs_path, manifest_path)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`, img.ImageID, img.Name, img.SourceImage, img.RootfsPath, img.ManifestPath).Scan(&img.ID, &img.CreatedAt)
+
+	return mapError(err)
+}
+
+// GetImage retrieves an image by its image id
+func (q *Queries) GetImage(ctx context.Context, imageID string) (*Image, error) {
+	row := q.q.QueryRowContext(ctx, `SELECT `+imageColumns+` FROM images WHERE image_id = ?`, imageID)
+	return scanImage(row)
+}
+
+// ListImages returns all images
+func (q *Queries) ListImages(ctx context.Context) ([]*Image, error) {
+	rows, err := q.q.QueryContext(ctx, `SELECT `+imageColumns+` FROM images ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// DeleteImage removes an image
+func (q *Queries) DeleteImage(ctx context.Context, imageID string) error {
+	result, err := q.q.ExecContext(ctx, `DELETE FROM images WHERE image_id = ?`, imageID)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+func scanImage(row scanner) (*Image, error) {
+	var img Image
+
+	err := row.Scan(&img.ID, &img.ImageID, &img.Name, &img.SourceImage, &img.RootfsPath, &img.ManifestPath, &img.CreatedAt)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &img, nil
+}
@@ -0,0 +1,185 @@
+-- +migrate Up
+-- Initial inferno state schema, mirrors scripts/schema.sql so databases
+-- created by the bash tooling can be adopted as-is.
+
+CREATE TABLE IF NOT EXISTS images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    image_id TEXT UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    source_image TEXT NOT NULL,
+    rootfs_path TEXT UNIQUE NOT NULL,
+    manifest_path TEXT UNIQUE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS vms (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    tap_device TEXT UNIQUE NOT NULL,
+    gateway_ip TEXT NOT NULL,
+    guest_ip TEXT UNIQUE NOT NULL,
+    mac_address TEXT UNIQUE NOT NULL,
+    state TEXT NOT NULL DEFAULT 'created' CHECK (state IN ('created', 'running', 'stopped')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    image_id INTEGER REFERENCES images(id)
+);
+
+CREATE TABLE IF NOT EXISTS routes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id INTEGER NOT NULL,
+    mode TEXT NOT NULL CHECK (mode IN ('l4', 'l7')),
+    host_port INTEGER NOT NULL,
+    guest_port INTEGER NOT NULL,
+    hostname TEXT,
+    public_ip TEXT,
+    active BOOLEAN DEFAULT TRUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (vm_id) REFERENCES vms(id)
+);
+
+CREATE TABLE IF NOT EXISTS network_state (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id INTEGER NOT NULL,
+    state TEXT NOT NULL CHECK (state IN ('created', 'exposed', 'deleted')),
+    nft_rules_hash TEXT NOT NULL,
+    config_files_hash TEXT NOT NULL,
+    last_updated DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (vm_id) REFERENCES vms(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_l7_routes
+ON routes(hostname, host_port)
+WHERE mode = 'l7' AND active = TRUE AND hostname IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_l4_routes
+ON routes(public_ip, host_port)
+WHERE mode = 'l4' AND active = TRUE AND public_ip IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS volumes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    volume_id TEXT UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    device_path TEXT UNIQUE NOT NULL,
+    size_gb INTEGER NOT NULL,
+    vm_id INTEGER,
+    encrypted BOOLEAN NOT NULL DEFAULT TRUE,
+    state TEXT NOT NULL DEFAULT 'available' CHECK(state IN ('available', 'attaching', 'attached', 'detaching', 'error')),
+    active_source_checkpoint_id INTEGER,
+    destination TEXT NOT NULL DEFAULT '/data',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (vm_id) REFERENCES vms(id) ON DELETE SET NULL,
+    FOREIGN KEY (active_source_checkpoint_id) REFERENCES volume_checkpoints(id)
+);
+
+CREATE TABLE IF NOT EXISTS volume_checkpoints (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    volume_id INTEGER NOT NULL,
+    lv_name TEXT UNIQUE NOT NULL,
+    sequence_num INTEGER NOT NULL,
+    source_checkpoint_id INTEGER,
+    type TEXT NOT NULL DEFAULT 'user' CHECK(type IN ('user', 'pre_restore', 'scheduled')),
+    comment TEXT,
+    size_mb INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (volume_id) REFERENCES volumes(id) ON DELETE CASCADE,
+    FOREIGN KEY (source_checkpoint_id) REFERENCES volume_checkpoints(id),
+    UNIQUE(volume_id, sequence_num)
+);
+
+CREATE INDEX IF NOT EXISTS idx_volume_checkpoints_volume ON volume_checkpoints(volume_id, sequence_num DESC);
+CREATE INDEX IF NOT EXISTS idx_volume_checkpoints_source ON volume_checkpoints(source_checkpoint_id);
+
+CREATE TABLE IF NOT EXISTS vms_versions (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id        INTEGER NOT NULL,
+    version      TEXT    NOT NULL,
+    created_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(vm_id, version),
+    FOREIGN KEY (vm_id) REFERENCES vms(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_vms_versions_vm_version ON vms_versions(vm_id, version DESC);
+
+CREATE TABLE IF NOT EXISTS base_images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    docker_ref TEXT NOT NULL,
+    docker_digest TEXT UNIQUE NOT NULL,
+    lv_name TEXT UNIQUE NOT NULL,
+    lv_path TEXT NOT NULL,
+    size_mb INTEGER NOT NULL,
+    manifest_json TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_base_images_digest ON base_images(docker_digest);
+
+CREATE TABLE IF NOT EXISTS ephemeral_snapshots (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id INTEGER NOT NULL UNIQUE,
+    base_image_id INTEGER NOT NULL,
+    lv_name TEXT UNIQUE NOT NULL,
+    lv_path TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (vm_id) REFERENCES vms(id) ON DELETE CASCADE,
+    FOREIGN KEY (base_image_id) REFERENCES base_images(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ephemeral_snapshots_vm ON ephemeral_snapshots(vm_id);
+
+DROP VIEW IF EXISTS vm_details;
+CREATE VIEW vm_details AS
+SELECT
+    v.name,
+    v.tap_device,
+    v.guest_ip,
+    v.gateway_ip,
+    i.name as image_name,
+    i.image_id,
+    ns.state,
+    ns.last_updated,
+    COUNT(r.id) as active_routes,
+    COUNT(vol.id) as volumes
+FROM vms v
+LEFT JOIN network_state ns ON ns.vm_id = v.id
+LEFT JOIN routes r ON r.vm_id = v.id AND r.active = TRUE
+LEFT JOIN volumes vol ON vol.vm_id = v.id
+LEFT JOIN images i ON i.id = v.image_id
+GROUP BY v.id;
+
+DROP VIEW IF EXISTS vm_rootfs_details;
+CREATE VIEW vm_rootfs_details AS
+SELECT
+    v.name AS vm_name,
+    v.state AS vm_state,
+    bi.docker_ref AS base_image,
+    bi.docker_digest AS image_digest,
+    bi.size_mb AS base_size_mb,
+    bi.lv_name AS base_lv,
+    es.lv_name AS snapshot_lv,
+    es.lv_path AS snapshot_path,
+    es.created_at AS snapshot_created_at
+FROM vms v
+LEFT JOIN ephemeral_snapshots es ON es.vm_id = v.id
+LEFT JOIN base_images bi ON es.base_image_id = bi.id;
+
+-- +migrate Down
+DROP VIEW IF EXISTS vm_rootfs_details;
+DROP VIEW IF EXISTS vm_details;
+DROP INDEX IF EXISTS idx_ephemeral_snapshots_vm;
+DROP TABLE IF EXISTS ephemeral_snapshots;
+DROP INDEX IF EXISTS idx_base_images_digest;
+DROP TABLE IF EXISTS base_images;
+DROP INDEX IF EXISTS idx_vms_versions_vm_version;
+DROP TABLE IF EXISTS vms_versions;
+DROP INDEX IF EXISTS idx_volume_checkpoints_source;
+DROP INDEX IF EXISTS idx_volume_checkpoints_volume;
+DROP TABLE IF EXISTS volume_checkpoints;
+DROP TABLE IF EXISTS volumes;
+DROP INDEX IF EXISTS idx_l4_routes;
+DROP INDEX IF EXISTS idx_l7_routes;
+DROP TABLE IF EXISTS network_state;
+DROP TABLE IF EXISTS routes;
+DROP TABLE IF EXISTS vms;
+DROP TABLE IF EXISTS images;
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RouteMode mirrors the CHECK constraint on routes.mode
+type RouteMode string
+
+const (
+	RouteModeL4 RouteMode = "l4"
+	RouteModeL7 RouteMode = "l7"
+)
+
+// Route is a row of the routes table, it exposes a guest port on the host
+type Route struct {
+	ID        int64     `json:"id"`
+	VMID      int64     `json:"vm_id"`
+	Mode      RouteMode `json:"mode"`
+	HostPort  int       `json:"host_port"`
+	GuestPort int       `json:"guest_port"`
+	Hostname  *string   `json:"hostname,omitempty"`
+	PublicIP  *string   `json:"public_ip,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const routeColumns = `id, vm_id, mode, host_port, guest_port, hostname, public_ip, active, created_at`
+
+// CreateRoute inserts an active route and fills in its generated fields
+func (q *Queries) CreateRoute(ctx context.Context, route *Route) error {
+	route.Active = true
+
+	err := q.q.QueryRowContext(ctx, `
+		INSERT INTO routes (vm_id, mode, host_port, guest_port, hostname, public_ip, active)
+		VALUES (?, ?, ?, ?, ?, ?, TRUE)
+		RETURNING id, created_at
+	`, route.VMID, route.Mode, route.HostPort, route.GuestPort, route.Hostname, route.PublicIP).Scan(&route.ID, &route.CreatedAt)
+
+	return mapError(err)
+}
+
+// GetRoute retrieves a route by id
+func (q *Queries) GetRoute(ctx context.Context, id int64) (*Route, error) {
+	row := q.q.QueryRowContext(ctx, `SELECT `+routeColumns+` FROM routes WHERE id = ?`, id)
+	return scanRoute(row)
+}
+
+// ListRoutes returns the routes of a VM, set activeOnly to skip deactivated ones
+func (q *Queries) ListRoutes(ctx context.Context, vmID int64, activeOnly bool) ([]*Route, error) {
+	query := `SELECT ` + routeColumns + ` FROM routes WHERE vm_id = ?`
+	if activeOnly {
+		query += ` AND active = TRUE`
+	}
+	query += ` ORDER BY id`
+
+	rows, err := q.q.QueryContext(ctx, query, vmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var routes []*Route
+	for rows.Next() {
+		route, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+// SetRouteActive activates or deactivates a route
+func (q *Queries) SetRouteActive(ctx context.Context, id int64, active bool) error {
+	result, err := q.q.ExecContext(ctx, `UPDATE routes SET active = ? WHERE id = ?`, active, id)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// DeleteRoute removes a route
+func (q *Queries) DeleteRoute(ctx context.Context, id int64) error {
+	result, err := q.q.ExecContext(ctx, `DELETE FROM routes WHERE id = ?`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+func scanRoute(row scanner) (*Route, error) {
+	var (
+		route    Route
+		hostname sql.NullString
+		publicIP sql.NullString
+	)
+
+	err := row.Scan(&route.ID, &route.VMID, &route.Mode, &route.HostPort, &route.GuestPort, &hostname, &publicIP, &route.Active, &route.CreatedAt)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if hostname.Valid {
+		route.Hostname = &hostname.String
+	}
+	if publicIP.Valid {
+		route.PublicIP = &publicIP.String
+	}
+	return &route, nil
+}
@@ -0,0 +1,171 @@
+// Package store provides the SQLite-backed state shared by the inferno daemon and tooling.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rubenv/sql-migrate"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+var (
+	// ErrNotFound is returned when a record does not exist
+	ErrNotFound = errors.New("record not found")
+
+	// ErrExists is returned when a record violates a uniqueness constraint
+	ErrExists = errors.New("record already exists")
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Queries holds the typed CRUD operations, it runs either against
+// the database directly or inside a transaction.
+type Queries struct {
+	q querier
+}
+
+// Store owns the inferno state database
+type Store struct {
+	*Queries
+
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+// Tx is a transaction on the store
+type Tx struct {
+	*Queries
+
+	tx *sql.Tx
+}
+
+// New opens the database at dbPath and runs migrations
+func New(dbPath string, logger *slog.Logger) (*Store, error) {
+	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Enable WAL mode for better concurrency with the bash tooling
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to enable WAL mode: %w", err)
+	}
+
+	store := &Store{
+		Queries: &Queries{q: db},
+		db:      db,
+		logger:  logger,
+	}
+
+	if err := store.runMigrations(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	logger.Info("State store initialized", "db_path", dbPath)
+
+	return store, nil
+}
+
+// runMigrations applies all pending migrations
+func (s *Store) runMigrations() error {
+	migrations := &migrate.EmbedFileSystemMigrationSource{
+		FileSystem: migrationsFS,
+		Root:       "migrations",
+	}
+
+	n, err := migrate.Exec(s.db, "sqlite3", migrations, migrate.Up)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		s.logger.Info("Applied migrations", "count", n)
+	} else {
+		s.logger.Debug("No new migrations to apply")
+	}
+	return nil
+}
+
+// WithTx runs fn inside a transaction. The transaction is committed when fn
+// returns nil and rolled back otherwise.
+func (s *Store) WithTx(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	sqlTx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	tx := &Tx{
+		Queries: &Queries{q: sqlTx},
+		tx:      sqlTx,
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = sqlTx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if rbErr := sqlTx.Rollback(); rbErr != nil {
+				s.logger.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Close cleans up the store resources
+func (s *Store) Close() error {
+	s.logger.Info("Closing state store")
+	return s.db.Close()
+}
+
+// mapError translates driver errors into store errors
+func mapError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return fmt.Errorf("%w: %v", ErrExists, err)
+		}
+	}
+	return err
+}
+
+// mustAffect returns ErrNotFound when a statement touched no rows
+func mustAffect(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
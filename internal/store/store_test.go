@@ -0,0 +1,128 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/rugwirobaker/inferno/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T) *store.Store {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := store.New(filepath.Join(t.TempDir(), "inferno.db"), logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func testVM(name, octet string) *store.VM {
+	return &store.VM{
+		Name:       name,
+		TapDevice:  "tap" + name,
+		GatewayIP:  "172.16." + octet + ".1",
+		GuestIP:    "172.16." + octet + ".2",
+		MACAddress: "AA:BB:00:00:00:" + octet,
+	}
+}
+
+// TestVMLifecycle tests creating, reading, updating and deleting a VM.
+func TestVMLifecycle(t *testing.T) {
+	var (
+		ctx = context.Background()
+		s   = newStore(t)
+	)
+
+	vm := testVM("web1", "10")
+	require.NoError(t, s.CreateVM(ctx, vm))
+	assert.NotZero(t, vm.ID)
+	assert.Equal(t, store.VMStateCreated, vm.State)
+	assert.False(t, vm.CreatedAt.IsZero())
+
+	err := s.CreateVM(ctx, testVM("web1", "11"))
+	assert.ErrorIs(t, err, store.ErrExists, "duplicate names must be rejected")
+
+	require.NoError(t, s.UpdateVMState(ctx, "web1", store.VMStateRunning))
+
+	got, err := s.GetVMByName(ctx, "web1")
+	require.NoError(t, err)
+	assert.Equal(t, store.VMStateRunning, got.State)
+	assert.Equal(t, vm.GuestIP, got.GuestIP)
+
+	running, err := s.ListVMs(ctx, store.VMStateRunning)
+	require.NoError(t, err)
+	assert.Len(t, running, 1)
+
+	require.NoError(t, s.DeleteVM(ctx, vm.ID))
+
+	_, err = s.GetVM(ctx, vm.ID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+// TestWithTxRollback tests that a failing transaction leaves no trace.
+func TestWithTxRollback(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		s       = newStore(t)
+		errStop = errors.New("stop")
+	)
+
+	err := s.WithTx(ctx, func(tx *store.Tx) error {
+		vm := testVM("web2", "20")
+		if err := tx.CreateVM(ctx, vm); err != nil {
+			return err
+		}
+		route := &store.Route{VMID: vm.ID, Mode: store.RouteModeL4, HostPort: 8080, GuestPort: 80}
+		if err := tx.CreateRoute(ctx, route); err != nil {
+			return err
+		}
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+
+	_, err = s.GetVMByName(ctx, "web2")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+// TestCheckpointSequence tests that checkpoints get monotonic sequence numbers per volume.
+func TestCheckpointSequence(t *testing.T) {
+	var (
+		ctx = context.Background()
+		s   = newStore(t)
+	)
+
+	vol := &store.Volume{VolumeID: "vol_abc", Name: "data", DevicePath: "/dev/inferno_vg/vol_abc", SizeGB: 1}
+	require.NoError(t, s.CreateVolume(ctx, vol))
+
+	for _, name := range []string{"vol_abc_cp_001", "vol_abc_cp_002"} {
+		err := s.WithTx(ctx, func(tx *store.Tx) error {
+			seq, err := tx.NextCheckpointSequence(ctx, vol.ID)
+			if err != nil {
+				return err
+			}
+			return tx.CreateCheckpoint(ctx, &store.Checkpoint{VolumeID: vol.ID, LVName: name, SequenceNum: seq})
+		})
+		require.NoError(t, err)
+	}
+
+	checkpoints, err := s.ListCheckpoints(ctx, vol.ID)
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 2)
+	assert.Equal(t, 2, checkpoints[0].SequenceNum)
+	assert.Equal(t, 1, checkpoints[1].SequenceNum)
+
+	// checkpoints cascade with their volume
+	require.NoError(t, s.DeleteVolume(ctx, vol.VolumeID))
+
+	_, err = s.GetCheckpoint(ctx, checkpoints[0].ID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
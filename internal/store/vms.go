@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// VMState mirrors the CHECK constraint on vms.state
+type VMState string
+
+const (
+	VMStateCreated VMState = "created"
+	VMStateRunning VMState = "running"
+	VMStateStopped VMState = "stopped"
+)
+
+// VM is a row of the vms table
+type VM struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	TapDevice  string    `json:"tap_device"`
+	GatewayIP  string    `json:"gateway_ip"`
+	GuestIP    string    `json:"guest_ip"`
+	MACAddress string    `json:"mac_address"`
+	State      VMState   `json:"state"`
+	ImageID    *int64    `json:"image_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const vmColumns = `id, name, tap_device, gateway_ip, guest_ip, mac_address, state, image_id, created_at`
+
+// CreateVM inserts a VM and fills in its generated fields
+func (q *Queries) CreateVM(ctx context.Context, vm *VM) error {
+	if vm.State == "" {
+		vm.State = VMStateCreated
+	}
+
+	err := q.q.QueryRowContext(ctx, `
+		INSERT INTO vms (name, tap_device, gateway_ip, guest_ip, mac_address, state, image_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`, vm.Name, vm.TapDevice, vm.GatewayIP, vm.GuestIP, vm.MACAddress, vm.State, vm.ImageID).Scan(&vm.ID, &vm.CreatedAt)
+
+	return mapError(err)
+}
+
+// GetVM retrieves a VM by its database id
+func (q *Queries) GetVM(ctx context.Context, id int64) (*VM, error) {
+	row := q.q.QueryRowContext(ctx, `SELECT `+vmColumns+` FROM vms WHERE id = ?`, id)
+	return scanVM(row)
+}
+
+// GetVMByName retrieves a VM by its unique name
+func (q *Queries) GetVMByName(ctx context.Context, name string) (*VM, error) {
+	row := q.q.QueryRowContext(ctx, `SELECT `+vmColumns+` FROM vms WHERE name = ?`, name)
+	return scanVM(row)
+}
+
+// ListVMs returns all VMs, optionally filtered by state
+func (q *Queries) ListVMs(ctx context.Context, state VMState) ([]*VM, error) {
+	query := `SELECT ` + vmColumns + ` FROM vms`
+	args := []any{}
+	if state != "" {
+		query += ` WHERE state = ?`
+		args = append(args, state)
+	}
+	query += ` ORDER BY id`
+
+	rows, err := q.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vms []*VM
+	for rows.Next() {
+		vm, err := scanVM(rows)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, rows.Err()
+}
+
+// UpdateVMState sets the state of the VM with the given name
+func (q *Queries) UpdateVMState(ctx context.Context, name string, state VMState) error {
+	result, err := q.q.ExecContext(ctx, `UPDATE vms SET state = ? WHERE name = ?`, state, name)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// DeleteVM removes a VM along with its routes and network state.
+// Volumes are detached by the foreign key and versions cascade.
+func (q *Queries) DeleteVM(ctx context.Context, id int64) error {
+	if _, err := q.q.ExecContext(ctx, `DELETE FROM routes WHERE vm_id = ?`, id); err != nil {
+		return mapError(err)
+	}
+	if _, err := q.q.ExecContext(ctx, `DELETE FROM network_state WHERE vm_id = ?`, id); err != nil {
+		return mapError(err)
+	}
+
+	result, err := q.q.ExecContext(ctx, `DELETE FROM vms WHERE id = ?`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVM(row scanner) (*VM, error) {
+	var (
+		vm      VM
+		imageID sql.NullInt64
+	)
+
+	err := row.Scan(&vm.ID, &vm.Name, &vm.TapDevice, &vm.GatewayIP, &vm.GuestIP, &vm.MACAddress, &vm.State, &imageID, &vm.CreatedAt)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if imageID.Valid {
+		vm.ImageID = &imageID.Int64
+	}
+	return &vm, nil
+}
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// VolumeState mirrors the CHECK constraint on volumes.state
+type VolumeState string
+
+const (
+	VolumeStateAvailable VolumeState = "available"
+	VolumeStateAttaching VolumeState = "attaching"
+	VolumeStateAttached  VolumeState = "attached"
+	VolumeStateDetaching VolumeState = "detaching"
+	VolumeStateError     VolumeState = "error"
+)
+
+// CheckpointType mirrors the CHECK constraint on volume_checkpoints.type
+type CheckpointType string
+
+const (
+	CheckpointTypeUser       CheckpointType = "user"
+	CheckpointTypePreRestore CheckpointType = "pre_restore"
+	CheckpointTypeScheduled  CheckpointType = "scheduled"
+)
+
+// Volume is a row of the volumes table
+type Volume struct {
+	ID                       int64       `json:"id"`
+	VolumeID                 string      `json:"volume_id"`
+	Name                     string      `json:"name"`
+	DevicePath               string      `json:"device_path"`
+	SizeGB                   int         `json:"size_gb"`
+	VMID                     *int64      `json:"vm_id,omitempty"`
+	Encrypted                bool        `json:"encrypted"`
+	State                    VolumeState `json:"state"`
+	ActiveSourceCheckpointID *int64      `json:"active_source_checkpoint_id,omitempty"`
+	Destination              string      `json:"destination"`
+	CreatedAt                time.Time   `json:"created_at"`
+}
+
+// Checkpoint is a row of the volume_checkpoints table
+type Checkpoint struct {
+	ID                 int64          `json:"id"`
+	VolumeID           int64          `json:"volume_id"`
+	LVName             string         `json:"lv_name"`
+	SequenceNum        int            `json:"sequence_num"`
+	SourceCheckpointID *int64         `json:"source_checkpoint_id,omitempty"`
+	Type               CheckpointType `json:"type"`
+	Comment            *string        `json:"comment,omitempty"`
+	SizeMB             *int64         `json:"size_mb,omitempty"`
+	CreatedAt          time.Time      `json:"created_at"`
+}
+
+const volumeColumns = `id, volume_id, name, device_path, size_gb, vm_id, encrypted, state, active_source_checkpoint_id, destination, created_at`
+
+const checkpointColumns = `id, volume_id, lv_name, sequence_num, source_checkpoint_id, type, comment, size_mb, created_at`
+
+// CreateVolume inserts a volume and fills in its generated fields
+func (q *Queries) CreateVolume(ctx context.Context, vol *Volume) error {
+	if vol.State == "" {
+		vol.State = VolumeStateAvailable
+	}
+	if vol.Destination == "" {
+		vol.Destination = "/data"
+	}
+
+	err := q.q.QueryRowContext(ctx, `
+		INSERT INTO volumes (volume_id, name, device_path, size_gb, vm_id, encrypted, state, destination)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`, vol.VolumeID, vol.Name, vol.DevicePath, vol.SizeGB, vol.VMID, vol.Encrypted, vol.State, vol.Destination).Scan(&vol.ID, &vol.CreatedAt)
+
+	return mapError(err)
+}
+
+// GetVolume retrieves a volume by its volume id (vol_xxx)
+func (q *Queries) GetVolume(ctx context.Context, volumeID string) (*Volume, error) {
+	row := q.q.QueryRowContext(ctx, `SELECT `+volumeColumns+` FROM volumes WHERE volume_id = ?`, volumeID)
+	return scanVolume(row)
+}
+
+// ListVolumes returns all volumes, or only those attached to vmID when it is non-nil
+func (q *Queries) ListVolumes(ctx context.Context, vmID *int64) ([]*Volume, error) {
+	query := `SELECT ` + volumeColumns + ` FROM volumes`
+	args := []any{}
+	if vmID != nil {
+		query += ` WHERE vm_id = ?`
+		args = append(args, *vmID)
+	}
+	query += ` ORDER BY id`
+
+	rows, err := q.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var volumes []*Volume
+	for rows.Next() {
+		vol, err := scanVolume(rows)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, vol)
+	}
+	return volumes, rows.Err()
+}
+
+// AttachVolume assigns a volume to a VM
+func (q *Queries) AttachVolume(ctx context.Context, volumeID string, vmID int64) error {
+	result, err := q.q.ExecContext(ctx, `
+		UPDATE volumes SET vm_id = ?, state = ? WHERE volume_id = ?
+	`, vmID, VolumeStateAttached, volumeID)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// DetachVolume releases a volume from its VM
+func (q *Queries) DetachVolume(ctx context.Context, volumeID string) error {
+	result, err := q.q.ExecContext(ctx, `
+		UPDATE volumes SET vm_id = NULL, state = ? WHERE volume_id = ?
+	`, VolumeStateAvailable, volumeID)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// UpdateVolumeState sets the state of a volume
+func (q *Queries) UpdateVolumeState(ctx context.Context, volumeID string, state VolumeState) error {
+	result, err := q.q.ExecContext(ctx, `UPDATE volumes SET state = ? WHERE volume_id = ?`, state, volumeID)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// SetVolumeSourceCheckpoint records which checkpoint the volume is currently based on
+func (q *Queries) SetVolumeSourceCheckpoint(ctx context.Context, volumeID string, checkpointID *int64) error {
+	result, err := q.q.ExecContext(ctx, `
+		UPDATE volumes SET active_source_checkpoint_id = ? WHERE volume_id = ?
+	`, checkpointID, volumeID)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// DeleteVolume removes a volume, its checkpoints cascade
+func (q *Queries) DeleteVolume(ctx context.Context, volumeID string) error {
+	result, err := q.q.ExecContext(ctx, `DELETE FROM volumes WHERE volume_id = ?`, volumeID)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+// NextCheckpointSequence returns the sequence number the next checkpoint of a volume should use.
+// Call it within a transaction together with CreateCheckpoint.
+func (q *Queries) NextCheckpointSequence(ctx context.Context, volumeID int64) (int, error) {
+	var seq int
+	err := q.q.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(sequence_num), 0) + 1 FROM volume_checkpoints WHERE volume_id = ?
+	`, volumeID).Scan(&seq)
+	if err != nil {
+		return 0, mapError(err)
+	}
+	return seq, nil
+}
+
+// CreateCheckpoint inserts a volume checkpoint and fills in its generated fields
+func (q *Queries) CreateCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	if cp.Type == "" {
+		cp.Type = CheckpointTypeUser
+	}
+
+	err := q.q.QueryRowContext(ctx, `
+		INSERT INTO volume_checkpoints (volume_id, lv_name, sequence_num, source_checkpoint_id, type, comment, size_mb)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at
+	`, cp.VolumeID, cp.LVName, cp.SequenceNum, cp.SourceCheckpointID, cp.Type, cp.Comment, cp.SizeMB).Scan(&cp.ID, &cp.CreatedAt)
+
+	return mapError(err)
+}
+
+// GetCheckpoint retrieves a checkpoint by id
+func (q *Queries) GetCheckpoint(ctx context.Context, id int64) (*Checkpoint, error) {
+	row := q.q.QueryRowContext(ctx, `SELECT `+checkpointColumns+` FROM volume_checkpoints WHERE id = ?`, id)
+	return scanCheckpoint(row)
+}
+
+// ListCheckpoints returns the checkpoints of a volume, newest first
+func (q *Queries) ListCheckpoints(ctx context.Context, volumeID int64) ([]*Checkpoint, error) {
+	rows, err := q.q.QueryContext(ctx, `
+		SELECT `+checkpointColumns+` FROM volume_checkpoints
+		WHERE volume_id = ? ORDER BY sequence_num DESC
+	`, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []*Checkpoint
+	for rows.Next() {
+		cp, err := scanCheckpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	return checkpoints, rows.Err()
+}
+
+// DeleteCheckpoint removes a checkpoint
+func (q *Queries) DeleteCheckpoint(ctx context.Context, id int64) error {
+	result, err := q.q.ExecContext(ctx, `DELETE FROM volume_checkpoints WHERE id = ?`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	return mustAffect(result)
+}
+
+func scanVolume(row scanner) (*Volume, error) {
+	var (
+		vol        Volume
+		vmID       sql.NullInt64
+		checkpoint sql.NullInt64
+	)
+
+	err := row.Scan(&vol.ID, &vol.VolumeID, &vol.Name, &vol.DevicePath, &vol.SizeGB, &vmID, &vol.Encrypted, &vol.State, &checkpoint, &vol.Destination, &vol.CreatedAt)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if vmID.Valid {
+		vol.VMID = &vmID.Int64
+	}
+	if checkpoint.Valid {
+		vol.ActiveSourceCheckpointID = &checkpoint.Int64
+	}
+	return &vol, nil
+}
+
+func scanCheckpoint(row scanner) (*Checkpoint, error) {
+	var (
+		cp      Checkpoint
+		source  sql.NullInt64
+		comment sql.NullString
+		sizeMB  sql.NullInt64
+	)
+
+	err := row.Scan(&cp.ID, &cp.VolumeID, &cp.LVName, &cp.SequenceNum, &source, &cp.Type, &comment, &sizeMB, &cp.CreatedAt)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	if source.Valid {
+		cp.SourceCheckpointID = &source.Int64
+	}
+	if comment.Valid {
+		cp.Comment = &comment.String
+	}
+	if sizeMB.Valid {
+		cp.SizeMB = &sizeMB.Int64
+	}
+	return &cp, nil
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -22,9 +23,14 @@ const (
 	StateFailed       State = "failed"
 )
 
+// attachPollInterval is how often an attached kiln process is checked for liveness
+const attachPollInterval = time.Second
+
 type Config struct {
 	Chroot      string
 	LogPathSock string
+	// Jail starts kiln through kiln jail, which needs root
+	Jail bool
 }
 
 type VM struct {
@@ -38,12 +44,18 @@ type VM struct {
 	Mutex sync.Mutex
 
 	PID int
+
+	// done is closed once the kiln process has exited
+	done chan struct{}
+	// err holds the error returned when waiting on the kiln process
+	err error
 }
 
 func New(id string, cfg *Config) *VM {
 	return &VM{
 		ID:     id,
 		Config: cfg,
+		done:   make(chan struct{}),
 	}
 }
 
@@ -51,14 +63,20 @@ func (vm *VM) Start(ctx context.Context) error {
 	vm.Mutex.Lock()
 	defer vm.Mutex.Unlock()
 
-	if err := unix.Mkfifo(vm.Config.LogPathSock, 0o666); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("could not create kiln fifo: %w", err)
+	if vm.Config.LogPathSock != "" {
+		if err := unix.Mkfifo(vm.Config.LogPathSock, 0o666); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("could not create kiln fifo: %w", err)
+		}
 	}
 
-	kilnConfigPath := filepath.Join(vm.Config.Chroot, "kiln.json")
-
-	// create cmd
-	cmd := exec.Command("kiln", "--config", kilnConfigPath)
+	// create cmd, kiln expects to run from inside the chroot where it finds kiln.json
+	var args []string
+	if vm.Config.Jail {
+		// kiln jail execs kiln once the jail is set up, the PID stays kiln's
+		args = []string{"jail", "--chroot", vm.Config.Chroot}
+	}
+	cmd := exec.Command(filepath.Join(vm.Config.Chroot, "kiln"), args...)
+	cmd.Dir = vm.Config.Chroot
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -68,25 +86,101 @@ func (vm *VM) Start(ctx context.Context) error {
 		Pgid:    0,
 	}
 
-	vm.setPID(cmd.Process.Pid)
-
 	// start the process
 	if err := cmd.Start(); err != nil {
 		return err
 	}
 
+	vm.PID = cmd.Process.Pid
+
 	go func() {
 		// wait for the process to finish
-		if err := cmd.Wait(); err != nil {
-			slog.Error("kiln process failed", "error", err)
+		err := cmd.Wait()
+		if err != nil {
+			slog.Error("kiln process failed", "vm-id", vm.ID, "error", err)
 		}
+
+		vm.Mutex.Lock()
+		vm.err = err
+		vm.Mutex.Unlock()
+
+		close(vm.done)
 	}()
 
 	return nil
 }
 
-func (vm *VM) setPID(pid int) {
+// Attach adopts a kiln process that is already running, for instance one started
+// before the daemon restarted. It isn't our child so we can't wait on it and
+// instead poll until it's gone.
+func (vm *VM) Attach(pid int) error {
 	vm.Mutex.Lock()
 	defer vm.Mutex.Unlock()
+
+	if !Alive(pid) {
+		return fmt.Errorf("kiln process %d is not running", pid)
+	}
 	vm.PID = pid
+
+	go func() {
+		ticker := time.NewTicker(attachPollInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !Alive(pid) {
+				break
+			}
+		}
+		close(vm.done)
+	}()
+
+	return nil
+}
+
+// Alive reports whether a process with the given pid exists
+func Alive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// Done returns a channel that is closed when the kiln process exits.
+func (vm *VM) Done() <-chan struct{} {
+	return vm.done
+}
+
+// Err returns the error reported when the kiln process exited, if any.
+func (vm *VM) Err() error {
+	vm.Mutex.Lock()
+	defer vm.Mutex.Unlock()
+	return vm.err
+}
+
+// Signal sends a signal to the kiln process, which relays it to Firecracker.
+func (vm *VM) Signal(sig os.Signal) error {
+	vm.Mutex.Lock()
+	pid := vm.PID
+	vm.Mutex.Unlock()
+
+	if pid == 0 {
+		return fmt.Errorf("vm %s has not been started", vm.ID)
+	}
+
+	ps, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return ps.Signal(sig)
+}
+
+// Kill sends SIGKILL to kiln's process group. Kiln leads the group, killing
+// it alone would leave the firecracker process it started running.
+func (vm *VM) Kill() error {
+	vm.Mutex.Lock()
+	pid := vm.PID
+	vm.Mutex.Unlock()
+
+	if pid == 0 {
+		return fmt.Errorf("vm %s has not been started", vm.ID)
+	}
+	return unix.Kill(-pid, unix.SIGKILL)
 }
@@ -0,0 +1,61 @@
+package vm_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rugwirobaker/inferno/internal/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exited reports whether pid is gone, a zombie nobody reaped yet counts
+func exited(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// the state follows the parenthesised command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// TestKill tests that killing a VM takes down the processes kiln started.
+func TestKill(t *testing.T) {
+	chroot := t.TempDir()
+
+	// stands in for kiln running firecracker
+	script := "#!/bin/sh\nsleep 60 &\necho $! > child.pid\nwait\n"
+	require.NoError(t, os.WriteFile(filepath.Join(chroot, "kiln"), []byte(script), 0o755))
+
+	machine := vm.New("vm1", &vm.Config{Chroot: chroot})
+	require.NoError(t, machine.Start(context.Background()))
+
+	var child int
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(chroot, "child.pid"))
+		if err != nil {
+			return false
+		}
+		child, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, machine.Kill())
+
+	select {
+	case <-machine.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("kiln was not killed")
+	}
+	assert.Eventually(t, func() bool { return exited(child) }, 5*time.Second, 10*time.Millisecond,
+		"the process kiln started outlived it")
+
+	assert.Error(t, vm.New("vm2", &vm.Config{Chroot: chroot}).Kill(), "a VM that never started can't be killed")
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/mdlayher/vsock"
@@ -23,6 +24,8 @@ const (
 	VsockAPIPort
 	// VsockKeyPort is port used by the guest to request encryption keys from the host
 	VsockKeyPort
+	// VsockHeartbeatPort is port used by the guest to tell the host it's still alive
+	VsockHeartbeatPort
 )
 
 // NewVsockConn creates a new vsock connection to the host via the specified port
@@ -34,32 +37,75 @@ func NewVsockConn(port uint32) (net.Conn, error) {
 	return conn, nil
 }
 
-// NewHostClient creates a new http client that connects to the host via /dev/vsock
+// NewHostClient creates a new http client that connects to the host via /dev/vsock.
+// Each connection is dialed on demand, vsock connections don't survive the VM
+// being restored from a snapshot.
 func NewHostClient(ctx context.Context, port uint32) (*http.Client, error) {
-	// Dial to the host server over vsock
-	conn, err := NewVsockConn(port)
-	if err != nil {
-		return nil, err
-	}
-	// Create an HTTP client that uses the VSOCK connection
 	client := &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return conn, nil
+				return NewVsockConn(port)
 			},
 		},
 	}
 	return client, nil
 }
 
-// NewGuestClient creates a new http client that connects that the host uses to connect to the guest
-// it will mainly be used to call the unit control API
+// RedialConn is a connection to the host that redials once when a write
+// fails, so output keeps flowing after the VM is restored from a snapshot
+type RedialConn struct {
+	port uint32
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewRedialConn connects to the host on port
+func NewRedialConn(port uint32) (*RedialConn, error) {
+	conn, err := NewVsockConn(port)
+	if err != nil {
+		return nil, err
+	}
+	return &RedialConn{port: port, conn: conn}, nil
+}
+
+func (c *RedialConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, err := c.conn.Write(p)
+	if err == nil {
+		return n, nil
+	}
+
+	conn, dialErr := NewVsockConn(c.port)
+	if dialErr != nil {
+		return n, err
+	}
+	c.conn.Close()
+	c.conn = conn
+
+	m, err := conn.Write(p[n:])
+	return n + m, err
+}
+
+func (c *RedialConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
 func NewGuestClient(chroot string, port int) *http.Client {
-	vsockPath := filepath.Join(chroot, "control.sock")
+	return NewGuestClientAt(filepath.Join(chroot, "control.sock"), port)
+}
 
+// NewGuestClientAt is like NewGuestClient for a vsock unix socket at an arbitrary path
+func NewGuestClientAt(vsockPath string, port int) *http.Client {
 	return &http.Client{
 		Timeout: 5 * time.Second,
 		Transport: &maxBytesTransport{
+			MaxBodySize: maxGuestResponseSize,
 			Transport: &http.Transport{
 				DisableKeepAlives: true,
 				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
@@ -118,6 +164,9 @@ func NewVsockUnixListener(path string) (net.Listener, error) {
 	return listener, nil
 }
 
+// maxGuestResponseSize caps the size of responses read from the guest
+const maxGuestResponseSize = 4 << 20
+
 type maxBytesTransport struct {
 	Transport   http.RoundTripper
 	MaxBodySize int64
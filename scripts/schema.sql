@@ -1,4 +1,5 @@
 -- Description: This script creates the schema for the database
+-- NOTE: internal/store/migrations mirrors this schema for the Go daemon, keep them in sync.
 CREATE TABLE IF NOT EXISTS vms (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name TEXT UNIQUE NOT NULL,